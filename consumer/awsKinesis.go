@@ -16,14 +16,14 @@ package consumer
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
-	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,20 +33,36 @@ import (
 const (
 	kinesisOffsetNewest = "newest"
 	kinesisOffsetOldest = "oldest"
+
+	kinesisStoreFile     = "file"
+	kinesisStoreDynamoDB = "dynamodb"
 )
 
 // AwsKinesis consumer
 //
 // This consumer reads a message from an AWS Kinesis router.
 //
+// Shards created by splitting or merging shards are read after all of their
+// parent shards have been read completely. Shards are assigned to consumers
+// using leases, so that multiple gollum instances can read the same stream.
+// Leases and the last read sequence number of each shard (the checkpoint) are
+// kept in a checkpoint store. A checkpoint is written after all records
+// returned by a query have been enqueued.
+//
+// The "file" checkpoint store keeps leases in memory and is meant for a single
+// instance. To share a stream between instances use the "dynamodb" store. The
+// table used by the "dynamodb" store has to be created beforehand with a
+// partition key "shardId" of type string.
+//
 // Parameters
 //
 // - KinesisStream: This value defines the stream to read from.
 // By default this parameter is set to "default".
 //
-// - OffsetFile: This value defines a file to store the current offset per shard.
-// To disable this parameter, set it to "". If the parameter is set and the file
-// is found, consuming will start after the offset stored in the file.
+// - OffsetFile: This value defines a file to store the current offset per shard
+// when using the "file" checkpoint store. To disable this parameter, set it
+// to "". If the parameter is set and the file is found, consuming will start
+// after the offset stored in the file.
 // By default this parameter is set to "".
 //
 // - RecordsPerQuery: This value defines the number of records to pull per query.
@@ -64,14 +80,39 @@ const (
 // trying to reconnect to a shard.
 // By default this parameter is set to "4".
 //
-// - CheckNewShardsSec: This value sets a timer to update shards in Kinesis.
-// You can set this parameter to "0" for disabling.
+// - CheckNewShardsSec: This value defines the interval in seconds in which
+// new shards are detected and leases are renewed. If set to "0", a third of
+// LeaseTimeoutSec is used.
 // By default this parameter is set to "0".
 //
 // - DefaultOffset: This value defines the message index to start reading from.
-// Valid values are either "newest", "oldest", or a number.
+// Valid values are either "newest", "oldest", or a number. This value is
+// only used for shards that do not have a checkpoint.
 // By default this parameter is set to "newest".
 //
+// - CheckpointStore: This value defines where leases and checkpoints are
+// stored. Valid values are "file" and "dynamodb".
+// By default this parameter is set to "file".
+//
+// - CheckpointTable: This value defines the DynamoDB table used by the
+// "dynamodb" checkpoint store. Multiple consumers of the same stream have to
+// use the same table. Different streams should use different tables.
+// By default this parameter is set to "gollum-kinesis".
+//
+// - CheckpointEndpoint: This value defines the DynamoDB endpoint used by the
+// "dynamodb" checkpoint store. If set to "", the endpoint of the configured
+// region is used.
+// By default this parameter is set to "".
+//
+// - WorkerId: This value defines the name used to identify this consumer when
+// holding leases. It has to be unique for each consumer of a stream. If set
+// to "", the hostname and process id are used.
+// By default this parameter is set to "".
+//
+// - LeaseTimeoutSec: This value defines the number of seconds after which a
+// lease that has not been renewed can be taken over by another consumer.
+// By default this parameter is set to "30".
+//
 // Examples
 //
 // This example consumes a kinesis stream "myStream" and create messages:
@@ -84,26 +125,42 @@ const (
 //      Profile: default
 //    Region: "eu-west-1"
 //    KinesisStream: myStream
+//
+// This example shares the shards of "myStream" between all gollum instances
+// using the same DynamoDB table:
+//
+//  KinesisIn:
+//    Type: consumer.AwsKinesis
+//    Region: "eu-west-1"
+//    KinesisStream: myStream
+//    CheckpointStore: dynamodb
+//    CheckpointTable: myStream-checkpoints
 type AwsKinesis struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 
 	// AwsMultiClient is public to make AwsMultiClient.Configure() callable
 	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
 
-	stream          string        `config:"KinesisStream" default:"default"`
-	offsetFile      string        `config:"OffsetFile"`
-	recordsPerQuery int64         `config:"RecordsPerQuery" default:"100"`
-	delimiter       []byte        `config:"RecordMessageDelimiter"`
-	sleepTime       time.Duration `config:"QuerySleepTimeMs" default:"1000" metric:"ms"`
-	retryTime       time.Duration `config:"RetrySleepTimeSec" default:"4" metric:"sec"`
-	shardTime       time.Duration `config:"CheckNewShardsSec" default:"0" metric:"sec"`
+	stream             string        `config:"KinesisStream" default:"default"`
+	offsetFile         string        `config:"OffsetFile"`
+	recordsPerQuery    int64         `config:"RecordsPerQuery" default:"100"`
+	delimiter          []byte        `config:"RecordMessageDelimiter"`
+	sleepTime          time.Duration `config:"QuerySleepTimeMs" default:"1000" metric:"ms"`
+	retryTime          time.Duration `config:"RetrySleepTimeSec" default:"4" metric:"sec"`
+	shardTime          time.Duration `config:"CheckNewShardsSec" default:"0" metric:"sec"`
+	storeType          string        `config:"CheckpointStore" default:"file"`
+	checkpointTable    string        `config:"CheckpointTable" default:"gollum-kinesis"`
+	checkpointEndpoint string        `config:"CheckpointEndpoint"`
+	workerID           string        `config:"WorkerId"`
+	leaseTime          time.Duration `config:"LeaseTimeoutSec" default:"30" metric:"sec"`
 
 	client        *kinesis.Kinesis
-	offsets       map[string]string
+	store         kinesisCheckpointStore
 	offsetType    string
 	defaultOffset string
-	running       bool
-	offsetsGuard  *sync.RWMutex
+	readers       map[string]chan struct{}
+	readersGuard  *sync.Mutex
+	stop          chan struct{}
 }
 
 func init() {
@@ -112,8 +169,9 @@ func init() {
 
 // Configure initializes this consumer with values from a plugin config.
 func (cons *AwsKinesis) Configure(conf core.PluginConfigReader) {
-	cons.offsets = make(map[string]string)
-	cons.offsetsGuard = new(sync.RWMutex)
+	cons.readers = make(map[string]chan struct{})
+	cons.readersGuard = new(sync.Mutex)
+	cons.stop = make(chan struct{})
 
 	// Offset
 	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kinesisOffsetNewest))
@@ -136,107 +194,388 @@ func (cons *AwsKinesis) Configure(conf core.PluginConfigReader) {
 		cons.defaultOffset = offsetValue
 	}
 
-	if cons.offsetFile != "" {
-		fileContents, err := ioutil.ReadFile(cons.offsetFile)
-		if err != nil {
-			cons.Logger.Errorf("Failed to open kinesis offset file: %s", err.Error())
+	if cons.shardTime <= 0 {
+		cons.shardTime = cons.leaseTime / 3
+	}
+	if cons.leaseTime <= cons.shardTime {
+		conf.Errors.Pushf("LeaseTimeoutSec must be larger than CheckNewShardsSec")
+	}
+
+	if cons.workerID == "" {
+		hostname, _ := os.Hostname()
+		cons.workerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	switch strings.ToLower(cons.storeType) {
+	case kinesisStoreFile:
+		store, err := newKinesisFileStore(cons.offsetFile)
+		if !conf.Errors.Push(err) {
+			cons.store = store
+		}
+
+	case kinesisStoreDynamoDB:
+		if cons.offsetFile != "" {
+			cons.Logger.Warning("OffsetFile is ignored when using the dynamodb checkpoint store")
+		}
+		// The DynamoDB store is created on connect
+
+	default:
+		conf.Errors.Pushf("CheckpointStore must be \"%s\" or \"%s\"", kinesisStoreFile, kinesisStoreDynamoDB)
+	}
+}
+
+func (cons *AwsKinesis) initKinesisClient() error {
+	sess, err := cons.AwsMultiClient.NewSessionWithOptions()
+	if err != nil {
+		return err
+	}
+
+	awsConfig := cons.AwsMultiClient.GetConfig().Copy()
+
+	// set auto endpoint to kinesis if setting is empty
+	if awsConfig.Endpoint == nil || *awsConfig.Endpoint == "" {
+		awsConfig.WithEndpoint(fmt.Sprintf("kinesis.%s.amazonaws.com", *awsConfig.Region))
+	}
+
+	cons.client = kinesis.New(sess, awsConfig)
+
+	if cons.store == nil {
+		awsConfig = cons.AwsMultiClient.GetConfig().Copy()
+		if cons.checkpointEndpoint != "" {
+			awsConfig.WithEndpoint(cons.checkpointEndpoint)
 		} else {
-			cons.offsetType = kinesis.ShardIteratorTypeAfterSequenceNumber
-			conf.Errors.Push(json.Unmarshal(fileContents, &cons.offsets))
+			awsConfig.WithEndpoint(fmt.Sprintf("dynamodb.%s.amazonaws.com", *awsConfig.Region))
 		}
+		cons.store = newKinesisDynamoStore(dynamodb.New(sess, awsConfig), cons.checkpointTable)
 	}
+	return nil
 }
 
-func (cons *AwsKinesis) marshalOffsets() ([]byte, error) {
-	cons.offsetsGuard.RLock()
-	defer cons.offsetsGuard.RUnlock()
-	return json.Marshal(cons.offsets)
+// listShards returns all shards of the stream including closed shards
+func (cons *AwsKinesis) listShards() ([]*kinesis.Shard, error) {
+	shards := []*kinesis.Shard{}
+	streamQuery := &kinesis.DescribeStreamInput{
+		StreamName: aws.String(cons.stream),
+	}
+
+	err := cons.client.DescribeStreamPages(streamQuery, func(page *kinesis.DescribeStreamOutput, lastPage bool) bool {
+		if page.StreamDescription == nil {
+			return false
+		}
+		for _, shard := range page.StreamDescription.Shards {
+			if shard != nil && shard.ShardId != nil {
+				shards = append(shards, shard)
+			}
+		}
+		return true
+	})
+
+	return shards, err
 }
 
-func (cons *AwsKinesis) storeOffsets() {
-	if cons.offsetFile != "" {
-		fileContents, err := cons.marshalOffsets()
-		if err != nil {
-			cons.Logger.Errorf("Failed to marshal kinesis offsets: %s", err.Error())
-			return
+// kinesisEligibleShards returns all shards that have not been read completely
+// and whose parents have been read completely. Parents that are not listed
+// anymore are considered to be read completely.
+func kinesisEligibleShards(shards []*kinesis.Shard, leases map[string]kinesisLease) []*kinesis.Shard {
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[*shard.ShardId] = true
+	}
+
+	isDone := func(shardID *string) bool {
+		if shardID == nil || *shardID == "" || !listed[*shardID] {
+			return true
 		}
+		return leases[*shardID].checkpoint == kinesisCheckpointShardEnd
+	}
 
-		if err := ioutil.WriteFile(cons.offsetFile, fileContents, 0644); err != nil {
-			cons.Logger.Errorf("Failed to write kinesis offsets: %s", err.Error())
+	eligible := []*kinesis.Shard{}
+	for _, shard := range shards {
+		if leases[*shard.ShardId].checkpoint == kinesisCheckpointShardEnd {
+			continue // ### continue, already read ###
+		}
+		if isDone(shard.ParentShardId) && isDone(shard.AdjacentParentShardId) {
+			eligible = append(eligible, shard)
 		}
 	}
+	return eligible
 }
 
-func (cons *AwsKinesis) createShardIteratorConfig(shardID string) *kinesis.GetRecordsInput {
-	for cons.running {
-		cons.offsetsGuard.RLock()
-		offset := cons.offsets[shardID]
-		cons.offsetsGuard.RUnlock()
-
-		iteratorConfig := kinesis.GetShardIteratorInput{
-			ShardId:                aws.String(shardID),
-			ShardIteratorType:      aws.String(cons.offsetType),
-			StreamName:             aws.String(cons.stream),
-			StartingSequenceNumber: aws.String(offset),
+// kinesisLeaseTarget returns the number of leases a worker should hold so that
+// the given leases are evenly distributed between all active workers.
+func kinesisLeaseTarget(leases map[string]kinesisLease, owner string, now time.Time) int {
+	owners := map[string]bool{owner: true}
+	for _, lease := range leases {
+		if !lease.isAvailable(now) {
+			owners[lease.owner] = true
 		}
+	}
+	return (len(leases) + len(owners) - 1) / len(owners)
+}
 
-		if *iteratorConfig.StartingSequenceNumber == "" {
-			iteratorConfig.StartingSequenceNumber = nil
-		} else {
-			// starting sequence number requires ShardIteratorTypeAfterSequenceNumber
-			iteratorConfig.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+// balanceShards renews the leases held by this consumer, takes available
+// leases and steals leases from other consumers if the shards are not evenly
+// distributed.
+func (cons *AwsKinesis) balanceShards() {
+	shards, err := cons.listShards()
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to list shards of %s", cons.stream)
+		return
+	}
+
+	leases, err := cons.store.getLeases()
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to read kinesis leases")
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(cons.leaseTime)
+	eligible := kinesisEligibleShards(shards, leases)
+	eligibleLeases := make(map[string]kinesisLease, len(eligible))
+	for _, shard := range eligible {
+		eligibleLeases[*shard.ShardId] = leases[*shard.ShardId]
+	}
+
+	// Renew leases of running readers
+	held := 0
+	for _, shard := range eligible {
+		shardID := *shard.ShardId
+		if !cons.isReading(shardID) {
+			continue // ### continue, not reading ###
 		}
 
-		iterator, err := cons.client.GetShardIterator(&iteratorConfig)
-		if err == nil && iterator.ShardIterator != nil {
-			return &kinesis.GetRecordsInput{
-				ShardIterator: iterator.ShardIterator,
-				Limit:         aws.Int64(cons.recordsPerQuery),
+		lease := eligibleLeases[shardID]
+		if lease.owner == cons.workerID {
+			taken, err := cons.store.takeLease(shardID, lease, cons.workerID, expires)
+			if err != nil {
+				cons.Logger.WithError(err).Errorf("Failed to renew lease of %s:%s", cons.stream, shardID)
+				held++ // retry on next interval, the lease might still be valid
+				continue
+			}
+			if taken {
+				held++
+				continue // ### continue, renewed ###
 			}
 		}
 
-		cons.Logger.Errorf("Failed to iterate shard %s:%s - %s", *iteratorConfig.StreamName, *iteratorConfig.ShardId, err.Error())
-		time.Sleep(3 * time.Second)
+		cons.Logger.Warningf("Lease of %s:%s has been taken by another consumer", cons.stream, shardID)
+		cons.stopReader(shardID)
 	}
 
-	return nil
+	// Take available leases
+	target := kinesisLeaseTarget(eligibleLeases, cons.workerID, now)
+	for _, shard := range eligible {
+		if held >= target {
+			return // ### return, enough leases ###
+		}
+
+		shardID := *shard.ShardId
+		lease := eligibleLeases[shardID]
+		if cons.isReading(shardID) || !(lease.isAvailable(now) || lease.owner == cons.workerID) {
+			continue // ### continue, not available ###
+		}
+
+		if cons.takeLease(shard, lease, expires) {
+			held++
+		}
+	}
+
+	if held >= target {
+		return // ### return, enough leases ###
+	}
+
+	// Steal one lease from the consumer holding the most leases
+	leaseCount := make(map[string]int)
+	for _, lease := range eligibleLeases {
+		if !lease.isAvailable(now) {
+			leaseCount[lease.owner]++
+		}
+	}
+
+	victim := ""
+	for owner, count := range leaseCount {
+		if owner != cons.workerID && count > target && count > leaseCount[victim] {
+			victim = owner
+		}
+	}
+	if victim == "" {
+		return // ### return, nothing to steal ###
+	}
+
+	for _, shard := range eligible {
+		if lease := eligibleLeases[*shard.ShardId]; lease.owner == victim && !lease.isAvailable(now) {
+			cons.Logger.Infof("Taking over %s:%s from %s", cons.stream, *shard.ShardId, victim)
+			cons.takeLease(shard, lease, expires)
+			return // ### return, stole one ###
+		}
+	}
 }
 
-func (cons *AwsKinesis) processShard(shardID string) {
+// takeLease acquires the lease of a shard and starts reading from it
+func (cons *AwsKinesis) takeLease(shard *kinesis.Shard, lease kinesisLease, expires time.Time) bool {
+	shardID := *shard.ShardId
+	taken, err := cons.store.takeLease(shardID, lease, cons.workerID, expires)
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to take lease of %s:%s", cons.stream, shardID)
+		return false
+	}
+	if !taken {
+		return false // ### return, taken by another consumer ###
+	}
+
+	stop := make(chan struct{})
+	cons.readersGuard.Lock()
+	cons.readers[shardID] = stop
+	cons.readersGuard.Unlock()
+
+	cons.Logger.Debugf("Starting consumer for %s:%s", cons.stream, shardID)
 	cons.AddWorker()
-	defer cons.WorkerDone()
-	recordConfig := (*kinesis.GetRecordsInput)(nil)
+	go cons.processShard(shard, lease.checkpoint, stop)
+	return true
+}
 
-	for cons.running {
-		if recordConfig == nil {
-			recordConfig = cons.createShardIteratorConfig(shardID)
+func (cons *AwsKinesis) isReading(shardID string) bool {
+	cons.readersGuard.Lock()
+	defer cons.readersGuard.Unlock()
+	_, isReading := cons.readers[shardID]
+	return isReading
+}
+
+func (cons *AwsKinesis) stopReader(shardID string) {
+	cons.readersGuard.Lock()
+	defer cons.readersGuard.Unlock()
+	if stop, isReading := cons.readers[shardID]; isReading {
+		close(stop)
+		delete(cons.readers, shardID)
+	}
+}
+
+func (cons *AwsKinesis) removeReader(shardID string, stop chan struct{}) {
+	cons.readersGuard.Lock()
+	defer cons.readersGuard.Unlock()
+	if cons.readers[shardID] == stop {
+		delete(cons.readers, shardID)
+	}
+}
+
+// wait sleeps for the given duration. False is returned if the reader has
+// been stopped in the meantime.
+func (cons *AwsKinesis) wait(duration time.Duration, stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-cons.stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+func (cons *AwsKinesis) isStopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	case <-cons.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cons *AwsKinesis) getShardIterator(shardID, checkpoint string, stop chan struct{}) *string {
+	iteratorConfig := kinesis.GetShardIteratorInput{
+		ShardId:    aws.String(shardID),
+		StreamName: aws.String(cons.stream),
+	}
+
+	switch checkpoint {
+	case "":
+		iteratorConfig.ShardIteratorType = aws.String(cons.offsetType)
+		if cons.defaultOffset != "" {
+			iteratorConfig.StartingSequenceNumber = aws.String(cons.defaultOffset)
+		}
+
+	case kinesisCheckpointTrimHorizon:
+		iteratorConfig.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+
+	default:
+		iteratorConfig.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		iteratorConfig.StartingSequenceNumber = aws.String(checkpoint)
+	}
+
+	for {
+		iterator, err := cons.client.GetShardIterator(&iteratorConfig)
+		if err == nil && iterator.ShardIterator != nil {
+			return iterator.ShardIterator
 		}
 
-		result, err := cons.client.GetRecords(recordConfig)
+		if err == nil {
+			err = fmt.Errorf("no iterator returned")
+		}
+		cons.Logger.Errorf("Failed to iterate shard %s:%s - %s", cons.stream, shardID, err.Error())
+		if !cons.wait(cons.retryTime, stop) {
+			return nil // ### return, stopped ###
+		}
+	}
+}
+
+func (cons *AwsKinesis) processShard(shard *kinesis.Shard, checkpoint string, stop chan struct{}) {
+	shardID := *shard.ShardId
+	defer cons.WorkerDone()
+	defer cons.removeReader(shardID, stop)
+	defer func() {
+		if err := cons.store.releaseLease(shardID, cons.workerID); err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to release lease of %s:%s", cons.stream, shardID)
+		}
+	}()
+
+	// Children of a shard that was already closed when starting at the newest
+	// offset are started at the newest offset, too.
+	isClosed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+	followChildren := checkpoint != "" || cons.offsetType != kinesis.ShardIteratorTypeLatest || !isClosed
+
+	iterator := (*string)(nil)
+	for {
+		if iterator == nil {
+			if iterator = cons.getShardIterator(shardID, checkpoint, stop); iterator == nil {
+				return // ### return, stopped ###
+			}
+		}
+
+		result, err := cons.client.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(cons.recordsPerQuery),
+		})
+
 		if err != nil {
 			cons.Logger.Errorf("Failed to get records from shard %s:%s - %s", cons.stream, shardID, err.Error())
+			retryTime := cons.retryTime
 
 			if AWSerr, isAWSerr := err.(awserr.Error); isAWSerr {
 				switch AWSerr.Code() {
 				case "ProvisionedThroughputExceededException":
 					// We reached thethroughput limit
-					time.Sleep(5 * time.Second)
+					retryTime = 5 * time.Second
 
 				case "ExpiredIteratorException":
 					// We need to create a new iterator
-					recordConfig = nil
+					iterator = nil
+					retryTime = 0
 				}
 			}
+			if !cons.wait(retryTime, stop) {
+				return // ### return, stopped ###
+			}
 			continue // ### continue ###
 		}
 
-		if result.NextShardIterator == nil {
-			cons.Logger.Warningf("Shard %s:%s has been closed", cons.stream, shardID)
-			return // ### return, closed ###
-		}
-
+		lastSequence := ""
 		for _, record := range result.Records {
-			if record == nil {
+			if cons.isStopped(stop) {
+				break // ### break, stopped ###
+			}
+			if record == nil || record.SequenceNumber == nil {
 				continue // ### continue ###
 			}
 
@@ -248,123 +587,94 @@ func (cons *AwsKinesis) processShard(shardID string) {
 			} else {
 				cons.Enqueue(record.Data)
 			}
-
-			// Why not an exclusive lock here?
-			// - the map already has an entry for the shardID at this point.
-			// - we are the only one writing to this field
-			// - reading an offset is always a race as it can change at any time
-			// - performance is crucial here
-			// If we could be sure this actually IS a number, we could use atomic.Store here
-			cons.offsetsGuard.RLock()
-			cons.offsets[shardID] = *record.SequenceNumber
-			cons.offsetsGuard.RUnlock()
+			lastSequence = *record.SequenceNumber
 		}
 
-		cons.storeOffsets()
-		recordConfig.ShardIterator = result.NextShardIterator
-		time.Sleep(cons.sleepTime)
-	}
-}
+		if lastSequence != "" {
+			checkpoint = lastSequence
+			if err := cons.store.setCheckpoint(shardID, cons.workerID, checkpoint); err != nil {
+				if err == errKinesisLeaseLost {
+					cons.Logger.Warningf("Lease of %s:%s has been taken by another consumer", cons.stream, shardID)
+					return // ### return, lease lost ###
+				}
+				cons.Logger.WithError(err).Errorf("Failed to store checkpoint of %s:%s", cons.stream, shardID)
+			}
+		}
 
-func (cons *AwsKinesis) initKinesisClient() {
-	sess, err := cons.AwsMultiClient.NewSessionWithOptions()
-	if err != nil {
-		cons.Logger.WithError(err).Error("Can't get proper aws config")
-	}
+		if cons.isStopped(stop) {
+			return // ### return, stopped ###
+		}
 
-	awsConfig := cons.AwsMultiClient.GetConfig()
+		if result.NextShardIterator == nil {
+			cons.finishShard(shardID, followChildren)
+			return // ### return, closed ###
+		}
 
-	// set auto endpoint to s3 if setting is empty
-	if awsConfig.Endpoint == nil || *awsConfig.Endpoint == "" {
-		awsConfig.WithEndpoint(fmt.Sprintf("kinesis.%s.amazonaws.com", *awsConfig.Region))
+		iterator = result.NextShardIterator
+		if !cons.wait(cons.sleepTime, stop) {
+			return // ### return, stopped ###
+		}
 	}
-
-	cons.client = kinesis.New(sess, awsConfig)
 }
 
-func (cons *AwsKinesis) connect() error {
-	cons.initKinesisClient()
+// finishShard marks a shard as read completely so that its children can be
+// read starting at their first record.
+func (cons *AwsKinesis) finishShard(shardID string, followChildren bool) {
+	cons.Logger.Infof("Shard %s:%s has been closed", cons.stream, shardID)
 
-	// Get shard ids for stream
-	streamQuery := &kinesis.DescribeStreamInput{
-		StreamName: aws.String(cons.stream),
-	}
-
-	streamInfo, err := cons.client.DescribeStream(streamQuery)
-	if err != nil {
-		return err
-	}
-
-	if streamInfo.StreamDescription == nil {
-		return fmt.Errorf("StreamDescription could not be retrieved")
-	}
-
-	cons.running = true
-	for _, shard := range streamInfo.StreamDescription.Shards {
-		if shard.ShardId == nil {
-			return fmt.Errorf("ShardId could not be retrieved")
+	if followChildren {
+		shards, err := cons.listShards()
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to list children of %s:%s", cons.stream, shardID)
+			return
 		}
 
-		// No locks required here as connect is called only once on start
-		if _, offsetStored := cons.offsets[*shard.ShardId]; !offsetStored {
-			cons.offsets[*shard.ShardId] = cons.defaultOffset
+		for _, shard := range shards {
+			isParent := shard.ParentShardId != nil && *shard.ParentShardId == shardID
+			isAdjacentParent := shard.AdjacentParentShardId != nil && *shard.AdjacentParentShardId == shardID
+			if isParent || isAdjacentParent {
+				if err := cons.store.initCheckpoint(*shard.ShardId, kinesisCheckpointTrimHorizon); err != nil {
+					cons.Logger.WithError(err).Errorf("Failed to initialize checkpoint of %s:%s", cons.stream, *shard.ShardId)
+					return
+				}
+			}
 		}
 	}
 
-	// No locks required here updateShards is not yet running and processShard
-	// does not change the offsets structure.
-	for shardID := range cons.offsets {
-		cons.Logger.Debugf("Starting consumer for %s:%s", cons.stream, shardID)
-		go cons.processShard(shardID)
+	if err := cons.store.setCheckpoint(shardID, cons.workerID, kinesisCheckpointShardEnd); err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to store checkpoint of %s:%s", cons.stream, shardID)
 	}
-
-	if cons.shardTime > 0 {
-		cons.AddWorker()
-		time.AfterFunc(cons.shardTime, cons.updateShards)
-	}
-
-	return nil
 }
 
-func (cons *AwsKinesis) updateShards() {
+func (cons *AwsKinesis) coordinate() {
 	defer cons.WorkerDone()
 
-	streamQuery := &kinesis.DescribeStreamInput{
-		StreamName: aws.String(cons.stream),
-	}
-
-	for cons.running {
-		streamInfo, err := cons.client.DescribeStream(streamQuery)
-		if err != nil {
-			cons.Logger.Warningf("StreamInfo could not be retrieved.")
-		}
-
-		if streamInfo.StreamDescription == nil {
-			cons.Logger.Warningf("StreamDescription could not be retrieved.")
-			continue
+	for {
+		cons.balanceShards()
+		select {
+		case <-cons.stop:
+			return // ### return, stopped ###
+		case <-time.After(cons.shardTime):
 		}
+	}
+}
 
-		cons.running = true
-		for _, shard := range streamInfo.StreamDescription.Shards {
-			if shard.ShardId == nil {
-				cons.Logger.Warningf("ShardId could not be retrieved.")
-				continue
-			}
+func (cons *AwsKinesis) connect() error {
+	if err := cons.initKinesisClient(); err != nil {
+		return err
+	}
 
-			cons.offsetsGuard.Lock()
-			if _, offsetStored := cons.offsets[*shard.ShardId]; !offsetStored {
-				cons.offsets[*shard.ShardId] = cons.defaultOffset
-				cons.Logger.Debugf("Starting kinesis consumer for %s:%s", cons.stream, *shard.ShardId)
-				go cons.processShard(*shard.ShardId)
-			}
-			cons.offsetsGuard.Unlock()
-		}
-		time.Sleep(cons.shardTime)
+	if _, err := cons.listShards(); err != nil {
+		return err
 	}
+
+	cons.AddWorker()
+	go cons.coordinate()
+	return nil
 }
 
 func (cons *AwsKinesis) close() {
-	cons.running = false
+	close(cons.stop)
 	cons.WorkerDone()
 }
 
@@ -0,0 +1,362 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// kinesisCheckpointShardEnd marks a closed shard that has been read
+	// completely. Children of this shard may be processed.
+	kinesisCheckpointShardEnd = "SHARD_END"
+
+	// kinesisCheckpointTrimHorizon marks a shard that has to be read from the
+	// beginning as its parents have been processed.
+	kinesisCheckpointTrimHorizon = "TRIM_HORIZON"
+)
+
+// errKinesisLeaseLost is returned when writing a checkpoint for a shard that
+// is leased by another worker.
+var errKinesisLeaseLost = errors.New("lease is held by another worker")
+
+// kinesisLease holds the lease and checkpoint state of a shard
+type kinesisLease struct {
+	owner      string
+	expires    time.Time
+	checkpoint string
+}
+
+// isHeldBy returns true if the lease is owned by the given worker and has
+// not expired.
+func (lease kinesisLease) isHeldBy(owner string, now time.Time) bool {
+	return lease.owner == owner && lease.expires.After(now)
+}
+
+// isAvailable returns true if the lease is not held by any worker
+func (lease kinesisLease) isAvailable(now time.Time) bool {
+	return lease.owner == "" || !lease.expires.After(now)
+}
+
+// kinesisCheckpointStore stores shard leases and checkpoints so that multiple
+// workers can coordinate which shards they read.
+type kinesisCheckpointStore interface {
+	// getLeases returns the lease state of all shards known to the store.
+	getLeases() (map[string]kinesisLease, error)
+
+	// takeLease sets the owner and expiry of a lease if the lease still
+	// matches the expected owner and expiry. This is used to acquire, renew
+	// and steal leases. It returns false if the lease has been changed by
+	// another worker.
+	takeLease(shardID string, expected kinesisLease, owner string, expires time.Time) (bool, error)
+
+	// releaseLease removes the owner of a lease if it is held by owner.
+	releaseLease(shardID, owner string) error
+
+	// setCheckpoint stores the last processed sequence number of a shard.
+	// errKinesisLeaseLost is returned if owner does not hold the lease.
+	setCheckpoint(shardID, owner, checkpoint string) error
+
+	// initCheckpoint sets the checkpoint of a shard if none is stored yet.
+	initCheckpoint(shardID, checkpoint string) error
+}
+
+// kinesisFileStore keeps leases in memory and stores checkpoints in a file.
+// It is meant for a single worker. If no file is given, checkpoints are kept
+// in memory only.
+type kinesisFileStore struct {
+	path   string
+	leases map[string]kinesisLease
+	guard  *sync.Mutex
+}
+
+func newKinesisFileStore(path string) (*kinesisFileStore, error) {
+	store := &kinesisFileStore{
+		path:   path,
+		leases: make(map[string]kinesisLease),
+		guard:  new(sync.Mutex),
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	fileContents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	checkpoints := make(map[string]string)
+	if err := json.Unmarshal(fileContents, &checkpoints); err != nil {
+		return nil, err
+	}
+
+	for shardID, checkpoint := range checkpoints {
+		store.leases[shardID] = kinesisLease{checkpoint: checkpoint}
+	}
+	return store, nil
+}
+
+func (store *kinesisFileStore) getLeases() (map[string]kinesisLease, error) {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	leases := make(map[string]kinesisLease, len(store.leases))
+	for shardID, lease := range store.leases {
+		leases[shardID] = lease
+	}
+	return leases, nil
+}
+
+func (store *kinesisFileStore) takeLease(shardID string, expected kinesisLease, owner string, expires time.Time) (bool, error) {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	lease := store.leases[shardID]
+	if lease.owner != expected.owner || !lease.expires.Equal(expected.expires) {
+		return false, nil
+	}
+
+	lease.owner = owner
+	lease.expires = expires
+	store.leases[shardID] = lease
+	return true, nil
+}
+
+func (store *kinesisFileStore) releaseLease(shardID, owner string) error {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	if lease := store.leases[shardID]; lease.owner == owner {
+		lease.owner = ""
+		lease.expires = time.Time{}
+		store.leases[shardID] = lease
+	}
+	return nil
+}
+
+func (store *kinesisFileStore) setCheckpoint(shardID, owner, checkpoint string) error {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	lease := store.leases[shardID]
+	if lease.owner != owner {
+		return errKinesisLeaseLost
+	}
+
+	lease.checkpoint = checkpoint
+	store.leases[shardID] = lease
+	return store.write()
+}
+
+func (store *kinesisFileStore) initCheckpoint(shardID, checkpoint string) error {
+	store.guard.Lock()
+	defer store.guard.Unlock()
+
+	lease := store.leases[shardID]
+	if lease.checkpoint != "" {
+		return nil
+	}
+
+	lease.checkpoint = checkpoint
+	store.leases[shardID] = lease
+	return store.write()
+}
+
+// write stores all checkpoints to the file. The guard must be held.
+func (store *kinesisFileStore) write() error {
+	if store.path == "" {
+		return nil
+	}
+
+	checkpoints := make(map[string]string)
+	for shardID, lease := range store.leases {
+		if lease.checkpoint != "" {
+			checkpoints[shardID] = lease.checkpoint
+		}
+	}
+
+	fileContents, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.path, fileContents, 0644)
+}
+
+// kinesisDynamoStore stores leases and checkpoints in a DynamoDB table with
+// the string hash key "shardId". All changes are done using conditional
+// updates so that multiple workers can share a table.
+type kinesisDynamoStore struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+var kinesisDynamoAttributeNames = map[string]*string{
+	"#owner":      aws.String("leaseOwner"),
+	"#expires":    aws.String("leaseExpires"),
+	"#checkpoint": aws.String("checkpoint"),
+}
+
+func newKinesisDynamoStore(client *dynamodb.DynamoDB, table string) *kinesisDynamoStore {
+	return &kinesisDynamoStore{
+		client: client,
+		table:  table,
+	}
+}
+
+func kinesisDynamoTime(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	awsErr, isAwsErr := err.(awserr.Error)
+	return isAwsErr && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func (store *kinesisDynamoStore) update(shardID, update, condition string, values map[string]*dynamodb.AttributeValue) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(store.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"shardId": {S: aws.String(shardID)},
+		},
+		UpdateExpression:         aws.String(update),
+		ConditionExpression:      aws.String(condition),
+		ExpressionAttributeNames: make(map[string]*string),
+	}
+
+	// Only names used by the expressions may be passed
+	for placeholder, name := range kinesisDynamoAttributeNames {
+		if strings.Contains(update, placeholder) || strings.Contains(condition, placeholder) {
+			input.ExpressionAttributeNames[placeholder] = name
+		}
+	}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+
+	_, err := store.client.UpdateItem(input)
+	return err
+}
+
+func (store *kinesisDynamoStore) getLeases() (map[string]kinesisLease, error) {
+	leases := make(map[string]kinesisLease)
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(store.table),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	for {
+		result, err := store.client.Scan(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Items {
+			shardID := item["shardId"]
+			if shardID == nil || shardID.S == nil {
+				continue // ### continue, invalid item ###
+			}
+
+			lease := kinesisLease{}
+			if owner := item["leaseOwner"]; owner != nil && owner.S != nil {
+				lease.owner = *owner.S
+			}
+			if expires := item["leaseExpires"]; expires != nil && expires.N != nil {
+				ms, _ := strconv.ParseInt(*expires.N, 10, 64)
+				lease.expires = time.Unix(0, ms*int64(time.Millisecond))
+			}
+			if checkpoint := item["checkpoint"]; checkpoint != nil && checkpoint.S != nil {
+				lease.checkpoint = *checkpoint.S
+			}
+			leases[*shardID.S] = lease
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return leases, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (store *kinesisDynamoStore) takeLease(shardID string, expected kinesisLease, owner string, expires time.Time) (bool, error) {
+	values := map[string]*dynamodb.AttributeValue{
+		":owner":   {S: aws.String(owner)},
+		":expires": kinesisDynamoTime(expires),
+	}
+
+	condition := "attribute_not_exists(#owner)"
+	if expected.owner != "" {
+		condition = "#owner = :prevOwner AND #expires = :prevExpires"
+		values[":prevOwner"] = &dynamodb.AttributeValue{S: aws.String(expected.owner)}
+		values[":prevExpires"] = kinesisDynamoTime(expected.expires)
+	}
+
+	err := store.update(shardID, "SET #owner = :owner, #expires = :expires", condition, values)
+	switch {
+	case err == nil:
+		return true, nil
+	case isConditionalCheckFailed(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (store *kinesisDynamoStore) releaseLease(shardID, owner string) error {
+	err := store.update(shardID, "REMOVE #owner, #expires", "#owner = :owner",
+		map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(owner)}})
+
+	if isConditionalCheckFailed(err) {
+		return nil // lease is not ours anymore
+	}
+	return err
+}
+
+func (store *kinesisDynamoStore) setCheckpoint(shardID, owner, checkpoint string) error {
+	err := store.update(shardID, "SET #checkpoint = :checkpoint", "#owner = :owner",
+		map[string]*dynamodb.AttributeValue{
+			":checkpoint": {S: aws.String(checkpoint)},
+			":owner":      {S: aws.String(owner)},
+		})
+
+	if isConditionalCheckFailed(err) {
+		return errKinesisLeaseLost
+	}
+	return err
+}
+
+func (store *kinesisDynamoStore) initCheckpoint(shardID, checkpoint string) error {
+	err := store.update(shardID, "SET #checkpoint = :checkpoint", "attribute_not_exists(#checkpoint)",
+		map[string]*dynamodb.AttributeValue{":checkpoint": {S: aws.String(checkpoint)}})
+
+	if isConditionalCheckFailed(err) {
+		return nil // checkpoint already set
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dynamoStandIn implements the parts of the DynamoDB API used by
+// kinesisDynamoStore on a single in-memory table.
+type dynamoStandIn struct {
+	items map[string]map[string]map[string]string
+	guard sync.Mutex
+}
+
+type dynamoStandInRequest struct {
+	Key                       map[string]map[string]string
+	UpdateExpression          string
+	ConditionExpression       string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]map[string]string
+}
+
+func (db *dynamoStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	db.guard.Lock()
+	defer db.guard.Unlock()
+
+	request := dynamoStandInRequest{}
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &request)
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	switch r.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.Scan":
+		items := []map[string]map[string]string{}
+		for _, item := range db.items {
+			items = append(items, item)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Items": items})
+
+	case "DynamoDB_20120810.UpdateItem":
+		key := request.Key["shardId"]["S"]
+		item, exists := db.items[key]
+		if !exists {
+			item = map[string]map[string]string{"shardId": {"S": key}}
+		}
+
+		for _, term := range strings.Split(request.ConditionExpression, " AND ") {
+			if strings.HasPrefix(term, "attribute_not_exists(") {
+				name := request.ExpressionAttributeNames[strings.TrimSuffix(strings.TrimPrefix(term, "attribute_not_exists("), ")")]
+				if _, set := item[name]; !set {
+					continue
+				}
+			} else {
+				parts := strings.Split(term, " = ")
+				name := request.ExpressionAttributeNames[parts[0]]
+				if value, set := item[name]; set && value["S"]+value["N"] == request.ExpressionAttributeValues[parts[1]]["S"]+request.ExpressionAttributeValues[parts[1]]["N"] {
+					continue
+				}
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`))
+			return
+		}
+
+		if strings.HasPrefix(request.UpdateExpression, "REMOVE ") {
+			for _, placeholder := range strings.Split(strings.TrimPrefix(request.UpdateExpression, "REMOVE "), ", ") {
+				delete(item, request.ExpressionAttributeNames[placeholder])
+			}
+		} else {
+			for _, assignment := range strings.Split(strings.TrimPrefix(request.UpdateExpression, "SET "), ", ") {
+				parts := strings.Split(assignment, " = ")
+				item[request.ExpressionAttributeNames[parts[0]]] = request.ExpressionAttributeValues[parts[1]]
+			}
+		}
+
+		db.items[key] = item
+		w.Write([]byte("{}"))
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#UnknownOperationException"}`))
+	}
+}
+
+func newTestKinesisDynamoStore() (*kinesisDynamoStore, *httptest.Server) {
+	server := httptest.NewServer(&dynamoStandIn{
+		items: make(map[string]map[string]map[string]string),
+	})
+
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithEndpoint(server.URL).
+		WithMaxRetries(0).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+
+	return newKinesisDynamoStore(dynamodb.New(sess), "test"), server
+}
+
+func testKinesisStore(expect ttesting.Expect, store kinesisCheckpointStore) {
+	now := time.Now().Truncate(time.Millisecond)
+	expires := now.Add(time.Minute)
+
+	taken, err := store.takeLease("shard-0", kinesisLease{}, "a", expires)
+	expect.NoError(err)
+	expect.True(taken)
+
+	taken, err = store.takeLease("shard-0", kinesisLease{}, "b", expires)
+	expect.NoError(err)
+	expect.False(taken)
+
+	expect.NoError(store.setCheckpoint("shard-0", "a", "100"))
+	expect.Equal(errKinesisLeaseLost, store.setCheckpoint("shard-0", "b", "200"))
+
+	expect.NoError(store.initCheckpoint("shard-0", kinesisCheckpointTrimHorizon))
+	expect.NoError(store.initCheckpoint("shard-1", kinesisCheckpointTrimHorizon))
+
+	leases, err := store.getLeases()
+	expect.NoError(err)
+	expect.Equal(2, len(leases))
+	expect.Equal("a", leases["shard-0"].owner)
+	expect.Equal("100", leases["shard-0"].checkpoint)
+	expect.True(leases["shard-0"].isHeldBy("a", now))
+	expect.True(leases["shard-1"].isAvailable(now))
+	expect.Equal(kinesisCheckpointTrimHorizon, leases["shard-1"].checkpoint)
+
+	// Steal using the state read before
+	taken, err = store.takeLease("shard-0", leases["shard-0"], "b", expires.Add(time.Second))
+	expect.NoError(err)
+	expect.True(taken)
+
+	taken, err = store.takeLease("shard-0", leases["shard-0"], "a", expires.Add(time.Second))
+	expect.NoError(err)
+	expect.False(taken)
+
+	// Release by a former owner does not change the lease
+	expect.NoError(store.releaseLease("shard-0", "a"))
+	expect.NoError(store.releaseLease("shard-0", "b"))
+
+	leases, err = store.getLeases()
+	expect.NoError(err)
+	expect.True(leases["shard-0"].isAvailable(now))
+	expect.Equal("100", leases["shard-0"].checkpoint)
+}
+
+func TestKinesisFileStore(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-kinesis")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "offsets.json")
+	store, err := newKinesisFileStore(path)
+	expect.NoError(err)
+	testKinesisStore(expect, store)
+
+	store, err = newKinesisFileStore(path)
+	expect.NoError(err)
+	leases, err := store.getLeases()
+	expect.NoError(err)
+	expect.Equal("100", leases["shard-0"].checkpoint)
+	expect.Equal(kinesisCheckpointTrimHorizon, leases["shard-1"].checkpoint)
+	expect.Equal("", leases["shard-0"].owner)
+}
+
+func TestKinesisDynamoStore(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	store, server := newTestKinesisDynamoStore()
+	defer server.Close()
+
+	testKinesisStore(expect, store)
+}
+
+func TestKinesisEligibleShards(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	shards := []*kinesis.Shard{
+		{ShardId: aws.String("parent-0")},
+		{ShardId: aws.String("parent-1")},
+		{ShardId: aws.String("split-0"), ParentShardId: aws.String("parent-0")},
+		{ShardId: aws.String("merge-0"), ParentShardId: aws.String("parent-0"), AdjacentParentShardId: aws.String("parent-1")},
+		{ShardId: aws.String("orphan-0"), ParentShardId: aws.String("expired-0")},
+	}
+
+	eligibleIDs := func(leases map[string]kinesisLease) []string {
+		ids := []string{}
+		for _, shard := range kinesisEligibleShards(shards, leases) {
+			ids = append(ids, *shard.ShardId)
+		}
+		return ids
+	}
+
+	leases := map[string]kinesisLease{}
+	expect.Equal([]string{"parent-0", "parent-1", "orphan-0"}, eligibleIDs(leases))
+
+	leases["parent-0"] = kinesisLease{checkpoint: kinesisCheckpointShardEnd}
+	expect.Equal([]string{"parent-1", "split-0", "orphan-0"}, eligibleIDs(leases))
+
+	leases["parent-1"] = kinesisLease{checkpoint: kinesisCheckpointShardEnd}
+	expect.Equal([]string{"split-0", "merge-0", "orphan-0"}, eligibleIDs(leases))
+}
+
+func TestKinesisLeaseTarget(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	now := time.Now()
+	valid := now.Add(time.Minute)
+	expired := now.Add(-time.Minute)
+
+	leases := map[string]kinesisLease{
+		"0": {owner: "a", expires: valid},
+		"1": {owner: "a", expires: valid},
+		"2": {owner: "a", expires: valid},
+		"3": {owner: "b", expires: valid},
+		"4": {owner: "c", expires: expired},
+	}
+
+	expect.Equal(3, kinesisLeaseTarget(leases, "b", now))
+	expect.Equal(2, kinesisLeaseTarget(leases, "d", now))
+	expect.Equal(5, kinesisLeaseTarget(map[string]kinesisLease{
+		"0": {}, "1": {}, "2": {}, "3": {}, "4": {},
+	}, "a", now))
+}
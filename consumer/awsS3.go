@@ -0,0 +1,575 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tmath"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AwsS3 consumer plugin
+//
+// This consumer reads objects from Amazon S3 and splits them into messages.
+// Objects are either found by listing a bucket or by receiving S3 event
+// notifications from an SQS queue. Gzip compressed objects are decompressed
+// transparently.
+//
+// Objects that have been read completely are recorded in a state file so that
+// they are not read again after a restart. Objects are identified by bucket,
+// key and ETag, i.e. an object that has been overwritten is read again. If
+// the consumer is stopped while reading an object, the object is read again
+// from the start on the next run. The state file is written after each page
+// of listed objects and after each batch of event notifications, so objects
+// read shortly before a crash may be read again, too.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - bucket: The bucket the object was read from (set)
+//
+// - key: The key of the object (set)
+//
+// - line: The number of the message within the object, starting at 1 (set)
+//
+// Parameters
+//
+// - Bucket: This value defines the bucket to read from. When reading event
+// notifications, only events for this bucket are processed. If set to "", all
+// buckets found in event notifications are processed. Either Bucket or
+// QueueUrl has to be set.
+// By default this parameter is set to "".
+//
+// - Prefix: This value defines the key prefix of the objects to read.
+// By default this parameter is set to "".
+//
+// - QueueUrl: This value defines the url of an SQS queue receiving S3 event
+// notifications. Notifications sent through SNS are supported, too. If set,
+// the bucket is not listed and only objects from received notifications are
+// read. SQS messages are deleted after all objects have been read.
+// By default this parameter is set to "".
+//
+// - Delimiter: This value defines the delimiter used to split objects into
+// messages. If set to "", each object is sent as one message.
+// By default this parameter is set to "\n".
+//
+// - MaxMessageSizeKB: This value defines the maximum size of a message in
+// kilobytes. Larger messages are skipped and the rest of the object is read.
+// By default this parameter is set to "1024".
+//
+// - StateFile: This value defines the file storing the objects that have been
+// read completely. If set to "", the state is kept in memory only.
+// By default this parameter is set to "".
+//
+// - PollIntervalSec: This value defines the number of seconds to wait before
+// listing the bucket again. If set to "0", the bucket is listed only once.
+// By default this parameter is set to "60".
+//
+// - RetryDelayMs: This value defines the number of milliseconds to wait after
+// a failed request.
+// By default this parameter is set to "1000".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in
+// the metadata section will be added to each message.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example reads all archived logs below "logs/2017/" once:
+//
+//  S3In:
+//    Type: consumer.AwsS3
+//    Streams: archive
+//    Region: eu-west-1
+//    Bucket: gollum-s3-test
+//    Prefix: logs/2017/
+//    StateFile: /var/lib/gollum/s3-archive.json
+//    PollIntervalSec: 0
+//    SetMetadata: true
+//
+// This example reads new objects using S3 event notifications:
+//
+//  S3Events:
+//    Type: consumer.AwsS3
+//    Streams: logs
+//    Region: eu-west-1
+//    Bucket: gollum-s3-test
+//    QueueUrl: https://sqs.eu-west-1.amazonaws.com/123456789012/s3-events
+type AwsS3 struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	// AwsMultiClient is public to make AwsMultiClient.Configure() callable
+	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
+
+	bucket         string        `config:"Bucket"`
+	prefix         string        `config:"Prefix"`
+	queueURL       string        `config:"QueueUrl"`
+	delimiter      string        `config:"Delimiter" default:"\n"`
+	maxMessageSize int           `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	stateFile      string        `config:"StateFile"`
+	pollInterval   time.Duration `config:"PollIntervalSec" default:"60" metric:"sec"`
+	retryDelay     time.Duration `config:"RetryDelayMs" default:"1000" metric:"ms"`
+	hasMetadata    bool          `config:"SetMetadata" default:"false"`
+
+	s3Client   *s3.S3
+	sqsClient  *sqs.SQS
+	done       map[string]string
+	stateDirty bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// s3EventNotification contains the fields of an S3 event notification used
+// by this consumer.
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+
+	// SNS envelope
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// s3Object identifies an object to read
+type s3Object struct {
+	bucket string
+	key    string
+	etag   string
+}
+
+func (obj s3Object) id() string {
+	return obj.bucket + "/" + obj.key
+}
+
+func init() {
+	core.TypeRegistry.Register(AwsS3{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *AwsS3) Configure(conf core.PluginConfigReader) {
+	cons.done = make(map[string]string)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	cons.SetStopCallback(cons.cancel)
+
+	if cons.bucket == "" && cons.queueURL == "" {
+		conf.Errors.Pushf("Either Bucket or QueueUrl must be set")
+	}
+	if cons.queueURL != "" {
+		if queueURL, err := url.Parse(cons.queueURL); err != nil || queueURL.Host == "" {
+			conf.Errors.Pushf("QueueUrl must be an absolute url")
+		}
+	}
+	if cons.maxMessageSize <= 0 {
+		conf.Errors.Pushf("MaxMessageSizeKB must be larger than 0")
+	}
+
+	if cons.stateFile != "" {
+		fileContents, err := ioutil.ReadFile(cons.stateFile)
+		switch {
+		case err == nil:
+			conf.Errors.Push(json.Unmarshal(fileContents, &cons.done))
+		case !os.IsNotExist(err):
+			conf.Errors.Push(err)
+		}
+	}
+}
+
+func (cons *AwsS3) initClients() error {
+	sess, err := cons.AwsMultiClient.NewSessionWithOptions()
+	if err != nil {
+		return err
+	}
+
+	awsConfig := cons.AwsMultiClient.GetConfig().Copy()
+
+	// set auto endpoint to s3 if setting is empty
+	if awsConfig.Endpoint == nil || *awsConfig.Endpoint == "" {
+		if *awsConfig.Region != components.DefaultAwsRegion {
+			awsConfig.WithEndpoint(fmt.Sprintf("s3-%s.amazonaws.com", *awsConfig.Region))
+		} else {
+			awsConfig.WithEndpoint("s3.amazonaws.com")
+		}
+	}
+	cons.s3Client = s3.New(sess, awsConfig)
+
+	if cons.queueURL != "" {
+		awsConfig = cons.AwsMultiClient.GetConfig().Copy()
+		awsConfig.WithEndpoint(fmt.Sprintf("sqs.%s.amazonaws.com", *awsConfig.Region))
+		cons.sqsClient = sqs.New(sess, awsConfig)
+	}
+	return nil
+}
+
+// wait sleeps for the given duration and returns false if the consumer has
+// been stopped in the meantime.
+func (cons *AwsS3) wait(duration time.Duration) bool {
+	select {
+	case <-cons.ctx.Done():
+		return false
+	case <-time.After(duration):
+		return cons.IsActive()
+	}
+}
+
+func (cons *AwsS3) isDone(obj s3Object) bool {
+	etag, isDone := cons.done[obj.id()]
+	return isDone && etag == obj.etag
+}
+
+func (cons *AwsS3) markDone(obj s3Object) {
+	cons.done[obj.id()] = obj.etag
+	cons.stateDirty = cons.stateFile != ""
+}
+
+// storeState writes the state file if objects have been marked as done since
+// the last call.
+func (cons *AwsS3) storeState() {
+	if !cons.stateDirty {
+		return
+	}
+
+	fileContents, err := json.Marshal(cons.done)
+	if err == nil {
+		err = ioutil.WriteFile(cons.stateFile, fileContents, 0644)
+	}
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to write state file")
+		return
+	}
+	cons.stateDirty = false
+}
+
+// readObject reads an object and passes each message to enqueue. Gzip
+// compressed objects are detected by their header. Messages larger than
+// MaxMessageSizeKB are skipped.
+func (cons *AwsS3) readObject(obj s3Object, enqueue func([]byte, core.Metadata)) error {
+	result, err := cons.s3Client.GetObjectWithContext(cons.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(obj.bucket),
+		Key:    aws.String(obj.key),
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	var reader io.Reader = bufio.NewReader(result.Body)
+	if header, _ := reader.(*bufio.Reader).Peek(2); len(header) == 2 && header[0] == 0x1f && header[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	splitter := s3MessageSplitter{
+		delimiter: []byte(cons.delimiter),
+		maxSize:   cons.maxMessageSize,
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, tmath.MinI(64*1024, cons.maxMessageSize)), cons.maxMessageSize)
+	scanner.Split(splitter.split)
+
+	line := 0
+	for scanner.Scan() {
+		if !cons.IsActive() {
+			return fmt.Errorf("consumer stopped")
+		}
+
+		line++
+		var metadata core.Metadata
+		if cons.hasMetadata {
+			metadata = core.Metadata{}
+			metadata.SetValue("bucket", []byte(obj.bucket))
+			metadata.SetValue("key", []byte(obj.key))
+			metadata.SetValue("line", []byte(strconv.Itoa(line)))
+		}
+
+		data := make([]byte, len(scanner.Bytes()))
+		copy(data, scanner.Bytes())
+		enqueue(data, metadata)
+	}
+
+	if splitter.numSkipped > 0 {
+		cons.Logger.Warningf("Skipped %d messages larger than %d bytes in s3://%s", splitter.numSkipped, cons.maxMessageSize, obj.id())
+	}
+	return scanner.Err()
+}
+
+// s3MessageSplitter splits data at a delimiter and skips messages larger than
+// maxSize. If the delimiter is empty, all data is returned as one token.
+type s3MessageSplitter struct {
+	delimiter  []byte
+	maxSize    int
+	skipping   bool
+	numSkipped int
+}
+
+// split implements bufio.SplitFunc. Tokens are never larger than maxSize so
+// the scanner does not fail with bufio.ErrTooLong.
+func (splitter *s3MessageSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	idx := -1
+	if len(splitter.delimiter) > 0 {
+		idx = bytes.Index(data, splitter.delimiter)
+	}
+
+	switch {
+	case splitter.skipping:
+		if idx >= 0 {
+			splitter.skipping = false
+			return idx + len(splitter.delimiter), nil, nil
+		}
+		if atEOF {
+			return len(data), nil, nil
+		}
+		// Keep a possibly incomplete delimiter at the end of data
+		if keep := len(splitter.delimiter) - 1; len(data) > keep {
+			return len(data) - keep, nil, nil
+		}
+		return 0, nil, nil // ### return, need more data ###
+
+	case idx >= 0:
+		return idx + len(splitter.delimiter), data[:idx], nil
+
+	case atEOF:
+		return len(data), data, nil
+
+	case len(data) >= splitter.maxSize:
+		splitter.skipping = true
+		splitter.numSkipped++
+		return splitter.split(data, atEOF)
+
+	default:
+		return 0, nil, nil // ### return, need more data ###
+	}
+}
+
+func (cons *AwsS3) enqueue(data []byte, metadata core.Metadata) {
+	if metadata != nil {
+		cons.EnqueueWithMetadata(data, metadata)
+	} else {
+		cons.Enqueue(data)
+	}
+}
+
+// processObject reads an object unless it has been read before
+func (cons *AwsS3) processObject(obj s3Object) bool {
+	if cons.isDone(obj) {
+		return true
+	}
+
+	cons.Logger.Debugf("Reading s3://%s", obj.id())
+	if err := cons.readObject(obj, cons.enqueue); err != nil {
+		if cons.IsActive() {
+			cons.Logger.WithError(err).Errorf("Failed to read s3://%s", obj.id())
+		}
+		return false
+	}
+
+	cons.markDone(obj)
+	return true
+}
+
+func (cons *AwsS3) listBucket() {
+	for cons.IsActive() {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(cons.bucket),
+		}
+		if cons.prefix != "" {
+			input.Prefix = aws.String(cons.prefix)
+		}
+
+		err := cons.s3Client.ListObjectsV2PagesWithContext(cons.ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				if !cons.IsActive() {
+					return false
+				}
+				if object.Key == nil || strings.HasSuffix(*object.Key, "/") {
+					continue // ### continue, no object ###
+				}
+				cons.processObject(s3Object{
+					bucket: cons.bucket,
+					key:    *object.Key,
+					etag:   strings.Trim(aws.StringValue(object.ETag), "\""),
+				})
+			}
+			cons.storeState()
+			return true
+		})
+
+		if err != nil && cons.IsActive() {
+			cons.Logger.WithError(err).Errorf("Failed to list bucket %s", cons.bucket)
+			if !cons.wait(cons.retryDelay) {
+				return // ### return, stopped ###
+			}
+			continue // ### continue, retry ###
+		}
+
+		if cons.pollInterval <= 0 || !cons.wait(cons.pollInterval) {
+			return // ### return, done ###
+		}
+	}
+}
+
+// parseS3Events returns the created objects from an S3 event notification.
+// Notifications wrapped into SNS messages are unwrapped.
+func parseS3Events(body []byte) ([]s3Object, error) {
+	notification := s3EventNotification{}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+
+	if notification.Type == "Notification" && notification.Message != "" {
+		return parseS3Events([]byte(notification.Message))
+	}
+
+	objects := []s3Object{}
+	for _, record := range notification.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue // ### continue, not a new object ###
+		}
+
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, s3Object{
+			bucket: record.S3.Bucket.Name,
+			key:    key,
+			etag:   strings.Trim(record.S3.Object.ETag, "\""),
+		})
+	}
+	return objects, nil
+}
+
+func (cons *AwsS3) receiveEvents() {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(cons.queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+	}
+
+	for cons.IsActive() {
+		result, err := cons.sqsClient.ReceiveMessageWithContext(cons.ctx, input)
+		if err != nil {
+			if !cons.IsActive() {
+				return // ### return, stopped ###
+			}
+			cons.Logger.WithError(err).Errorf("Failed to receive messages from %s", cons.queueURL)
+			cons.wait(cons.retryDelay)
+			continue // ### continue, retry ###
+		}
+
+		processed := []*sqs.Message{}
+		for _, msg := range result.Messages {
+			if cons.processEvent(msg) {
+				processed = append(processed, msg)
+			}
+		}
+
+		// Store the state before deleting so that objects of deleted
+		// notifications are known to be done.
+		cons.storeState()
+		for _, msg := range processed {
+			_, err := cons.sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(cons.queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				cons.Logger.WithError(err).Error("Failed to delete event notification")
+			}
+		}
+	}
+}
+
+// processEvent reads all objects of an event notification. False is returned
+// if the notification has to be processed again.
+func (cons *AwsS3) processEvent(msg *sqs.Message) bool {
+	objects, err := parseS3Events([]byte(aws.StringValue(msg.Body)))
+	if err != nil {
+		cons.Logger.WithError(err).Warning("Ignoring invalid event notification")
+		return true
+	}
+
+	for _, obj := range objects {
+		if cons.bucket != "" && obj.bucket != cons.bucket {
+			continue // ### continue, other bucket ###
+		}
+		if !strings.HasPrefix(obj.key, cons.prefix) {
+			continue // ### continue, other prefix ###
+		}
+		if !cons.processObject(obj) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cons *AwsS3) run() {
+	defer cons.WorkerDone()
+	defer cons.storeState()
+
+	if err := cons.initClients(); err != nil {
+		cons.Logger.WithError(err).Error("Can't get proper aws config")
+		return
+	}
+
+	if cons.queueURL != "" {
+		cons.receiveEvents()
+	} else {
+		cons.listBucket()
+	}
+}
+
+// Consume reads objects from S3 and listens for control commands.
+func (cons *AwsS3) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go tgo.WithRecoverShutdown(cons.run)
+	cons.ControlLoop()
+}
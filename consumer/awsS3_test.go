@@ -0,0 +1,203 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestAwsS3Consumer(expect ttesting.Expect, id string, objects map[string][]byte) (*AwsS3, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, exists := objects[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+
+	config := core.NewPluginConfig(id, "consumer.AwsS3")
+	config.Override("Bucket", "logs")
+	config.Override("SetMetadata", true)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*AwsS3)
+	expect.True(casted)
+
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithMaxRetries(0).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+	cons.s3Client = s3.New(sess)
+
+	return cons, server
+}
+
+func TestAwsS3ReadObject(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("c\nd"))
+	writer.Close()
+
+	cons, server := newTestAwsS3Consumer(expect, "testAwsS3ReadObject", map[string][]byte{
+		"/logs/plain.log": []byte("a\nb\n"),
+		"/logs/data.gz":   compressed.Bytes(),
+	})
+	defer server.Close()
+
+	lines := []string{}
+	keys := []string{}
+	enqueue := func(data []byte, metadata core.Metadata) {
+		lines = append(lines, string(data)+"@"+metadata.GetValueString("line"))
+		keys = append(keys, metadata.GetValueString("bucket")+"/"+metadata.GetValueString("key"))
+	}
+
+	expect.NoError(cons.readObject(s3Object{bucket: "logs", key: "plain.log"}, enqueue))
+	expect.NoError(cons.readObject(s3Object{bucket: "logs", key: "data.gz"}, enqueue))
+	expect.Equal("a@1,b@2,c@1,d@2", strings.Join(lines, ","))
+	expect.Equal("logs/plain.log", keys[0])
+	expect.Equal("logs/data.gz", keys[3])
+
+	expect.NotNil(cons.readObject(s3Object{bucket: "logs", key: "missing"}, enqueue))
+}
+
+func TestAwsS3SkipLargeMessages(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	large := strings.Repeat("x", 200*1024)
+	cons, server := newTestAwsS3Consumer(expect, "testAwsS3SkipLargeMessages", map[string][]byte{
+		"/logs/large.log": []byte("a\n" + large + "\nb\n" + large),
+	})
+	defer server.Close()
+	cons.maxMessageSize = 100 * 1024
+
+	lines := []string{}
+	enqueue := func(data []byte, metadata core.Metadata) {
+		lines = append(lines, string(data))
+	}
+
+	expect.NoError(cons.readObject(s3Object{bucket: "logs", key: "large.log"}, enqueue))
+	expect.Equal("a,b", strings.Join(lines, ","))
+
+	// Delimiters split across reads are found while skipping
+	splitter := s3MessageSplitter{delimiter: []byte("--"), maxSize: 4}
+	advance, token, err := splitter.split([]byte("xxxx-"), false)
+	expect.NoError(err)
+	expect.Nil(token)
+	expect.True(splitter.skipping)
+	expect.Equal(4, advance)
+
+	advance, token, err = splitter.split([]byte("--ab--"), false)
+	expect.NoError(err)
+	expect.Nil(token)
+	expect.False(splitter.skipping)
+	expect.Equal(2, advance)
+	expect.Equal(1, splitter.numSkipped)
+}
+
+func TestAwsS3StateFile(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-s3")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	cons, server := newTestAwsS3Consumer(expect, "testAwsS3StateFile", map[string][]byte{})
+	defer server.Close()
+	cons.stateFile = stateFile
+
+	// State is only written when storing it explicitly
+	cons.markDone(s3Object{bucket: "logs", key: "a.log", etag: "1"})
+	cons.markDone(s3Object{bucket: "logs", key: "b.log", etag: "2"})
+	_, err = os.Stat(stateFile)
+	expect.True(os.IsNotExist(err))
+
+	cons.storeState()
+	expect.False(cons.stateDirty)
+	data, err := ioutil.ReadFile(stateFile)
+	expect.NoError(err)
+	expect.Equal(`{"logs/a.log":"1","logs/b.log":"2"}`, string(data))
+
+	config := core.NewPluginConfig("testAwsS3StateFileReload", "consumer.AwsS3")
+	config.Override("Bucket", "logs")
+	config.Override("StateFile", stateFile)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	expect.True(plugin.(*AwsS3).isDone(s3Object{bucket: "logs", key: "b.log", etag: "2"}))
+	expect.False(plugin.(*AwsS3).isDone(s3Object{bucket: "logs", key: "b.log", etag: "3"}))
+}
+
+func TestAwsS3Configure(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testAwsS3ConfigureEmpty", "consumer.AwsS3")
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("testAwsS3ConfigureQueue", "consumer.AwsS3")
+	config.Override("QueueUrl", "s3-events")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("testAwsS3ConfigureValid", "consumer.AwsS3")
+	config.Override("QueueUrl", "https://sqs.eu-west-1.amazonaws.com/123456789012/s3-events")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+}
+
+func TestAwsS3Events(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	event := `{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"2017/a+b%3D.log","eTag":"abc"}}},
+		{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"logs"},"object":{"key":"old.log"}}}
+	]}`
+
+	objects, err := parseS3Events([]byte(event))
+	expect.NoError(err)
+	expect.Equal(1, len(objects))
+	expect.Equal("logs", objects[0].bucket)
+	expect.Equal("2017/a b=.log", objects[0].key)
+	expect.Equal("abc", objects[0].etag)
+
+	wrapped := `{"Type":"Notification","Message":` + strings.Replace(strings.Replace(`"`+strings.Replace(event, `"`, `\"`, -1)+`"`, "\n", "", -1), "\t", "", -1) + `}`
+	objects, err = parseS3Events([]byte(wrapped))
+	expect.NoError(err)
+	expect.Equal(1, len(objects))
+
+	objects, err = parseS3Events([]byte(`{"Event":"s3:TestEvent"}`))
+	expect.NoError(err)
+	expect.Equal(0, len(objects))
+}
@@ -0,0 +1,367 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AwsSQS consumer plugin
+//
+// This consumer reads messages from an AWS SQS queue using long polling.
+// Each SQS message is enqueued as one gollum message. Messages are deleted
+// from the queue after they have been enqueued. While a batch of messages is
+// being enqueued, the visibility timeout of these messages is extended so
+// that they are not delivered to another receiver in the meantime.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - messageId: The id of the SQS message (set)
+//
+// - groupId: The message group id of messages read from a FIFO queue (set)
+//
+// - <attribute>: The value of each string, number or binary message attribute
+// is stored using the attribute name as key (set)
+//
+// Parameters
+//
+// - QueueName: This value defines the name of the queue to read from. The
+// queue url is resolved on startup. This parameter is ignored if QueueUrl is
+// set.
+// By default this parameter is set to "default".
+//
+// - QueueUrl: This value defines the url of the queue to read from.
+// By default this parameter is set to "".
+//
+// - Receivers: This value defines the number of concurrent receive calls.
+// By default this parameter is set to "1".
+//
+// - MaxMessages: This value defines the maximum number of messages returned
+// by a single receive call. Valid values are 1 to 10.
+// By default this parameter is set to "10".
+//
+// - WaitTimeSec: This value defines the number of seconds a receive call waits
+// for messages to arrive (long polling). Valid values are 0 to 20.
+// By default this parameter is set to "20".
+//
+// - VisibilityTimeoutSec: This value defines the number of seconds received
+// messages are hidden from other receivers. The timeout is extended until all
+// messages of a batch have been enqueued. If set to "0" the visibility timeout
+// of the queue is used and not extended.
+// By default this parameter is set to "30".
+//
+// - RetryDelayMs: This value defines the number of milliseconds to wait after
+// a failed request.
+// By default this parameter is set to "1000".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in
+// the metadata section will be added to each message.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example reads messages from the queue "myQueue" using four concurrent
+// receivers:
+//
+//  SqsIn:
+//    Type: consumer.AwsSQS
+//    Streams: sqs
+//    Region: eu-west-1
+//    QueueName: myQueue
+//    Receivers: 4
+//    SetMetadata: true
+type AwsSQS struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	// AwsMultiClient is public to make AwsMultiClient.Configure() callable
+	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
+
+	queueName         string        `config:"QueueName" default:"default"`
+	queueURL          string        `config:"QueueUrl"`
+	receivers         int           `config:"Receivers" default:"1"`
+	maxMessages       int64         `config:"MaxMessages" default:"10"`
+	waitTime          time.Duration `config:"WaitTimeSec" default:"20" metric:"sec"`
+	visibilityTimeout time.Duration `config:"VisibilityTimeoutSec" default:"30" metric:"sec"`
+	retryDelay        time.Duration `config:"RetryDelayMs" default:"1000" metric:"ms"`
+	hasMetadata       bool          `config:"SetMetadata" default:"false"`
+
+	client *sqs.SQS
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func init() {
+	core.TypeRegistry.Register(AwsSQS{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *AwsSQS) Configure(conf core.PluginConfigReader) {
+	if cons.receivers < 1 {
+		conf.Errors.Pushf("Receivers must be at least 1")
+	}
+	if cons.maxMessages < 1 || cons.maxMessages > 10 {
+		conf.Errors.Pushf("MaxMessages must be between 1 and 10")
+	}
+	if cons.waitTime < 0 || cons.waitTime > 20*time.Second {
+		conf.Errors.Pushf("WaitTimeSec must be between 0 and 20")
+	}
+
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	cons.SetStopCallback(cons.cancel)
+}
+
+func (cons *AwsSQS) initSQSClient() error {
+	sess, err := cons.AwsMultiClient.NewSessionWithOptions()
+	if err != nil {
+		return err
+	}
+
+	awsConfig := cons.AwsMultiClient.GetConfig()
+
+	// set auto endpoint to sqs if setting is empty
+	if awsConfig.Endpoint == nil || *awsConfig.Endpoint == "" {
+		awsConfig.WithEndpoint(fmt.Sprintf("sqs.%s.amazonaws.com", *awsConfig.Region))
+	}
+
+	cons.client = sqs.New(sess, awsConfig)
+	return nil
+}
+
+// wait sleeps for the given duration and returns false if the consumer has
+// been stopped in the meantime.
+func (cons *AwsSQS) wait(duration time.Duration) bool {
+	select {
+	case <-cons.ctx.Done():
+		return false
+	case <-time.After(duration):
+		return cons.IsActive()
+	}
+}
+
+func (cons *AwsSQS) resolveQueueURL() bool {
+	for cons.queueURL == "" {
+		result, err := cons.client.GetQueueUrlWithContext(cons.ctx, &sqs.GetQueueUrlInput{
+			QueueName: aws.String(cons.queueName),
+		})
+
+		if err == nil && result.QueueUrl != nil {
+			cons.queueURL = *result.QueueUrl
+			break
+		}
+
+		cons.Logger.WithError(err).Errorf("Failed to resolve url of queue %s", cons.queueName)
+		if !cons.wait(cons.retryDelay) {
+			return false // ### return, stopped ###
+		}
+	}
+	return true
+}
+
+func (cons *AwsSQS) run() {
+	defer cons.WorkerDone()
+
+	if err := cons.initSQSClient(); err != nil {
+		cons.Logger.WithError(err).Error("Can't get proper aws config")
+		return
+	}
+
+	if !cons.resolveQueueURL() {
+		return // ### return, stopped ###
+	}
+
+	for i := 0; i < cons.receivers; i++ {
+		cons.AddWorker()
+		go tgo.WithRecoverShutdown(cons.receive)
+	}
+}
+
+func (cons *AwsSQS) receive() {
+	defer cons.WorkerDone()
+
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(cons.queueURL),
+		MaxNumberOfMessages: aws.Int64(cons.maxMessages),
+		WaitTimeSeconds:     aws.Int64(int64(cons.waitTime / time.Second)),
+	}
+	if cons.visibilityTimeout > 0 {
+		input.VisibilityTimeout = aws.Int64(int64(cons.visibilityTimeout / time.Second))
+	}
+	if cons.hasMetadata {
+		input.MessageAttributeNames = []*string{aws.String("All")}
+		input.AttributeNames = []*string{aws.String(sqs.MessageSystemAttributeNameMessageGroupId)}
+	}
+
+	for cons.IsActive() {
+		result, err := cons.client.ReceiveMessageWithContext(cons.ctx, input)
+		if err != nil {
+			if cons.ctx.Err() != nil {
+				return // ### return, stopped ###
+			}
+			cons.Logger.WithError(err).Errorf("Failed to receive messages from %s", cons.queueURL)
+			cons.wait(cons.retryDelay)
+			continue // ### continue, retry ###
+		}
+
+		if len(result.Messages) > 0 {
+			cons.processMessages(result.Messages)
+		}
+	}
+}
+
+// processMessages enqueues the given messages and deletes them from the
+// queue afterwards. Messages that were not enqueued because the consumer has
+// been stopped are made visible again.
+func (cons *AwsSQS) processMessages(messages []*sqs.Message) {
+	done := make(chan struct{})
+	if cons.visibilityTimeout > 0 {
+		go cons.extendVisibility(messages, done)
+	}
+
+	enqueued := 0
+	for _, msg := range messages {
+		if !cons.IsActive() {
+			break // ### break, stopped ###
+		}
+		if msg == nil || msg.Body == nil {
+			enqueued++
+			continue // ### continue, nothing to enqueue ###
+		}
+
+		if cons.hasMetadata {
+			cons.EnqueueWithMetadata([]byte(*msg.Body), getSQSMetadata(msg))
+		} else {
+			cons.Enqueue([]byte(*msg.Body))
+		}
+		enqueued++
+	}
+	close(done)
+
+	cons.deleteMessages(messages[:enqueued])
+	cons.releaseMessages(messages[enqueued:])
+}
+
+// getSQSMetadata returns the metadata for a given SQS message
+func getSQSMetadata(msg *sqs.Message) core.Metadata {
+	metadata := core.Metadata{}
+	if msg.MessageId != nil {
+		metadata.SetValue("messageId", []byte(*msg.MessageId))
+	}
+	if groupID := msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]; groupID != nil {
+		metadata.SetValue("groupId", []byte(*groupID))
+	}
+
+	for name, attribute := range msg.MessageAttributes {
+		switch {
+		case attribute == nil:
+		case attribute.StringValue != nil:
+			metadata.SetValue(name, []byte(*attribute.StringValue))
+		case attribute.BinaryValue != nil:
+			metadata.SetValue(name, attribute.BinaryValue)
+		}
+	}
+	return metadata
+}
+
+// extendVisibility extends the visibility timeout of the given messages until
+// done is closed.
+func (cons *AwsSQS) extendVisibility(messages []*sqs.Message, done chan struct{}) {
+	interval := cons.visibilityTimeout / 2
+	timeout := int64(cons.visibilityTimeout / time.Second)
+
+	for {
+		select {
+		case <-done:
+			return // ### return, batch processed ###
+		case <-time.After(interval):
+			cons.changeVisibility(messages, timeout)
+		}
+	}
+}
+
+func (cons *AwsSQS) changeVisibility(messages []*sqs.Message, timeout int64) {
+	if len(messages) == 0 {
+		return
+	}
+
+	input := &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(cons.queueURL),
+		Entries:  make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(messages)),
+	}
+	for idx, msg := range messages {
+		input.Entries = append(input.Entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(idx)),
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(timeout),
+		})
+	}
+
+	result, err := cons.client.ChangeMessageVisibilityBatch(input)
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to change message visibility")
+		return
+	}
+	for _, failed := range result.Failed {
+		cons.Logger.Warningf("Failed to change visibility of message: %s", aws.StringValue(failed.Message))
+	}
+}
+
+// releaseMessages makes the given messages visible to other receivers
+func (cons *AwsSQS) releaseMessages(messages []*sqs.Message) {
+	cons.changeVisibility(messages, 0)
+}
+
+func (cons *AwsSQS) deleteMessages(messages []*sqs.Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	input := &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(cons.queueURL),
+		Entries:  make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(messages)),
+	}
+	for idx, msg := range messages {
+		input.Entries = append(input.Entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(idx)),
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+	}
+
+	result, err := cons.client.DeleteMessageBatch(input)
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to delete messages")
+		return
+	}
+	for _, failed := range result.Failed {
+		cons.Logger.Errorf("Failed to delete message: %s", aws.StringValue(failed.Message))
+	}
+}
+
+// Consume starts the receivers and listens for control commands.
+func (cons *AwsSQS) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go tgo.WithRecoverShutdown(cons.run)
+	cons.ControlLoop()
+}
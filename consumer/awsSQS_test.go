@@ -0,0 +1,56 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+)
+
+func TestSQSMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	msg := &sqs.Message{
+		MessageId: aws.String("1234"),
+		Body:      aws.String("payload"),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameMessageGroupId: aws.String("user1"),
+		},
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"source": {DataType: aws.String("String"), StringValue: aws.String("web")},
+			"count":  {DataType: aws.String("Number"), StringValue: aws.String("42")},
+			"raw":    {DataType: aws.String("Binary"), BinaryValue: []byte{1, 2}},
+		},
+	}
+
+	metadata := getSQSMetadata(msg)
+	expect.Equal("1234", metadata.GetValueString("messageId"))
+	expect.Equal("user1", metadata.GetValueString("groupId"))
+	expect.Equal("web", metadata.GetValueString("source"))
+	expect.Equal("42", metadata.GetValueString("count"))
+	expect.Equal([]byte{1, 2}, metadata.GetValue("raw"))
+}
+
+func TestSQSConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testSQSConfig", "consumer.AwsSQS")
+	config.Override("MaxMessages", 11)
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,435 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	beatsBufferSize    = 64 << 10
+	beatsMaxFrameSize  = 64 << 20
+	beatsVersion       = '2'
+	beatsFrameWindow   = 'W'
+	beatsFrameJSON     = 'J'
+	beatsFrameData     = 'D'
+	beatsFrameCompress = 'C'
+	beatsFrameAck      = 'A'
+)
+
+// Beats consumer plugin
+//
+// The beats consumer receives events sent via the lumberjack v2 protocol as
+// used by filebeat and other Elastic beats. Events are collected until the
+// window announced by the client is complete. The last sequence number of a
+// window is acknowledged after all events of that window have been enqueued,
+// so that beats resends unacknowledged windows after reconnecting. Windows
+// larger than MaxWindowSizeKB are enqueued and acknowledged in parts.
+// Both JSON and key/value data frames are supported, optionally zlib
+// compressed. The payload of each message is the JSON encoded event.
+// Connections can be secured with TLS by setting Certificate and PrivateKey.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - beat: The name of the beat as sent in the event's "@metadata" (set)
+//
+// - remote: The address of the client (set)
+//
+// Parameters
+//
+// - Address: Defines the host and port to bind to.
+// By default this parameter is set to ":5044".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this consumer.
+// Clients stalling for longer than this while sending a window are
+// disconnected.
+// By default this parameter is set to "5".
+//
+// - AckTimeoutSec: Defines the number of seconds to wait for acknowledgements
+// to be sent.
+// By default this parameter is set to "1".
+//
+// - ReconnectAfterSec: Defines the number of seconds to wait before a failed
+// listen is retried.
+// By default this parameter is set to "2".
+//
+// - MaxWindowSizeKB: Defines the maximum number of KB of events buffered for
+// a window. When this limit is reached, the events received so far are
+// enqueued and acknowledged before the rest of the window is read.
+// By default this parameter is set to "16384".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the metadata
+// section will be added to each message. Adding metadata will have a
+// performance impact on systems with high throughput.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example receives events from filebeat via TLS:
+//
+//  BeatsIn:
+//    Type: consumer.Beats
+//    Streams: beats
+//    Address: ":5044"
+//    Certificate: /etc/gollum/server.crt
+//    PrivateKey: /etc/gollum/server.key
+//
+type Beats struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	TLS                 components.TLSServerConfig `gollumdoc:"embed_type"`
+
+	address          string        `config:"Address" default:":5044"`
+	readTimeout      time.Duration `config:"ReadTimeoutSec" default:"5" metric:"sec"`
+	ackTimeout       time.Duration `config:"AckTimeoutSec" default:"1" metric:"sec"`
+	reconnectTime    time.Duration `config:"ReconnectAfterSec" default:"2" metric:"sec"`
+	maxWindowSize    int           `config:"MaxWindowSizeKB" default:"16384" metric:"kb"`
+	hasToSetMetadata bool          `config:"SetMetadata" default:"false"`
+
+	listener net.Listener
+}
+
+// beatsWindow collects the events of a single lumberjack window
+type beatsWindow struct {
+	size     uint32
+	received uint32
+	lastSeq  uint32
+	events   [][]byte
+	bytes    int
+}
+
+func init() {
+	core.TypeRegistry.Register(Beats{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Beats) Configure(conf core.PluginConfigReader) {
+	_, cons.address = tnet.ParseAddress(cons.address, "tcp")
+	if cons.maxWindowSize <= 0 {
+		cons.maxWindowSize = 16384 << 10
+	}
+}
+
+// isComplete returns true if all events announced by the window frame have
+// been received.
+func (window *beatsWindow) isComplete() bool {
+	return window.size > 0 && window.received >= window.size
+}
+
+// isFull returns true if the events collected so far take up at least
+// maxBytes.
+func (window *beatsWindow) isFull(maxBytes int) bool {
+	return window.bytes >= maxBytes
+}
+
+func (window *beatsWindow) add(seq uint32, event []byte) {
+	window.lastSeq = seq
+	window.received++
+	window.events = append(window.events, event)
+	window.bytes += len(event)
+}
+
+// clearEvents removes all collected events but keeps the window open
+func (window *beatsWindow) clearEvents() {
+	window.events = window.events[:0]
+	window.bytes = 0
+}
+
+func (window *beatsWindow) reset() {
+	window.size = 0
+	window.received = 0
+	window.lastSeq = 0
+	window.clearEvents()
+}
+
+func readBeatsUint32(reader io.Reader) (uint32, error) {
+	var value uint32
+	err := binary.Read(reader, binary.BigEndian, &value)
+	return value, err
+}
+
+func readBeatsBytes(reader io.Reader) ([]byte, error) {
+	length, err := readBeatsUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > beatsMaxFrameSize {
+		return nil, fmt.Errorf("frame size %d exceeds limit", length)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(length)))
+	if err == nil && uint32(len(data)) < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+// readBeatsFrame reads a single lumberjack v2 frame and adds its contents
+// to the given window. Compressed frames are unpacked recursively.
+func readBeatsFrame(reader io.Reader, window *beatsWindow) error {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return err
+	}
+
+	if header[0] != beatsVersion {
+		return fmt.Errorf("unsupported protocol version %q", header[0])
+	}
+
+	switch header[1] {
+	case beatsFrameWindow:
+		size, err := readBeatsUint32(reader)
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return fmt.Errorf("window size 0 is invalid")
+		}
+		window.reset()
+		window.size = size
+		return nil
+
+	case beatsFrameJSON:
+		seq, err := readBeatsUint32(reader)
+		if err != nil {
+			return err
+		}
+		event, err := readBeatsBytes(reader)
+		if err != nil {
+			return err
+		}
+		window.add(seq, event)
+		return nil
+
+	case beatsFrameData:
+		seq, err := readBeatsUint32(reader)
+		if err != nil {
+			return err
+		}
+		numPairs, err := readBeatsUint32(reader)
+		if err != nil {
+			return err
+		}
+
+		fields := make(map[string]string)
+		for i := uint32(0); i < numPairs; i++ {
+			key, err := readBeatsBytes(reader)
+			if err != nil {
+				return err
+			}
+			value, err := readBeatsBytes(reader)
+			if err != nil {
+				return err
+			}
+			fields[string(key)] = string(value)
+		}
+
+		event, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		window.add(seq, event)
+		return nil
+
+	case beatsFrameCompress:
+		compressed, err := readBeatsBytes(reader)
+		if err != nil {
+			return err
+		}
+		zlibReader, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		defer zlibReader.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(zlibReader, beatsMaxFrameSize))
+		if err != nil {
+			return err
+		}
+
+		inner := bytes.NewReader(data)
+		for inner.Len() > 0 {
+			if err := readBeatsFrame(inner, window); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported frame type %q", header[1])
+}
+
+func (cons *Beats) sendACK(conn net.Conn, seq uint32) error {
+	var ack [6]byte
+	ack[0] = beatsVersion
+	ack[1] = beatsFrameAck
+	binary.BigEndian.PutUint32(ack[2:], seq)
+
+	conn.SetWriteDeadline(time.Now().Add(cons.ackTimeout))
+	_, err := conn.Write(ack[:])
+	return err
+}
+
+// enqueueWindow enqueues all events of a window. It returns false if the
+// consumer stopped before all events were enqueued.
+func (cons *Beats) enqueueWindow(window *beatsWindow, remote string) bool {
+	for _, event := range window.events {
+		if !cons.IsActive() {
+			return false // ### return, shutdown ###
+		}
+
+		if !cons.hasToSetMetadata {
+			cons.Enqueue(event)
+			continue
+		}
+
+		metadata := core.Metadata{}
+		metadata.SetValue("remote", []byte(remote))
+
+		fields := struct {
+			Metadata struct {
+				Beat string `json:"beat"`
+			} `json:"@metadata"`
+		}{}
+		if err := json.Unmarshal(event, &fields); err == nil && fields.Metadata.Beat != "" {
+			metadata.SetValue("beat", []byte(fields.Metadata.Beat))
+		}
+
+		cons.EnqueueWithMetadata(event, metadata)
+	}
+	return true
+}
+
+func (cons *Beats) readFromConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	reader := bufio.NewReaderSize(timeoutReader{conn: conn, timeout: cons.readTimeout}, beatsBufferSize)
+	window := &beatsWindow{}
+
+	for cons.IsActive() {
+		// Wait for the next frame. Timeouts while idle are expected.
+		if _, err := reader.Peek(1); err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue // ### continue, idle ###
+			}
+			if err != io.EOF && !tnet.IsDisconnectedError(err) {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", remote)
+			}
+			return // ### return, connection closed ###
+		}
+
+		if err := readBeatsFrame(reader, window); err != nil {
+			cons.Logger.WithError(err).Errorf("Invalid frame from %s", remote)
+			return // ### return, stream is corrupted ###
+		}
+
+		if !window.isComplete() && !window.isFull(cons.maxWindowSize) {
+			continue // ### continue, window not complete ###
+		}
+
+		if !cons.enqueueWindow(window, remote) {
+			return // ### return, do not ack ###
+		}
+
+		if err := cons.sendACK(conn, window.lastSeq); err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to send ack to %s", remote)
+			return // ### return, connection broken ###
+		}
+
+		if window.isComplete() {
+			window.reset()
+		} else {
+			window.clearEvents() // partial window, wait for the remaining events
+		}
+	}
+}
+
+func (cons *Beats) listen() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		socket, err := net.Listen("tcp", cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			time.Sleep(cons.reconnectTime)
+			continue
+		}
+
+		cons.listener = cons.TLS.NewListener(socket)
+		cons.Logger.Debugf("Listening to %s", cons.address)
+
+		for cons.IsActive() {
+			conn, err := cons.listener.Accept()
+			if err != nil {
+				if cons.IsActive() {
+					cons.Logger.WithError(err).Errorf("Socket accept failed for %s", cons.address)
+				}
+				break // ### break, reopen ###
+			}
+
+			cons.AddWorker()
+			go cons.readFromConnection(conn)
+		}
+
+		cons.closeListener()
+	}
+}
+
+func (cons *Beats) closeListener() {
+	if cons.listener == nil {
+		return
+	}
+	cons.Logger.Debugf("Closing socket %s", cons.address)
+	cons.listener.Close()
+	cons.listener = nil
+}
+
+// onRoll reloads the TLS certificates if TLS is enabled
+func (cons *Beats) onRoll() {
+	if err := cons.TLS.Reload(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to reload certificates, keeping the previous ones")
+	}
+}
+
+// Consume listens to the configured address.
+func (cons *Beats) Consume(workers *sync.WaitGroup) {
+	cons.SetRollCallback(cons.onRoll)
+	cons.AddMainWorker(workers)
+	defer cons.closeListener()
+
+	go tgo.WithRecoverShutdown(cons.listen)
+	cons.ControlLoop()
+}
@@ -0,0 +1,118 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+)
+
+func writeTestBeatsBytes(buffer *bytes.Buffer, data string) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	buffer.WriteString(data)
+}
+
+func writeTestBeatsJSON(buffer *bytes.Buffer, seq uint32, data string) {
+	buffer.WriteString("2J")
+	binary.Write(buffer, binary.BigEndian, seq)
+	writeTestBeatsBytes(buffer, data)
+}
+
+func TestBeatsFrames(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	stream := bytes.NewBuffer(nil)
+
+	stream.WriteString("2W")
+	binary.Write(stream, binary.BigEndian, uint32(3))
+	writeTestBeatsJSON(stream, 1, `{"message":"first"}`)
+
+	// Key/value data frame
+	stream.WriteString("2D")
+	binary.Write(stream, binary.BigEndian, uint32(2))
+	binary.Write(stream, binary.BigEndian, uint32(1))
+	writeTestBeatsBytes(stream, "line")
+	writeTestBeatsBytes(stream, "second")
+
+	// Compressed frame
+	inner := bytes.NewBuffer(nil)
+	writeTestBeatsJSON(inner, 3, `{"message":"third"}`)
+	compressed := bytes.NewBuffer(nil)
+	writer := zlib.NewWriter(compressed)
+	writer.Write(inner.Bytes())
+	writer.Close()
+
+	stream.WriteString("2C")
+	writeTestBeatsBytes(stream, compressed.String())
+
+	window := &beatsWindow{}
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.Equal(uint32(3), window.size)
+	expect.False(window.isComplete())
+
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.False(window.isComplete())
+
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.True(window.isComplete())
+	expect.Equal(uint32(3), window.lastSeq)
+	expect.Equal(`{"message":"first"}`, string(window.events[0]))
+	expect.Equal(`{"line":"second"}`, string(window.events[1]))
+	expect.Equal(`{"message":"third"}`, string(window.events[2]))
+
+	expect.NotNil(readBeatsFrame(bytes.NewBufferString("1W"), window))
+	expect.NotNil(readBeatsFrame(bytes.NewBufferString("2X"), window))
+
+	// A window of size 0 would never be acknowledged
+	stream.Reset()
+	stream.WriteString("2W")
+	binary.Write(stream, binary.BigEndian, uint32(0))
+	expect.NotNil(readBeatsFrame(stream, window))
+}
+
+func TestBeatsPartialWindow(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	stream := bytes.NewBuffer(nil)
+
+	stream.WriteString("2W")
+	binary.Write(stream, binary.BigEndian, uint32(1<<31))
+	writeTestBeatsJSON(stream, 1, `{"message":"first"}`)
+	writeTestBeatsJSON(stream, 2, `{"message":"second"}`)
+	writeTestBeatsJSON(stream, 3, `{"message":"third"}`)
+
+	window := &beatsWindow{}
+	maxBytes := 2 * len(`{"message":"first"}`)
+
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.False(window.isFull(maxBytes))
+
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.True(window.isFull(maxBytes))
+	expect.False(window.isComplete())
+	expect.Equal(uint32(2), window.lastSeq)
+
+	window.clearEvents()
+	expect.Equal(0, len(window.events))
+	expect.False(window.isFull(maxBytes))
+
+	expect.NoError(readBeatsFrame(stream, window))
+	expect.Equal(uint32(3), window.lastSeq)
+	expect.Equal(uint32(3), window.received)
+	expect.Equal(uint32(1<<31), window.size)
+}
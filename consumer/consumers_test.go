@@ -22,6 +22,12 @@ import (
 	"testing"
 )
 
+// requiredConsumerSettings contains the settings consumers cannot be
+// configured without.
+var requiredConsumerSettings = map[string]map[string]interface{}{
+	"consumer.AwsS3": {"Bucket": "gollum"},
+}
+
 func TestConsumerInterface(t *testing.T) {
 	consumers := core.TypeRegistry.GetRegistered("consumer.")
 
@@ -39,6 +45,9 @@ func TestConsumerInterface(t *testing.T) {
 	var idx int
 	for idx, name = range consumers {
 		conf := core.NewPluginConfig(fmt.Sprintf("cons%d", idx), name)
+		for key, value := range requiredConsumerSettings[name] {
+			conf.Override(key, value)
+		}
 		_, err := core.NewPluginWithConfig(conf)
 		if err != nil {
 			t.Errorf("Failed to create consumer %s: %s", name, err.Error())
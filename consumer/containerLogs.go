@@ -0,0 +1,657 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	containerLogFormatAuto   = "auto"
+	containerLogFormatDocker = "docker"
+	containerLogFormatCRI    = "cri"
+	containerLogReadSize     = 64 * 1024
+)
+
+// ContainerLogs consumer plugin
+//
+// This consumer reads the log files written by docker or a CRI compatible
+// container runtime (e.g. containerd or CRI-O) for kubernetes containers,
+// usually found in /var/log/containers. Each log line is parsed and the
+// log message is enqueued without the runtime specific framing. The creation
+// time of each message is set to the time stored in the log line.
+//
+// Lines split by the runtime are reassembled. For CRI logs these are lines
+// tagged with "P" followed by a line tagged with "F". For docker json-file
+// logs these are lines not ending with a newline.
+//
+// Files matching Path are discovered periodically. Files removed or rotated
+// by the kubelet are read to the end before they are closed.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - pod: The name of the pod the container belongs to (set)
+//
+// - namespace: The namespace of the pod (set)
+//
+// - container: The name of the container (set)
+//
+// - container_id: The id of the container (set)
+//
+// - stream: The output the line was written to, either "stdout" or "stderr" (set)
+//
+// - file: The path of the log file (set)
+//
+// Parameters
+//
+// - Path: This value defines a glob pattern matching the log files to read.
+// The file names are expected to follow the kubernetes naming scheme
+// "<pod>_<namespace>_<container>-<container id>.log".
+// By default this parameter is set to "/var/log/containers/*.log".
+//
+// - Format: This value defines the format of the log lines. Valid values are
+// "docker", "cri" and "auto". When set to "auto" the format is detected for
+// each line.
+// By default this parameter is set to "auto".
+//
+// - OffsetFile: This value defines the path to a file that stores the
+// current offset of each log file. If the consumer is restarted, these
+// offsets are used to continue reading from the previous position. To
+// disable this setting, set it to "".
+// By default this parameter is set to "".
+//
+// - DefaultOffset: This value defines where to start reading files found when
+// the consumer starts and that have no stored offset. Valid values are "oldest"
+// and "newest". Files discovered later are always read from the beginning.
+// By default this parameter is set to "newest".
+//
+// - PollingDelayMs: This value defines the number of milliseconds to wait
+// before checking the files for new content after all files have been read.
+// By default this parameter is set to "100".
+//
+// - DiscoverIntervalSec: This value defines the number of seconds between
+// two searches for new or removed files.
+// By default this parameter is set to "5".
+//
+// - MaxMessageSizeKB: This value defines the maximum size of a reassembled
+// message in kilobytes. Larger messages are split.
+// By default this parameter is set to "1024".
+//
+// - MaxLineSizeKB: This value defines the maximum size of a single line in the
+// log file in kilobytes. Larger lines cannot be parsed and are dropped.
+// By default this parameter is set to "1024".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the
+// metadata section will be added to each message.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example reads all container logs of a kubernetes node and keeps track
+// of the read position in a host directory:
+//
+//  ContainerLogsIn:
+//    Type: consumer.ContainerLogs
+//    Streams: containers
+//    Path: /var/log/containers/*.log
+//    OffsetFile: /var/lib/gollum/containers.offsets
+//    DefaultOffset: oldest
+type ContainerLogs struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	pattern          string        `config:"Path" default:"/var/log/containers/*.log"`
+	format           string        `config:"Format" default:"auto"`
+	offsetFileName   string        `config:"OffsetFile"`
+	pollingDelay     time.Duration `config:"PollingDelayMs" default:"100" metric:"ms"`
+	discoverInterval time.Duration `config:"DiscoverIntervalSec" default:"5" metric:"sec"`
+	maxMessageSize   int           `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	maxLineSize      int           `config:"MaxLineSizeKB" default:"1024" metric:"kb"`
+	hasMetadata      bool          `config:"SetMetadata" default:"true"`
+
+	startAtEnd bool
+	files      map[string]*containerLogFile
+	offsets    map[string]int64
+	stop       chan struct{}
+}
+
+// containerLogLine holds the parsed contents of a single log line
+type containerLogLine struct {
+	timestamp time.Time
+	stream    string
+	partial   bool
+	content   []byte
+}
+
+// containerLogFile holds the read state of a single log file
+type containerLogFile struct {
+	path     string
+	metadata core.Metadata
+	file     *os.File
+	offset   int64
+	buffer   []byte
+	partials map[string]*containerLogLine
+
+	// committed is the offset of the first byte of the first line that has
+	// not been enqueued completely, i.e. the offset to continue from.
+	committed int64
+	removed   bool
+
+	// discarding is set while the remainder of a line exceeding the maximum
+	// line size is skipped.
+	discarding bool
+}
+
+// dockerLogLine is the line format of the docker json-file log driver
+type dockerLogLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+func init() {
+	core.TypeRegistry.Register(ContainerLogs{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *ContainerLogs) Configure(conf core.PluginConfigReader) {
+	cons.SetStopCallback(cons.close)
+
+	cons.files = make(map[string]*containerLogFile)
+	cons.offsets = make(map[string]int64)
+	cons.stop = make(chan struct{})
+
+	switch strings.ToLower(conf.GetString("DefaultOffset", fileOffsetEnd)) {
+	case fileOffsetEnd:
+		cons.startAtEnd = true
+	case fileOffsetStart:
+		cons.startAtEnd = false
+	default:
+		conf.Errors.Pushf("DefaultOffset must be either %s or %s", fileOffsetStart, fileOffsetEnd)
+	}
+
+	cons.format = strings.ToLower(cons.format)
+	switch cons.format {
+	case containerLogFormatAuto, containerLogFormatDocker, containerLogFormatCRI:
+	default:
+		conf.Errors.Pushf("Unknown format '%s'", cons.format)
+	}
+
+	if _, err := filepath.Match(cons.pattern, ""); err != nil {
+		conf.Errors.Push(err)
+	}
+	if cons.maxMessageSize <= 0 {
+		cons.maxMessageSize = 1024 * 1024
+	}
+	if cons.maxLineSize <= 0 {
+		cons.maxLineSize = 1024 * 1024
+	}
+	if cons.pollingDelay <= 0 {
+		cons.pollingDelay = time.Millisecond
+	}
+}
+
+// parseContainerLogName extracts pod, namespace, container name and container
+// id from a log file name following the kubernetes naming scheme
+// "<pod>_<namespace>_<container>-<container id>.log".
+func parseContainerLogName(path string) (pod, namespace, container, containerID string, valid bool) {
+	name := strings.TrimSuffix(filepath.Base(path), ".log")
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) != 3 {
+		return "", "", "", "", false
+	}
+
+	idStart := strings.LastIndexByte(parts[2], '-')
+	if idStart <= 0 || idStart == len(parts[2])-1 {
+		return "", "", "", "", false
+	}
+
+	return parts[0], parts[1], parts[2][:idStart], parts[2][idStart+1:], true
+}
+
+// parseDockerLogLine parses a line written by the docker json-file driver.
+// Lines not ending with a newline have been split by docker.
+func parseDockerLogLine(data []byte) (containerLogLine, error) {
+	parsed := dockerLogLine{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return containerLogLine{}, err
+	}
+
+	line := containerLogLine{
+		timestamp: parsed.Time,
+		stream:    parsed.Stream,
+		partial:   !strings.HasSuffix(parsed.Log, "\n"),
+		content:   []byte(strings.TrimSuffix(parsed.Log, "\n")),
+	}
+	return line, nil
+}
+
+// parseCRILogLine parses a line following the CRI logging format
+// "<RFC3339Nano time> <stream> <tags> <message>". The first tag is either
+// "P" for partial lines or "F" for the last part of a line.
+func parseCRILogLine(data []byte) (containerLogLine, error) {
+	fields := bytes.SplitN(data, []byte{' '}, 4)
+	if len(fields) < 3 {
+		return containerLogLine{}, fmt.Errorf("Invalid CRI log line: %q", data)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return containerLogLine{}, err
+	}
+
+	line := containerLogLine{
+		timestamp: timestamp,
+		stream:    string(fields[1]),
+	}
+
+	tags := bytes.SplitN(fields[2], []byte{':'}, 2)
+	switch string(tags[0]) {
+	case "P":
+		line.partial = true
+	case "F":
+	default:
+		return containerLogLine{}, fmt.Errorf("Invalid CRI log tag: %q", fields[2])
+	}
+
+	if len(fields) == 4 {
+		line.content = fields[3]
+	}
+	return line, nil
+}
+
+// parseContainerLogLine parses a line in the given format. Lines in "auto"
+// format are treated as docker json-file lines if they start with a "{".
+func parseContainerLogLine(data []byte, format string) (containerLogLine, error) {
+	switch format {
+	case containerLogFormatDocker:
+		return parseDockerLogLine(data)
+	case containerLogFormatCRI:
+		return parseCRILogLine(data)
+	default:
+		if len(data) > 0 && data[0] == '{' {
+			return parseDockerLogLine(data)
+		}
+		return parseCRILogLine(data)
+	}
+}
+
+// assemble joins partial lines per stream. The complete line is returned
+// when a final line is added or when the joined line exceeds maxSize.
+func (logFile *containerLogFile) assemble(line containerLogLine, maxSize int) (containerLogLine, bool) {
+	pending, hasPending := logFile.partials[line.stream]
+	if hasPending {
+		pending.content = append(pending.content, line.content...)
+		pending.partial = line.partial
+	} else {
+		line.content = append([]byte(nil), line.content...)
+		pending = &line
+	}
+
+	if pending.partial && len(pending.content) < maxSize {
+		logFile.partials[line.stream] = pending
+		return containerLogLine{}, false
+	}
+
+	delete(logFile.partials, line.stream)
+	return *pending, true
+}
+
+// flushPartials returns all partial lines that are still pending, ordered
+// by stream.
+func (logFile *containerLogFile) flushPartials() []containerLogLine {
+	streams := make([]string, 0, len(logFile.partials))
+	for stream := range logFile.partials {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	lines := make([]containerLogLine, 0, len(streams))
+	for _, stream := range streams {
+		lines = append(lines, *logFile.partials[stream])
+		delete(logFile.partials, stream)
+	}
+	return lines
+}
+
+// isRotated returns true if the path now points to a different file or if
+// the file has been truncated.
+func (logFile *containerLogFile) isRotated() bool {
+	newStat, err := os.Stat(logFile.path)
+	if err != nil {
+		return false // ### return, removed files are handled by discover ###
+	}
+	oldStat, err := logFile.file.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(newStat, oldStat) || newStat.Size() < logFile.offset
+}
+
+func (logFile *containerLogFile) reset() {
+	if logFile.file != nil {
+		logFile.file.Close()
+		logFile.file = nil
+	}
+	logFile.offset = 0
+	logFile.committed = 0
+	logFile.buffer = logFile.buffer[:0]
+	logFile.discarding = false
+}
+
+func (cons *ContainerLogs) newContainerLogFile(path string, offset int64) *containerLogFile {
+	logFile := &containerLogFile{
+		path:      path,
+		metadata:  core.Metadata{},
+		offset:    offset,
+		committed: offset,
+		partials:  make(map[string]*containerLogLine),
+	}
+
+	logFile.metadata.SetValue("file", []byte(path))
+	if pod, namespace, container, containerID, valid := parseContainerLogName(path); valid {
+		logFile.metadata.SetValue("pod", []byte(pod))
+		logFile.metadata.SetValue("namespace", []byte(namespace))
+		logFile.metadata.SetValue("container", []byte(container))
+		logFile.metadata.SetValue("container_id", []byte(containerID))
+	} else {
+		cons.Logger.Warningf("%s does not follow the kubernetes log file naming scheme", path)
+	}
+
+	return logFile
+}
+
+// discover adds files matching the configured pattern and marks files that
+// do not match anymore as removed. Files found during startup begin at the
+// stored offset or at the configured default offset.
+func (cons *ContainerLogs) discover(isStartup bool) {
+	paths, err := filepath.Glob(cons.pattern)
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to search for log files")
+		return // ### return, invalid pattern ###
+	}
+
+	found := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		found[path] = true
+		if logFile, isKnown := cons.files[path]; isKnown {
+			logFile.removed = false
+			continue // ### continue, already known ###
+		}
+
+		offset, hasOffset := cons.offsets[path]
+		switch {
+		case hasOffset:
+		case isStartup && cons.startAtEnd:
+			offset = -1
+		default:
+			offset = 0
+		}
+
+		cons.Logger.Debugf("Found log file %s", path)
+		cons.files[path] = cons.newContainerLogFile(path, offset)
+	}
+
+	for path, logFile := range cons.files {
+		if !found[path] {
+			logFile.removed = true
+		}
+	}
+}
+
+// readFile reads all new lines of a log file and passes complete messages
+// to onLine. Rotated files are reopened after they have been read to the end.
+func (cons *ContainerLogs) readFile(logFile *containerLogFile, onLine func(*containerLogFile, containerLogLine)) {
+	if logFile.file == nil {
+		file, err := os.Open(logFile.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				cons.Logger.WithError(err).Warningf("Failed to open %s", logFile.path)
+			}
+			return // ### return, retry later ###
+		}
+
+		stat, err := file.Stat()
+		switch {
+		case err != nil:
+			cons.Logger.WithError(err).Warningf("Failed to stat %s", logFile.path)
+			file.Close()
+			return // ### return, retry later ###
+		case logFile.offset < 0:
+			logFile.offset = stat.Size()
+		case stat.Size() < logFile.offset:
+			cons.Logger.Infof("%s has been truncated, reading from start", logFile.path)
+			logFile.offset = 0
+		}
+
+		if _, err := file.Seek(logFile.offset, io.SeekStart); err != nil {
+			cons.Logger.WithError(err).Warningf("Failed to seek in %s", logFile.path)
+			file.Close()
+			return // ### return, retry later ###
+		}
+
+		logFile.file = file
+		logFile.committed = logFile.offset
+		logFile.buffer = logFile.buffer[:0]
+		logFile.discarding = false
+	}
+
+	chunk := make([]byte, containerLogReadSize)
+	for {
+		n, err := logFile.file.Read(chunk)
+		if n > 0 {
+			logFile.buffer = append(logFile.buffer, chunk[:n]...)
+			cons.processLines(logFile, onLine)
+		}
+
+		switch {
+		case err == nil:
+			continue
+		case err != io.EOF:
+			cons.Logger.WithError(err).Errorf("Failed to read %s", logFile.path)
+			logFile.file.Close()
+			logFile.file = nil
+		case logFile.isRotated():
+			cons.Logger.Infof("%s has been rotated", logFile.path)
+			logFile.reset()
+		}
+		return // ### return, end of file ###
+	}
+}
+
+// processLines parses all complete lines stored in the buffer of a file.
+// Incomplete lines exceeding the maximum line size are dropped.
+func (cons *ContainerLogs) processLines(logFile *containerLogFile, onLine func(*containerLogFile, containerLogLine)) {
+	start := 0
+	for {
+		end := bytes.IndexByte(logFile.buffer[start:], '\n')
+		if end < 0 {
+			break
+		}
+
+		data := logFile.buffer[start : start+end]
+		start += end + 1
+		logFile.offset += int64(end + 1)
+
+		switch {
+		case logFile.discarding:
+			logFile.discarding = false // end of a dropped line
+		case len(data) > 0:
+			line, err := parseContainerLogLine(data, cons.format)
+			if err != nil {
+				cons.Logger.WithError(err).Warningf("Failed to parse line in %s", logFile.path)
+			} else if message, isComplete := logFile.assemble(line, cons.maxMessageSize); isComplete {
+				onLine(logFile, message)
+			}
+		}
+
+		if len(logFile.partials) == 0 {
+			logFile.committed = logFile.offset
+		}
+	}
+
+	remaining := copy(logFile.buffer, logFile.buffer[start:])
+	logFile.buffer = logFile.buffer[:remaining]
+
+	if remaining > cons.maxLineSize {
+		if !logFile.discarding {
+			cons.Logger.Warningf("Dropping line larger than %d bytes in %s", cons.maxLineSize, logFile.path)
+			logFile.discarding = true
+		}
+		logFile.offset += int64(remaining)
+		logFile.buffer = logFile.buffer[:0]
+		if len(logFile.partials) == 0 {
+			logFile.committed = logFile.offset
+		}
+	}
+}
+
+func (cons *ContainerLogs) enqueueLine(logFile *containerLogFile, line containerLogLine) {
+	var metadata core.Metadata
+	if cons.hasMetadata {
+		metadata = logFile.metadata.Clone()
+		metadata.SetValue("stream", []byte(line.stream))
+	}
+
+	if line.timestamp.IsZero() {
+		cons.EnqueueWithMetadata(line.content, metadata)
+	} else {
+		cons.EnqueueWithTime(line.content, metadata, line.timestamp)
+	}
+}
+
+// closeFile enqueues pending partial lines and closes a removed file
+func (cons *ContainerLogs) closeFile(logFile *containerLogFile) {
+	for _, line := range logFile.flushPartials() {
+		cons.enqueueLine(logFile, line)
+	}
+	if logFile.file != nil {
+		logFile.file.Close()
+	}
+	delete(cons.files, logFile.path)
+	delete(cons.offsets, logFile.path)
+	cons.Logger.Debugf("Closed log file %s", logFile.path)
+}
+
+func (cons *ContainerLogs) loadOffsets() {
+	if cons.offsetFileName == "" {
+		return // ### return, offsets not stored ###
+	}
+
+	data, err := ioutil.ReadFile(cons.offsetFileName)
+	switch {
+	case os.IsNotExist(err):
+		return // ### return, no offsets stored yet ###
+	case err != nil:
+		cons.Logger.WithError(err).Error("Error reading offset file")
+		return // ### return, cannot read offsets ###
+	}
+
+	if err := json.Unmarshal(data, &cons.offsets); err != nil {
+		cons.Logger.WithError(err).Error("Error parsing offset file")
+	}
+}
+
+// storeOffsets writes the offsets of all files to OffsetFile if one of
+// them changed.
+func (cons *ContainerLogs) storeOffsets() {
+	if cons.offsetFileName == "" {
+		return // ### return, offsets not stored ###
+	}
+
+	changed := len(cons.offsets) != len(cons.files)
+	offsets := make(map[string]int64, len(cons.files))
+	for path, logFile := range cons.files {
+		if logFile.committed < 0 {
+			continue // ### continue, not opened yet ###
+		}
+		offsets[path] = logFile.committed
+		if stored, isStored := cons.offsets[path]; !isStored || stored != logFile.committed {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return // ### return, nothing to do ###
+	}
+
+	data, err := json.Marshal(offsets)
+	if err == nil {
+		err = ioutil.WriteFile(cons.offsetFileName, data, 0644)
+	}
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to write offset file")
+		return // ### return, retry later ###
+	}
+	cons.offsets = offsets
+}
+
+func (cons *ContainerLogs) run() {
+	defer cons.WorkerDone()
+
+	cons.loadOffsets()
+	cons.discover(true)
+	lastDiscover := time.Now()
+
+	for {
+		if time.Since(lastDiscover) >= cons.discoverInterval {
+			cons.discover(false)
+			lastDiscover = time.Now()
+		}
+
+		for _, logFile := range cons.files {
+			cons.readFile(logFile, cons.enqueueLine)
+			if logFile.removed {
+				cons.closeFile(logFile)
+			}
+		}
+		cons.storeOffsets()
+
+		select {
+		case <-cons.stop:
+			for _, logFile := range cons.files {
+				if logFile.file != nil {
+					logFile.file.Close()
+				}
+			}
+			return // ### return, stopped ###
+		case <-time.After(cons.pollingDelay):
+		}
+	}
+}
+
+func (cons *ContainerLogs) close() {
+	close(cons.stop)
+}
+
+// Consume starts reading container log files
+func (cons *ContainerLogs) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go tgo.WithRecoverShutdown(cons.run)
+	cons.ControlLoop()
+}
@@ -0,0 +1,194 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainerLogsFileName(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	pod, namespace, container, id, valid := parseContainerLogName("/var/log/containers/web-7d4b9c-x2z_shop_nginx-proxy-0123abcd.log")
+	expect.True(valid)
+	expect.Equal("web-7d4b9c-x2z", pod)
+	expect.Equal("shop", namespace)
+	expect.Equal("nginx-proxy", container)
+	expect.Equal("0123abcd", id)
+
+	_, _, _, _, valid = parseContainerLogName("/var/log/syslog.log")
+	expect.False(valid)
+
+	_, _, _, _, valid = parseContainerLogName("/var/log/containers/pod_ns_container.log")
+	expect.False(valid)
+}
+
+func TestContainerLogsParse(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	line, err := parseContainerLogLine([]byte(`{"log":"hello\n","stream":"stderr","time":"2018-01-02T03:04:05.123456789Z"}`), containerLogFormatAuto)
+	expect.NoError(err)
+	expect.Equal("hello", string(line.content))
+	expect.Equal("stderr", line.stream)
+	expect.False(line.partial)
+	expect.Equal(123456789, line.timestamp.Nanosecond())
+
+	line, err = parseContainerLogLine([]byte(`{"log":"split","stream":"stdout","time":"2018-01-02T03:04:05Z"}`), containerLogFormatDocker)
+	expect.NoError(err)
+	expect.True(line.partial)
+
+	line, err = parseContainerLogLine([]byte("2018-01-02T03:04:05.5Z stdout P a b c"), containerLogFormatAuto)
+	expect.NoError(err)
+	expect.Equal("a b c", string(line.content))
+	expect.Equal("stdout", line.stream)
+	expect.True(line.partial)
+
+	line, err = parseContainerLogLine([]byte("2018-01-02T03:04:05.5Z stderr F"), containerLogFormatCRI)
+	expect.NoError(err)
+	expect.Equal("", string(line.content))
+	expect.False(line.partial)
+
+	_, err = parseContainerLogLine([]byte("2018-01-02T03:04:05.5Z stdout X text"), containerLogFormatCRI)
+	expect.NotNil(err)
+
+	_, err = parseContainerLogLine([]byte("not a log line"), containerLogFormatAuto)
+	expect.NotNil(err)
+}
+
+func TestContainerLogsRead(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-containerlogs")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pod_default_app-abc123.log")
+	expect.NoError(ioutil.WriteFile(path, []byte(
+		"2018-01-02T03:04:05Z stdout P first \n"+
+			"2018-01-02T03:04:05Z stderr F error\n"+
+			"2018-01-02T03:04:06Z stdout F part\n"+
+			"2018-01-02T03:04:07Z stdout P pending \n"+
+			"2018-01-02T03:04:07Z stdout F"), 0644))
+
+	config := core.NewPluginConfig("testContainerLogsRead", "consumer.ContainerLogs")
+	config.Override("Path", filepath.Join(dir, "*.log"))
+	config.Override("DefaultOffset", "oldest")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*ContainerLogs)
+	expect.True(casted)
+
+	lines := []containerLogLine{}
+	onLine := func(logFile *containerLogFile, line containerLogLine) {
+		lines = append(lines, line)
+	}
+
+	cons.discover(true)
+	expect.Equal(1, len(cons.files))
+	logFile := cons.files[path]
+	expect.Equal("app", logFile.metadata.GetValueString("container"))
+
+	cons.readFile(logFile, onLine)
+	expect.Equal(2, len(lines))
+	expect.Equal("error", string(lines[0].content))
+	expect.Equal("first part", string(lines[1].content))
+	expect.Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), lines[1].timestamp)
+
+	// The pending partial line must be read again after a restart
+	completeLength := int64(len("2018-01-02T03:04:05Z stdout P first \n2018-01-02T03:04:05Z stderr F error\n2018-01-02T03:04:06Z stdout F part\n"))
+	expect.Equal(completeLength, logFile.committed)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	expect.NoError(err)
+	_, err = file.WriteString(" line\n")
+	expect.NoError(err)
+	file.Close()
+
+	cons.readFile(logFile, onLine)
+	expect.Equal(3, len(lines))
+	expect.Equal("pending line", string(lines[2].content))
+	expect.Equal(logFile.offset, logFile.committed)
+
+	// Rotation: the path is replaced by a new file
+	expect.NoError(os.Rename(path, path+".1"))
+	expect.NoError(ioutil.WriteFile(path, []byte("{\"log\":\"rotated\\n\",\"stream\":\"stdout\",\"time\":\"2018-01-02T03:04:08Z\"}\n"), 0644))
+
+	cons.readFile(logFile, onLine)
+	cons.readFile(logFile, onLine)
+	expect.Equal(4, len(lines))
+	expect.Equal("rotated", string(lines[3].content))
+
+	// Removal
+	expect.NoError(os.Remove(path))
+	cons.discover(false)
+	expect.True(logFile.removed)
+}
+
+func TestContainerLogsMaxLineSize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-containerlogs")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pod_default_app-abc123.log")
+	large := "2018-01-02T03:04:05Z stdout F " + strings.Repeat("x", 4*containerLogReadSize)
+	expect.NoError(ioutil.WriteFile(path, []byte(
+		"2018-01-02T03:04:05Z stdout F before\n"+large), 0644))
+
+	config := core.NewPluginConfig("testContainerLogsMaxLineSize", "consumer.ContainerLogs")
+	config.Override("Path", filepath.Join(dir, "*.log"))
+	config.Override("DefaultOffset", "oldest")
+	config.Override("MaxLineSizeKB", 1)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*ContainerLogs)
+	expect.True(casted)
+
+	lines := []containerLogLine{}
+	onLine := func(logFile *containerLogFile, line containerLogLine) {
+		lines = append(lines, line)
+	}
+
+	cons.discover(true)
+	logFile := cons.files[path]
+
+	cons.readFile(logFile, onLine)
+	expect.Equal(1, len(lines))
+	expect.True(logFile.discarding)
+	expect.Leq(len(logFile.buffer), 1024)
+
+	// The rest of the large line is dropped, too
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	expect.NoError(err)
+	_, err = file.WriteString("xxx\n2018-01-02T03:04:06Z stdout F after\n")
+	expect.NoError(err)
+	file.Close()
+
+	cons.readFile(logFile, onLine)
+	expect.Equal(2, len(lines))
+	expect.Equal("after", string(lines[1].content))
+	expect.False(logFile.discarding)
+	expect.Equal(logFile.offset, logFile.committed)
+}
@@ -0,0 +1,307 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tio"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	execBufferGrowSize = 4096
+)
+
+// Exec consumer plugin
+//
+// This consumer starts a command and reads messages from its standard output.
+// Messages are separated using the same partitioners as consumer.Socket.
+// When the command exits, it is restarted. The delay between restarts is
+// doubled after each restart up to MaxRestartDelaySec and reset if the
+// command ran longer than MaxRestartDelaySec.
+//
+// When the consumer is stopped, the command receives SIGTERM. If it does not
+// exit within StopTimeoutSec it is killed.
+//
+// Parameters
+//
+// - Command: This value defines the executable to start. If the path does not
+// contain a slash, the executable is searched in PATH.
+// By default this parameter is set to "".
+//
+// - Arguments: This value defines the list of arguments passed to the command.
+// By default this parameter is set to an empty list.
+//
+// - Environment: This value defines a list of "KEY=value" pairs that are added
+// to the environment of the command.
+// By default this parameter is set to an empty list.
+//
+// - WorkDir: This value defines the working directory of the command. If set
+// to "", the working directory of gollum is used.
+// By default this parameter is set to "".
+//
+// - Partitioner: This value defines the algorithm used to read messages from
+// the output of the command. See consumer.Socket for the available options.
+// By default this parameter is set to "delimiter".
+//
+// - Delimiter: This value defines the delimiter used by the text and delimiter
+// partitioners.
+// By default this parameter is set to "\n".
+//
+// - Offset: This value defines the offset used by the binary and text partitioners.
+// This setting is ignored by the fixed partitioner.
+// By default this parameter is set to "0".
+//
+// - Size: This value defines the size in bytes used by the binary and fixed
+// partitioners. See consumer.Socket for details.
+// By default this parameter is set to "1".
+//
+// - StderrStream: This value defines the stream messages read from the
+// standard error output are sent to. If set to "", each line written to
+// standard error is logged as a warning.
+// By default this parameter is set to "".
+//
+// - Restart: When set to "false", the command is not restarted after it
+// exited.
+// By default this parameter is set to "true".
+//
+// - RestartDelayMs: This value defines the number of milliseconds to wait
+// before the command is restarted for the first time.
+// By default this parameter is set to "1000".
+//
+// - MaxRestartDelaySec: This value defines the maximum number of seconds to
+// wait before restarting the command.
+// By default this parameter is set to "60".
+//
+// - StopTimeoutSec: This value defines the number of seconds to wait for the
+// command to exit after SIGTERM has been sent.
+// By default this parameter is set to "5".
+//
+// Examples
+//
+// This example follows the logs of a kubernetes pod and sends error output to
+// a separate stream:
+//
+//  KubectlIn:
+//    Type: consumer.Exec
+//    Streams: pod_logs
+//    Command: kubectl
+//    Arguments:
+//      - logs
+//      - -f
+//      - my-pod
+//    StderrStream: pod_errors
+type Exec struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	command         string               `config:"Command"`
+	arguments       []string             `config:"Arguments"`
+	environment     []string             `config:"Environment"`
+	workDir         string               `config:"WorkDir"`
+	delimiter       string               `config:"Delimiter" default:"\n"`
+	offset          int                  `config:"Offset" default:"0"`
+	stderrStream    core.MessageStreamID `config:"StderrStream"`
+	restart         bool                 `config:"Restart" default:"true"`
+	restartDelay    time.Duration        `config:"RestartDelayMs" default:"1000" metric:"ms"`
+	maxRestartDelay time.Duration        `config:"MaxRestartDelaySec" default:"60" metric:"sec"`
+	stopTimeout     time.Duration        `config:"StopTimeoutSec" default:"5" metric:"sec"`
+
+	flags     tio.BufferedReaderFlags
+	process   *os.Process
+	exited    chan struct{}
+	stop      chan struct{}
+	procGuard *sync.Mutex
+}
+
+func init() {
+	core.TypeRegistry.Register(Exec{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Exec) Configure(conf core.PluginConfigReader) {
+	cons.SetStopCallback(cons.close)
+
+	cons.flags, cons.offset = configurePartitioner(conf, cons.offset)
+	cons.stop = make(chan struct{})
+	cons.procGuard = new(sync.Mutex)
+
+	if cons.restartDelay <= 0 {
+		cons.restartDelay = time.Millisecond
+	}
+	if cons.maxRestartDelay < cons.restartDelay {
+		cons.maxRestartDelay = cons.restartDelay
+	}
+}
+
+// readOutput reads messages from the given reader until it is closed
+func (cons *Exec) readOutput(reader io.Reader, onMessage func([]byte)) {
+	buffer := tio.NewBufferedReader(execBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+
+	for {
+		err := buffer.ReadAll(reader, onMessage)
+		switch {
+		case err == nil:
+			continue
+		case err == tio.BufferDataInvalid:
+			cons.Logger.Warning("Invalid data read from command output")
+			continue
+		case err != io.EOF:
+			cons.Logger.WithError(err).Error("Failed to read command output")
+		}
+		return // ### return, closed ###
+	}
+}
+
+func (cons *Exec) logStderr(data []byte) {
+	cons.Logger.Warningf("%s: %s", cons.command, string(data))
+}
+
+func (cons *Exec) enqueueStderr(data []byte) {
+	cons.EnqueueToStream(data, nil, cons.stderrStream)
+}
+
+// execute runs the command once and blocks until it exited and all output
+// has been read.
+func (cons *Exec) execute(onStdout, onStderr func([]byte)) error {
+	cmd := exec.Command(cons.command, cons.arguments...)
+	cmd.Dir = cons.workDir
+	if len(cons.environment) > 0 {
+		cmd.Env = append(os.Environ(), cons.environment...)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+
+	cons.procGuard.Lock()
+	cons.process = cmd.Process
+	cons.exited = exited
+	cons.procGuard.Unlock()
+
+	select {
+	case <-cons.stop:
+		// Stopped while starting, close did not see this process
+		cmd.Process.Signal(syscall.SIGTERM)
+	default:
+	}
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		cons.readOutput(stderr, onStderr)
+	}()
+
+	cons.readOutput(stdout, onStdout)
+	<-stderrDone
+
+	return cmd.Wait()
+}
+
+func (cons *Exec) run() {
+	defer cons.WorkerDone()
+
+	if cons.command == "" {
+		cons.Logger.Error("No command given")
+		return // ### return, nothing to do ###
+	}
+
+	onStderr := cons.logStderr
+	if cons.stderrStream != core.InvalidStreamID {
+		onStderr = cons.enqueueStderr
+	}
+
+	delay := cons.restartDelay
+	for cons.IsActive() {
+		started := time.Now()
+		cons.Logger.Debugf("Starting %s", cons.command)
+
+		err := cons.execute(cons.Enqueue, onStderr)
+		if !cons.IsActive() {
+			return // ### return, stopped ###
+		}
+
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Command %s failed", cons.command)
+		} else {
+			cons.Logger.Infof("Command %s exited", cons.command)
+		}
+
+		if !cons.restart {
+			return // ### return, no restart ###
+		}
+
+		if time.Since(started) > cons.maxRestartDelay {
+			delay = cons.restartDelay
+		}
+
+		cons.Logger.Infof("Restarting %s in %s", cons.command, delay)
+		select {
+		case <-cons.stop:
+			return // ### return, stopped ###
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > cons.maxRestartDelay {
+			delay = cons.maxRestartDelay
+		}
+	}
+}
+
+// close terminates the running command
+func (cons *Exec) close() {
+	close(cons.stop)
+
+	cons.procGuard.Lock()
+	process := cons.process
+	exited := cons.exited
+	cons.procGuard.Unlock()
+
+	if process == nil {
+		return // ### return, not running ###
+	}
+
+	process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(cons.stopTimeout):
+		cons.Logger.Warningf("Command %s did not exit, killing it", cons.command)
+		process.Kill()
+	}
+}
+
+// Consume starts the command and listens for control commands
+func (cons *Exec) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	go tgo.WithRecoverShutdown(cons.run)
+	cons.ControlLoop()
+}
@@ -0,0 +1,65 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExecOutput(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testExecOutput", "consumer.Exec")
+	config.Override("Command", "sh")
+	config.Override("Arguments", []string{"-c", "printf 'a;b;'; printf 'err;' >&2; exit 3"})
+	config.Override("Delimiter", ";")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Exec)
+	expect.True(casted)
+
+	guard := new(sync.Mutex)
+	stdout := []string{}
+	stderr := []string{}
+	err = cons.execute(
+		func(data []byte) {
+			guard.Lock()
+			defer guard.Unlock()
+			stdout = append(stdout, string(data))
+		},
+		func(data []byte) {
+			guard.Lock()
+			defer guard.Unlock()
+			stderr = append(stderr, string(data))
+		})
+
+	expect.NotNil(err)
+	expect.Equal("a,b", strings.Join(stdout, ","))
+	expect.Equal("err", strings.Join(stderr, ","))
+}
+
+func TestExecPartitioner(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testExecPartitioner", "consumer.Exec")
+	config.Override("Partitioner", "unknown")
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,603 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	forwardBufferSize = 64 << 10
+	forwardNonceSize  = 16
+)
+
+// Forward consumer plugin
+//
+// The forward consumer receives messages sent via the fluentd forward protocol
+// (https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1)
+// as used by fluentd and fluent bit. The Message, Forward, PackedForward and
+// CompressedPackedForward modes are supported. Each record is converted to
+// JSON and used as the message payload.
+// If the client sends a "chunk" option, an acknowledgement is sent after all
+// records of the request have been enqueued. Requests that could not be
+// fully processed are not acknowledged so that the client resends them.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - tag: The fluent tag of the record (set)
+//
+// - time: The event time of the record, formatted using TimestampFormat (set)
+//
+// Parameters
+//
+// - Address: Defines the protocol, host and port or socket to bind to.
+// Valid protocols are "tcp" and "unix".
+// By default this parameter is set to "tcp://0.0.0.0:24224".
+//
+// - TagStreams: A map of fluent tags to stream names. Records with a matching
+// tag are sent to the given stream instead of the streams configured via
+// Streams. A tag ending with "*" matches all tags with the given prefix. If
+// more than one prefix matches, the longest one is used.
+// By default this parameter is set to an empty map.
+//
+// - SharedKey: If set, clients have to authenticate using the forward
+// protocol's handshake (HELO, PING, PONG) with this shared key.
+// By default this parameter is set to "".
+//
+// - SelfHostname: The hostname sent to clients during the handshake.
+// By default this parameter is set to the hostname of the machine.
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this consumer.
+// Clients stalling for longer than this while sending a request are
+// disconnected.
+// By default this parameter is set to "5".
+//
+// - AckTimeoutSec: Defines the number of seconds to wait for acknowledgements
+// and handshake responses to be sent.
+// By default this parameter is set to "1".
+//
+// - ReconnectAfterSec: Defines the number of seconds to wait before a failed
+// listen is retried.
+// By default this parameter is set to "2".
+//
+// - Permissions: This value sets the filesystem permissions for UNIX domain
+// sockets as a four-digit octal number.
+// By default this parameter is set to "0770".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the metadata
+// section will be added to each message. Adding metadata will have a
+// performance impact on systems with high throughput.
+// By default this parameter is set to "false".
+//
+// - TimestampFormat: When using SetMetadata this string denotes the go time
+// format used to convert event times into strings.
+// By default this parameter is set to "2006-01-02T15:04:05.000 MST".
+//
+// Examples
+//
+// This example receives records from fluent bit agents. Records tagged with
+// "kube.*" are sent to the stream "kubernetes", all others to "fluent".
+//
+//  ForwardIn:
+//    Type: consumer.Forward
+//    Streams: fluent
+//    Address: tcp://0.0.0.0:24224
+//    SharedKey: "secret"
+//    SetMetadata: true
+//    TagStreams:
+//      "kube.*": kubernetes
+//
+type Forward struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	sharedKey        string        `config:"SharedKey"`
+	readTimeout      time.Duration `config:"ReadTimeoutSec" default:"5" metric:"sec"`
+	ackTimeout       time.Duration `config:"AckTimeoutSec" default:"1" metric:"sec"`
+	reconnectTime    time.Duration `config:"ReconnectAfterSec" default:"2" metric:"sec"`
+	fileFlags        os.FileMode   `config:"Permissions" default:"0770"`
+	hasToSetMetadata bool          `config:"SetMetadata" default:"false"`
+	timestampFormat  string        `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+
+	protocol     string
+	address      string
+	selfHostname string
+	tagStreams   map[string]core.MessageStreamID
+	tagPrefixes  []string
+	listener     net.Listener
+}
+
+// forwardEvent is a single record decoded from a forward request
+type forwardEvent struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+// forwardRequest is a decoded forward protocol request
+type forwardRequest struct {
+	tag     string
+	events  []forwardEvent
+	options map[string]interface{}
+}
+
+// timeoutReader refreshes the read deadline of a connection before each read.
+// This allows blocking reads to time out only if a client stalls.
+type timeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func init() {
+	core.TypeRegistry.Register(Forward{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Forward) Configure(conf core.PluginConfigReader) {
+	address := conf.GetString("Address", "tcp://0.0.0.0:24224")
+	cons.protocol, cons.address = tnet.ParseAddress(address, "tcp")
+
+	switch cons.protocol {
+	case "tcp", "unix":
+	default:
+		conf.Errors.Pushf("Unsupported protocol %s. Only tcp and unix are supported", cons.protocol)
+	}
+
+	hostname, _ := os.Hostname()
+	cons.selfHostname = conf.GetString("SelfHostname", hostname)
+
+	cons.tagStreams = make(map[string]core.MessageStreamID)
+	cons.tagPrefixes = []string{}
+	for tag, streamName := range conf.GetStringMap("TagStreams", map[string]string{}) {
+		cons.tagStreams[tag] = core.GetStreamID(streamName)
+		if strings.HasSuffix(tag, "*") {
+			cons.tagPrefixes = append(cons.tagPrefixes, tag)
+		}
+	}
+
+	// Longest prefix first
+	sort.Slice(cons.tagPrefixes, func(i, j int) bool {
+		return len(cons.tagPrefixes[i]) > len(cons.tagPrefixes[j])
+	})
+}
+
+// getStreamForTag returns the stream mapped to the given tag or
+// InvalidStreamID if the tag is not mapped.
+func (cons *Forward) getStreamForTag(tag string) core.MessageStreamID {
+	if streamID, isMapped := cons.tagStreams[tag]; isMapped {
+		return streamID
+	}
+	for _, prefix := range cons.tagPrefixes {
+		if strings.HasPrefix(tag, prefix[:len(prefix)-1]) {
+			return cons.tagStreams[prefix]
+		}
+	}
+	return core.InvalidStreamID
+}
+
+func (reader timeoutReader) Read(data []byte) (int, error) {
+	reader.conn.SetReadDeadline(time.Now().Add(reader.timeout))
+	return reader.conn.Read(data)
+}
+
+// parseForwardTime converts an integer, float or EventTime extension into
+// time.Time.
+func parseForwardTime(value interface{}) (time.Time, error) {
+	switch typedValue := value.(type) {
+	case int64:
+		return time.Unix(typedValue, 0), nil
+	case uint64:
+		return time.Unix(int64(typedValue), 0), nil
+	case float64:
+		seconds := int64(typedValue)
+		return time.Unix(seconds, int64((typedValue-float64(seconds))*1e9)), nil
+	case msgpackExt:
+		if typedValue.Type != 0 || len(typedValue.Data) != 8 {
+			return time.Time{}, fmt.Errorf("invalid EventTime extension")
+		}
+		seconds := binary.BigEndian.Uint32(typedValue.Data[:4])
+		nanoseconds := binary.BigEndian.Uint32(typedValue.Data[4:])
+		return time.Unix(int64(seconds), int64(nanoseconds)), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time type %T", value)
+}
+
+// parseForwardEntry parses an entry of the form [time, record]
+func parseForwardEntry(value interface{}) (forwardEvent, error) {
+	entry, isArray := value.([]interface{})
+	if !isArray || len(entry) < 2 {
+		return forwardEvent{}, fmt.Errorf("entry is not an array of time and record")
+	}
+
+	eventTime, err := parseForwardTime(entry[0])
+	if err != nil {
+		return forwardEvent{}, err
+	}
+
+	record, isMap := entry[1].(map[string]interface{})
+	if !isMap {
+		return forwardEvent{}, fmt.Errorf("record is not a map")
+	}
+
+	return forwardEvent{time: eventTime, record: record}, nil
+}
+
+// parseForwardEntryStream parses a msgpack stream of [time, record] entries
+// as sent in PackedForward and CompressedPackedForward mode.
+func parseForwardEntryStream(data []byte, compressed bool) ([]forwardEvent, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	if compressed {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	events := []forwardEvent{}
+	decoder := newMsgpackDecoder(reader)
+	for {
+		value, err := decoder.Decode()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		event, err := parseForwardEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+// parseForwardRequest converts a decoded msgpack value into a forward
+// request. All four modes of the forward protocol are supported.
+func parseForwardRequest(value interface{}) (forwardRequest, error) {
+	request := forwardRequest{}
+
+	array, isArray := value.([]interface{})
+	if !isArray || len(array) < 2 {
+		return request, fmt.Errorf("request is not an array")
+	}
+
+	tag, isString := array[0].(string)
+	if !isString {
+		return request, fmt.Errorf("tag is not a string")
+	}
+	request.tag = tag
+
+	var err error
+	optionIdx := 2
+
+	switch entries := array[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		request.events = make([]forwardEvent, 0, len(entries))
+		for _, entry := range entries {
+			event, err := parseForwardEntry(entry)
+			if err != nil {
+				return request, err
+			}
+			request.events = append(request.events, event)
+		}
+
+	case string, []byte:
+		// PackedForward mode: [tag, entries, option]
+		var packed []byte
+		if entriesStr, isStr := entries.(string); isStr {
+			packed = []byte(entriesStr)
+		} else {
+			packed = entries.([]byte)
+		}
+
+		if len(array) > optionIdx {
+			request.options, _ = array[optionIdx].(map[string]interface{})
+		}
+
+		compression, _ := request.options["compressed"].(string)
+		switch compression {
+		case "", "text":
+			request.events, err = parseForwardEntryStream(packed, false)
+		case "gzip":
+			request.events, err = parseForwardEntryStream(packed, true)
+		default:
+			return request, fmt.Errorf("unsupported compression \"%s\"", compression)
+		}
+		if err != nil {
+			return request, err
+		}
+
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(array) < 3 {
+			return request, fmt.Errorf("message mode request is missing the record")
+		}
+		event, err := parseForwardEntry(array[1:3])
+		if err != nil {
+			return request, err
+		}
+		request.events = []forwardEvent{event}
+		optionIdx = 3
+	}
+
+	if request.options == nil && len(array) > optionIdx {
+		request.options, _ = array[optionIdx].(map[string]interface{})
+	}
+	return request, nil
+}
+
+// toJSONCompatible converts binary values in msgpack decoded data to strings
+// so that they can be serialized as JSON.
+func toJSONCompatible(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case []byte:
+		return string(typedValue)
+	case []interface{}:
+		for i, item := range typedValue {
+			typedValue[i] = toJSONCompatible(item)
+		}
+	case map[string]interface{}:
+		for key, item := range typedValue {
+			typedValue[key] = toJSONCompatible(item)
+		}
+	case msgpackExt:
+		if eventTime, err := parseForwardTime(typedValue); err == nil {
+			return eventTime.Format(time.RFC3339Nano)
+		}
+		return typedValue.Data
+	}
+	return value
+}
+
+// enqueueRequest enqueues all events of a request. It returns false if the
+// consumer stopped before all events were enqueued.
+func (cons *Forward) enqueueRequest(request forwardRequest) bool {
+	streamID := cons.getStreamForTag(request.tag)
+
+	for _, event := range request.events {
+		if !cons.IsActive() {
+			return false // ### return, shutdown ###
+		}
+
+		payload, err := json.Marshal(toJSONCompatible(event.record))
+		if err != nil {
+			cons.Logger.WithError(err).Error("Failed to convert record to JSON")
+			return false // ### return, invalid record ###
+		}
+
+		var metadata core.Metadata
+		if cons.hasToSetMetadata {
+			metadata = core.Metadata{}
+			metadata.SetValue("tag", []byte(request.tag))
+			metadata.SetValue("time", []byte(event.time.Format(cons.timestampFormat)))
+		}
+
+		if streamID != core.InvalidStreamID {
+			cons.EnqueueToStream(payload, metadata, streamID)
+		} else {
+			cons.EnqueueWithMetadata(payload, metadata)
+		}
+	}
+	return true
+}
+
+func (cons *Forward) write(conn net.Conn, value interface{}) error {
+	buffer := bytes.NewBuffer(nil)
+	if err := msgpackEncode(buffer, value); err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(cons.ackTimeout))
+	_, err := conn.Write(buffer.Bytes())
+	return err
+}
+
+func (cons *Forward) sharedKeyDigest(salt, hostname string, nonce []byte) string {
+	hash := sha512.New()
+	hash.Write([]byte(salt))
+	hash.Write([]byte(hostname))
+	hash.Write(nonce)
+	hash.Write([]byte(cons.sharedKey))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// handshake performs the HELO, PING, PONG sequence used for shared key
+// authentication.
+func (cons *Forward) handshake(conn net.Conn, decoder *msgpackDecoder) error {
+	nonce := make([]byte, forwardNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	helo := []interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      []byte{},
+		"keepalive": true,
+	}}
+	if err := cons.write(conn, helo); err != nil {
+		return err
+	}
+
+	value, err := decoder.Decode()
+	if err != nil {
+		return err
+	}
+
+	ping, isArray := value.([]interface{})
+	if !isArray || len(ping) < 4 || ping[0] != "PING" {
+		return fmt.Errorf("expected PING")
+	}
+
+	clientHostname, _ := ping[1].(string)
+	salt := msgpackString(ping[2])
+	digest, _ := ping[3].(string)
+
+	expected := cons.sharedKeyDigest(salt, clientHostname, nonce)
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) != 1 {
+		cons.write(conn, []interface{}{"PONG", false, "shared_key mismatch", cons.selfHostname, ""})
+		return fmt.Errorf("shared key mismatch for %s", clientHostname)
+	}
+
+	pong := []interface{}{"PONG", true, "", cons.selfHostname,
+		cons.sharedKeyDigest(salt, cons.selfHostname, nonce)}
+	return cons.write(conn, pong)
+}
+
+// msgpackString returns string or binary values as string
+func msgpackString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case []byte:
+		return string(typedValue)
+	}
+	return ""
+}
+
+func (cons *Forward) readFromConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	reader := bufio.NewReaderSize(timeoutReader{conn: conn, timeout: cons.readTimeout}, forwardBufferSize)
+	decoder := newMsgpackDecoder(reader)
+
+	if cons.sharedKey != "" {
+		if err := cons.handshake(conn, decoder); err != nil {
+			cons.Logger.WithError(err).Warningf("Handshake with %s failed", remote)
+			return // ### return, not authenticated ###
+		}
+	}
+
+	for cons.IsActive() {
+		// Wait for the next request. Timeouts while idle are expected.
+		if _, err := reader.Peek(1); err != nil {
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				continue // ### continue, idle ###
+			}
+			if err != io.EOF && !tnet.IsDisconnectedError(err) {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", remote)
+			}
+			return // ### return, connection closed ###
+		}
+
+		value, err := decoder.Decode()
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to decode request from %s", remote)
+			return // ### return, stream is corrupted ###
+		}
+
+		request, err := parseForwardRequest(value)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Invalid request from %s", remote)
+			return // ### return, stream is corrupted ###
+		}
+
+		if !cons.enqueueRequest(request) {
+			return // ### return, do not ack ###
+		}
+
+		if chunk, hasChunk := request.options["chunk"]; hasChunk {
+			if err := cons.write(conn, map[string]interface{}{"ack": chunk}); err != nil {
+				cons.Logger.WithError(err).Errorf("Failed to send ack to %s", remote)
+				return // ### return, connection broken ###
+			}
+		}
+	}
+}
+
+func (cons *Forward) listen() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		if cons.protocol == "unix" {
+			if err := os.Remove(cons.address); err == nil {
+				cons.Logger.Warningf("Removed existing socket %s", cons.address)
+			}
+		}
+
+		socket, err := net.Listen(cons.protocol, cons.address)
+		if err == nil && cons.protocol == "unix" {
+			err = os.Chmod(cons.address, cons.fileFlags)
+		}
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			time.Sleep(cons.reconnectTime)
+			continue
+		}
+
+		cons.listener = socket
+		cons.Logger.Debugf("Listening to %s", cons.address)
+
+		for cons.IsActive() {
+			conn, err := socket.Accept()
+			if err != nil {
+				if cons.IsActive() {
+					cons.Logger.WithError(err).Errorf("Socket accept failed for %s", cons.address)
+				}
+				break // ### break, reopen ###
+			}
+
+			cons.AddWorker()
+			go cons.readFromConnection(conn)
+		}
+
+		cons.closeListener()
+	}
+}
+
+func (cons *Forward) closeListener() {
+	if cons.listener == nil {
+		return
+	}
+	cons.Logger.Debugf("Closing socket %s", cons.address)
+	cons.listener.Close()
+	cons.listener = nil
+}
+
+// Consume listens to the configured address.
+func (cons *Forward) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	defer cons.closeListener()
+
+	go tgo.WithRecoverShutdown(cons.listen)
+	cons.ControlLoop()
+}
@@ -0,0 +1,163 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"strings"
+	"testing"
+)
+
+func encodeTestMsgpack(value interface{}) []byte {
+	buffer := bytes.NewBuffer(nil)
+	if err := msgpackEncode(buffer, value); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func decodeTestMsgpack(data []byte) interface{} {
+	value, err := newMsgpackDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+func TestMsgpackRoundtrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	longString := strings.Repeat("x", 300)
+	value := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"int":    int64(-100000),
+		"small":  int64(-3),
+		"uint":   uint64(1 << 63),
+		"float":  1.5,
+		"string": longString,
+		"bin":    []byte{1, 2, 3},
+		"array":  []interface{}{int64(1), "two", []interface{}{}},
+	}
+
+	decoded, isMap := decodeTestMsgpack(encodeTestMsgpack(value)).(map[string]interface{})
+	expect.True(isMap)
+	expect.Nil(decoded["nil"])
+	expect.Equal(true, decoded["bool"])
+	expect.Equal(int64(-100000), decoded["int"])
+	expect.Equal(int64(-3), decoded["small"])
+	expect.Equal(uint64(1<<63), decoded["uint"])
+	expect.Equal(1.5, decoded["float"])
+	expect.Equal(longString, decoded["string"])
+	expect.Equal([]byte{1, 2, 3}, decoded["bin"])
+	expect.Equal(3, len(decoded["array"].([]interface{})))
+
+	// fixext8 EventTime: 1500000000 seconds, 500 nanoseconds
+	eventTime := []byte{0xd7, 0x00, 0x59, 0x68, 0x2f, 0x00, 0x00, 0x00, 0x01, 0xf4}
+	parsed, err := parseForwardTime(decodeTestMsgpack(eventTime))
+	expect.NoError(err)
+	expect.Equal(int64(1500000000), parsed.Unix())
+	expect.Equal(500, parsed.Nanosecond())
+
+	_, err = newMsgpackDecoder(bytes.NewReader([]byte{0xdb, 0xff, 0xff, 0xff, 0xff})).Decode()
+	expect.NotNil(err)
+
+	// Nesting is limited to protect the stack: msgpackMaxDepth nested arrays
+	// are accepted, one more level of nesting is rejected.
+	nested := append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth-1), 0x90)
+	_, err = newMsgpackDecoder(bytes.NewReader(nested)).Decode()
+	expect.NoError(err)
+
+	nested = append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth), 0x81, 0xa1, 'a', 0x90)
+	_, err = newMsgpackDecoder(bytes.NewReader(nested)).Decode()
+	expect.NotNil(err)
+
+	nested = bytes.Repeat([]byte{0x91}, 1000000)
+	_, err = newMsgpackDecoder(bytes.NewReader(nested)).Decode()
+	expect.NotNil(err)
+}
+
+func TestForwardModes(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	record := map[string]interface{}{"log": "hello"}
+
+	// Message mode
+	request, err := parseForwardRequest(decodeTestMsgpack(encodeTestMsgpack(
+		[]interface{}{"app.web", int64(1500000000), record, map[string]interface{}{"chunk": "abc"}})))
+	expect.NoError(err)
+	expect.Equal("app.web", request.tag)
+	expect.Equal(1, len(request.events))
+	expect.Equal("hello", request.events[0].record["log"])
+	expect.Equal("abc", request.options["chunk"])
+
+	// Forward mode
+	entries := []interface{}{
+		[]interface{}{int64(1500000000), record},
+		[]interface{}{int64(1500000001), record},
+	}
+	request, err = parseForwardRequest(decodeTestMsgpack(encodeTestMsgpack(
+		[]interface{}{"app.web", entries})))
+	expect.NoError(err)
+	expect.Equal(2, len(request.events))
+	expect.Equal(int64(1500000001), request.events[1].time.Unix())
+
+	// PackedForward mode
+	packed := append(encodeTestMsgpack(entries[0]), encodeTestMsgpack(entries[1])...)
+	request, err = parseForwardRequest(decodeTestMsgpack(encodeTestMsgpack(
+		[]interface{}{"app.web", packed, map[string]interface{}{"size": int64(2)}})))
+	expect.NoError(err)
+	expect.Equal(2, len(request.events))
+
+	// CompressedPackedForward mode
+	compressed := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(compressed)
+	writer.Write(packed)
+	writer.Close()
+
+	request, err = parseForwardRequest(decodeTestMsgpack(encodeTestMsgpack(
+		[]interface{}{"app.web", compressed.Bytes(), map[string]interface{}{"compressed": "gzip", "chunk": "c1"}})))
+	expect.NoError(err)
+	expect.Equal(2, len(request.events))
+	expect.Equal("c1", request.options["chunk"])
+
+	_, err = parseForwardRequest(decodeTestMsgpack(encodeTestMsgpack(
+		[]interface{}{"app.web", int64(1500000000), "not a record"})))
+	expect.NotNil(err)
+}
+
+func TestForwardTagStreams(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testForwardTagStreams", "consumer.Forward")
+	config.Override("TagStreams", map[string]string{
+		"app.web":   "web",
+		"app.*":     "app",
+		"app.db.*":  "db",
+		"other.tag": "other",
+	})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Forward)
+	expect.True(casted)
+
+	expect.Equal(core.GetStreamID("web"), cons.getStreamForTag("app.web"))
+	expect.Equal(core.GetStreamID("app"), cons.getStreamForTag("app.worker"))
+	expect.Equal(core.GetStreamID("db"), cons.getStreamForTag("app.db.mysql"))
+	expect.Equal(core.InvalidStreamID, cons.getStreamForTag("unknown"))
+}
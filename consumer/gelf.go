@@ -0,0 +1,488 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tio"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	gelfBufferGrowSize   = 1024
+	gelfMaxDatagramSize  = 65536
+	gelfMaxChunks        = 128
+	gelfChunkHeaderSize  = 12
+	gelfMaxMessageSize   = 32 << 20
+	gelfChunkMagic0      = 0x1e
+	gelfChunkMagic1      = 0x0f
+	gelfPurgeIntervalSec = 1
+)
+
+// GELF consumer plugin
+//
+// The GELF consumer receives messages in the Graylog Extended Log Format.
+// Messages can be sent via UDP or TCP. UDP messages may be chunked and may be
+// gzip or zlib compressed. TCP messages must be uncompressed and are
+// separated by a null byte. Messages that are missing one of the required
+// fields "version", "host" or "short_message" are discarded.
+// The payload of each message is the (decompressed) GELF JSON document.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - host: The GELF "host" field (set)
+//
+// - short_message: The GELF "short_message" field (set)
+//
+// - level: The GELF "level" field, if present (set)
+//
+// - <field>: All additional fields ("_<field>") without the leading
+// underscore. Non-string values are stored as JSON (set)
+//
+// Parameters
+//
+// - Address: Defines the protocol, host and port to bind to. Valid protocols
+// are "udp" and "tcp".
+// By default this parameter is set to "udp://0.0.0.0:12201".
+//
+// - ChunkTimeoutSec: Defines the number of seconds to wait for all chunks of
+// a chunked UDP message. Incomplete messages are discarded after this time.
+// By default this parameter is set to "5".
+//
+// - ChunkMaxPending: Defines the maximum number of incomplete chunked UDP
+// messages kept at the same time. If this limit is reached, the oldest
+// incomplete message is discarded.
+// By default this parameter is set to "1024".
+//
+// - ReadTimeoutSec: Defines the number of seconds to wait for data to be
+// received. This setting affects the maximum shutdown duration of this consumer.
+// By default this parameter is set to "2".
+//
+// - ReconnectAfterSec: Defines the number of seconds to wait before a failed
+// listen is retried.
+// By default this parameter is set to "2".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the metadata
+// section will be added to each message. Adding metadata will have a
+// performance impact on systems with high throughput.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example receives GELF messages via UDP and stores the GELF fields as
+// metadata:
+//
+//  GelfIn:
+//    Type: consumer.GELF
+//    Streams: gelf
+//    Address: udp://0.0.0.0:12201
+//    SetMetadata: true
+//
+type GELF struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	chunkTimeout     time.Duration `config:"ChunkTimeoutSec" default:"5" metric:"sec"`
+	chunkMaxPending  int           `config:"ChunkMaxPending" default:"1024"`
+	readTimeout      time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	reconnectTime    time.Duration `config:"ReconnectAfterSec" default:"2" metric:"sec"`
+	hasToSetMetadata bool          `config:"SetMetadata" default:"false"`
+
+	protocol string
+	address  string
+	listener io.Closer
+	chunks   *gelfChunkAssembler
+}
+
+// gelfChunkedMessage holds the chunks of a message received so far
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	received  int
+	firstSeen time.Time
+	element   *list.Element
+}
+
+// gelfChunkAssembler reassembles chunked GELF UDP messages.
+// The assembler is not thread safe.
+type gelfChunkAssembler struct {
+	pending    map[string]*gelfChunkedMessage
+	order      *list.List
+	timeout    time.Duration
+	maxPending int
+	numEvicted int
+	lastPurge  time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(GELF{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *GELF) Configure(conf core.PluginConfigReader) {
+	address := conf.GetString("Address", "udp://0.0.0.0:12201")
+	cons.protocol, cons.address = tnet.ParseAddress(address, "udp")
+
+	switch cons.protocol {
+	case "udp", "tcp":
+	default:
+		conf.Errors.Pushf("Unsupported protocol %s. Only udp and tcp are supported", cons.protocol)
+	}
+
+	if cons.chunkMaxPending < 1 {
+		conf.Errors.Pushf("ChunkMaxPending must be at least 1")
+	}
+
+	cons.chunks = newGelfChunkAssembler(cons.chunkTimeout, cons.chunkMaxPending)
+}
+
+func newGelfChunkAssembler(timeout time.Duration, maxPending int) *gelfChunkAssembler {
+	return &gelfChunkAssembler{
+		pending:    make(map[string]*gelfChunkedMessage),
+		order:      list.New(),
+		timeout:    timeout,
+		maxPending: maxPending,
+		lastPurge:  time.Now(),
+	}
+}
+
+// isGelfChunk returns true if the given datagram is a GELF chunk
+func isGelfChunk(data []byte) bool {
+	return len(data) >= gelfChunkHeaderSize && data[0] == gelfChunkMagic0 && data[1] == gelfChunkMagic1
+}
+
+// add stores the given chunk. If all chunks of a message have been received,
+// the reassembled message is returned and the second return value is true.
+func (assembler *gelfChunkAssembler) add(chunk []byte, now time.Time) ([]byte, bool, error) {
+	messageID := string(chunk[2:10])
+	seqNum := int(chunk[10])
+	seqCount := int(chunk[11])
+
+	if seqCount == 0 || seqCount > gelfMaxChunks || seqNum >= seqCount {
+		return nil, false, fmt.Errorf("invalid chunk %d of %d", seqNum, seqCount)
+	}
+
+	msg, exists := assembler.pending[messageID]
+	if !exists {
+		// Evict the oldest message so that senders cannot exhaust memory by
+		// sending single chunks of many different messages.
+		for len(assembler.pending) >= assembler.maxPending {
+			assembler.remove(assembler.order.Front().Value.(string))
+			assembler.numEvicted++
+		}
+
+		msg = &gelfChunkedMessage{
+			chunks:    make([][]byte, seqCount),
+			firstSeen: now,
+			element:   assembler.order.PushBack(messageID),
+		}
+		assembler.pending[messageID] = msg
+	}
+
+	if len(msg.chunks) != seqCount {
+		assembler.remove(messageID)
+		return nil, false, fmt.Errorf("chunk count mismatch for message %x", messageID)
+	}
+
+	if msg.chunks[seqNum] == nil {
+		msg.chunks[seqNum] = append([]byte(nil), chunk[gelfChunkHeaderSize:]...)
+		msg.received++
+	}
+
+	if msg.received < seqCount {
+		return nil, false, nil // ### return, incomplete ###
+	}
+
+	assembler.remove(messageID)
+	return bytes.Join(msg.chunks, nil), true, nil
+}
+
+// remove drops the given message from the list of pending messages
+func (assembler *gelfChunkAssembler) remove(messageID string) {
+	if msg, exists := assembler.pending[messageID]; exists {
+		assembler.order.Remove(msg.element)
+		delete(assembler.pending, messageID)
+	}
+}
+
+// purge removes all incomplete messages that have timed out and returns the
+// number of messages removed. Messages evicted by add since the last purge
+// are included in this number.
+func (assembler *gelfChunkAssembler) purge(now time.Time) int {
+	if now.Sub(assembler.lastPurge) < gelfPurgeIntervalSec*time.Second {
+		return 0
+	}
+	assembler.lastPurge = now
+
+	// Messages are ordered by the time they have been seen first
+	numPurged := assembler.numEvicted
+	assembler.numEvicted = 0
+	for front := assembler.order.Front(); front != nil; front = assembler.order.Front() {
+		messageID := front.Value.(string)
+		if now.Sub(assembler.pending[messageID].firstSeen) <= assembler.timeout {
+			break
+		}
+		assembler.remove(messageID)
+		numPurged++
+	}
+	return numPurged
+}
+
+// decompressGelf detects gzip and zlib compressed data and returns the
+// decompressed message. Uncompressed data is returned as-is.
+func decompressGelf(data []byte) ([]byte, error) {
+	var (
+		reader io.ReadCloser
+		err    error
+	)
+
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+
+	case len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+
+	default:
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, gelfMaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > gelfMaxMessageSize {
+		return nil, fmt.Errorf("decompressed message exceeds %d bytes", gelfMaxMessageSize)
+	}
+	return decompressed, nil
+}
+
+// parseGelf validates a GELF document and returns the metadata derived from
+// its fields.
+func parseGelf(data []byte) (core.Metadata, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, required := range []string{"version", "host", "short_message"} {
+		var value string
+		if err := json.Unmarshal(fields[required], &value); err != nil || value == "" {
+			return nil, fmt.Errorf("missing or invalid required field \"%s\"", required)
+		}
+	}
+
+	metadata := core.Metadata{}
+	for key, rawValue := range fields {
+		switch {
+		case key == "host" || key == "short_message" || key == "level":
+		case strings.HasPrefix(key, "_") && key != "_id" && len(key) > 1:
+			key = key[1:]
+		default:
+			continue // ### continue, not mapped ###
+		}
+
+		var value string
+		if err := json.Unmarshal(rawValue, &value); err == nil {
+			metadata.SetValue(key, []byte(value))
+		} else {
+			metadata.SetValue(key, []byte(rawValue))
+		}
+	}
+
+	return metadata, nil
+}
+
+// enqueueGelf validates and enqueues an uncompressed GELF document
+func (cons *GELF) enqueueGelf(data []byte, remote string) {
+	metadata, err := parseGelf(data)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Discarding invalid GELF message from %s", remote)
+		return // ### return, invalid message ###
+	}
+
+	if cons.hasToSetMetadata {
+		cons.EnqueueWithMetadata(data, metadata)
+	} else {
+		cons.Enqueue(data)
+	}
+}
+
+// processDatagram handles a single UDP datagram which might be a chunk or a
+// complete, optionally compressed message.
+func (cons *GELF) processDatagram(data []byte, remote string) {
+	if isGelfChunk(data) {
+		message, complete, err := cons.chunks.add(data, time.Now())
+		if err != nil {
+			cons.Logger.WithError(err).Warningf("Discarding invalid GELF chunk from %s", remote)
+			return // ### return, invalid chunk ###
+		}
+		if !complete {
+			return // ### return, waiting for more chunks ###
+		}
+		data = message
+	}
+
+	message, err := decompressGelf(data)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to decompress GELF message from %s", remote)
+		return // ### return, invalid compression ###
+	}
+
+	cons.enqueueGelf(message, remote)
+}
+
+func (cons *GELF) listenUDP() {
+	defer cons.WorkerDone()
+	buffer := make([]byte, gelfMaxDatagramSize)
+
+	for cons.IsActive() {
+		socket, err := net.ListenPacket(cons.protocol, cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			time.Sleep(cons.reconnectTime)
+			continue
+		}
+
+		cons.listener = socket
+		cons.Logger.Debugf("Listening to %s", cons.address)
+
+		for cons.IsActive() {
+			if numPurged := cons.chunks.purge(time.Now()); numPurged > 0 {
+				cons.Logger.Warningf("Discarded %d incomplete chunked GELF messages", numPurged)
+			}
+
+			socket.SetReadDeadline(time.Now().Add(cons.readTimeout))
+			size, remote, err := socket.ReadFrom(buffer)
+			if err != nil {
+				if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+					continue // ### continue, no data ###
+				}
+				if cons.IsActive() {
+					cons.Logger.WithError(err).Errorf("Failed to read from %s", cons.address)
+				}
+				break // ### break, reopen ###
+			}
+
+			cons.processDatagram(buffer[:size], remote.String())
+		}
+
+		cons.closeListener()
+	}
+}
+
+func (cons *GELF) listenTCP() {
+	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		socket, err := net.Listen(cons.protocol, cons.address)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			time.Sleep(cons.reconnectTime)
+			continue
+		}
+
+		cons.listener = socket
+		cons.Logger.Debugf("Listening to %s", cons.address)
+
+		for cons.IsActive() {
+			conn, err := socket.Accept()
+			if err != nil {
+				if cons.IsActive() {
+					cons.Logger.WithError(err).Errorf("Socket accept failed for %s", cons.address)
+				}
+				break // ### break, reopen ###
+			}
+
+			cons.AddWorker()
+			go cons.readFromConnection(conn)
+		}
+
+		cons.closeListener()
+	}
+}
+
+func (cons *GELF) readFromConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		cons.WorkerDone()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	buffer := tio.NewBufferedReader(gelfBufferGrowSize, tio.BufferedReaderFlagDelimiter, 0, "\x00")
+	enqueue := func(data []byte) {
+		cons.enqueueGelf(data, remote)
+	}
+
+	for cons.IsActive() {
+		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
+		if err := buffer.ReadAll(conn, enqueue); err != nil {
+			netErr, isNetErr := err.(net.Error)
+			switch {
+			case isNetErr && netErr.Timeout():
+				continue // ### continue, no data ###
+
+			case tnet.IsDisconnectedError(err):
+				cons.Logger.Debugf("Client %s closed connection", remote)
+
+			default:
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", remote)
+			}
+			return // ### return, connection closed ###
+		}
+	}
+}
+
+func (cons *GELF) closeListener() {
+	if cons.listener == nil {
+		return
+	}
+	cons.Logger.Debugf("Closing socket %s", cons.address)
+	cons.listener.Close()
+	cons.listener = nil
+}
+
+// Consume listens to the configured address.
+func (cons *GELF) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	defer cons.closeListener()
+
+	if cons.protocol == "udp" {
+		go tgo.WithRecoverShutdown(cons.listenUDP)
+	} else {
+		go tgo.WithRecoverShutdown(cons.listenTCP)
+	}
+
+	cons.ControlLoop()
+}
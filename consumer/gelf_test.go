@@ -0,0 +1,149 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+	"time"
+)
+
+func newGelfChunk(id string, seqNum, seqCount byte, data string) []byte {
+	chunk := []byte{gelfChunkMagic0, gelfChunkMagic1}
+	chunk = append(chunk, []byte(id)...)
+	chunk = append(chunk, seqNum, seqCount)
+	return append(chunk, []byte(data)...)
+}
+
+func TestGelfChunkAssembler(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	assembler := newGelfChunkAssembler(5*time.Second, 16)
+	now := time.Now()
+
+	chunk := newGelfChunk("abcdefgh", 1, 2, "world")
+	expect.True(isGelfChunk(chunk))
+
+	_, complete, err := assembler.add(chunk, now)
+	expect.NoError(err)
+	expect.False(complete)
+
+	// Duplicates are ignored
+	_, complete, err = assembler.add(chunk, now)
+	expect.NoError(err)
+	expect.False(complete)
+
+	message, complete, err := assembler.add(newGelfChunk("abcdefgh", 0, 2, "hello "), now)
+	expect.NoError(err)
+	expect.True(complete)
+	expect.Equal("hello world", string(message))
+	expect.Equal(0, len(assembler.pending))
+
+	_, _, err = assembler.add(newGelfChunk("abcdefgh", 2, 2, ""), now)
+	expect.NotNil(err)
+
+	_, _, err = assembler.add(newGelfChunk("12345678", 0, 2, "hello"), now)
+	expect.NoError(err)
+	expect.Equal(0, assembler.purge(now.Add(time.Second)))
+	expect.Equal(1, assembler.purge(now.Add(10*time.Second)))
+	expect.Equal(0, len(assembler.pending))
+}
+
+func TestGelfChunkAssemblerMaxPending(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	assembler := newGelfChunkAssembler(5*time.Second, 2)
+	now := time.Now()
+
+	// Only the 2 newest incomplete messages are kept
+	for _, id := range []string{"message1", "message2", "message3"} {
+		_, complete, err := assembler.add(newGelfChunk(id, 0, 2, id), now)
+		expect.NoError(err)
+		expect.False(complete)
+	}
+	expect.Equal(2, len(assembler.pending))
+	expect.Equal(2, assembler.order.Len())
+
+	_, complete, err := assembler.add(newGelfChunk("message1", 1, 2, "!"), now)
+	expect.NoError(err)
+	expect.False(complete)
+
+	message, complete, err := assembler.add(newGelfChunk("message3", 1, 2, "!"), now)
+	expect.NoError(err)
+	expect.True(complete)
+	expect.Equal("message3!", string(message))
+
+	// message1 and message2 have been evicted by message3 and the second
+	// chunk of message1. The restarted message1 times out.
+	expect.Equal(1, len(assembler.pending))
+	expect.Equal(3, assembler.purge(now.Add(time.Minute)))
+	expect.Equal(0, len(assembler.pending))
+	expect.Equal(0, assembler.order.Len())
+}
+
+func TestGelfDecompress(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	message := `{"version":"1.1","host":"example.org","short_message":"test"}`
+
+	data, err := decompressGelf([]byte(message))
+	expect.NoError(err)
+	expect.Equal(message, string(data))
+
+	gzipped := bytes.NewBuffer(nil)
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte(message))
+	gzipWriter.Close()
+
+	data, err = decompressGelf(gzipped.Bytes())
+	expect.NoError(err)
+	expect.Equal(message, string(data))
+
+	zlibbed := bytes.NewBuffer(nil)
+	zlibWriter := zlib.NewWriter(zlibbed)
+	zlibWriter.Write([]byte(message))
+	zlibWriter.Close()
+
+	data, err = decompressGelf(zlibbed.Bytes())
+	expect.NoError(err)
+	expect.Equal(message, string(data))
+}
+
+func TestGelfParse(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	metadata, err := parseGelf([]byte(`{"version":"1.1","host":"example.org","short_message":"test",` +
+		`"level":3,"timestamp":1500000000.5,"_user":"alice","_count":12,"_id":"x"}`))
+	expect.NoError(err)
+	expect.Equal("example.org", metadata.GetValueString("host"))
+	expect.Equal("test", metadata.GetValueString("short_message"))
+	expect.Equal("3", metadata.GetValueString("level"))
+	expect.Equal("alice", metadata.GetValueString("user"))
+	expect.Equal("12", metadata.GetValueString("count"))
+
+	_, hasTimestamp := metadata.TryGetValue("timestamp")
+	expect.False(hasTimestamp)
+	_, hasID := metadata.TryGetValue("id")
+	expect.False(hasID)
+
+	_, err = parseGelf([]byte(`{"version":"1.1","short_message":"test"}`))
+	expect.NotNil(err)
+
+	_, err = parseGelf([]byte(`{"version":"1.1","host":"example.org","short_message":""}`))
+	expect.NotNil(err)
+
+	_, err = parseGelf([]byte(`not json`))
+	expect.NotNil(err)
+}
@@ -16,9 +16,9 @@ package consumer
 
 import (
 	"bytes"
-	"crypto/tls"
 	"github.com/abbot/go-http-auth"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo/tnet"
 	"io/ioutil"
 	"net/http"
@@ -32,6 +32,19 @@ import (
 // This consumer opens up an HTTP 1.1 server and processes the contents of any
 // incoming HTTP request.
 //
+// Requests can be authenticated using HTTP Basic Authentication, static
+// bearer tokens, HMAC signed JSON web tokens (JWT) or client certificates.
+// If more than one of Htpasswd, BearerTokens and JWTSecret is set, a request
+// is accepted if any of these methods succeeds.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - client_subject: The subject of the client certificate, if one was sent
+//
+// Claims configured via JWTClaims are always added to the metadata.
+//
 // Parameters
 //
 // - Address: Defines the TCP port and optional IP address to listen on.
@@ -53,11 +66,23 @@ import (
 // - BasicRealm: Defines the Authentication Realm for HTTP Basic Authentication.
 // Meaningful only in conjunction with Htpasswd.
 //
-// - Certificate: Path to an X509 formatted certificate file. If defined, turns on
-// SSL/TLS  support in the HTTP server. Requires PrivateKey to be set.
+// - BearerTokens: A list of static tokens. If defined, requests are accepted
+// if they send one of these tokens in an "Authorization: Bearer" header.
+// By default this parameter is set to an empty list.
 //
-// - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
-// conjunction with Certificate.
+// - JWTSecret: The shared secret used to verify HMAC signed (HS256, HS384,
+// HS512) JSON web tokens sent in an "Authorization: Bearer" header. The
+// registered claims "exp" and "nbf" are checked if present.
+// By default this parameter is set to "".
+//
+// - JWTClaims: A map of JWT claim names to metadata keys. The value of each
+// listed claim is copied to the given metadata key. Non-string values are
+// stored as JSON. Meaningful only in conjunction with JWTSecret.
+// By default this parameter is set to an empty map.
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the
+// metadata section will be added to each message.
+// By default this parameter is set to "false".
 //
 // Examples
 //
@@ -69,16 +94,36 @@ import (
 //     Address: "localhost:9090"
 //     WithHeaders: false
 //
+// This example accepts JSON web tokens and client certificates signed by a
+// given CA. The "sub" claim of the token is stored as metadata "team".
+//
+//   "HttpIn01":
+//     Type: "consumer.HTTP"
+//     Streams: "http_in_01"
+//     Address: ":9443"
+//     WithHeaders: false
+//     SetMetadata: true
+//     Certificate: /etc/gollum/server.crt
+//     PrivateKey: /etc/gollum/server.key
+//     ClientCA: /etc/gollum/teams-ca.pem
+//     JWTSecret: "mysecret"
+//     JWTClaims:
+//       sub: team
+//
 type HTTP struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
-	address             string        `config:"Address" default:":80"`
-	readTimeoutSec      time.Duration `config:"ReadTimeoutSec" default:"3" metric:"sec"`
-	withHeaders         bool          `config:"WithHeaders" default:"true"`
-	htpasswd            string        `config:"Htpasswd"`
-	basicRealm          string        `config:"BasicRealm"`
+	TLS                 components.TLSServerConfig `gollumdoc:"embed_type"`
+	address             string                     `config:"Address" default:":80"`
+	readTimeoutSec      time.Duration              `config:"ReadTimeoutSec" default:"3" metric:"sec"`
+	withHeaders         bool                       `config:"WithHeaders" default:"true"`
+	htpasswd            string                     `config:"Htpasswd"`
+	basicRealm          string                     `config:"BasicRealm"`
+	bearerTokens        []string                   `config:"BearerTokens"`
+	jwtSecret           string                     `config:"JWTSecret"`
+	hasToSetMetadata    bool                       `config:"SetMetadata" default:"false"`
+	jwtClaims           map[string]string
 	secrets             auth.SecretProvider
 	listen              *tnet.StopListener
-	certificate         *tls.Config
 }
 
 func init() {
@@ -95,23 +140,13 @@ func (cons *HTTP) Configure(conf core.PluginConfigReader) {
 		cons.secrets = auth.HtpasswdFileProvider(cons.htpasswd)
 	}
 
-	certificateFile := conf.GetString("Certificate", "")
-	keyFile := conf.GetString("PrivateKey", "")
-
-	if certificateFile != "" || keyFile != "" {
-		if certificateFile == "" || keyFile == "" {
-			conf.Errors.Pushf("There must always be a certificate and a private key or none of both")
-		} else {
-
-			cons.certificate = new(tls.Config)
-			cons.certificate.NextProtos = []string{"http/1.1"}
-
-			keypair, err := tls.LoadX509KeyPair(certificateFile, keyFile)
-			if !conf.Errors.Push(err) {
-				cons.certificate.Certificates = []tls.Certificate{keypair}
-			}
-		}
+	cons.jwtClaims = conf.GetStringMap("JWTClaims", map[string]string{})
+	if len(cons.jwtClaims) > 0 && cons.jwtSecret == "" {
+		conf.Errors.Pushf("JWTClaims requires JWTSecret to be set")
 	}
+
+	// The server does not support HTTP/2, so only offer HTTP/1.1 via ALPN
+	cons.TLS.SetNextProtos("http/1.1")
 }
 
 func (cons *HTTP) checkAuth(r *http.Request) bool {
@@ -122,12 +157,57 @@ func (cons *HTTP) checkAuth(r *http.Request) bool {
 	return true
 }
 
+// requiresAuth returns true if any request based authentication method is
+// configured.
+func (cons *HTTP) requiresAuth() bool {
+	return cons.htpasswd != "" || len(cons.bearerTokens) > 0 || cons.jwtSecret != ""
+}
+
+// authenticate checks all configured authentication methods and returns true
+// if one of them succeeds. Claims of valid JSON web tokens are copied to the
+// given metadata.
+func (cons *HTTP) authenticate(req *http.Request, metadata core.Metadata) bool {
+	if cons.htpasswd != "" && cons.checkAuth(req) {
+		return true
+	}
+
+	token, hasToken := parseBearerToken(req)
+	if !hasToken {
+		return false
+	}
+
+	if len(cons.bearerTokens) > 0 && isStaticToken(token, cons.bearerTokens) {
+		return true
+	}
+
+	if cons.jwtSecret != "" {
+		claims, err := parseJWT(token, []byte(cons.jwtSecret), time.Now())
+		if err != nil {
+			cons.Logger.WithError(err).Debugf("Rejected token from %s", req.RemoteAddr)
+			return false
+		}
+		claims.copyToMetadata(cons.jwtClaims, metadata)
+		return true
+	}
+
+	return false
+}
+
 // requestHandler will handle a single web request.
 func (cons *HTTP) requestHandler(resp http.ResponseWriter, req *http.Request) {
-	if cons.htpasswd != "" {
-		if !cons.checkAuth(req) {
-			resp.WriteHeader(http.StatusUnauthorized)
-			return
+	metadata := core.Metadata{}
+
+	if cons.requiresAuth() && !cons.authenticate(req, metadata) {
+		if cons.jwtSecret != "" || len(cons.bearerTokens) > 0 {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		resp.WriteHeader(http.StatusUnauthorized)
+		return // ### return, not authorized ###
+	}
+
+	if cons.hasToSetMetadata {
+		if subject, hasCert := components.GetPeerSubject(req.TLS); hasCert {
+			metadata.SetValue("client_subject", []byte(subject))
 		}
 	}
 
@@ -140,7 +220,7 @@ func (cons *HTTP) requestHandler(resp http.ResponseWriter, req *http.Request) {
 			return // ### return, missing body or bad write ###
 		}
 
-		cons.Enqueue(requestBuffer.Bytes())
+		cons.EnqueueWithMetadata(requestBuffer.Bytes(), metadata)
 		resp.WriteHeader(http.StatusOK)
 	} else {
 		// Read only the message body
@@ -157,7 +237,7 @@ func (cons *HTTP) requestHandler(resp http.ResponseWriter, req *http.Request) {
 		}
 		defer req.Body.Close()
 
-		cons.Enqueue(body)
+		cons.EnqueueWithMetadata(body, metadata)
 		resp.WriteHeader(http.StatusOK)
 	}
 }
@@ -169,10 +249,9 @@ func (cons *HTTP) serve() {
 		Addr:        cons.address,
 		Handler:     http.HandlerFunc(cons.requestHandler),
 		ReadTimeout: cons.readTimeoutSec,
-		TLSConfig:   cons.certificate,
 	}
 
-	err := srv.Serve(cons.listen)
+	err := srv.Serve(cons.TLS.NewListener(cons.listen))
 	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
 		cons.Logger.Error(err)
 	}
@@ -0,0 +1,171 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtAlgorithms lists the supported HMAC based signing algorithms
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// jwtClaims holds the decoded payload of a JSON web token
+type jwtClaims map[string]interface{}
+
+// parseBearerToken extracts the token from an "Authorization: Bearer <token>"
+// header. The second return value is false if no bearer token was sent.
+func parseBearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, len(token) > 0
+}
+
+// isStaticToken returns true if the given token is part of the list of valid
+// tokens. Tokens are compared in constant time.
+func isStaticToken(token string, validTokens []string) bool {
+	valid := 0
+	for _, candidate := range validTokens {
+		valid |= subtle.ConstantTimeCompare([]byte(token), []byte(candidate))
+	}
+	return valid == 1
+}
+
+// parseJWT validates a HMAC signed JSON web token and returns its claims.
+// The registered claims "exp" and "nbf" are checked against the given time.
+func parseJWT(token string, secret []byte, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err)
+	}
+
+	header := struct {
+		Algorithm string `json:"alg"`
+	}{}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err)
+	}
+
+	newHash, isSupported := jwtAlgorithms[header.Algorithm]
+	if !isSupported {
+		return nil, fmt.Errorf("unsupported signing algorithm \"%s\"", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %s", err)
+	}
+
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	claimData, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %s", err)
+	}
+
+	claims := jwtClaims{}
+	decoder := json.NewDecoder(bytes.NewReader(claimData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %s", err)
+	}
+
+	exp, hasExp, err := claims.getTime("exp")
+	if err != nil {
+		return nil, err
+	}
+	if hasExp && !now.Before(exp) {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	nbf, hasNbf, err := claims.getTime("nbf")
+	if err != nil {
+		return nil, err
+	}
+	if hasNbf && now.Before(nbf) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+
+	return claims, nil
+}
+
+// getTime returns a NumericDate claim as time.Time. The second return value
+// is false if the claim is not set. An error is returned if the claim is set
+// but not a number, so that malformed tokens never pass the time checks.
+func (claims jwtClaims) getTime(key string) (time.Time, bool, error) {
+	value, isSet := claims[key]
+	if !isSet {
+		return time.Time{}, false, nil
+	}
+
+	number, isNumber := value.(json.Number)
+	if !isNumber {
+		return time.Time{}, true, fmt.Errorf("malformed token claim \"%s\"", key)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("malformed token claim \"%s\"", key)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// copyToMetadata stores the claims given by claimToKey in the given metadata.
+// Strings are copied as-is, all other values are stored as JSON.
+func (claims jwtClaims) copyToMetadata(claimToKey map[string]string, metadata core.Metadata) {
+	for claim, key := range claimToKey {
+		value, isSet := claims[claim]
+		if !isSet {
+			continue
+		}
+
+		switch typedValue := value.(type) {
+		case string:
+			metadata.SetValue(key, []byte(typedValue))
+		case json.Number:
+			metadata.SetValue(key, []byte(typedValue.String()))
+		default:
+			if data, err := json.Marshal(typedValue); err == nil {
+				metadata.SetValue(key, data)
+			}
+		}
+	}
+}
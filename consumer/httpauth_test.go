@@ -0,0 +1,102 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signTestJWT(header, claims, secret string) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseJWT(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	now := time.Unix(1500000000, 0)
+	header := `{"alg":"HS256","typ":"JWT"}`
+
+	token := signTestJWT(header, `{"sub":"team-a","exp":1500000060,"scope":["read"]}`, "secret")
+	claims, err := parseJWT(token, []byte("secret"), now)
+	expect.NoError(err)
+
+	metadata := core.Metadata{}
+	claims.copyToMetadata(map[string]string{"sub": "team", "scope": "scope", "exp": "exp", "foo": "bar"}, metadata)
+	expect.Equal("team-a", metadata.GetValueString("team"))
+	expect.Equal(`["read"]`, metadata.GetValueString("scope"))
+	expect.Equal("1500000060", metadata.GetValueString("exp"))
+	_, hasBar := metadata.TryGetValue("bar")
+	expect.False(hasBar)
+
+	_, err = parseJWT(token, []byte("wrong"), now)
+	expect.NotNil(err)
+
+	_, err = parseJWT(token, []byte("secret"), now.Add(time.Minute))
+	expect.NotNil(err)
+
+	token = signTestJWT(header, `{"nbf":1500000060}`, "secret")
+	_, err = parseJWT(token, []byte("secret"), now)
+	expect.NotNil(err)
+
+	// Malformed time claims must not disable the time checks
+	for _, claims := range []string{`{"exp":"1400000000"}`, `{"exp":null}`, `{"nbf":"soon"}`, `{"nbf":[1]}`} {
+		token = signTestJWT(header, claims, "secret")
+		_, err = parseJWT(token, []byte("secret"), now)
+		expect.NotNil(err)
+	}
+
+	token = signTestJWT(`{"alg":"none"}`, `{}`, "secret")
+	_, err = parseJWT(token, []byte("secret"), now)
+	expect.NotNil(err)
+}
+
+func TestHTTPBearerAuth(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testHTTPBearerAuth", "consumer.HTTP")
+	config.Override("BearerTokens", []string{"token1", "token2"})
+	config.Override("JWTSecret", "secret")
+	config.Override("JWTClaims", map[string]string{"sub": "team"})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*HTTP)
+	expect.True(casted)
+
+	req := httptest.NewRequest("POST", "/", nil)
+	expect.False(cons.authenticate(req, core.Metadata{}))
+
+	req.Header.Set("Authorization", "Bearer token2")
+	expect.True(cons.authenticate(req, core.Metadata{}))
+
+	req.Header.Set("Authorization", "Bearer token3")
+	expect.False(cons.authenticate(req, core.Metadata{}))
+
+	metadata := core.Metadata{}
+	req.Header.Set("Authorization", "Bearer "+signTestJWT(`{"alg":"HS256"}`, `{"sub":"team-b"}`, "secret"))
+	expect.True(cons.authenticate(req, metadata))
+	expect.Equal("team-b", metadata.GetValueString("team"))
+}
@@ -0,0 +1,568 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	journalReadBatchSize = 1000
+	journalStoreInterval = time.Second
+)
+
+var journalPriorities = map[string]int{
+	"emerg":   0,
+	"alert":   1,
+	"crit":    2,
+	"err":     3,
+	"warning": 4,
+	"notice":  5,
+	"info":    6,
+	"debug":   7,
+}
+
+// Journal consumer plugin
+//
+// This consumer reads entries from the systemd journal without requiring
+// libsystemd. Unlike native.Systemd it is part of the standard builds.
+// The MESSAGE field of each entry is used as the message payload and the
+// creation time of each message is set to the time of the entry.
+//
+// By default the journal files written by journald are read directly. Entries
+// of all files are merged by time. Fields compressed with LZ4 are supported.
+// Fields compressed with XZ or ZSTD, as written by recent journald versions
+// for values larger than 512 bytes, cannot be read and are left out. Entries
+// missing the MESSAGE field because of this are skipped. Set "Compress=no"
+// in journald.conf or use ExportFile if this is a problem.
+//
+// Alternatively the consumer reads the output of "journalctl -o export" from
+// a file, a named pipe or stdin. In this mode journalctl takes care of
+// decompression.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// All fields of an entry (or the fields listed in Fields) are stored as
+// metadata using the journal field name as key, e.g. "_SYSTEMD_UNIT",
+// "PRIORITY" or "_HOSTNAME". In addition the following keys are set:
+//
+// - __CURSOR: The cursor of the entry as used by journalctl (set)
+//
+// - __REALTIME_TIMESTAMP: The time of the entry in microseconds since epoch (set)
+//
+// - __MONOTONIC_TIMESTAMP: The monotonic time of the entry in microseconds (set)
+//
+// Parameters
+//
+// - Files: This value defines a list of glob patterns matching the journal
+// files to read. The files are searched periodically.
+// By default this parameter is set to "/var/log/journal/*/*.journal" and
+// "/run/log/journal/*/*.journal".
+//
+// - ExportFile: This value defines a file containing the output of
+// "journalctl -o export". If set, Files is ignored. Set to "-" to read from
+// stdin. Regular files are followed like consumer.File does.
+// By default this parameter is set to "".
+//
+// - Units: This value defines a list of systemd units to read entries for.
+// Entries are matched by their _SYSTEMD_UNIT field. Unit names without
+// suffix are treated as services. Glob patterns like "docker*" are allowed.
+// If the list is empty, all entries are read.
+// By default this parameter is set to an empty list.
+//
+// - Priority: This value defines the lowest priority of entries to read.
+// Valid values are the syslog priority names "emerg", "alert", "crit", "err",
+// "warning", "notice", "info", "debug" or their numeric values 0 to 7.
+// Entries without priority are always read.
+// By default this parameter is set to "debug".
+//
+// - Fields: This value defines the list of journal fields to add as metadata.
+// If the list is empty, all fields are added.
+// By default this parameter is set to an empty list.
+//
+// - OffsetFile: This value defines the path to a file that stores the cursor
+// of the last entry read. If the consumer is restarted, reading continues
+// after this entry. The file uses the same format as "journalctl --cursor-file".
+// To disable this setting, set it to "".
+// By default this parameter is set to "".
+//
+// - DefaultOffset: This value defines where to start reading if no cursor is
+// stored. Valid values are "oldest" and "newest". This setting is ignored when
+// reading from ExportFile.
+// By default this parameter is set to "newest".
+//
+// - PollingDelayMs: This value defines the number of milliseconds to wait
+// before checking for new entries after all entries have been read.
+// By default this parameter is set to "250".
+//
+// - DiscoverIntervalSec: This value defines the number of seconds between
+// two searches for new or removed journal files.
+// By default this parameter is set to "10".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the
+// metadata section will be added to each message.
+// By default this parameter is set to "true".
+//
+// Examples
+//
+// This example reads errors of the ssh and docker services and stores the
+// read position:
+//
+//  JournalIn:
+//    Type: consumer.Journal
+//    Streams: journal
+//    Units:
+//      - ssh
+//      - docker.service
+//    Priority: err
+//    Fields:
+//      - _SYSTEMD_UNIT
+//      - _HOSTNAME
+//      - PRIORITY
+//    OffsetFile: /var/lib/gollum/journal.cursor
+//
+// This example reads the journal of a remote host using journalctl:
+//
+//  JournalIn:
+//    Type: consumer.Journal
+//    Streams: journal
+//    ExportFile: /var/run/gollum/journal.pipe
+//
+// with "journalctl -o export -f -M remote > /var/run/gollum/journal.pipe".
+type Journal struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	patterns         []string      `config:"Files" default:"/var/log/journal/*/*.journal,/run/log/journal/*/*.journal"`
+	exportFileName   string        `config:"ExportFile"`
+	units            []string      `config:"Units"`
+	fields           []string      `config:"Fields"`
+	offsetFileName   string        `config:"OffsetFile"`
+	pollingDelay     time.Duration `config:"PollingDelayMs" default:"250" metric:"ms"`
+	discoverInterval time.Duration `config:"DiscoverIntervalSec" default:"10" metric:"sec"`
+	hasMetadata      bool          `config:"SetMetadata" default:"true"`
+
+	maxPriority  int
+	fieldFilter  map[string]bool
+	startAtEnd   bool
+	cursor       journalCursor
+	hasCursor    bool
+	storedCursor journalCursor
+	lastStore    time.Time
+	journals     map[string]*journalFile
+	exportFile   *os.File
+	exportGuard  *sync.Mutex
+	stop         chan struct{}
+}
+
+// journalTailReader blocks at the end of a regular file until new data is
+// written or the consumer is stopped.
+type journalTailReader struct {
+	file  *os.File
+	delay time.Duration
+	stop  chan struct{}
+}
+
+func init() {
+	core.TypeRegistry.Register(Journal{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Journal) Configure(conf core.PluginConfigReader) {
+	cons.SetStopCallback(cons.close)
+
+	cons.journals = make(map[string]*journalFile)
+	cons.exportGuard = new(sync.Mutex)
+	cons.stop = make(chan struct{})
+
+	priority := strings.ToLower(conf.GetString("Priority", "debug"))
+	if value, isName := journalPriorities[priority]; isName {
+		cons.maxPriority = value
+	} else if value, err := strconv.Atoi(priority); err == nil && value >= 0 && value <= 7 {
+		cons.maxPriority = value
+	} else {
+		conf.Errors.Pushf("Unknown priority '%s'", priority)
+	}
+
+	switch strings.ToLower(conf.GetString("DefaultOffset", fileOffsetEnd)) {
+	case fileOffsetEnd:
+		cons.startAtEnd = true
+	case fileOffsetStart:
+		cons.startAtEnd = false
+	default:
+		conf.Errors.Pushf("DefaultOffset must be either %s or %s", fileOffsetStart, fileOffsetEnd)
+	}
+
+	for idx, unit := range cons.units {
+		if !strings.Contains(unit, ".") {
+			cons.units[idx] = unit + ".service"
+		}
+		if _, err := filepath.Match(cons.units[idx], ""); err != nil {
+			conf.Errors.Push(err)
+		}
+	}
+
+	if len(cons.fields) > 0 {
+		cons.fieldFilter = make(map[string]bool, len(cons.fields))
+		for _, field := range cons.fields {
+			cons.fieldFilter[field] = true
+		}
+	}
+
+	if cons.pollingDelay <= 0 {
+		cons.pollingDelay = time.Millisecond
+	}
+}
+
+// isMatching returns true if the entry passes the unit and priority matches
+func (cons *Journal) isMatching(entry journalEntry) bool {
+	if priority, hasPriority := entry.getField("PRIORITY"); hasPriority {
+		if value, err := strconv.Atoi(string(priority)); err == nil && value > cons.maxPriority {
+			return false
+		}
+	}
+
+	if len(cons.units) == 0 {
+		return true
+	}
+
+	unit, hasUnit := entry.getField("_SYSTEMD_UNIT")
+	if !hasUnit {
+		return false
+	}
+	for _, pattern := range cons.units {
+		if matched, _ := filepath.Match(pattern, string(unit)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// getMetadata returns the metadata for an entry
+func (cons *Journal) getMetadata(entry journalEntry) core.Metadata {
+	metadata := core.Metadata{}
+	for _, field := range entry.fields {
+		if cons.fieldFilter != nil && !cons.fieldFilter[field.name] {
+			continue // ### continue, field not requested ###
+		}
+		if _, isSet := metadata[field.name]; !isSet {
+			metadata.SetValue(field.name, field.value)
+		}
+	}
+
+	metadata.SetValue("__CURSOR", []byte(entry.cursor.String()))
+	metadata.SetValue("__REALTIME_TIMESTAMP", []byte(strconv.FormatUint(entry.cursor.realtime, 10)))
+	metadata.SetValue("__MONOTONIC_TIMESTAMP", []byte(strconv.FormatUint(entry.cursor.monotonic, 10)))
+	return metadata
+}
+
+// processEntry passes entries after the current cursor that match the
+// configured filters to onEntry and advances the cursor.
+func (cons *Journal) processEntry(entry journalEntry, onEntry func(journalEntry)) {
+	if cons.hasCursor && !entry.cursor.isAfter(cons.cursor) {
+		return // ### return, already read ###
+	}
+	cons.cursor = entry.cursor
+	cons.hasCursor = true
+
+	if _, hasMessage := entry.getField("MESSAGE"); !hasMessage || !cons.isMatching(entry) {
+		return // ### return, filtered ###
+	}
+	onEntry(entry)
+}
+
+func (cons *Journal) enqueueEntry(entry journalEntry) {
+	message, _ := entry.getField("MESSAGE")
+	timestamp := time.Unix(0, int64(entry.cursor.realtime)*int64(time.Microsecond))
+
+	if cons.hasMetadata {
+		cons.EnqueueWithTime(message, cons.getMetadata(entry), timestamp)
+	} else {
+		cons.EnqueueWithTime(message, nil, timestamp)
+	}
+}
+
+func (cons *Journal) loadCursor() {
+	if cons.offsetFileName == "" {
+		return // ### return, cursor not stored ###
+	}
+
+	data, err := ioutil.ReadFile(cons.offsetFileName)
+	switch {
+	case os.IsNotExist(err):
+		return // ### return, no cursor stored yet ###
+	case err != nil:
+		cons.Logger.WithError(err).Error("Error reading offset file")
+		return // ### return, cannot read cursor ###
+	}
+
+	cursor, err := parseJournalCursor(string(data))
+	if err != nil {
+		cons.Logger.WithError(err).Error("Error parsing offset file")
+		return // ### return, invalid cursor ###
+	}
+
+	cons.cursor = cursor
+	cons.hasCursor = true
+	cons.storedCursor = cursor
+}
+
+// storeCursor writes the current cursor to OffsetFile. Unless forced, the
+// cursor is written at most once per second.
+func (cons *Journal) storeCursor(force bool) {
+	if cons.offsetFileName == "" || !cons.hasCursor || cons.cursor == cons.storedCursor {
+		return // ### return, nothing to do ###
+	}
+	if !force && time.Since(cons.lastStore) < journalStoreInterval {
+		return // ### return, stored recently ###
+	}
+
+	if err := ioutil.WriteFile(cons.offsetFileName, []byte(cons.cursor.String()), 0644); err != nil {
+		cons.Logger.WithError(err).Error("Failed to write offset file")
+		return // ### return, retry later ###
+	}
+	cons.storedCursor = cons.cursor
+	cons.lastStore = time.Now()
+}
+
+// discover opens new journal files and closes files that have been removed.
+// Files are identified by their file id, so archived files are not read
+// twice. Without a stored cursor, files found during startup begin at the
+// configured default offset.
+func (cons *Journal) discover(isStartup bool) {
+	found := make(map[string]bool)
+	for _, pattern := range cons.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to search for journal files using %s", pattern)
+			continue // ### continue, invalid pattern ###
+		}
+
+		for _, path := range paths {
+			journal, err := openJournalFile(path)
+			if err != nil {
+				cons.Logger.WithError(err).Warningf("Failed to open %s", path)
+				continue // ### continue, not readable ###
+			}
+
+			found[journal.fileID] = true
+			if known, isKnown := cons.journals[journal.fileID]; isKnown {
+				known.path = path
+				journal.close()
+				continue // ### continue, already known ###
+			}
+
+			if isStartup && !cons.hasCursor && cons.startAtEnd {
+				if err := journal.seekTail(); err != nil {
+					cons.Logger.WithError(err).Warningf("Failed to seek to the end of %s", path)
+				}
+			}
+
+			cons.Logger.Debugf("Found journal file %s", path)
+			cons.journals[journal.fileID] = journal
+		}
+	}
+
+	for fileID, journal := range cons.journals {
+		if !found[fileID] {
+			cons.Logger.Debugf("Closed journal file %s", journal.path)
+			journal.close()
+			delete(cons.journals, fileID)
+		}
+	}
+}
+
+// fillPending reads the next batch of entries of a journal file if all
+// entries read before have been processed. False is returned if no entries
+// are pending.
+func (cons *Journal) fillPending(journal *journalFile) bool {
+	if len(journal.pending) > 0 {
+		return true
+	}
+
+	skipped, err := journal.readEntries(journalReadBatchSize, func(entry journalEntry) {
+		journal.pending = append(journal.pending, entry)
+	})
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to read %s", journal.path)
+	}
+	if skipped > 0 {
+		cons.Logger.Warningf("Skipped %d compressed fields in %s", skipped, journal.path)
+	}
+	return len(journal.pending) > 0
+}
+
+// readJournals merges the new entries of all journal files and passes up to
+// journalReadBatchSize of them to onEntry, oldest first. Files without new
+// entries are not read again during the same call. The number of entries
+// processed is returned.
+func (cons *Journal) readJournals(onEntry func(journalEntry)) int {
+	drained := make(map[*journalFile]bool)
+	count := 0
+
+	for ; count < journalReadBatchSize; count++ {
+		var next *journalFile
+		for _, journal := range cons.journals {
+			if drained[journal] {
+				continue // ### continue, no new entries ###
+			}
+			if !cons.fillPending(journal) {
+				drained[journal] = true
+				continue // ### continue, no new entries ###
+			}
+			if next == nil || next.pending[0].cursor.isAfter(journal.pending[0].cursor) {
+				next = journal
+			}
+		}
+
+		if next == nil {
+			break // ### break, all files read ###
+		}
+
+		entry := next.pending[0]
+		next.pending = next.pending[1:]
+		cons.processEntry(entry, onEntry)
+	}
+	return count
+}
+
+func (cons *Journal) readFiles() {
+	defer cons.WorkerDone()
+
+	cons.loadCursor()
+	cons.discover(true)
+	lastDiscover := time.Now()
+
+	for {
+		if time.Since(lastDiscover) >= cons.discoverInterval {
+			cons.discover(false)
+			lastDiscover = time.Now()
+		}
+
+		count := cons.readJournals(cons.enqueueEntry)
+		cons.storeCursor(false)
+		if count >= journalReadBatchSize {
+			continue // ### continue, more entries available ###
+		}
+
+		select {
+		case <-cons.stop:
+			cons.storeCursor(true)
+			for _, journal := range cons.journals {
+				journal.close()
+			}
+			return // ### return, stopped ###
+		case <-time.After(cons.pollingDelay):
+		}
+	}
+}
+
+func (reader journalTailReader) Read(data []byte) (int, error) {
+	for {
+		n, err := reader.file.Read(data)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+
+		select {
+		case <-reader.stop:
+			return 0, io.EOF
+		case <-time.After(reader.delay):
+		}
+	}
+}
+
+func (cons *Journal) openExportFile() (io.Reader, error) {
+	file := os.Stdin
+	if cons.exportFileName != "-" {
+		var err error
+		if file, err = os.Open(cons.exportFileName); err != nil {
+			return nil, err
+		}
+	}
+
+	cons.exportGuard.Lock()
+	defer cons.exportGuard.Unlock()
+	cons.exportFile = file
+
+	if stat, err := file.Stat(); err == nil && stat.Mode().IsRegular() {
+		return journalTailReader{file: file, delay: cons.pollingDelay, stop: cons.stop}, nil
+	}
+	return file, nil
+}
+
+func (cons *Journal) readExport() {
+	defer cons.WorkerDone()
+	defer cons.storeCursor(true)
+
+	cons.loadCursor()
+	file, err := cons.openExportFile()
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to open export file")
+		return // ### return, cannot read ###
+	}
+
+	reader := bufio.NewReader(file)
+	for cons.IsActive() {
+		entry, err := readJournalExport(reader)
+		switch {
+		case err == nil:
+			cons.processEntry(entry, cons.enqueueEntry)
+			cons.storeCursor(false)
+		case err == io.EOF:
+			cons.Logger.Info("End of journal export reached")
+			return // ### return, done ###
+		default:
+			if cons.IsActive() {
+				cons.Logger.WithError(err).Error("Failed to read journal export")
+			}
+			return // ### return, cannot continue ###
+		}
+	}
+}
+
+func (cons *Journal) close() {
+	close(cons.stop)
+
+	cons.exportGuard.Lock()
+	defer cons.exportGuard.Unlock()
+	if cons.exportFile != nil {
+		cons.exportFile.Close()
+	}
+}
+
+// Consume starts reading the journal
+func (cons *Journal) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+
+	if cons.exportFileName != "" {
+		go tgo.WithRecoverShutdown(cons.readExport)
+	} else {
+		go tgo.WithRecoverShutdown(cons.readFiles)
+	}
+
+	cons.ControlLoop()
+}
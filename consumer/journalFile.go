@@ -0,0 +1,475 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pierrec/lz4"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Journal file layout as documented in systemd's journal-def.h
+const (
+	journalSignature         = "LPKSHHRH"
+	journalMinHeaderSize     = 208
+	journalObjectHeaderSize  = 16
+	journalEntryItemsOffset  = 64
+	journalDataOffset        = 64
+	journalCompactDataOffset = 72
+	journalMaxDataSize       = 64 * 1024 * 1024
+
+	journalObjectData  = 1
+	journalObjectEntry = 3
+
+	journalObjectCompressedXZ   = 1
+	journalObjectCompressedLZ4  = 2
+	journalObjectCompressedZSTD = 4
+
+	journalIncompatibleCompact   = 16
+	journalIncompatibleSupported = 31
+)
+
+var (
+	errJournalCompression = errors.New("Unsupported journal data compression")
+)
+
+// journalHeader holds the parts of a journal file header needed for reading
+type journalHeader struct {
+	incompatibleFlags uint32
+	fileID            string
+	seqnumID          string
+	headerSize        uint64
+	arenaSize         uint64
+	tailObjectOffset  uint64
+	entries           uint64
+}
+
+// journalCursor identifies a journal entry. The string representation is
+// compatible with the cursors used by journalctl.
+type journalCursor struct {
+	seqnumID  string
+	seqnum    uint64
+	bootID    string
+	monotonic uint64
+	realtime  uint64
+	xorHash   uint64
+}
+
+// journalField is a single FIELD=value pair of a journal entry
+type journalField struct {
+	name  string
+	value []byte
+}
+
+// journalEntry holds the fields of a journal entry
+type journalEntry struct {
+	cursor journalCursor
+	fields []journalField
+}
+
+// journalFile reads entries from a journal file in the order they were
+// written.
+type journalFile struct {
+	path     string
+	file     *os.File
+	fileID   string
+	compact  bool
+	position uint64
+	entries  uint64
+
+	// pending holds entries that have been read but not processed yet
+	pending []journalEntry
+}
+
+// String returns the cursor in the format used by journalctl
+func (cursor journalCursor) String() string {
+	return fmt.Sprintf("s=%s;i=%x;b=%s;m=%x;t=%x;x=%x",
+		cursor.seqnumID, cursor.seqnum, cursor.bootID, cursor.monotonic, cursor.realtime, cursor.xorHash)
+}
+
+// isAfter returns true if the entry identified by cursor has been written
+// after the one identified by other. Like journalctl, sequence numbers are
+// compared first, monotonic time second and wall clock time last.
+func (cursor journalCursor) isAfter(other journalCursor) bool {
+	switch {
+	case cursor.seqnumID == other.seqnumID:
+		return cursor.seqnum > other.seqnum
+	case cursor.bootID == other.bootID:
+		return cursor.monotonic > other.monotonic
+	default:
+		return cursor.realtime > other.realtime
+	}
+}
+
+// parseJournalCursor parses a cursor in the format used by journalctl
+func parseJournalCursor(text string) (journalCursor, error) {
+	cursor := journalCursor{}
+	for _, part := range strings.Split(strings.TrimSpace(text), ";") {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return cursor, fmt.Errorf("Invalid journal cursor: %s", text)
+		}
+
+		var err error
+		switch keyValue[0] {
+		case "s":
+			cursor.seqnumID = keyValue[1]
+		case "i":
+			cursor.seqnum, err = strconv.ParseUint(keyValue[1], 16, 64)
+		case "b":
+			cursor.bootID = keyValue[1]
+		case "m":
+			cursor.monotonic, err = strconv.ParseUint(keyValue[1], 16, 64)
+		case "t":
+			cursor.realtime, err = strconv.ParseUint(keyValue[1], 16, 64)
+		case "x":
+			cursor.xorHash, err = strconv.ParseUint(keyValue[1], 16, 64)
+		}
+		if err != nil {
+			return cursor, fmt.Errorf("Invalid journal cursor: %s", text)
+		}
+	}
+
+	if cursor.seqnumID == "" || cursor.bootID == "" {
+		return cursor, fmt.Errorf("Invalid journal cursor: %s", text)
+	}
+	return cursor, nil
+}
+
+// getField returns the value of the first field with the given name
+func (entry journalEntry) getField(name string) ([]byte, bool) {
+	for _, field := range entry.fields {
+		if field.name == name {
+			return field.value, true
+		}
+	}
+	return nil, false
+}
+
+func (entry *journalEntry) addField(data []byte) {
+	separator := bytes.IndexByte(data, '=')
+	if separator <= 0 {
+		return // ### return, invalid field ###
+	}
+	entry.fields = append(entry.fields, journalField{
+		name:  string(data[:separator]),
+		value: data[separator+1:],
+	})
+}
+
+func journalAlign(size uint64) uint64 {
+	return (size + 7) &^ 7
+}
+
+// openJournalFile opens a journal file and validates its header
+func openJournalFile(path string) (*journalFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &journalFile{
+		path: path,
+		file: file,
+	}
+
+	header, err := journal.readHeader()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if header.incompatibleFlags&^journalIncompatibleSupported != 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s uses unsupported journal features (%x)", path, header.incompatibleFlags)
+	}
+
+	journal.fileID = header.fileID
+	journal.compact = header.incompatibleFlags&journalIncompatibleCompact != 0
+	journal.position = header.headerSize
+	return journal, nil
+}
+
+func (journal *journalFile) close() {
+	journal.file.Close()
+}
+
+func (journal *journalFile) readHeader() (journalHeader, error) {
+	data := make([]byte, journalMinHeaderSize)
+	if _, err := journal.file.ReadAt(data, 0); err != nil {
+		return journalHeader{}, err
+	}
+	if string(data[:8]) != journalSignature {
+		return journalHeader{}, fmt.Errorf("%s is not a journal file", journal.path)
+	}
+
+	header := journalHeader{
+		incompatibleFlags: binary.LittleEndian.Uint32(data[12:]),
+		fileID:            hex.EncodeToString(data[24:40]),
+		seqnumID:          hex.EncodeToString(data[72:88]),
+		headerSize:        binary.LittleEndian.Uint64(data[88:]),
+		arenaSize:         binary.LittleEndian.Uint64(data[96:]),
+		tailObjectOffset:  binary.LittleEndian.Uint64(data[136:]),
+		entries:           binary.LittleEndian.Uint64(data[152:]),
+	}
+
+	if header.headerSize < journalMinHeaderSize {
+		return header, fmt.Errorf("%s has an invalid header size", journal.path)
+	}
+	return header, nil
+}
+
+// readObject reads the object stored at the given offset and returns its
+// type, flags and complete contents including the object header.
+func (journal *journalFile) readObject(offset uint64, header journalHeader) (byte, byte, []byte, error) {
+	objectHeader := make([]byte, journalObjectHeaderSize)
+	if _, err := journal.file.ReadAt(objectHeader, int64(offset)); err != nil {
+		return 0, 0, nil, err
+	}
+
+	size := binary.LittleEndian.Uint64(objectHeader[8:])
+	if size < journalObjectHeaderSize || offset+size > header.headerSize+header.arenaSize || size > journalMaxDataSize {
+		return 0, 0, nil, fmt.Errorf("Invalid object at offset %d in %s", offset, journal.path)
+	}
+
+	data := make([]byte, size)
+	if _, err := journal.file.ReadAt(data, int64(offset)); err != nil {
+		return 0, 0, nil, err
+	}
+	return objectHeader[0], objectHeader[1], data, nil
+}
+
+// readData returns the FIELD=value payload of the data object stored at
+// the given offset.
+func (journal *journalFile) readData(offset uint64, header journalHeader) ([]byte, error) {
+	objectType, flags, data, err := journal.readObject(offset, header)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadOffset := uint64(journalDataOffset)
+	if journal.compact {
+		payloadOffset = journalCompactDataOffset
+	}
+	if objectType != journalObjectData || uint64(len(data)) < payloadOffset {
+		return nil, fmt.Errorf("Invalid data object at offset %d in %s", offset, journal.path)
+	}
+	payload := data[payloadOffset:]
+
+	switch {
+	case flags&journalObjectCompressedLZ4 != 0:
+		// The uncompressed size is stored in front of the lz4 block
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("Invalid data object at offset %d in %s", offset, journal.path)
+		}
+		size := binary.LittleEndian.Uint64(payload)
+		if size > journalMaxDataSize {
+			return nil, fmt.Errorf("Invalid data object at offset %d in %s", offset, journal.path)
+		}
+		uncompressed := make([]byte, size)
+		n, err := lz4.UncompressBlock(payload[8:], uncompressed, 0)
+		if err != nil {
+			return nil, err
+		}
+		return uncompressed[:n], nil
+
+	case flags&(journalObjectCompressedXZ|journalObjectCompressedZSTD) != 0:
+		return nil, errJournalCompression
+
+	default:
+		return payload, nil
+	}
+}
+
+// readEntry parses the entry object and resolves all data objects it
+// references. The number of fields that could not be decompressed is
+// returned along with the entry.
+func (journal *journalFile) readEntry(data []byte, header journalHeader) (journalEntry, int, error) {
+	if len(data) < journalEntryItemsOffset {
+		return journalEntry{}, 0, fmt.Errorf("Invalid entry object in %s", journal.path)
+	}
+
+	entry := journalEntry{
+		cursor: journalCursor{
+			seqnumID:  header.seqnumID,
+			seqnum:    binary.LittleEndian.Uint64(data[16:]),
+			realtime:  binary.LittleEndian.Uint64(data[24:]),
+			monotonic: binary.LittleEndian.Uint64(data[32:]),
+			bootID:    hex.EncodeToString(data[40:56]),
+			xorHash:   binary.LittleEndian.Uint64(data[56:]),
+		},
+	}
+
+	itemSize := 16
+	if journal.compact {
+		itemSize = 4
+	}
+
+	skipped := 0
+	for item := data[journalEntryItemsOffset:]; len(item) >= itemSize; item = item[itemSize:] {
+		var offset uint64
+		if journal.compact {
+			offset = uint64(binary.LittleEndian.Uint32(item))
+		} else {
+			offset = binary.LittleEndian.Uint64(item)
+		}
+		if offset == 0 {
+			continue // ### continue, unused item ###
+		}
+
+		payload, err := journal.readData(offset, header)
+		switch {
+		case err == errJournalCompression:
+			skipped++
+		case err != nil:
+			return entry, skipped, err
+		default:
+			entry.addField(payload)
+		}
+	}
+
+	return entry, skipped, nil
+}
+
+// seekTail moves the read position behind the last entry of the file
+func (journal *journalFile) seekTail() error {
+	header, err := journal.readHeader()
+	if err != nil {
+		return err
+	}
+	if header.tailObjectOffset < header.headerSize {
+		return nil // ### return, empty file ###
+	}
+
+	objectHeader := make([]byte, journalObjectHeaderSize)
+	if _, err := journal.file.ReadAt(objectHeader, int64(header.tailObjectOffset)); err != nil {
+		return err
+	}
+
+	journal.position = header.tailObjectOffset + journalAlign(binary.LittleEndian.Uint64(objectHeader[8:]))
+	journal.entries = header.entries
+	return nil
+}
+
+// readEntries passes up to maxEntries entries that have been written since
+// the last call to onEntry. Only entries that have been linked into the
+// journal, i.e. that are completely written, are returned. The number of
+// fields that could not be decompressed is returned.
+func (journal *journalFile) readEntries(maxEntries int, onEntry func(journalEntry)) (int, error) {
+	header, err := journal.readHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	skipped := 0
+	for count := 0; count < maxEntries && journal.entries < header.entries && journal.position <= header.tailObjectOffset; {
+		objectType, _, data, err := journal.readObject(journal.position, header)
+		if err != nil {
+			return skipped, err
+		}
+
+		if objectType == journalObjectEntry {
+			entry, skippedFields, err := journal.readEntry(data, header)
+			if err != nil {
+				return skipped, err
+			}
+			skipped += skippedFields
+			journal.entries++
+			count++
+			onEntry(entry)
+		}
+
+		journal.position += journalAlign(uint64(len(data)))
+	}
+
+	return skipped, nil
+}
+
+// readJournalExport reads the next entry in the journal export format
+// as written by "journalctl -o export". Special fields starting with "__"
+// are used for the cursor and are not added to the entry fields.
+func readJournalExport(reader *bufio.Reader) (journalEntry, error) {
+	entry := journalEntry{}
+	hasCursor := false
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF && len(line) == 0 && len(entry.fields) > 0 {
+				err = nil
+				break
+			}
+			if err == io.EOF && (len(line) > 0 || len(entry.fields) > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return entry, err
+		}
+
+		line = line[:len(line)-1]
+		if len(line) == 0 {
+			if len(entry.fields) == 0 && !hasCursor {
+				continue // ### continue, leading empty line ###
+			}
+			break // ### break, end of entry ###
+		}
+
+		if bytes.IndexByte(line, '=') < 0 {
+			// Binary field: name, little endian size, data, newline
+			name := string(line)
+			sizeData := make([]byte, 8)
+			if _, err := io.ReadFull(reader, sizeData); err != nil {
+				return entry, io.ErrUnexpectedEOF
+			}
+			size := binary.LittleEndian.Uint64(sizeData)
+			if size > journalMaxDataSize {
+				return entry, fmt.Errorf("Journal field %s exceeds the size limit", name)
+			}
+			value := make([]byte, size+1)
+			if _, err := io.ReadFull(reader, value); err != nil {
+				return entry, io.ErrUnexpectedEOF
+			}
+			entry.fields = append(entry.fields, journalField{name: name, value: value[:size]})
+			continue // ### continue, binary field ###
+		}
+
+		switch {
+		case bytes.HasPrefix(line, []byte("__CURSOR=")):
+			cursor, err := parseJournalCursor(string(line[len("__CURSOR="):]))
+			if err != nil {
+				return entry, err
+			}
+			entry.cursor = cursor
+			hasCursor = true
+
+		case bytes.HasPrefix(line, []byte("__")):
+			// Other special fields are part of the cursor
+
+		default:
+			entry.addField(append([]byte(nil), line...))
+		}
+	}
+
+	if !hasCursor {
+		return entry, errors.New("Journal export entry without cursor")
+	}
+	return entry, nil
+}
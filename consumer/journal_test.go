@@ -0,0 +1,351 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pierrec/lz4"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+const testJournalHeaderSize = 272
+
+// testJournal writes minimal journal files containing data and entry objects
+type testJournal struct {
+	compact bool
+	data    []byte
+	tail    uint64
+	entries uint64
+}
+
+func newTestJournal(compact bool) *testJournal {
+	journal := &testJournal{
+		compact: compact,
+		data:    make([]byte, testJournalHeaderSize),
+	}
+	copy(journal.data, journalSignature)
+	copy(journal.data[24:], bytes.Repeat([]byte{0xf1}, 16))
+	copy(journal.data[72:], bytes.Repeat([]byte{0x5e}, 16))
+	return journal
+}
+
+func (journal *testJournal) addObject(objectType, flags byte, body []byte) uint64 {
+	offset := uint64(len(journal.data))
+	header := make([]byte, journalObjectHeaderSize)
+	header[0] = objectType
+	header[1] = flags
+	binary.LittleEndian.PutUint64(header[8:], uint64(journalObjectHeaderSize+len(body)))
+
+	journal.data = append(journal.data, header...)
+	journal.data = append(journal.data, body...)
+	for len(journal.data)%8 != 0 {
+		journal.data = append(journal.data, 0)
+	}
+	journal.tail = offset
+	return offset
+}
+
+func (journal *testJournal) addData(payload string, compress bool) uint64 {
+	headerSize := journalDataOffset - journalObjectHeaderSize
+	if journal.compact {
+		headerSize = journalCompactDataOffset - journalObjectHeaderSize
+	}
+	body := make([]byte, headerSize)
+
+	if !compress {
+		return journal.addObject(journalObjectData, 0, append(body, payload...))
+	}
+
+	compressed := make([]byte, lz4.CompressBlockBound(len(payload)))
+	n, err := lz4.CompressBlock([]byte(payload), compressed, 0)
+	if err != nil || n == 0 {
+		panic("payload not compressible")
+	}
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(payload)))
+	body = append(body, size...)
+	return journal.addObject(journalObjectData, journalObjectCompressedLZ4, append(body, compressed[:n]...))
+}
+
+func (journal *testJournal) addEntry(seqnum, realtime uint64, fields ...uint64) {
+	body := make([]byte, journalEntryItemsOffset-journalObjectHeaderSize)
+	binary.LittleEndian.PutUint64(body[0:], seqnum)
+	binary.LittleEndian.PutUint64(body[8:], realtime)
+	binary.LittleEndian.PutUint64(body[16:], realtime/2)
+	copy(body[24:], bytes.Repeat([]byte{0xb0}, 16))
+
+	for _, offset := range fields {
+		if journal.compact {
+			item := make([]byte, 4)
+			binary.LittleEndian.PutUint32(item, uint32(offset))
+			body = append(body, item...)
+		} else {
+			item := make([]byte, 16)
+			binary.LittleEndian.PutUint64(item, offset)
+			body = append(body, item...)
+		}
+	}
+
+	journal.addObject(journalObjectEntry, 0, body)
+	journal.entries++
+}
+
+func (journal *testJournal) write(path string, linkedEntries uint64) error {
+	flags := uint32(0)
+	if journal.compact {
+		flags = journalIncompatibleCompact
+	}
+	// The header flag for LZ4 compressed files is 2
+	binary.LittleEndian.PutUint32(journal.data[12:], flags|2)
+	binary.LittleEndian.PutUint64(journal.data[88:], testJournalHeaderSize)
+	binary.LittleEndian.PutUint64(journal.data[96:], uint64(len(journal.data)-testJournalHeaderSize))
+	binary.LittleEndian.PutUint64(journal.data[136:], journal.tail)
+	binary.LittleEndian.PutUint64(journal.data[152:], linkedEntries)
+	return ioutil.WriteFile(path, journal.data, 0644)
+}
+
+func readTestJournal(journal *journalFile) ([]journalEntry, error) {
+	entries := []journalEntry{}
+	_, err := journal.readEntries(100, func(entry journalEntry) {
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+func TestJournalFile(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-journal")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, compact := range []bool{false, true} {
+		path := filepath.Join(dir, "system.journal")
+		writer := newTestJournal(compact)
+		unit := writer.addData("_SYSTEMD_UNIT=ssh.service", false)
+		message := writer.addData("MESSAGE=hello", false)
+		long := writer.addData("MESSAGE="+string(bytes.Repeat([]byte("long "), 100)), true)
+		writer.addEntry(1, 1000, unit, message)
+		writer.addEntry(2, 2000, unit, long)
+		expect.NoError(writer.write(path, 1))
+
+		journal, err := openJournalFile(path)
+		expect.NoError(err)
+		expect.Equal(compact, journal.compact)
+		expect.Equal("f1f1f1f1f1f1f1f1f1f1f1f1f1f1f1f1", journal.fileID)
+
+		// Only linked entries are read
+		entries, err := readTestJournal(journal)
+		expect.NoError(err)
+		expect.Equal(1, len(entries))
+		expect.Equal(uint64(1000), entries[0].cursor.realtime)
+		expect.Equal("5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e5e", entries[0].cursor.seqnumID)
+		value, _ := entries[0].getField("MESSAGE")
+		expect.Equal("hello", string(value))
+		value, _ = entries[0].getField("_SYSTEMD_UNIT")
+		expect.Equal("ssh.service", string(value))
+
+		expect.NoError(writer.write(path, 2))
+		entries, err = readTestJournal(journal)
+		expect.NoError(err)
+		expect.Equal(1, len(entries))
+		value, _ = entries[0].getField("MESSAGE")
+		expect.Equal(500, len(value))
+
+		writer.addEntry(3, 3000, message)
+		expect.NoError(writer.write(path, 3))
+		expect.NoError(journal.seekTail())
+		entries, err = readTestJournal(journal)
+		expect.NoError(err)
+		expect.Equal(0, len(entries))
+		journal.close()
+	}
+}
+
+func TestJournalMerge(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-journal")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := core.NewPluginConfig("testJournalMerge", "consumer.Journal")
+	config.Override("Files", []string{filepath.Join(dir, "*.journal")})
+	config.Override("DefaultOffset", "oldest")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Journal)
+	expect.True(casted)
+
+	// Every tenth entry goes to the second file, so a batch of the second
+	// file reaches far beyond a batch of the first file. Both files contain
+	// more than one batch.
+	numEntries := uint64(12 * journalReadBatchSize)
+	writers := []*testJournal{newTestJournal(false), newTestJournal(false)}
+	copy(writers[1].data[24:], bytes.Repeat([]byte{0xf2}, 16))
+	messages := []uint64{writers[0].addData("MESSAGE=a", false), writers[1].addData("MESSAGE=b", false)}
+
+	for seqnum := uint64(1); seqnum <= numEntries; seqnum++ {
+		idx := 0
+		if seqnum%10 == 0 {
+			idx = 1
+		}
+		writers[idx].addEntry(seqnum, seqnum*1000, messages[idx])
+	}
+	for idx, writer := range writers {
+		path := filepath.Join(dir, "system"+strconv.Itoa(idx)+".journal")
+		expect.NoError(writer.write(path, writer.entries))
+	}
+
+	cons.discover(true)
+	expect.Equal(2, len(cons.journals))
+
+	seqnums := []uint64{}
+	onEntry := func(entry journalEntry) {
+		seqnums = append(seqnums, entry.cursor.seqnum)
+	}
+
+	for count := cons.readJournals(onEntry); count > 0; count = cons.readJournals(onEntry) {
+		expect.Equal(journalReadBatchSize, count)
+	}
+
+	expect.Equal(int(numEntries), len(seqnums))
+	for idx, seqnum := range seqnums {
+		if !expect.Equal(uint64(idx+1), seqnum) {
+			break
+		}
+	}
+
+	for _, journal := range cons.journals {
+		journal.close()
+	}
+}
+
+func TestJournalCursor(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	text := "s=776f864ec9ee488eaa61657c7f6efae7;i=15a;b=52156fa98d42443dbc3d004427ab6998;m=94e5791b;t=65e2458788023;x=5105e28d5b8e7345"
+	cursor, err := parseJournalCursor(text + "\n")
+	expect.NoError(err)
+	expect.Equal(uint64(0x15a), cursor.seqnum)
+	expect.Equal(text, cursor.String())
+
+	next := cursor
+	next.seqnum++
+	next.monotonic = 0
+	expect.True(next.isAfter(cursor))
+	expect.False(cursor.isAfter(next))
+
+	otherSeqnum := cursor
+	otherSeqnum.seqnumID = "other"
+	otherSeqnum.seqnum = 0
+	otherSeqnum.monotonic++
+	expect.True(otherSeqnum.isAfter(cursor))
+
+	otherBoot := otherSeqnum
+	otherBoot.bootID = "other"
+	expect.False(otherBoot.isAfter(cursor))
+
+	_, err = parseJournalCursor("s=abc;i=zz")
+	expect.NotNil(err)
+}
+
+func TestJournalExport(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	export := bytes.NewBufferString("__CURSOR=s=a;i=1;b=b;m=1;t=10;x=0\n" +
+		"__REALTIME_TIMESTAMP=16\n" +
+		"MESSAGE=first\n" +
+		"PRIORITY=3\n" +
+		"\n" +
+		"__CURSOR=s=a;i=2;b=b;m=2;t=20;x=0\n" +
+		"MESSAGE\n")
+	binary.Write(export, binary.LittleEndian, uint64(7))
+	export.WriteString("two\nrow\n")
+	export.WriteString("_SYSTEMD_UNIT=cron.service\n")
+
+	reader := bufio.NewReader(export)
+	entry, err := readJournalExport(reader)
+	expect.NoError(err)
+	expect.Equal(uint64(1), entry.cursor.seqnum)
+	expect.Equal(2, len(entry.fields))
+	value, _ := entry.getField("MESSAGE")
+	expect.Equal("first", string(value))
+
+	entry, err = readJournalExport(reader)
+	expect.NoError(err)
+	expect.Equal(uint64(0x20), entry.cursor.realtime)
+	value, _ = entry.getField("MESSAGE")
+	expect.Equal("two\nrow", string(value))
+	value, _ = entry.getField("_SYSTEMD_UNIT")
+	expect.Equal("cron.service", string(value))
+
+	_, err = readJournalExport(reader)
+	expect.Equal(io.EOF, err)
+
+	_, err = readJournalExport(bufio.NewReader(bytes.NewBufferString("MESSAGE=incomplete\n")))
+	expect.NotNil(err)
+}
+
+func TestJournalMatches(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testJournalMatches", "consumer.Journal")
+	config.Override("Units", []string{"ssh", "docker*"})
+	config.Override("Priority", "warning")
+	config.Override("Fields", []string{"_SYSTEMD_UNIT"})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Journal)
+	expect.True(casted)
+
+	newEntry := func(seqnum uint64, fields ...string) journalEntry {
+		entry := journalEntry{cursor: journalCursor{seqnumID: "s", bootID: "b", seqnum: seqnum}}
+		for _, field := range fields {
+			entry.addField([]byte(field))
+		}
+		return entry
+	}
+
+	matched := []uint64{}
+	onEntry := func(entry journalEntry) {
+		matched = append(matched, entry.cursor.seqnum)
+	}
+
+	cons.processEntry(newEntry(1, "MESSAGE=a", "_SYSTEMD_UNIT=ssh.service", "PRIORITY=3"), onEntry)
+	cons.processEntry(newEntry(2, "MESSAGE=b", "_SYSTEMD_UNIT=ssh.service", "PRIORITY=6"), onEntry)
+	cons.processEntry(newEntry(3, "MESSAGE=c", "_SYSTEMD_UNIT=docker.service"), onEntry)
+	cons.processEntry(newEntry(4, "MESSAGE=d", "_SYSTEMD_UNIT=cron.service"), onEntry)
+	cons.processEntry(newEntry(5, "_SYSTEMD_UNIT=ssh.service"), onEntry)
+	cons.processEntry(newEntry(3, "MESSAGE=c", "_SYSTEMD_UNIT=docker.service"), onEntry)
+	expect.Equal([]uint64{1, 3}, matched)
+	expect.Equal(uint64(5), cons.cursor.seqnum)
+
+	metadata := cons.getMetadata(newEntry(6, "MESSAGE=e", "_SYSTEMD_UNIT=ssh.service"))
+	expect.Equal("ssh.service", metadata.GetValueString("_SYSTEMD_UNIT"))
+	expect.Equal("", metadata.GetValueString("MESSAGE"))
+	expect.Equal("s=s;i=6;b=b;m=0;t=0;x=0", metadata.GetValueString("__CURSOR"))
+}
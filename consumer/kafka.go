@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +44,19 @@ const (
 // This consumer reads data from a kafka topic. It is based on the sarama
 // library; most settings are mapped to the settings from this library.
 //
+// When a GroupId is set, this consumer joins the given consumer group and
+// reads only the partitions assigned to it, so that multiple instances can
+// share the load of a topic. Offsets are marked after a message has been
+// enqueued and are committed to Kafka periodically. When partitions are
+// revoked during a rebalance, messages in flight are given RebalanceTimeoutMs
+// to be enqueued before all marked offsets are committed and the partitions
+// are handed over. Multiple topics can be read by setting Topics or
+// TopicRegex in this mode.
+//
+// Record headers (Kafka >= 0.11) are copied to the message metadata when
+// SetMetadata is active. If UseRecordTime is set, the record timestamp
+// (Kafka >= 0.10) is used as the creation time of the message.
+//
 // Metadata
 //
 // *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
@@ -51,6 +65,16 @@ const (
 //
 // - key: Contains the key of the kafka message
 //
+// - partition: Contains the partition the message was read from
+//
+// - offset: Contains the offset of the message inside its partition
+//
+// - timestamp: Contains the timestamp of the message formatted using
+// TimestampFormat. Only set for Kafka versions >= 0.10.
+//
+// - <HeaderPrefix><header>: Contains the value of each record header. Only set
+// for Kafka versions >= 0.11.
+//
 // Parameters
 //
 // - Servers: Defines the list of all kafka brokers to initially connect to when
@@ -58,9 +82,19 @@ const (
 // ideally contains all the brokers in the cluster.
 // By default this parameter is set to ["localhost:9092"].
 //
-// - Topic: Defines the kafka topic to read from.
+// - Topic: Defines the kafka topic to read from. This setting is ignored if
+// Topics or TopicRegex is set.
 // By default this parameter is set to "default".
 //
+// - Topics: Defines a list of kafka topics to read from. This setting requires
+// GroupId to be set.
+// By default this parameter is set to an empty list.
+//
+// - TopicRegex: Defines a regular expression matching the kafka topics to read
+// from. Topics created later on are picked up when metadata is refreshed.
+// This setting requires GroupId to be set.
+// By default this parameter is set to "".
+//
 // - ClientId: Sets the client id used in requests by this consumer.
 // By default this parameter is set to "gollum".
 //
@@ -79,6 +113,20 @@ const (
 // performance impact on systems with high throughput.
 // By default this parameter is set to "false".
 //
+// - TimestampFormat: When using SetMetadata this string denotes the go time
+// format used for the "timestamp" metadata field.
+// By default this parameter is set to "2006-01-02T15:04:05.000 MST".
+//
+// - HeaderPrefix: Defines a string prepended to the name of each record header
+// when copying headers to the metadata. Use this to avoid collisions with
+// the other metadata fields.
+// By default this parameter is set to "".
+//
+// - UseRecordTime: When set to true, the timestamp of a record is used as the
+// creation time of the message instead of the time it was read. This
+// requires Kafka version >= 0.10.
+// By default this parameter is set to false.
+//
 // - DefaultOffset: Defines the initial offest when starting to read the topic.
 // Valid values are "oldest" and "newest". If OffsetFile
 // is defined and the file exists, the DefaultOffset parameter is ignored.
@@ -145,6 +193,17 @@ const (
 // kafka metadata from the cluster (e.g. number of partitons).
 // By default this parameter is set to 10000.
 //
+// - CommitIntervalMs: Defines the interval in milliseconds in which offsets
+// are committed to Kafka when using GroupId.
+// By default this parameter is set to 1000.
+//
+// - RebalanceTimeoutMs: Defines the number of milliseconds messages already
+// read from revoked partitions are given to be enqueued before their offsets
+// are committed during a rebalance. Offsets of messages that are not enqueued
+// in time are not committed, so these messages are read again by the new
+// owner of the partition.
+// By default this parameter is set to 1000.
+//
 // - TlsEnable: Defines whether to use TLS based authentication when
 // communicating with brokers.
 // By default this parameter is set to false.
@@ -195,12 +254,29 @@ const (
 //      - "kafka1:9092"
 //      - "kafka2:9092"
 //      - "kafka3:9092"
+//
+// This config reads all topics starting with "logs-" as a member of the
+// consumer group "gollum".
+//
+//  kafkaGroupIn:
+//    Type: consumer.Kafka
+//    Streams: logs
+//    GroupId: gollum
+//    TopicRegex: "^logs-"
+//    Version: "0.10.2"
+//    SetMetadata: true
+//    Servers:
+//      - "kafka0:9092"
 type Kafka struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	servers             []string      `config:"Servers"`
 	topic               string        `config:"Topic" default:"default"`
+	topics              []string      `config:"Topics"`
 	group               string        `config:"GroupId"`
 	hasToSetMetadata    bool          `config:"SetMetadata" default:"false"`
+	timestampFormat     string        `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+	headerPrefix        string        `config:"HeaderPrefix"`
+	useRecordTime       bool          `config:"UseRecordTime" default:"false"`
 	offsetFile          string        `config:"OffsetFile"`
 	persistTimeout      time.Duration `config:"PresistTimoutMs" default:"5000" metric:"ms"`
 	orderedRead         bool          `config:"Ordered"`
@@ -319,7 +395,30 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 	cons.config.Consumer.Fetch.Default = int32(conf.GetInt("DefaultFetchSizeByte", 32768))
 	cons.config.Consumer.MaxWaitTime = time.Duration(conf.GetInt("FetchTimeoutMs", 250)) * time.Millisecond
 
-	if cons.group != "" {
+	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kafkaOffsetNewest))
+	switch offsetValue {
+	case kafkaOffsetNewest:
+		cons.defaultOffset = kafka.OffsetNewest
+
+	case kafkaOffsetOldest:
+		cons.defaultOffset = kafka.OffsetOldest
+
+	default:
+		cons.defaultOffset, _ = strconv.ParseInt(offsetValue, 10, 64)
+	}
+
+	topicRegex := conf.GetString("TopicRegex", "")
+	if len(cons.topics) == 0 && topicRegex == "" {
+		cons.topics = []string{cons.topic}
+	}
+
+	if cons.group == "" {
+		if len(cons.topics) > 1 || topicRegex != "" {
+			conf.Errors.Pushf("Topics and TopicRegex require GroupId to be set")
+		} else {
+			cons.topic = cons.topics[0]
+		}
+	} else {
 		cons.offsetFile = "" // forcibly ignore this option
 		switch cons.config.Version {
 		case kafka.V0_8_2_0, kafka.V0_8_2_1, kafka.V0_8_2_2:
@@ -329,18 +428,25 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 
 		cons.groupConfig = cluster.NewConfig()
 		cons.groupConfig.Config = *cons.config
-	}
-
-	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kafkaOffsetNewest))
-	switch offsetValue {
-	case kafkaOffsetNewest:
-		cons.defaultOffset = kafka.OffsetNewest
+		cons.groupConfig.Group.Mode = cluster.ConsumerModePartitions
+		cons.groupConfig.Group.Return.Notifications = true
+		cons.groupConfig.Group.Offsets.Synchronization.DwellTime = time.Duration(conf.GetInt("RebalanceTimeoutMs", 1000)) * time.Millisecond
+		cons.groupConfig.Consumer.Offsets.CommitInterval = time.Duration(conf.GetInt("CommitIntervalMs", 1000)) * time.Millisecond
+		cons.groupConfig.Consumer.Return.Errors = true
+
+		if cons.defaultOffset == kafka.OffsetOldest {
+			cons.groupConfig.Consumer.Offsets.Initial = kafka.OffsetOldest
+		}
 
-	case kafkaOffsetOldest:
-		cons.defaultOffset = kafka.OffsetOldest
+		if topicRegex != "" {
+			whitelist, err := regexp.Compile(topicRegex)
+			if !conf.Errors.Push(err) {
+				cons.groupConfig.Group.Topics.Whitelist = whitelist
+				cons.groupConfig.Metadata.Full = true
+			}
+		}
 
-	default:
-		cons.defaultOffset, _ = strconv.ParseInt(offsetValue, 10, 64)
+		conf.Errors.Push(cons.groupConfig.Validate())
 	}
 
 	if cons.offsetFile != "" {
@@ -369,41 +475,54 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 	kafka.Logger = cons.Logger.WithField("Scope", "Sarama")
 }
 
-func (cons *Kafka) restartGroup() {
-	time.Sleep(cons.persistTimeout)
-	cons.readFromGroup()
-}
-
-// Main fetch loop for kafka events
+// readFromGroup joins the consumer group and reads all partitions assigned
+// to this consumer until the consumer is stopped.
 func (cons *Kafka) readFromGroup() {
-	consumer, err := cluster.NewConsumerFromClient(cons.groupClient, cons.group, []string{cons.topic})
-	if err != nil {
-		defer cons.restartGroup()
-		cons.Logger.Errorf("Restarting kafka consumer (%s:%s) - %s", cons.topic, cons.group, err.Error())
-		return // ### return, stop and retry ###
-	}
-
-	// Make sure we wait for all consumers to end
-	cons.AddWorker()
 	defer func() {
-		if !cons.groupClient.Closed() {
-			consumer.Close()
-		}
+		cons.groupClient.Close()
 		cons.WorkerDone()
 	}()
 
-	// Loop over worker
+	for cons.IsActive() {
+		consumer, err := cluster.NewConsumerFromClient(cons.groupClient, cons.group, cons.topics)
+		if err != nil {
+			cons.Logger.Errorf("Restarting kafka consumer (%v:%s) - %s", cons.topics, cons.group, err.Error())
+			time.Sleep(cons.persistTimeout)
+			continue // ### continue, retry ###
+		}
+
+		cons.consumeGroup(consumer)
+
+		// Closing the consumer waits for all partition readers and commits
+		// the marked offsets before leaving the group.
+		if err := consumer.Close(); err != nil {
+			cons.Logger.WithError(err).Error("Failed to close kafka consumer")
+		}
+	}
+}
+
+// consumeGroup starts a reader for each partition assigned to this consumer.
+// Partitions are revoked by closing their message channel.
+func (cons *Kafka) consumeGroup(consumer *cluster.Consumer) {
 	spin := tsync.NewSpinner(tsync.SpinPriorityLow)
 
-	for !cons.groupClient.Closed() {
+	for cons.IsActive() {
 		select {
-		case event := <-consumer.Messages():
-			cons.enqueueEvent(event)
+		case partCons, isOpen := <-consumer.Partitions():
+			if !isOpen {
+				return // ### return, consumer closed ###
+			}
+			cons.AddWorker()
+			go cons.readFromGroupPartition(consumer, partCons)
+
+		case notification, isOpen := <-consumer.Notifications():
+			if !isOpen {
+				return // ### return, consumer closed ###
+			}
+			cons.logRebalance(notification)
 
 		case err := <-consumer.Errors():
-			defer cons.restartGroup()
 			cons.Logger.Error("Kafka consumer error:", err)
-			return // ### return, try reconnect ###
 
 		default:
 			spin.Yield()
@@ -411,6 +530,32 @@ func (cons *Kafka) readFromGroup() {
 	}
 }
 
+// readFromGroupPartition enqueues the messages of a partition assigned to
+// this consumer. Offsets are marked only after a message has been enqueued.
+func (cons *Kafka) readFromGroupPartition(consumer *cluster.Consumer, partCons cluster.PartitionConsumer) {
+	defer cons.WorkerDone()
+
+	for event := range partCons.Messages() {
+		if !cons.IsActive() {
+			continue // ### continue, drain without marking ###
+		}
+		cons.enqueueEvent(event)
+		consumer.MarkOffset(event, "")
+	}
+}
+
+func (cons *Kafka) logRebalance(notification *cluster.Notification) {
+	switch notification.Type {
+	case cluster.RebalanceOK:
+		cons.Logger.Infof("Rebalanced group %s. Claimed: %v, released: %v, current: %v",
+			cons.group, notification.Claimed, notification.Released, notification.Current)
+	case cluster.RebalanceError:
+		cons.Logger.Warningf("Rebalancing group %s failed. Current: %v", cons.group, notification.Current)
+	default:
+		cons.Logger.Debugf("Rebalancing group %s", cons.group)
+	}
+}
+
 func (cons *Kafka) startConsumerForPartition(partitionID int32) kafka.PartitionConsumer {
 	for !cons.client.Closed() {
 		startOffset := atomic.LoadInt64(cons.offsets[partitionID])
@@ -518,15 +663,26 @@ func (cons *Kafka) readPartitions(partitions []int32) {
 }
 
 func (cons *Kafka) enqueueEvent(event *kafka.ConsumerMessage) {
+	var metaData core.Metadata
 	if cons.hasToSetMetadata {
-		metaData := core.Metadata{}
+		metaData = core.Metadata{}
+		for _, header := range event.Headers {
+			metaData.SetValue(cons.headerPrefix+string(header.Key), header.Value)
+		}
 
 		metaData.SetValue("topic", []byte(event.Topic))
 		metaData.SetValue("key", event.Key)
+		metaData.SetValue("partition", []byte(strconv.FormatInt(int64(event.Partition), 10)))
+		metaData.SetValue("offset", []byte(strconv.FormatInt(event.Offset, 10)))
+		if !event.Timestamp.IsZero() {
+			metaData.SetValue("timestamp", []byte(event.Timestamp.Format(cons.timestampFormat)))
+		}
+	}
 
-		cons.EnqueueWithMetadata(event.Value, metaData)
+	if cons.useRecordTime && !event.Timestamp.IsZero() {
+		cons.EnqueueWithTime(event.Value, metaData, event.Timestamp)
 	} else {
-		cons.SimpleConsumer.Enqueue(event.Value)
+		cons.EnqueueWithMetadata(event.Value, metaData)
 	}
 }
 
@@ -567,6 +723,7 @@ func (cons *Kafka) startAllConsumers() error {
 			return err
 		}
 
+		cons.AddWorker()
 		go cons.readFromGroup()
 		return nil // ### return, group processing ###
 	}
@@ -619,7 +776,11 @@ func (cons *Kafka) Consume(workers *sync.WaitGroup) {
 	}
 
 	defer func() {
-		cons.client.Close()
+		// The group client is closed by readFromGroup after offsets have
+		// been committed.
+		if cons.client != nil {
+			cons.client.Close()
+		}
 		cons.dumpIndex()
 	}()
 
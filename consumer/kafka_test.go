@@ -0,0 +1,49 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	kafka "github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+)
+
+func TestKafkaGroupConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testKafkaTopicsWithoutGroup", "consumer.Kafka")
+	config.Override("Topics", []string{"a", "b"})
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("testKafkaGroupConfig", "consumer.Kafka")
+	config.Override("GroupId", "gollum")
+	config.Override("TopicRegex", "^logs-")
+	config.Override("DefaultOffset", "oldest")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Kafka)
+	expect.True(casted)
+
+	expect.Equal(0, len(cons.topics))
+	expect.True(cons.groupConfig.Metadata.Full)
+	expect.True(cons.groupConfig.Group.Topics.Whitelist.MatchString("logs-web"))
+	expect.Equal(cluster.ConsumerModePartitions, cons.groupConfig.Group.Mode)
+	expect.Equal(kafka.OffsetOldest, cons.groupConfig.Consumer.Offsets.Initial)
+	expect.Equal(kafka.V0_9_0_1, cons.groupConfig.Version)
+}
@@ -0,0 +1,380 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// msgpackMaxLength is the maximum length of a string, binary, array or map
+// accepted by msgpackDecoder. This protects against allocating huge buffers
+// due to corrupted or malicious length fields.
+const msgpackMaxLength = 64 << 20
+
+// msgpackMaxDepth is the maximum nesting depth of arrays and maps accepted by
+// msgpackDecoder. Deeply nested data would otherwise overflow the stack.
+const msgpackMaxDepth = 100
+
+// msgpackExt holds a msgpack extension type
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// msgpackDecoder is a minimal msgpack decoder as required by protocols like
+// fluent forward. Maps are decoded into map[string]interface{}, strings into
+// string and binary data into []byte. Integers are decoded into int64 or
+// uint64, floats into float64.
+type msgpackDecoder struct {
+	reader io.Reader
+	buffer [8]byte
+	depth  int
+}
+
+func newMsgpackDecoder(reader io.Reader) *msgpackDecoder {
+	return &msgpackDecoder{reader: reader}
+}
+
+func (dec *msgpackDecoder) readN(n int) ([]byte, error) {
+	if n <= len(dec.buffer) {
+		_, err := io.ReadFull(dec.reader, dec.buffer[:n])
+		return dec.buffer[:n], err
+	}
+	return nil, fmt.Errorf("msgpack: invalid read size %d", n)
+}
+
+func (dec *msgpackDecoder) readUint(n int) (uint64, error) {
+	data, err := dec.readN(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(data[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(data)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(data)), nil
+	default:
+		return binary.BigEndian.Uint64(data), nil
+	}
+}
+
+func (dec *msgpackDecoder) readBytes(length uint64) ([]byte, error) {
+	if length > msgpackMaxLength {
+		return nil, fmt.Errorf("msgpack: length %d exceeds limit", length)
+	}
+	// Read via LimitReader so that memory grows with the data actually sent
+	data, err := ioutil.ReadAll(io.LimitReader(dec.reader, int64(length)))
+	if err == nil && uint64(len(data)) < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+// Decode reads the next value from the stream
+func (dec *msgpackDecoder) Decode() (interface{}, error) {
+	header, err := dec.readN(1)
+	if err != nil {
+		return nil, err
+	}
+	code := header[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return dec.decodeMap(uint64(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return dec.decodeArray(uint64(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		data, err := dec.readBytes(uint64(code & 0x1f))
+		return string(data), err
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		length, err := dec.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return dec.readBytes(length)
+
+	case 0xc7, 0xc8, 0xc9:
+		length, err := dec.readUint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return dec.decodeExt(length)
+
+	case 0xca:
+		bits, err := dec.readUint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := dec.readUint(8)
+		return math.Float64frombits(bits), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := dec.readUint(1 << (code - 0xcc))
+		if value <= math.MaxInt64 {
+			return int64(value), err
+		}
+		return value, err
+
+	case 0xd0:
+		value, err := dec.readUint(1)
+		return int64(int8(value)), err
+	case 0xd1:
+		value, err := dec.readUint(2)
+		return int64(int16(value)), err
+	case 0xd2:
+		value, err := dec.readUint(4)
+		return int64(int32(value)), err
+	case 0xd3:
+		value, err := dec.readUint(8)
+		return int64(value), err
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return dec.decodeExt(1 << (code - 0xd4))
+
+	case 0xd9, 0xda, 0xdb:
+		length, err := dec.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		data, err := dec.readBytes(length)
+		return string(data), err
+
+	case 0xdc, 0xdd:
+		length, err := dec.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return dec.decodeArray(length)
+
+	case 0xde, 0xdf:
+		length, err := dec.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return dec.decodeMap(length)
+	}
+
+	return nil, fmt.Errorf("msgpack: unknown type code 0x%02x", code)
+}
+
+func (dec *msgpackDecoder) decodeExt(length uint64) (interface{}, error) {
+	extType, err := dec.readUint(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := dec.readBytes(length)
+	return msgpackExt{Type: int8(extType), Data: data}, err
+}
+
+// enter increases the nesting depth and returns an error if the depth limit
+// is exceeded. Each call has to be followed by a call to leave.
+func (dec *msgpackDecoder) enter() error {
+	dec.depth++
+	if dec.depth > msgpackMaxDepth {
+		return fmt.Errorf("msgpack: nesting depth exceeds limit of %d", msgpackMaxDepth)
+	}
+	return nil
+}
+
+func (dec *msgpackDecoder) leave() {
+	dec.depth--
+}
+
+func (dec *msgpackDecoder) decodeArray(length uint64) (interface{}, error) {
+	if length > msgpackMaxLength {
+		return nil, fmt.Errorf("msgpack: array length %d exceeds limit", length)
+	}
+	defer dec.leave()
+	if err := dec.enter(); err != nil {
+		return nil, err
+	}
+	array := make([]interface{}, 0, minUint64(length, 1024))
+	for i := uint64(0); i < length; i++ {
+		value, err := dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
+func (dec *msgpackDecoder) decodeMap(length uint64) (interface{}, error) {
+	if length > msgpackMaxLength {
+		return nil, fmt.Errorf("msgpack: map length %d exceeds limit", length)
+	}
+	defer dec.leave()
+	if err := dec.enter(); err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, minUint64(length, 1024))
+	for i := uint64(0); i < length; i++ {
+		key, err := dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+		value, err := dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+
+		switch typedKey := key.(type) {
+		case string:
+			result[typedKey] = value
+		case []byte:
+			result[string(typedKey)] = value
+		default:
+			result[fmt.Sprintf("%v", typedKey)] = value
+		}
+	}
+	return result, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// msgpackEncode appends the msgpack representation of value to buffer.
+// Supported types are nil, bool, int, int64, uint64, float64, string, []byte,
+// []interface{} and map[string]interface{}. Map keys are written in sorted
+// order.
+func msgpackEncode(buffer *bytes.Buffer, value interface{}) error {
+	switch typedValue := value.(type) {
+	case nil:
+		buffer.WriteByte(0xc0)
+
+	case bool:
+		if typedValue {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+
+	case int:
+		msgpackEncodeInt(buffer, int64(typedValue))
+	case int64:
+		msgpackEncodeInt(buffer, typedValue)
+	case uint64:
+		if typedValue <= math.MaxInt64 {
+			msgpackEncodeInt(buffer, int64(typedValue))
+		} else {
+			buffer.WriteByte(0xcf)
+			binary.Write(buffer, binary.BigEndian, typedValue)
+		}
+
+	case float64:
+		buffer.WriteByte(0xcb)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(typedValue))
+
+	case string:
+		if len(typedValue) <= 31 {
+			buffer.WriteByte(0xa0 | byte(len(typedValue)))
+		} else {
+			msgpackEncodeLength(buffer, len(typedValue), 0xd9, 0xda, 0xdb)
+		}
+		buffer.WriteString(typedValue)
+
+	case []byte:
+		msgpackEncodeLength(buffer, len(typedValue), 0xc4, 0xc5, 0xc6)
+		buffer.Write(typedValue)
+
+	case []interface{}:
+		if len(typedValue) <= 15 {
+			buffer.WriteByte(0x90 | byte(len(typedValue)))
+		} else {
+			msgpackEncodeLength(buffer, len(typedValue), 0, 0xdc, 0xdd)
+		}
+		for _, item := range typedValue {
+			if err := msgpackEncode(buffer, item); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		if len(typedValue) <= 15 {
+			buffer.WriteByte(0x80 | byte(len(typedValue)))
+		} else {
+			msgpackEncodeLength(buffer, len(typedValue), 0, 0xde, 0xdf)
+		}
+		keys := make([]string, 0, len(typedValue))
+		for key := range typedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			msgpackEncode(buffer, key)
+			if err := msgpackEncode(buffer, typedValue[key]); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", value)
+	}
+	return nil
+}
+
+func msgpackEncodeInt(buffer *bytes.Buffer, value int64) {
+	switch {
+	case value >= 0 && value <= 0x7f:
+		buffer.WriteByte(byte(value))
+	case value < 0 && value >= -32:
+		buffer.WriteByte(byte(int8(value)))
+	default:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, value)
+	}
+}
+
+// msgpackEncodeLength writes the type code and length for the smallest of the
+// given 8, 16 or 32 bit length encodings. Pass 0 as code8 for types without an
+// 8 bit variant.
+func msgpackEncodeLength(buffer *bytes.Buffer, length int, code8, code16, code32 byte) {
+	switch {
+	case code8 != 0 && length <= math.MaxUint8:
+		buffer.WriteByte(code8)
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(code16)
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(code32)
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+}
@@ -0,0 +1,567 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	redisModeList   = "list"
+	redisModePubSub = "pubsub"
+	redisModeStream = "stream"
+)
+
+// Redis consumer plugin
+//
+// This consumer reads messages from a redis server. Three modes are supported:
+//
+// "list" pops messages from one or more lists using BLPOP. If a
+// ProcessingList is set, messages are moved from the tail of a single list to
+// the processing list using BRPOPLPUSH and removed from it after they have
+// been enqueued. Messages left in the processing list, e.g. after a crash, are
+// consumed again on startup. Producers should use LPUSH in this case to keep
+// the list in FIFO order.
+//
+// "pubsub" subscribes to channels and channel patterns.
+//
+// "stream" reads from redis streams as a member of a consumer group. Entries
+// are acknowledged via XACK after they have been enqueued. Entries that were
+// delivered to this consumer before but never acknowledged are read again on
+// startup. The group is created if it does not exist.
+//
+// This consumer does not implement support for redis 3.0 cluster.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - key: The list the message was popped from (set in list mode)
+//
+// - channel: The channel the message was published to (set in pubsub mode)
+//
+// - pattern: The pattern that matched the channel (set in pubsub mode, if
+// subscribed via Patterns)
+//
+// - stream: The stream the entry was read from (set in stream mode)
+//
+// - id: The ID of the stream entry (set in stream mode)
+//
+// Parameters
+//
+// - Address: Stores the identifier to connect to.
+// This can either be any ip address and port like "localhost:6379" or a file
+// like "unix:///var/redis.socket".
+// By default this parameter is set to ":6379".
+//
+// - Password: Defines the password used to authenticate at the server.
+// By default this parameter is set to "".
+//
+// - Database: Defines the redis database to connect to.
+// By default this parameter is set to "0".
+//
+// - Mode: Defines how messages are read. Valid values are "list", "pubsub"
+// and "stream".
+// By default this parameter is set to "list".
+//
+// - Keys: Defines the lists to read from in "list" mode. Only one list may be
+// given if ProcessingList is set.
+// By default this parameter is set to "default".
+//
+// - ProcessingList: Defines the list messages are moved to while they are
+// being processed in "list" mode. If set to an empty string, messages are
+// removed from the list as soon as they are read.
+// By default this parameter is set to "".
+//
+// - Channels: Defines the channels to subscribe to in "pubsub" mode.
+// By default this parameter is set to an empty list.
+//
+// - Patterns: Defines the channel patterns to subscribe to in "pubsub" mode.
+// By default this parameter is set to an empty list.
+//
+// - StreamKeys: Defines the streams to read from in "stream" mode.
+// By default this parameter is set to an empty list.
+//
+// - Group: Defines the consumer group used in "stream" mode.
+// By default this parameter is set to "gollum".
+//
+// - ConsumerName: Defines the name of this consumer inside the consumer group.
+// If set to an empty string the hostname is used.
+// By default this parameter is set to "".
+//
+// - StartID: Defines the ID the consumer group starts reading from if the
+// group has to be created. Use "0" to read the whole stream and "$" to read
+// new entries only.
+// By default this parameter is set to "$".
+//
+// - PayloadField: Defines the field of a stream entry used as payload. If an
+// entry does not contain this field, all fields are encoded as JSON object.
+// By default this parameter is set to "message".
+//
+// - BatchSize: Defines the maximum number of stream entries read at once.
+// By default this parameter is set to "100".
+//
+// - PollTimeoutSec: Defines the number of seconds a blocking read waits for
+// data. This setting affects the maximum shutdown duration of this consumer.
+// By default this parameter is set to "1".
+//
+// - RetryDelayMs: Defines the number of milliseconds to wait after a failed
+// request before retrying.
+// By default this parameter is set to "1000".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the metadata
+// section will be added to each message. Adding metadata will have a
+// performance impact on systems with high throughput.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example reads from the list "jobs" using a processing list:
+//
+//  RedisIn:
+//    Type: consumer.Redis
+//    Streams: jobs
+//    Address: "localhost:6379"
+//    Keys:
+//      - jobs
+//    ProcessingList: jobs:processing
+//
+// This example reads from a redis stream as member of the group "gollum":
+//
+//  RedisStreamIn:
+//    Type: consumer.Redis
+//    Streams: events
+//    Mode: stream
+//    StreamKeys:
+//      - events
+//    Group: gollum
+//    SetMetadata: true
+//
+type Redis struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	address             string
+	protocol            string
+	password            string        `config:"Password"`
+	database            int           `config:"Database" default:"0"`
+	mode                string        `config:"Mode" default:"list"`
+	keys                []string      `config:"Keys" default:"default"`
+	processingList      string        `config:"ProcessingList"`
+	channels            []string      `config:"Channels"`
+	patterns            []string      `config:"Patterns"`
+	streams             []string      `config:"StreamKeys"`
+	group               string        `config:"Group" default:"gollum"`
+	consumerName        string        `config:"ConsumerName"`
+	startID             string        `config:"StartID" default:"$"`
+	payloadField        string        `config:"PayloadField" default:"message"`
+	batchSize           int           `config:"BatchSize" default:"100"`
+	pollTimeout         time.Duration `config:"PollTimeoutSec" default:"1" metric:"sec"`
+	retryDelay          time.Duration `config:"RetryDelayMs" default:"1000" metric:"ms"`
+	hasToSetMetadata    bool          `config:"SetMetadata" default:"false"`
+	client              *redis.Client
+}
+
+// redisStreamEntry holds a single entry read from a redis stream
+type redisStreamEntry struct {
+	stream string
+	id     string
+	fields map[string]string
+}
+
+func init() {
+	core.TypeRegistry.Register(Redis{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Redis) Configure(conf core.PluginConfigReader) {
+	cons.protocol, cons.address = tnet.ParseAddress(conf.GetString("Address", ":6379"), "tcp")
+	cons.mode = strings.ToLower(cons.mode)
+
+	switch cons.mode {
+	case redisModeList:
+		if cons.processingList != "" && len(cons.keys) != 1 {
+			conf.Errors.Pushf("Exactly one key must be set when using a ProcessingList")
+		}
+
+	case redisModePubSub:
+		if len(cons.channels) == 0 && len(cons.patterns) == 0 {
+			conf.Errors.Pushf("Channels or Patterns must be set in pubsub mode")
+		}
+
+	case redisModeStream:
+		if len(cons.streams) == 0 {
+			conf.Errors.Pushf("StreamKeys must be set in stream mode")
+		}
+		if cons.consumerName == "" {
+			hostname, err := os.Hostname()
+			conf.Errors.Push(err)
+			cons.consumerName = hostname
+		}
+		if cons.batchSize < 1 {
+			cons.batchSize = 1
+		}
+
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", cons.mode)
+	}
+}
+
+// isTimeout returns true if the given error is the result of a blocking
+// command running into its timeout.
+func (cons *Redis) isTimeout(err error) bool {
+	if err == redis.Nil {
+		return true
+	}
+	netErr, isNetErr := err.(net.Error)
+	return isNetErr && netErr.Timeout()
+}
+
+func (cons *Redis) retryAfter(err error, format string, args ...interface{}) {
+	cons.Logger.WithError(err).Errorf(format, args...)
+	time.Sleep(cons.retryDelay)
+}
+
+func (cons *Redis) enqueue(data string, keyValues ...string) {
+	if !cons.hasToSetMetadata {
+		cons.Enqueue([]byte(data))
+		return
+	}
+
+	metadata := core.Metadata{}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if keyValues[i+1] != "" {
+			metadata.SetValue(keyValues[i], []byte(keyValues[i+1]))
+		}
+	}
+	cons.EnqueueWithMetadata([]byte(data), metadata)
+}
+
+// readList pops messages from the configured lists via BLPOP
+func (cons *Redis) readList() {
+
+	for cons.IsActive() {
+		result, err := cons.client.BLPop(cons.pollTimeout, cons.keys...).Result()
+		if err != nil {
+			if !cons.isTimeout(err) {
+				cons.retryAfter(err, "Failed to pop from %v", cons.keys)
+			}
+			continue // ### continue, retry ###
+		}
+
+		// BLPOP returns the key followed by the value
+		cons.enqueue(result[1], "key", result[0])
+	}
+}
+
+// ackFromProcessingList removes a message from the processing list once it
+// has been enqueued.
+func (cons *Redis) ackFromProcessingList(value string) {
+	if err := cons.client.LRem(cons.processingList, -1, value).Err(); err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to remove message from %s", cons.processingList)
+	}
+}
+
+// recoverProcessingList enqueues all messages left in the processing list
+// from a previous run.
+func (cons *Redis) recoverProcessingList() {
+	for cons.IsActive() {
+		pending, err := cons.client.LRange(cons.processingList, 0, -1).Result()
+		if err != nil {
+			cons.retryAfter(err, "Failed to read processing list %s", cons.processingList)
+			continue // ### continue, retry ###
+		}
+
+		if len(pending) > 0 {
+			cons.Logger.Infof("Recovering %d messages from %s", len(pending), cons.processingList)
+		}
+
+		// The processing list is filled from the head, so the oldest entries
+		// are at the tail.
+		for i := len(pending) - 1; i >= 0 && cons.IsActive(); i-- {
+			cons.enqueue(pending[i], "key", cons.keys[0])
+			cons.ackFromProcessingList(pending[i])
+		}
+		return
+	}
+}
+
+// readProcessingList moves messages to the processing list via BRPOPLPUSH
+// and removes them after they have been enqueued.
+func (cons *Redis) readProcessingList() {
+	cons.recoverProcessingList()
+
+	for cons.IsActive() {
+		value, err := cons.client.BRPopLPush(cons.keys[0], cons.processingList, cons.pollTimeout).Result()
+		if err != nil {
+			if !cons.isTimeout(err) {
+				cons.retryAfter(err, "Failed to pop from %s", cons.keys[0])
+			}
+			continue // ### continue, retry ###
+		}
+
+		cons.enqueue(value, "key", cons.keys[0])
+		cons.ackFromProcessingList(value)
+	}
+}
+
+// readPubSub receives messages from the configured channels and patterns
+func (cons *Redis) readPubSub() {
+
+	pubsub := cons.client.Subscribe()
+	defer pubsub.Close()
+
+	// Redis rejects SUBSCRIBE and PSUBSCRIBE without arguments
+	for cons.IsActive() {
+		var err error
+		if len(cons.channels) > 0 {
+			err = pubsub.Subscribe(cons.channels...)
+		}
+		if err == nil && len(cons.patterns) > 0 {
+			err = pubsub.PSubscribe(cons.patterns...)
+		}
+		if err == nil {
+			break
+		}
+		cons.retryAfter(err, "Failed to subscribe")
+	}
+
+	for cons.IsActive() {
+		reply, err := pubsub.ReceiveTimeout(cons.pollTimeout)
+		if err != nil {
+			if !cons.isTimeout(err) {
+				// pubsub reconnects and resubscribes on the next receive
+				cons.retryAfter(err, "Failed to receive from subscription")
+			}
+			continue // ### continue, retry ###
+		}
+
+		if msg, isMessage := reply.(*redis.Message); isMessage {
+			cons.enqueue(msg.Payload, "channel", msg.Channel, "pattern", msg.Pattern)
+		}
+	}
+}
+
+// parseRedisStreamReply converts the reply of XREADGROUP into a list of
+// entries. The reply is structured as [[stream, [[id, [field, value, ...]]]]].
+func parseRedisStreamReply(reply interface{}) ([]redisStreamEntry, error) {
+	if reply == nil {
+		return nil, nil // timeout
+	}
+
+	streams, isArray := reply.([]interface{})
+	if !isArray {
+		return nil, fmt.Errorf("unexpected reply type %T", reply)
+	}
+
+	entries := []redisStreamEntry{}
+	for _, streamReply := range streams {
+		stream, isArray := streamReply.([]interface{})
+		if !isArray || len(stream) != 2 {
+			return nil, fmt.Errorf("unexpected stream reply %v", streamReply)
+		}
+		streamName, _ := stream[0].(string)
+		streamEntries, isArray := stream[1].([]interface{})
+		if !isArray {
+			return nil, fmt.Errorf("unexpected entries of stream %s", streamName)
+		}
+
+		for _, entryReply := range streamEntries {
+			entry, isArray := entryReply.([]interface{})
+			if !isArray || len(entry) != 2 {
+				return nil, fmt.Errorf("unexpected entry in stream %s", streamName)
+			}
+
+			id, _ := entry[0].(string)
+			parsed := redisStreamEntry{
+				stream: streamName,
+				id:     id,
+				fields: make(map[string]string),
+			}
+
+			// Entries that were deleted while pending have no fields
+			if fields, isArray := entry[1].([]interface{}); isArray {
+				for i := 0; i+1 < len(fields); i += 2 {
+					key, _ := fields[i].(string)
+					value, _ := fields[i+1].(string)
+					parsed.fields[key] = value
+				}
+			}
+			entries = append(entries, parsed)
+		}
+	}
+	return entries, nil
+}
+
+// getStreamPayload returns the payload of a stream entry
+func (cons *Redis) getStreamPayload(entry redisStreamEntry) string {
+	if payload, exists := entry.fields[cons.payloadField]; exists {
+		return payload
+	}
+	encoded, _ := json.Marshal(entry.fields)
+	return string(encoded)
+}
+
+// createGroup creates the consumer group for all streams. Existing groups
+// are left untouched.
+func (cons *Redis) createGroup() {
+	for _, stream := range cons.streams {
+		for cons.IsActive() {
+			err := cons.client.Process(redis.NewStatusCmd("XGROUP", "CREATE", stream, cons.group, cons.startID, "MKSTREAM"))
+			if err == nil || strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				break
+			}
+			cons.retryAfter(err, "Failed to create group %s for stream %s", cons.group, stream)
+		}
+	}
+}
+
+// readGroup reads entries via XREADGROUP. Passing "0" as ID returns entries
+// that have been delivered to this consumer but were not acknowledged, ">"
+// returns new entries.
+func (cons *Redis) readGroup(id string, block bool) ([]redisStreamEntry, error) {
+	args := []interface{}{"XREADGROUP", "GROUP", cons.group, cons.consumerName, "COUNT", cons.batchSize}
+	if block {
+		args = append(args, "BLOCK", int64(cons.pollTimeout/time.Millisecond))
+	}
+	args = append(args, "STREAMS")
+	for _, stream := range cons.streams {
+		args = append(args, stream)
+	}
+	for range cons.streams {
+		args = append(args, id)
+	}
+
+	cmd := redis.NewCmd(args...)
+	if err := cons.client.Process(cmd); err != nil {
+		if err == redis.Nil {
+			return nil, nil // ### return, timeout ###
+		}
+		return nil, err
+	}
+	return parseRedisStreamReply(cmd.Val())
+}
+
+// enqueueStreamEntries enqueues the given entries and acknowledges them
+func (cons *Redis) enqueueStreamEntries(entries []redisStreamEntry) {
+	for _, entry := range entries {
+		if !cons.IsActive() {
+			return // ### return, do not ack ###
+		}
+
+		if len(entry.fields) > 0 {
+			cons.enqueue(cons.getStreamPayload(entry), "stream", entry.stream, "id", entry.id)
+		}
+		cons.ackStreamEntry(entry)
+	}
+}
+
+// ackStreamEntry acknowledges the given entry. Failed acknowledgements are
+// retried as unacknowledged entries would be enqueued again when reading the
+// pending entries. If the consumer stops before the acknowledgement
+// succeeded, the entry is enqueued again after a restart.
+func (cons *Redis) ackStreamEntry(entry redisStreamEntry) {
+	for cons.IsActive() {
+		err := cons.client.Process(redis.NewIntCmd("XACK", entry.stream, cons.group, entry.id))
+		if err == nil {
+			return // ### return, acknowledged ###
+		}
+		cons.retryAfter(err, "Failed to acknowledge %s in stream %s", entry.id, entry.stream)
+	}
+}
+
+// readStream reads from the configured streams as member of a consumer group
+func (cons *Redis) readStream() {
+	cons.createGroup()
+
+	// Process entries that were delivered before but never acknowledged.
+	// Pending entries are returned until all of them have been acknowledged.
+	for cons.IsActive() {
+		entries, err := cons.readGroup("0", false)
+		if err != nil {
+			cons.retryAfter(err, "Failed to read pending entries of group %s", cons.group)
+			continue // ### continue, retry ###
+		}
+		if len(entries) == 0 {
+			break
+		}
+		cons.enqueueStreamEntries(entries)
+	}
+
+	for cons.IsActive() {
+		entries, err := cons.readGroup(">", true)
+		if err != nil {
+			if !cons.isTimeout(err) {
+				cons.retryAfter(err, "Failed to read from group %s", cons.group)
+			}
+			continue // ### continue, retry ###
+		}
+		cons.enqueueStreamEntries(entries)
+	}
+}
+
+func (cons *Redis) read() {
+	defer func() {
+		cons.close()
+		cons.WorkerDone()
+	}()
+
+	switch {
+	case cons.mode == redisModePubSub:
+		cons.readPubSub()
+	case cons.mode == redisModeStream:
+		cons.readStream()
+	case cons.processingList != "":
+		cons.readProcessingList()
+	default:
+		cons.readList()
+	}
+}
+
+func (cons *Redis) close() {
+	if err := cons.client.Close(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to close connection")
+	}
+}
+
+// Consume reads from the configured redis server.
+func (cons *Redis) Consume(workers *sync.WaitGroup) {
+	cons.client = redis.NewClient(&redis.Options{
+		Addr:     cons.address,
+		Network:  cons.protocol,
+		Password: cons.password,
+		DB:       cons.database,
+		// Blocking stream reads do not adjust the read timeout themselves
+		ReadTimeout: cons.pollTimeout + 3*time.Second,
+	})
+
+	if err := cons.client.Ping().Err(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to connect to ", cons.address)
+	}
+
+	cons.AddMainWorker(workers)
+	go tgo.WithRecoverShutdown(cons.read)
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,76 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+)
+
+func TestParseRedisStreamReply(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	reply := []interface{}{
+		[]interface{}{"events", []interface{}{
+			[]interface{}{"1-0", []interface{}{"message", "hello", "host", "a"}},
+			[]interface{}{"1-1", nil},
+		}},
+		[]interface{}{"audit", []interface{}{
+			[]interface{}{"2-0", []interface{}{"user", "b"}},
+		}},
+	}
+
+	entries, err := parseRedisStreamReply(reply)
+	expect.NoError(err)
+	expect.Equal(3, len(entries))
+	expect.Equal("events", entries[0].stream)
+	expect.Equal("1-0", entries[0].id)
+	expect.Equal("hello", entries[0].fields["message"])
+	expect.Equal(0, len(entries[1].fields))
+	expect.Equal("audit", entries[2].stream)
+
+	entries, err = parseRedisStreamReply(nil)
+	expect.NoError(err)
+	expect.Equal(0, len(entries))
+
+	_, err = parseRedisStreamReply([]interface{}{"events"})
+	expect.NotNil(err)
+}
+
+func TestRedisStreamPayload(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testRedisStreamPayload", "consumer.Redis")
+	config.Override("Mode", "stream")
+	config.Override("StreamKeys", []string{"events"})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Redis)
+	expect.True(casted)
+
+	entry := redisStreamEntry{fields: map[string]string{"message": "hello", "host": "a"}}
+	expect.Equal("hello", cons.getStreamPayload(entry))
+
+	entry = redisStreamEntry{fields: map[string]string{"user": "b"}}
+	expect.Equal(`{"user":"b"}`, cons.getStreamPayload(entry))
+
+	config = core.NewPluginConfig("testRedisListConfig", "consumer.Redis")
+	config.Override("Keys", []string{"a", "b"})
+	config.Override("ProcessingList", "processing")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -15,6 +15,7 @@
 package consumer
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/tio"
 	"github.com/trivago/tgo/tnet"
@@ -39,6 +41,11 @@ const (
 // socket. Messages are separated from the stream by using a specific partitioner
 // method.
 //
+// TCP and unix domain sockets can be secured with TLS by setting Certificate
+// and PrivateKey. Client certificates are verified if ClientCA is set.
+// Certificates are reloaded when the consumer receives a roll command (e.g.
+// SIGHUP) without closing the listener.
+//
 // Parameters
 //
 // - Address: This value defines the protocol, host and port or socket to bind to.
@@ -92,6 +99,10 @@ const (
 // to be received. This setting affects the maximum shutdown duration of this consumer.
 // By default this parameter is set to "2".
 //
+// - HandshakeTimeoutSec: Defines the maximum number of seconds a client may
+// take to complete the TLS handshake before the connection is closed.
+// By default this parameter is set to "10".
+//
 // - RemoveOldSocket: If set to true, any existing file with the same name as the
 // socket (unix://<path>) is removed prior to connecting.
 // By default this parameter is set to "true".
@@ -107,17 +118,29 @@ const (
 //    Partitioner: fixed
 //    Size: 256
 //
+// This example accepts TLS connections from clients with a certificate signed
+// by a given CA:
+//
+//  socketIn:
+//    Type: consumer.Socket
+//    Address: tcp://0.0.0.0:5881
+//    Certificate: /etc/gollum/server.crt
+//    PrivateKey: /etc/gollum/server.key
+//    ClientCA: /etc/gollum/clients-ca.pem
+//
 type Socket struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
-
-	acknowledge   string        `config:"Acknowledge" default:""`
-	delimiter     string        `config:"Delimiter" default:"\n"`
-	reconnectTime time.Duration `config:"ReconnectAfterSec" default:"2" metric:"sec"`
-	ackTimeout    time.Duration `config:"AckTimeoutSec" default:"1" metric:"sec"`
-	readTimeout   time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
-	fileFlags     os.FileMode   `config:"Permissions" default:"0770"`
-	clearSocket   bool          `config:"RemoveOldSocket" default:"true"`
-	offset        int           `config:"Offset" default:"0"`
+	TLS                 components.TLSServerConfig `gollumdoc:"embed_type"`
+
+	acknowledge      string        `config:"Acknowledge" default:""`
+	delimiter        string        `config:"Delimiter" default:"\n"`
+	reconnectTime    time.Duration `config:"ReconnectAfterSec" default:"2" metric:"sec"`
+	ackTimeout       time.Duration `config:"AckTimeoutSec" default:"1" metric:"sec"`
+	readTimeout      time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
+	handshakeTimeout time.Duration `config:"HandshakeTimeoutSec" default:"10" metric:"sec"`
+	fileFlags        os.FileMode   `config:"Permissions" default:"0770"`
+	clearSocket      bool          `config:"RemoveOldSocket" default:"true"`
+	offset           int           `config:"Offset" default:"0"`
 
 	listener io.Closer
 	protocol string
@@ -137,35 +160,46 @@ func (cons *Socket) Configure(conf core.PluginConfigReader) {
 
 	address := conf.GetString("Address", "tcp://0.0.0.0:5880")
 	cons.protocol, cons.address = tnet.ParseAddress(address, "tcp")
-	cons.flags = 0
+	cons.flags, cons.offset = configurePartitioner(conf, cons.offset)
+
+	if cons.TLS.IsEnabled() && cons.protocol == "udp" {
+		conf.Errors.Pushf("UDP sockets do not support TLS.")
+	}
+}
+
+// configurePartitioner reads the Partitioner and Size parameters and returns
+// the matching flags for tio.BufferedReader. For the "fixed" partitioner the
+// message size is returned instead of the given offset.
+func configurePartitioner(conf core.PluginConfigReader, offset int) (tio.BufferedReaderFlags, int) {
+	flags := tio.BufferedReaderFlags(0)
 
 	partitioner := conf.GetString("Partitioner", "delimiter")
 	switch strings.ToLower(partitioner) {
 	case "binary_be":
-		cons.flags |= tio.BufferedReaderFlagBigEndian
+		flags |= tio.BufferedReaderFlagBigEndian
 		fallthrough
 
 	case "binary", "binary_le":
-		cons.flags |= tio.BufferedReaderFlagEverything
+		flags |= tio.BufferedReaderFlagEverything
 		switch conf.GetInt("Size", 4) {
 		case 1:
-			cons.flags |= tio.BufferedReaderFlagMLE8
+			flags |= tio.BufferedReaderFlagMLE8
 		case 2:
-			cons.flags |= tio.BufferedReaderFlagMLE16
+			flags |= tio.BufferedReaderFlagMLE16
 		case 4:
-			cons.flags |= tio.BufferedReaderFlagMLE32
+			flags |= tio.BufferedReaderFlagMLE32
 		case 8:
-			cons.flags |= tio.BufferedReaderFlagMLE64
+			flags |= tio.BufferedReaderFlagMLE64
 		default:
 			conf.Errors.Pushf("Size only supports the value 1,2,4 and 8")
 		}
 
 	case "fixed":
-		cons.flags |= tio.BufferedReaderFlagMLEFixed
-		cons.offset = int(conf.GetInt("Size", 1))
+		flags |= tio.BufferedReaderFlagMLEFixed
+		offset = int(conf.GetInt("Size", 1))
 
 	case "ascii":
-		cons.flags |= tio.BufferedReaderFlagMLE
+		flags |= tio.BufferedReaderFlagMLE
 
 	case "delimiter":
 		// Nothing to add
@@ -173,6 +207,19 @@ func (cons *Socket) Configure(conf core.PluginConfigReader) {
 	default:
 		conf.Errors.Pushf("Unknown partitioner: %s", partitioner)
 	}
+
+	return flags, offset
+}
+
+// onRoll reloads the TLS certificates if TLS is enabled
+func (cons *Socket) onRoll() {
+	if err := cons.TLS.Reload(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to reload certificates, keeping the previous ones")
+		return
+	}
+	if cons.TLS.IsEnabled() {
+		cons.Logger.Info("Reloaded certificates")
+	}
 }
 
 func (cons *Socket) listenUDP() {
@@ -228,6 +275,7 @@ func (cons *Socket) listen() {
 			}
 
 			if err == nil {
+				socket = cons.TLS.NewListener(socket)
 				cons.listener = socket
 				forceClose = new(bool) // new trigger for all clients from this listener
 				cons.Logger.Debugf("Listening to %s", cons.address)
@@ -266,6 +314,18 @@ func (cons *Socket) readFromClientConnection(conn net.Conn, forceClose *bool) {
 		cons.Logger.Debugf("Closed client connection to %s on %s", conn.RemoteAddr(), cons.address)
 		cons.WorkerDone()
 	}()
+
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		// Handshake now so that failed handshakes close the connection instead
+		// of being reported by each read.
+		tlsConn.SetDeadline(time.Now().Add(cons.handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			cons.Logger.WithError(err).Warningf("TLS handshake with %s failed", conn.RemoteAddr())
+			return // ### return, handshake failed ###
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
 	cons.readFromConnection(conn, forceClose)
 }
 
@@ -352,6 +412,7 @@ func (cons *Socket) tryRemoveUnixSocket() {
 
 // Consume listens to a given socket.
 func (cons *Socket) Consume(workers *sync.WaitGroup) {
+	cons.SetRollCallback(cons.onRoll)
 	cons.AddMainWorker(workers)
 	defer cons.closeListener()
 
@@ -0,0 +1,502 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tnet"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status codes sent by the Splunk HTTP event collector
+// See http://docs.splunk.com/Documentation/Splunk/latest/Data/TroubleshootHTTPEventCollector
+const (
+	splunkHECSuccess       = 0
+	splunkHECTokenRequired = 2
+	splunkHECInvalidAuth   = 3
+	splunkHECInvalidToken  = 4
+	splunkHECNoData        = 5
+	splunkHECInvalidFormat = 6
+	splunkHECEventRequired = 12
+	splunkHECEventBlank    = 13
+	splunkHECHealthy       = 17
+	splunkHECInvalidPath   = 404
+	splunkHECChannelHeader = "X-Splunk-Request-Channel"
+	splunkHECAuthScheme    = "Splunk "
+)
+
+var errSplunkHECTooLarge = errors.New("request body too large")
+
+// splunkHECBodyTooLargeError is the message of the error returned by
+// http.MaxBytesReader when the limit is exceeded
+const splunkHECBodyTooLargeError = "http: request body too large"
+
+// SplunkHEC consumer plugin
+//
+// This consumer implements the Splunk HTTP event collector (HEC) API so that
+// Splunk forwarders and logging libraries can send data to gollum.
+//
+// The endpoints "/services/collector/event" (and "/services/collector") and
+// "/services/collector/raw" are supported. Each event sent to the event
+// endpoint and each line sent to the raw endpoint is enqueued as a message.
+// Events given as a JSON string are enqueued as string, all other events are
+// enqueued as JSON. If an event contains a "time" field, this time is used as
+// the creation time of the message. Gzip compressed requests are supported.
+//
+// Requests sending a channel, i.e. an "X-Splunk-Request-Channel" header or a
+// "channel" query parameter, receive an "ackId". As messages are enqueued
+// before a response is sent, "/services/collector/ack" reports all ids as
+// acknowledged. The endpoint "/services/collector/health" reports the
+// consumer as healthy.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - host: The host of the event
+//
+// - source: The source of the event
+//
+// - sourcetype: The sourcetype of the event
+//
+// - index: The index of the event
+//
+// - channel: The channel of the request if given
+//
+// Indexed fields sent via "fields" are added to the metadata by their name.
+// For the raw endpoint, host, source, sourcetype and index are read from the
+// query parameters of the same name.
+//
+// Parameters
+//
+// - Address: Defines the TCP port and optional IP address to listen on.
+// By default this parameter is set to ":8088".
+//
+// - Tokens: Defines a list of tokens accepted in the "Authorization: Splunk
+// <token>" header. When empty, requests are not authenticated.
+// By default this parameter is set to an empty list.
+//
+// - ReadTimeoutSec: Defines the maximum duration in seconds before timing out
+// the HTTP read request.
+// By default this parameter is set to "10".
+//
+// - MaxRequestSizeKB: Defines the maximum size of a request body in
+// kilobytes. For compressed requests this limit applies to the compressed
+// and to the decompressed body. Larger requests are rejected.
+// By default this parameter is set to "10240".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in the
+// metadata section will be added to each message.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example accepts events from Splunk forwarders using the token
+// "00000000-0000-0000-0000-000000000000":
+//
+//  SplunkIn:
+//    Type: consumer.SplunkHEC
+//    Streams: splunk
+//    Address: ":8088"
+//    Certificate: /etc/gollum/server.crt
+//    PrivateKey: /etc/gollum/server.key
+//    Tokens:
+//      - "00000000-0000-0000-0000-000000000000"
+//    SetMetadata: true
+//
+type SplunkHEC struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	TLS                 components.TLSServerConfig `gollumdoc:"embed_type"`
+	address             string                     `config:"Address" default:":8088"`
+	tokens              []string                   `config:"Tokens"`
+	readTimeout         time.Duration              `config:"ReadTimeoutSec" default:"10" metric:"sec"`
+	maxRequestSize      int64                      `config:"MaxRequestSizeKB" default:"10240" metric:"kb"`
+	hasToSetMetadata    bool                       `config:"SetMetadata" default:"false"`
+	lastAckID           *int64
+	listen              *tnet.StopListener
+}
+
+// splunkHECEvent is an event sent to the event endpoint
+type splunkHECEvent struct {
+	Time       json.RawMessage        `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      json.RawMessage        `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// splunkHECResponse is the body of all responses
+type splunkHECResponse struct {
+	Text               string `json:"text"`
+	Code               int    `json:"code"`
+	InvalidEventNumber *int   `json:"invalid-event-number,omitempty"`
+	AckID              *int64 `json:"ackId,omitempty"`
+}
+
+// splunkHECEntry is a message parsed from a request
+type splunkHECEntry struct {
+	data      []byte
+	metadata  core.Metadata
+	timestamp time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(SplunkHEC{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *SplunkHEC) Configure(conf core.PluginConfigReader) {
+	cons.lastAckID = new(int64)
+}
+
+// isValidToken returns true if the request sends an accepted token
+func (cons *SplunkHEC) isValidToken(token string) bool {
+	for _, validToken := range cons.tokens {
+		if token == validToken {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the token of a request. A response is returned if the
+// request is not authorized.
+func (cons *SplunkHEC) authenticate(req *http.Request) (int, *splunkHECResponse) {
+	if len(cons.tokens) == 0 {
+		return http.StatusOK, nil // ### return, no authentication ###
+	}
+
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return http.StatusUnauthorized, &splunkHECResponse{Text: "Token is required", Code: splunkHECTokenRequired}
+	}
+
+	if !strings.HasPrefix(header, splunkHECAuthScheme) {
+		return http.StatusUnauthorized, &splunkHECResponse{Text: "Invalid authorization", Code: splunkHECInvalidAuth}
+	}
+
+	if !cons.isValidToken(strings.TrimSpace(header[len(splunkHECAuthScheme):])) {
+		return http.StatusForbidden, &splunkHECResponse{Text: "Invalid token", Code: splunkHECInvalidToken}
+	}
+	return http.StatusOK, nil
+}
+
+// parseSplunkHECTime parses the time of an event given as number or string of
+// seconds since epoch.
+func parseSplunkHECTime(raw json.RawMessage) (time.Time, bool) {
+	value := strings.Trim(string(raw), "\" ")
+	if value == "" || value == "null" {
+		return time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)).Round(time.Microsecond), true
+}
+
+// setSplunkHECMetadata sets the given metadata value if it is not empty
+func setSplunkHECMetadata(metadata core.Metadata, key, value string) {
+	if value != "" {
+		metadata.SetValue(key, []byte(value))
+	}
+}
+
+// parseEvents parses the concatenated JSON events sent to the event endpoint.
+// If an event is invalid, no entries and an error response are returned.
+func (cons *SplunkHEC) parseEvents(body []byte, channel string) ([]splunkHECEntry, *splunkHECResponse) {
+	entries := []splunkHECEntry{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+
+	for index := 0; ; index++ {
+		event := splunkHECEvent{}
+		if err := decoder.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &splunkHECResponse{Text: "Invalid data format", Code: splunkHECInvalidFormat, InvalidEventNumber: &index}
+		}
+
+		entry := splunkHECEntry{timestamp: time.Now()}
+		switch {
+		case len(event.Event) == 0 || string(event.Event) == "null":
+			return nil, &splunkHECResponse{Text: "Event field is required", Code: splunkHECEventRequired, InvalidEventNumber: &index}
+
+		case event.Event[0] == '"':
+			var text string
+			if err := json.Unmarshal(event.Event, &text); err != nil {
+				return nil, &splunkHECResponse{Text: "Invalid data format", Code: splunkHECInvalidFormat, InvalidEventNumber: &index}
+			}
+			if text == "" {
+				return nil, &splunkHECResponse{Text: "Event field cannot be blank", Code: splunkHECEventBlank, InvalidEventNumber: &index}
+			}
+			entry.data = []byte(text)
+
+		default:
+			entry.data = []byte(event.Event)
+		}
+
+		if timestamp, hasTime := parseSplunkHECTime(event.Time); hasTime {
+			entry.timestamp = timestamp
+		}
+
+		if cons.hasToSetMetadata {
+			entry.metadata = core.Metadata{}
+			setSplunkHECMetadata(entry.metadata, "host", event.Host)
+			setSplunkHECMetadata(entry.metadata, "source", event.Source)
+			setSplunkHECMetadata(entry.metadata, "sourcetype", event.SourceType)
+			setSplunkHECMetadata(entry.metadata, "index", event.Index)
+			setSplunkHECMetadata(entry.metadata, "channel", channel)
+
+			for key, value := range event.Fields {
+				if text, isString := value.(string); isString {
+					setSplunkHECMetadata(entry.metadata, key, text)
+				} else if data, err := json.Marshal(value); err == nil {
+					entry.metadata.SetValue(key, data)
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return nil, &splunkHECResponse{Text: "No data", Code: splunkHECNoData}
+	}
+	return entries, nil
+}
+
+// parseRaw splits the data sent to the raw endpoint into lines
+func (cons *SplunkHEC) parseRaw(body []byte, req *http.Request, channel string) ([]splunkHECEntry, *splunkHECResponse) {
+	var metadata core.Metadata
+	if cons.hasToSetMetadata {
+		metadata = core.Metadata{}
+		query := req.URL.Query()
+		for _, key := range []string{"host", "source", "sourcetype", "index"} {
+			setSplunkHECMetadata(metadata, key, query.Get(key))
+		}
+		setSplunkHECMetadata(metadata, "channel", channel)
+	}
+
+	entries := []splunkHECEntry{}
+	now := time.Now()
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		entry := splunkHECEntry{data: line, timestamp: now}
+		if metadata != nil {
+			entry.metadata = metadata.Clone()
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return nil, &splunkHECResponse{Text: "No data", Code: splunkHECNoData}
+	}
+	return entries, nil
+}
+
+// readSplunkHECBody returns the (decompressed) body of the given request.
+// errSplunkHECTooLarge is returned if the body exceeds maxSize bytes.
+func readSplunkHECBody(resp http.ResponseWriter, req *http.Request, maxSize int64) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+
+	body := http.MaxBytesReader(resp, req.Body, maxSize)
+	var reader io.Reader = body
+	if strings.Contains(req.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			if isSplunkHECBodyTooLarge(err) {
+				return nil, errSplunkHECTooLarge
+			}
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	// Read one byte more than allowed to detect oversized decompressed data
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	switch {
+	case err != nil && isSplunkHECBodyTooLarge(err):
+		return nil, errSplunkHECTooLarge
+	case err != nil:
+		return nil, err
+	case int64(len(data)) > maxSize:
+		return nil, errSplunkHECTooLarge
+	}
+	return data, nil
+}
+
+// isSplunkHECBodyTooLarge returns true if err was caused by the request
+// body exceeding the limit set by http.MaxBytesReader. The error is compared
+// by its message as http.MaxBytesError is not available before Go 1.19.
+func isSplunkHECBodyTooLarge(err error) bool {
+	return err.Error() == splunkHECBodyTooLargeError
+}
+
+// getSplunkHECAckIDs returns the ids of an ack request
+func getSplunkHECAckIDs(body []byte) ([]int64, error) {
+	request := struct {
+		Acks []int64 `json:"acks"`
+	}{}
+	err := json.Unmarshal(body, &request)
+	return request.Acks, err
+}
+
+func writeSplunkHECResponse(resp http.ResponseWriter, status int, body interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(body)
+}
+
+// handle processes a request and passes all parsed messages to enqueue
+func (cons *SplunkHEC) handle(resp http.ResponseWriter, req *http.Request, enqueue func(splunkHECEntry)) {
+	path := strings.TrimSuffix(strings.TrimSuffix(req.URL.Path, "/"), "/1.0")
+
+	if path == "/services/collector/health" {
+		writeSplunkHECResponse(resp, http.StatusOK, splunkHECResponse{Text: "HEC is healthy", Code: splunkHECHealthy})
+		return // ### return, health check ###
+	}
+
+	if status, errResponse := cons.authenticate(req); errResponse != nil {
+		writeSplunkHECResponse(resp, status, errResponse)
+		return // ### return, not authorized ###
+	}
+
+	body, err := readSplunkHECBody(resp, req, cons.maxRequestSize)
+	if err == errSplunkHECTooLarge {
+		cons.Logger.Warningf("Rejected request larger than %d bytes", cons.maxRequestSize)
+		writeSplunkHECResponse(resp, http.StatusRequestEntityTooLarge, splunkHECResponse{Text: "Content length too large", Code: splunkHECInvalidFormat})
+		return // ### return, body too large ###
+	}
+	if err != nil {
+		cons.Logger.WithError(err).Warning("Failed to read request")
+		writeSplunkHECResponse(resp, http.StatusBadRequest, splunkHECResponse{Text: "Invalid data format", Code: splunkHECInvalidFormat})
+		return // ### return, invalid body ###
+	}
+
+	channel := req.Header.Get(splunkHECChannelHeader)
+	if channel == "" {
+		channel = req.URL.Query().Get("channel")
+	}
+
+	var entries []splunkHECEntry
+	var errResponse *splunkHECResponse
+
+	switch path {
+	case "/services/collector", "/services/collector/event":
+		entries, errResponse = cons.parseEvents(body, channel)
+
+	case "/services/collector/raw":
+		entries, errResponse = cons.parseRaw(body, req, channel)
+
+	case "/services/collector/ack":
+		ids, err := getSplunkHECAckIDs(body)
+		if err != nil {
+			writeSplunkHECResponse(resp, http.StatusBadRequest, splunkHECResponse{Text: "Invalid data format", Code: splunkHECInvalidFormat})
+			return // ### return, invalid ack request ###
+		}
+		// Messages are enqueued before the response is sent
+		acks := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			acks[strconv.FormatInt(id, 10)] = true
+		}
+		writeSplunkHECResponse(resp, http.StatusOK, map[string]interface{}{"acks": acks})
+		return // ### return, acknowledged ###
+
+	default:
+		writeSplunkHECResponse(resp, http.StatusNotFound, splunkHECResponse{Text: "The requested URL was not found on this server.", Code: splunkHECInvalidPath})
+		return // ### return, unknown endpoint ###
+	}
+
+	if errResponse != nil {
+		writeSplunkHECResponse(resp, http.StatusBadRequest, errResponse)
+		return // ### return, invalid data ###
+	}
+
+	for _, entry := range entries {
+		enqueue(entry)
+	}
+
+	response := splunkHECResponse{Text: "Success", Code: splunkHECSuccess}
+	if channel != "" {
+		ackID := atomic.AddInt64(cons.lastAckID, 1) - 1
+		response.AckID = &ackID
+	}
+	writeSplunkHECResponse(resp, http.StatusOK, response)
+}
+
+func (cons *SplunkHEC) enqueue(entry splunkHECEntry) {
+	cons.EnqueueWithTime(entry.data, entry.metadata, entry.timestamp)
+}
+
+func (cons *SplunkHEC) requestHandler(resp http.ResponseWriter, req *http.Request) {
+	cons.handle(resp, req, cons.enqueue)
+}
+
+func (cons *SplunkHEC) serve() {
+	defer cons.WorkerDone()
+
+	srv := http.Server{
+		Addr:        cons.address,
+		Handler:     http.HandlerFunc(cons.requestHandler),
+		ReadTimeout: cons.readTimeout,
+	}
+
+	err := srv.Serve(cons.TLS.NewListener(cons.listen))
+	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
+		cons.Logger.Error(err)
+	}
+}
+
+// Consume opens a new http server listening on the specified address
+func (cons *SplunkHEC) Consume(workers *sync.WaitGroup) {
+	listen, err := tnet.NewStopListener(cons.address)
+	if err != nil {
+		cons.Logger.Error(err)
+		return // ### return, could not connect ###
+	}
+
+	cons.listen = listen
+	cons.AddMainWorker(workers)
+
+	go cons.serve()
+	defer cons.listen.Close()
+
+	cons.ControlLoop()
+}
@@ -0,0 +1,189 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSplunkHEC(expect ttesting.Expect, id string) *SplunkHEC {
+	config := core.NewPluginConfig(id, "consumer.SplunkHEC")
+	config.Override("Tokens", []string{"secret"})
+	config.Override("SetMetadata", true)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*SplunkHEC)
+	expect.True(casted)
+	return cons
+}
+
+func sendSplunkHECRequest(cons *SplunkHEC, req *http.Request) ([]splunkHECEntry, int, map[string]interface{}) {
+	entries := []splunkHECEntry{}
+	recorder := httptest.NewRecorder()
+	cons.handle(recorder, req, func(entry splunkHECEntry) {
+		entries = append(entries, entry)
+	})
+
+	response := map[string]interface{}{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return entries, recorder.Code, response
+}
+
+func TestSplunkHECEvents(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons := newTestSplunkHEC(expect, "testSplunkHECEvents")
+
+	body := `{"time": 1489672800.5, "host": "web01", "sourcetype": "access", "event": "hello", "fields": {"dc": "eu", "id": 1}}
+{"time": "1489672801", "index": "main", "event": {"status": 200}}`
+
+	req := httptest.NewRequest("POST", "/services/collector/event", strings.NewReader(body))
+	req.Header.Set("Authorization", "Splunk secret")
+	req.Header.Set(splunkHECChannelHeader, "channel-1")
+
+	entries, status, response := sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(float64(0), response["code"])
+	expect.Equal(float64(0), response["ackId"])
+	expect.Equal(2, len(entries))
+
+	expect.Equal("hello", string(entries[0].data))
+	expect.Equal(time.Unix(1489672800, 500000000).UnixNano(), entries[0].timestamp.UnixNano())
+	expect.Equal("web01", entries[0].metadata.GetValueString("host"))
+	expect.Equal("access", entries[0].metadata.GetValueString("sourcetype"))
+	expect.Equal("channel-1", entries[0].metadata.GetValueString("channel"))
+	expect.Equal("eu", entries[0].metadata.GetValueString("dc"))
+	expect.Equal("1", entries[0].metadata.GetValueString("id"))
+
+	expect.Equal(`{"status": 200}`, string(entries[1].data))
+	expect.Equal(int64(1489672801), entries[1].timestamp.Unix())
+	expect.Equal("main", entries[1].metadata.GetValueString("index"))
+
+	// Invalid events reject the whole request
+	req = httptest.NewRequest("POST", "/services/collector", strings.NewReader(`{"event": "a"}{"event": ""}`))
+	req.Header.Set("Authorization", "Splunk secret")
+	entries, status, response = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusBadRequest, status)
+	expect.Equal(float64(splunkHECEventBlank), response["code"])
+	expect.Equal(float64(1), response["invalid-event-number"])
+	expect.Equal(0, len(entries))
+
+	req = httptest.NewRequest("POST", "/services/collector/event", strings.NewReader(`{"host": "a"}`))
+	req.Header.Set("Authorization", "Splunk secret")
+	_, status, response = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusBadRequest, status)
+	expect.Equal(float64(splunkHECEventRequired), response["code"])
+
+	req = httptest.NewRequest("POST", "/services/collector/event", strings.NewReader(`{"event": "a"`))
+	req.Header.Set("Authorization", "Splunk secret")
+	_, status, response = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusBadRequest, status)
+	expect.Equal(float64(splunkHECInvalidFormat), response["code"])
+}
+
+func TestSplunkHECRaw(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons := newTestSplunkHEC(expect, "testSplunkHECRaw")
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("line 1\r\n\nline 2\n"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/services/collector/raw?host=db01&source=syslog", &compressed)
+	req.Header.Set("Authorization", "Splunk secret")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	entries, status, response := sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusOK, status)
+	expect.Nil(response["ackId"])
+	expect.Equal(2, len(entries))
+	expect.Equal("line 1", string(entries[0].data))
+	expect.Equal("line 2", string(entries[1].data))
+	expect.Equal("db01", entries[1].metadata.GetValueString("host"))
+	expect.Equal("syslog", entries[1].metadata.GetValueString("source"))
+
+	req = httptest.NewRequest("POST", "/services/collector/ack?channel=abc", strings.NewReader(`{"acks": [0, 3]}`))
+	req.Header.Set("Authorization", "Splunk secret")
+	_, status, response = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(map[string]interface{}{"0": true, "3": true}, response["acks"])
+}
+
+func TestSplunkHECAuth(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons := newTestSplunkHEC(expect, "testSplunkHECAuth")
+
+	req := httptest.NewRequest("POST", "/services/collector/event", strings.NewReader(`{"event": "a"}`))
+	_, status, response := sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusUnauthorized, status)
+	expect.Equal(float64(splunkHECTokenRequired), response["code"])
+
+	req.Header.Set("Authorization", "Splunk wrong")
+	_, status, response = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusForbidden, status)
+	expect.Equal(float64(splunkHECInvalidToken), response["code"])
+
+	req = httptest.NewRequest("GET", "/services/collector/health/1.0", nil)
+	_, status, response = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(float64(splunkHECHealthy), response["code"])
+
+	req = httptest.NewRequest("POST", "/services/other", nil)
+	req.Header.Set("Authorization", "Splunk secret")
+	_, status, _ = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusNotFound, status)
+}
+
+func TestSplunkHECMaxRequestSize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	cons := newTestSplunkHEC(expect, "testSplunkHECMaxRequestSize")
+	cons.maxRequestSize = 64
+
+	req := httptest.NewRequest("POST", "/services/collector/raw", strings.NewReader(strings.Repeat("a", 65)))
+	req.Header.Set("Authorization", "Splunk secret")
+	entries, status, _ := sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusRequestEntityTooLarge, status)
+	expect.Equal(0, len(entries))
+
+	// The compressed body is small, the decompressed one is not
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(strings.Repeat("a", 1024)))
+	writer.Close()
+	expect.Leq(compressed.Len(), 64)
+
+	req = httptest.NewRequest("POST", "/services/collector/raw", &compressed)
+	req.Header.Set("Authorization", "Splunk secret")
+	req.Header.Set("Content-Encoding", "gzip")
+	entries, status, _ = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusRequestEntityTooLarge, status)
+	expect.Equal(0, len(entries))
+
+	req = httptest.NewRequest("POST", "/services/collector/raw", strings.NewReader(strings.Repeat("a", 64)))
+	req.Header.Set("Authorization", "Splunk secret")
+	entries, status, _ = sendSplunkHECRequest(cons, req)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(1, len(entries))
+}
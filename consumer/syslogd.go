@@ -15,12 +15,18 @@
 package consumer
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tmath"
 	"github.com/trivago/tgo/tnet"
 	syslog "gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
@@ -31,6 +37,13 @@ import (
 // The syslogd consumer creates a syslogd-compatible log server and
 // receives messages on a TCP or UDP port or a UNIX filesystem socket.
 //
+// TCP sockets can be secured with TLS by setting Certificate and PrivateKey.
+// Client certificates are verified if ClientCA is set. Syslog over TLS follows
+// RFC5425, i.e. RFC5424 messages framed by octet counting. Certificates are
+// reloaded when the consumer receives a roll command (e.g. SIGHUP) without
+// closing the listener. The TLS handshake of each connection is done in its
+// own goroutine, so slow or idle clients do not block other connections.
+//
 // Parameters
 //
 // - Address: Defines the IP address or UNIX socket to listen to.
@@ -57,12 +70,22 @@ import (
 // RFC3164 supports: tag, timestamp, hostname, priority, facility, severity.
 // RFC5424 and RFC6587 support: app_name, version, proc_id , msg_id, timestamp,
 // hostname, priority, facility, severity.
+// If a client certificate was sent via TLS, its subject is stored as
+// client_subject.
 // By default this parameter is set to "false".
 //
 // - TimestampFormat: When using SetMetadata this string denotes the go time
 // format used to convert syslog timestamps into strings.
 // By default this parameter is set to "2006-01-02T15:04:05.000 MST".
 //
+// - HandshakeTimeoutSec: Defines the maximum number of seconds a client may
+// take to complete the TLS handshake before the connection is closed.
+// By default this parameter is set to "10".
+//
+// - MaxMessageSizeKB: Defines the maximum size of a message received via TLS
+// in KB. Larger messages are skipped and logged as a warning.
+// By default this parameter is set to "64".
+//
 // Examples
 //
 // Replace the system's standard syslogd with Gollum
@@ -81,13 +104,29 @@ import (
 //    Address: "tcp://0.0.0.0:5599"
 //    Format: "RFC6587"
 //
+// Receive syslog over TLS (RFC5425) from clients with a valid certificate
+//
+//  SyslogdTLSConsumer:
+//    Type: consumer.Syslogd
+//    Streams: "tls_syslog"
+//    Address: "tcp://0.0.0.0:6514"
+//    Format: "RFC5424"
+//    Certificate: /etc/gollum/server.crt
+//    PrivateKey: /etc/gollum/server.key
+//    ClientCA: /etc/gollum/clients-ca.pem
+//
 type Syslogd struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
-	format              format.Format // RFC3164, RFC5424 or RFC6587?
+	TLS                 components.TLSServerConfig `gollumdoc:"embed_type"`
+	format              format.Format              // RFC3164, RFC5424 or RFC6587?
 	protocol            string
 	address             string
-	withMetadata        bool   `config:"SetMetadata" default:"false"`
-	timestampFormat     string `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+	withMetadata        bool          `config:"SetMetadata" default:"false"`
+	timestampFormat     string        `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+	handshakeTimeout    time.Duration `config:"HandshakeTimeoutSec" default:"10" metric:"sec"`
+	maxMessageSize      int           `config:"MaxMessageSizeKB" default:"64" metric:"kb"`
+	tlsConnections      map[net.Conn]struct{}
+	tlsGuard            *sync.Mutex
 }
 
 func init() {
@@ -119,7 +158,10 @@ func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
 	// https://tools.ietf.org/html/rfc5424
 	case "RFC5424":
 		cons.format = syslog.RFC5424
-		if cons.protocol == "tcp" {
+		if cons.TLS.IsEnabled() {
+			// RFC5425 transports RFC5424 messages via octet counting
+			cons.format = syslog.RFC6587
+		} else if cons.protocol == "tcp" {
 			cons.Logger.Warning("RFC5424 demands UDP")
 			cons.protocol = "udp"
 		}
@@ -131,6 +173,188 @@ func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
 	default:
 		conf.Errors.Pushf("Format %s is not supported", format)
 	}
+
+	if cons.TLS.IsEnabled() && (cons.protocol != "tcp" || cons.format == syslog.RFC3164) {
+		conf.Errors.Pushf("TLS is only supported for TCP sockets using RFC5424 or RFC6587")
+	}
+
+	if cons.maxMessageSize <= 0 {
+		cons.maxMessageSize = bufio.MaxScanTokenSize
+	}
+
+	cons.tlsConnections = make(map[net.Conn]struct{})
+	cons.tlsGuard = new(sync.Mutex)
+}
+
+// onRoll reloads the TLS certificates if TLS is enabled
+func (cons *Syslogd) onRoll() {
+	if err := cons.TLS.Reload(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to reload certificates, keeping the previous ones")
+		return
+	}
+	if cons.TLS.IsEnabled() {
+		cons.Logger.Info("Reloaded certificates")
+	}
+}
+
+// acceptTLS accepts connections on the given TLS listener until the listener
+// is closed. Each connection is served by its own goroutine.
+func (cons *Syslogd) acceptTLS(listener net.Listener, handler syslog.Handler, connections *sync.WaitGroup) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if tnet.IsDisconnectedError(err) || !cons.IsActive() {
+				return // ### return, listener closed ###
+			}
+			cons.Logger.WithError(err).Warning("Failed to accept connection")
+			continue
+		}
+
+		connections.Add(1)
+		go cons.serveTLS(conn, handler, connections)
+	}
+}
+
+// serveTLS does the TLS handshake within HandshakeTimeoutSec and passes all
+// messages received on the given connection to handler.
+func (cons *Syslogd) serveTLS(conn net.Conn, handler syslog.Handler, connections *sync.WaitGroup) {
+	defer connections.Done()
+	defer conn.Close()
+
+	cons.tlsGuard.Lock()
+	cons.tlsConnections[conn] = struct{}{}
+	cons.tlsGuard.Unlock()
+
+	defer func() {
+		cons.tlsGuard.Lock()
+		delete(cons.tlsConnections, conn)
+		cons.tlsGuard.Unlock()
+	}()
+
+	tlsPeer := ""
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		tlsConn.SetDeadline(time.Now().Add(cons.handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			cons.Logger.WithError(err).Debug("TLS handshake failed")
+			return // ### return, handshake failed ###
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		state := tlsConn.ConnectionState()
+		tlsPeer, _ = components.GetPeerSubject(&state)
+	}
+
+	client := conn.RemoteAddr().String()
+	skipper := syslogdFrameSkipper{
+		split:   cons.format.GetSplitFunc(),
+		maxSize: cons.maxMessageSize,
+		onSkip: func() {
+			cons.Logger.Warningf("Skipping message larger than %d bytes from %s", cons.maxMessageSize, client)
+		},
+	}
+	if skipper.split == nil {
+		skipper.split = bufio.ScanLines
+	} else {
+		skipper.octetCounting = true
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, tmath.MinI(4096, cons.maxMessageSize)), cons.maxMessageSize)
+	scanner.Split(skipper.Split)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		parser := cons.format.GetParser(line)
+		err := parser.Parse()
+
+		parts := parser.Dump()
+		parts["client"] = client
+		parts["tls_peer"] = tlsPeer
+		handler.Handle(parts, int64(len(line)), err)
+	}
+}
+
+// syslogdFrameSkipper wraps a split function so that messages exceeding the
+// scanner buffer are skipped instead of stopping the scanner.
+type syslogdFrameSkipper struct {
+	split         bufio.SplitFunc
+	maxSize       int
+	octetCounting bool
+	onSkip        func()
+	skipping      bool
+	skipLength    int // remaining bytes of an octet counted frame, -1 to skip to the next newline
+}
+
+// Split implements bufio.SplitFunc
+func (s *syslogdFrameSkipper) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if s.skipping {
+		return s.skip(data)
+	}
+
+	advance, token, err := s.split(data, atEOF)
+	if advance > 0 || token != nil || err != nil || atEOF || len(data) < s.maxSize {
+		return advance, token, err // ### return, message fits into the buffer ###
+	}
+
+	s.onSkip()
+	s.skipping = true
+	s.skipLength = -1
+	if s.octetCounting {
+		if i := bytes.IndexByte(data, ' '); i > 0 {
+			if length, err := strconv.Atoi(string(data[:i])); err == nil {
+				s.skipLength = i + 1 + length
+			}
+		}
+	}
+	return s.skip(data)
+}
+
+// skip discards the data of the message that is currently skipped
+func (s *syslogdFrameSkipper) skip(data []byte) (int, []byte, error) {
+	if s.skipLength >= 0 {
+		if len(data) < s.skipLength {
+			s.skipLength -= len(data)
+			return len(data), nil, nil // ### return, frame continues ###
+		}
+		s.skipping = false
+		return s.skipLength, nil, nil
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		s.skipping = false
+		return i + 1, nil, nil
+	}
+	return len(data), nil, nil
+}
+
+// closeTLSConnections closes all connections served by serveTLS
+func (cons *Syslogd) closeTLSConnections() {
+	cons.tlsGuard.Lock()
+	defer cons.tlsGuard.Unlock()
+	for conn := range cons.tlsConnections {
+		conn.Close()
+	}
+}
+
+// consumeTLS listens for TLS connections until the consumer is stopped.
+// This replaces the TLS listener of the syslog server as that one does the
+// handshake within its accept loop.
+func (cons *Syslogd) consumeTLS() {
+	listener, err := net.Listen("tcp", cons.address)
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to open tls://", cons.address)
+		cons.ControlLoop()
+		return // ### return, failed to listen ###
+	}
+
+	connections := new(sync.WaitGroup)
+	listener = cons.TLS.NewListener(listener)
+	go cons.acceptTLS(listener, cons, connections)
+
+	cons.ControlLoop()
+	listener.Close()
+	cons.closeTLSConnections()
+	connections.Wait()
 }
 
 // Handle implements the syslog handle interface
@@ -184,6 +408,10 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 			metaData.SetValue("priority", []byte(strconv.Itoa(priority)))
 			metaData.SetValue("facility", []byte(strconv.Itoa(facility)))
 			metaData.SetValue("severity", []byte(strconv.Itoa(severity)))
+
+			if subject, _ := parts["tls_peer"].(string); subject != "" {
+				metaData.SetValue("client_subject", []byte(subject))
+			}
 		}
 
 	default:
@@ -208,6 +436,7 @@ func (cons *Syslogd) Consume(workers *sync.WaitGroup) {
 	server := syslog.NewServer()
 	server.SetFormat(cons.format)
 	server.SetHandler(cons)
+	cons.SetRollCallback(cons.onRoll)
 
 	switch cons.protocol {
 	case "unix":
@@ -228,6 +457,10 @@ func (cons *Syslogd) Consume(workers *sync.WaitGroup) {
 			cons.Logger.Error("Failed to open udp://", cons.address)
 		}
 	case "tcp":
+		if cons.TLS.IsEnabled() {
+			cons.consumeTLS()
+			return // ### return, TLS connections are served by this consumer ###
+		}
 		if err := server.ListenTCP(cons.address); err != nil {
 			cons.Logger.Error("Failed to open tcp://", cons.address)
 		}
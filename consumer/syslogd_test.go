@@ -0,0 +1,197 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// private key to the given files.
+func writeTestCertificate(expect ttesting.Expect, certFile, keyFile string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	expect.NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "gollum"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	expect.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	expect.NoError(err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	expect.NoError(err)
+
+	expect.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	expect.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert
+}
+
+type syslogdHandlerStandIn struct {
+	parts chan format.LogParts
+}
+
+func (handler syslogdHandlerStandIn) Handle(parts format.LogParts, length int64, err error) {
+	handler.parts <- parts
+}
+
+func dialTestSyslogd(expect ttesting.Expect, address string, cert *x509.Certificate) *tls.Conn {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+	expect.NoError(err)
+	return conn
+}
+
+func TestSyslogdTLS(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-syslogd")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	cert := writeTestCertificate(expect, certFile, keyFile, 1)
+
+	config := core.NewPluginConfig("testSyslogdTLS", "consumer.Syslogd")
+	config.Override("Address", "tcp://127.0.0.1:0")
+	config.Override("Format", "RFC5424")
+	config.Override("Certificate", certFile)
+	config.Override("PrivateKey", keyFile)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Syslogd)
+	expect.True(casted)
+	cons.handshakeTimeout = 100 * time.Millisecond
+	cons.maxMessageSize = 256
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	listener := cons.TLS.NewListener(tcpListener)
+	address := tcpListener.Addr().String()
+
+	handler := syslogdHandlerStandIn{make(chan format.LogParts, 1)}
+	connections := new(sync.WaitGroup)
+	go cons.acceptTLS(listener, handler, connections)
+
+	defer func() {
+		listener.Close()
+		cons.closeTLSConnections()
+		connections.Wait()
+	}()
+
+	// An idle client must not block other clients and is closed after
+	// the handshake timeout.
+	idle, err := net.Dial("tcp", address)
+	expect.NoError(err)
+	defer idle.Close()
+
+	client := dialTestSyslogd(expect, address, cert)
+	expect.Equal(int64(1), client.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+
+	message := "<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - hello"
+	fmt.Fprintf(client, "%d %s", len(message), message)
+
+	select {
+	case parts := <-handler.parts:
+		expect.Equal("hello", parts["message"])
+		expect.Equal("mymachine", parts["hostname"])
+	case <-time.After(time.Second):
+		t.Error("No message received")
+	}
+
+	// Oversized messages are skipped without closing the connection
+	large := "<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - " + strings.Repeat("x", 1024)
+	fmt.Fprintf(client, "%d %s", len(large), large)
+	message = "<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - after"
+	fmt.Fprintf(client, "%d %s", len(message), message)
+
+	select {
+	case parts := <-handler.parts:
+		expect.Equal("after", parts["message"])
+	case <-time.After(time.Second):
+		t.Error("No message received")
+	}
+	client.Close()
+
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	expect.Equal(io.EOF, err)
+
+	// New connections use the reloaded certificate
+	cert = writeTestCertificate(expect, certFile, keyFile, 2)
+	cons.onRoll()
+
+	client = dialTestSyslogd(expect, address, cert)
+	defer client.Close()
+	expect.Equal(int64(2), client.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestSyslogdFrameSkipperLines(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	skipped := 0
+	skipper := syslogdFrameSkipper{
+		split:   bufio.ScanLines,
+		maxSize: 16,
+		onSkip:  func() { skipped++ },
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader("first\n" + strings.Repeat("x", 40) + "\nsecond\n"))
+	scanner.Buffer(make([]byte, 0, 16), 16)
+	scanner.Split(skipper.Split)
+
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	expect.NoError(scanner.Err())
+	expect.Equal([]string{"first", "second"}, lines)
+	expect.Equal(1, skipped)
+}
@@ -0,0 +1,340 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Websocket consumer plugin
+//
+// This consumer reads messages from websocket connections. Each text or
+// binary frame is enqueued as one message.
+//
+// By default the consumer serves a websocket endpoint that any number of
+// clients can connect to. If URL is set, the consumer connects to the given
+// websocket server instead and reconnects if the connection is lost.
+//
+// Metadata
+//
+// *NOTE: The metadata will only set if the parameter `SetMetadata` is active.*
+//
+// - remote: The address of the remote end of the connection (set)
+//
+// - path: The request path used by the client, when serving (set)
+//
+// - url: The url connected to, when connecting to a server (set)
+//
+// - type: The frame type, either "text" or "binary" (set)
+//
+// - client_subject: The subject of the client certificate, if one was sent
+//
+// Parameters
+//
+// - Address: This value defines the host and port to bind to when serving.
+// By default this parameter is set to ":81".
+//
+// - Path: This value defines the url path to accept connections on.
+// By default this parameter is set to "/".
+//
+// - URL: This value defines the websocket url to connect to, e.g.
+// "wss://example.com/feed". If set, Address and Path are ignored.
+// By default this parameter is set to "".
+//
+// - ReadTimeoutSec: This value defines the maximum duration in seconds for
+// reading the handshake request when serving or completing the handshake when
+// connecting.
+// By default this parameter is set to "3".
+//
+// - IgnoreOrigin: When set to "true", connections are accepted regardless of
+// the Origin header sent by the client.
+// By default this parameter is set to "false".
+//
+// - AllowedOrigins: This value defines a list of origins that are accepted in
+// addition to the server's own host, e.g. "https://example.com".
+// By default this parameter is set to an empty list.
+//
+// - ReconnectAfterSec: This value defines the number of seconds to wait
+// before reconnecting to URL.
+// By default this parameter is set to "2".
+//
+// - MaxMessageSizeKB: This value defines the maximum size of a frame in
+// kilobytes. Connections sending larger frames are closed.
+// By default this parameter is set to "1024".
+//
+// - SetMetadata: When this value is set to "true", the fields mentioned in
+// the metadata section will be added to each message.
+// By default this parameter is set to "false".
+//
+// Examples
+//
+// This example accepts websocket connections from pages served by
+// example.com on port 8080:
+//
+//  WebsocketIn:
+//    Type: consumer.Websocket
+//    Streams: websocket
+//    Address: ":8080"
+//    Path: /ingest
+//    AllowedOrigins:
+//      - https://example.com
+//
+// This example reads from a remote websocket feed:
+//
+//  FeedIn:
+//    Type: consumer.Websocket
+//    Streams: feed
+//    URL: wss://example.com/feed
+//    SetMetadata: true
+type Websocket struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	TLS                 components.TLSServerConfig `gollumdoc:"embed_type"`
+	address             string                     `config:"Address" default:":81"`
+	path                string                     `config:"Path" default:"/"`
+	remoteURL           string                     `config:"URL"`
+	readTimeout         time.Duration              `config:"ReadTimeoutSec" default:"3" metric:"sec"`
+	ignoreOrigin        bool                       `config:"IgnoreOrigin" default:"false"`
+	allowedOrigins      []string                   `config:"AllowedOrigins"`
+	reconnectTime       time.Duration              `config:"ReconnectAfterSec" default:"2" metric:"sec"`
+	maxMessageSize      int64                      `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	hasMetadata         bool                       `config:"SetMetadata" default:"false"`
+	upgrader            websocket.Upgrader
+	listen              *tnet.StopListener
+	conns               map[*websocket.Conn]struct{}
+	connsGuard          *sync.Mutex
+	stop                chan struct{}
+	stopped             bool
+}
+
+func init() {
+	core.TypeRegistry.Register(Websocket{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Websocket) Configure(conf core.PluginConfigReader) {
+	cons.SetStopCallback(cons.close)
+
+	cons.conns = make(map[*websocket.Conn]struct{})
+	cons.connsGuard = new(sync.Mutex)
+	cons.stop = make(chan struct{})
+
+	cons.upgrader = websocket.Upgrader{
+		HandshakeTimeout: cons.readTimeout,
+		CheckOrigin:      cons.checkOrigin,
+	}
+
+	if cons.remoteURL != "" {
+		if _, err := url.Parse(cons.remoteURL); err != nil {
+			conf.Errors.Push(err)
+		}
+	}
+}
+
+// checkOrigin accepts requests without Origin header, requests from the
+// server's own host and requests from one of the allowed origins.
+func (cons *Websocket) checkOrigin(r *http.Request) bool {
+	if cons.ignoreOrigin {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range cons.allowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originURL.Host, r.Host)
+}
+
+// addConnection tracks a connection so that it can be closed on shutdown.
+// False is returned if the consumer is already stopped.
+func (cons *Websocket) addConnection(conn *websocket.Conn) bool {
+	cons.connsGuard.Lock()
+	defer cons.connsGuard.Unlock()
+
+	if cons.stopped {
+		conn.Close()
+		return false
+	}
+	cons.conns[conn] = struct{}{}
+	return true
+}
+
+func (cons *Websocket) removeConnection(conn *websocket.Conn) {
+	cons.connsGuard.Lock()
+	defer cons.connsGuard.Unlock()
+
+	delete(cons.conns, conn)
+	conn.Close()
+}
+
+// readConnection enqueues all frames received from a connection until the
+// connection is closed.
+func (cons *Websocket) readConnection(conn *websocket.Conn, metadata core.Metadata) {
+	defer cons.removeConnection(conn)
+	conn.SetReadLimit(cons.maxMessageSize)
+
+	for {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			if cons.IsActive() && websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				cons.Logger.WithError(err).Warningf("Connection to %s closed", conn.RemoteAddr())
+			}
+			return // ### return, connection closed ###
+		}
+
+		if !cons.hasMetadata {
+			cons.Enqueue(data)
+			continue // ### continue, no metadata ###
+		}
+
+		frameMetadata := metadata.Clone()
+		if frameType == websocket.BinaryMessage {
+			frameMetadata.SetValue("type", []byte("binary"))
+		} else {
+			frameMetadata.SetValue("type", []byte("text"))
+		}
+		cons.EnqueueWithMetadata(data, frameMetadata)
+	}
+}
+
+func (cons *Websocket) upgrade(w http.ResponseWriter, r *http.Request) {
+	conn, err := cons.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to accept connection from %s", r.RemoteAddr)
+		return // ### return, not upgraded ###
+	}
+
+	if !cons.addConnection(conn) {
+		return // ### return, stopped ###
+	}
+
+	metadata := core.Metadata{}
+	if cons.hasMetadata {
+		metadata.SetValue("remote", []byte(r.RemoteAddr))
+		metadata.SetValue("path", []byte(r.URL.Path))
+		if subject, hasCert := components.GetPeerSubject(r.TLS); hasCert {
+			metadata.SetValue("client_subject", []byte(subject))
+		}
+	}
+
+	cons.readConnection(conn, metadata)
+}
+
+func (cons *Websocket) serve() {
+	defer cons.WorkerDone()
+
+	listen, err := tnet.NewStopListener(cons.address)
+	if err != nil {
+		cons.Logger.Error(err)
+		return // ### return, could not listen ###
+	}
+
+	cons.connsGuard.Lock()
+	cons.listen = listen
+	if cons.stopped {
+		listen.Close()
+	}
+	cons.connsGuard.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cons.path, cons.upgrade)
+
+	srv := http.Server{
+		Handler:     mux,
+		ReadTimeout: cons.readTimeout,
+	}
+
+	err = srv.Serve(cons.TLS.NewListener(listen))
+	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest && cons.IsActive() {
+		cons.Logger.Error(err)
+	}
+}
+
+func (cons *Websocket) dial() {
+	defer cons.WorkerDone()
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: cons.readTimeout,
+	}
+
+	for cons.IsActive() {
+		conn, _, err := dialer.Dial(cons.remoteURL, nil)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to connect to %s", cons.remoteURL)
+		} else if cons.addConnection(conn) {
+			cons.Logger.Infof("Connected to %s", cons.remoteURL)
+
+			metadata := core.Metadata{}
+			if cons.hasMetadata {
+				metadata.SetValue("remote", []byte(conn.RemoteAddr().String()))
+				metadata.SetValue("url", []byte(cons.remoteURL))
+			}
+			cons.readConnection(conn, metadata)
+		}
+
+		select {
+		case <-cons.stop:
+			return // ### return, stopped ###
+		case <-time.After(cons.reconnectTime):
+		}
+	}
+}
+
+func (cons *Websocket) close() {
+	cons.connsGuard.Lock()
+	defer cons.connsGuard.Unlock()
+
+	cons.stopped = true
+	close(cons.stop)
+
+	if cons.listen != nil {
+		cons.listen.Close()
+	}
+	for conn := range cons.conns {
+		conn.Close()
+	}
+}
+
+// Consume starts serving or connects to a websocket server
+func (cons *Websocket) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+
+	if cons.remoteURL != "" {
+		go tgo.WithRecoverShutdown(cons.dial)
+	} else {
+		go tgo.WithRecoverShutdown(cons.serve)
+	}
+
+	cons.ControlLoop()
+}
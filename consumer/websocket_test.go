@@ -0,0 +1,50 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"net/http"
+	"testing"
+)
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testWebsocketCheckOrigin", "consumer.Websocket")
+	config.Override("AllowedOrigins", []string{"https://example.com/"})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	cons, casted := plugin.(*Websocket)
+	expect.True(casted)
+
+	request := func(origin string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://gollum.local:81/", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+
+	expect.True(cons.checkOrigin(request("")))
+	expect.True(cons.checkOrigin(request("http://gollum.local:81")))
+	expect.True(cons.checkOrigin(request("https://example.com")))
+	expect.False(cons.checkOrigin(request("https://evil.com")))
+
+	cons.ignoreOrigin = true
+	expect.True(cons.checkOrigin(request("https://evil.com")))
+}
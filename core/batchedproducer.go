@@ -98,9 +98,15 @@ func (prod *BatchedProducer) flushBatchOnTimeOut() {
 
 // BatchMessageLoop start the TickerMessageControlLoop() for batch producer
 func (prod *BatchedProducer) BatchMessageLoop(workers *sync.WaitGroup, onBatchFlush func() AssemblyFunc) {
-	prod.onBatchFlush = onBatchFlush
-
 	prod.AddMainWorker(workers)
+	prod.BatchControlLoop(onBatchFlush)
+}
+
+// BatchControlLoop works like BatchMessageLoop but expects AddMainWorker to
+// be called beforehand. This allows producers to start additional workers
+// before entering the loop.
+func (prod *BatchedProducer) BatchControlLoop(onBatchFlush func() AssemblyFunc) {
+	prod.onBatchFlush = onBatchFlush
 	prod.TickerMessageControlLoop(prod.appendMessage, prod.batchTimeout, prod.flushBatchOnTimeOut)
 }
 
@@ -128,10 +128,10 @@ func (bwa *BatchedWriterAssembly) Close() {
 	if bwa.writer != nil {
 		bwa.assembly.SetWriter(bwa.writer)
 		bwa.Batch.Close(bwa.assembly.Write, bwa.config.BatchFlushTimeout)
+		bwa.writer.Close()
 	} else {
 		bwa.Batch.Close(bwa.assembly.Flush, bwa.config.BatchFlushTimeout)
 	}
-	bwa.writer.Close()
 }
 
 // FlushOnTimeOut checks if timeout or slush count reached and flush in this case
@@ -0,0 +1,116 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"io"
+)
+
+// Streaming compression algorithms supported by NewStreamCompressor
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionLZ4  = "lz4"
+	CompressionZstd = "zstd"
+)
+
+// StreamCompressor is implemented by all streaming compression writers
+type StreamCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// zstdCompressor ends the current zstd frame on Flush, as a zstd decoder can
+// only read completed frames. Consecutive frames form a valid zstd stream.
+type zstdCompressor struct {
+	*zstd.Encoder
+	writer io.Writer
+}
+
+func (c *zstdCompressor) Flush() error {
+	if err := c.Encoder.Close(); err != nil {
+		return err
+	}
+	c.Encoder.Reset(c.writer)
+	return nil
+}
+
+// NewStreamCompressor returns a writer compressing all data written to it
+// using the given algorithm. The level is given as gzip level from 1
+// (fastest) to 9 (best), -1 selects the default compression. For lz4, a level
+// of 9 enables high compression. For zstd, the level is mapped to the
+// closest zstd encoder level. If algorithm is "none", nil is returned.
+func NewStreamCompressor(writer io.Writer, algorithm string, level int) (StreamCompressor, error) {
+	switch algorithm {
+	case CompressionNone:
+		return nil, nil
+
+	case CompressionGzip:
+		compressor, err := gzip.NewWriterLevel(writer, level)
+		if err != nil {
+			return nil, err
+		}
+		return compressor, nil
+
+	case CompressionLZ4:
+		compressor := lz4.NewWriter(writer)
+		compressor.HighCompression = level == gzip.BestCompression
+		return compressor, nil
+
+	case CompressionZstd:
+		zstdLevel := zstd.SpeedDefault
+		if level > 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		encoder, err := zstd.NewWriter(writer, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCompressor{encoder, writer}, nil
+
+	default:
+		return nil, ValidateCompression(algorithm)
+	}
+}
+
+// ValidateCompression returns an error if the given algorithm is not
+// supported by NewStreamCompressor.
+func ValidateCompression(algorithm string) error {
+	switch algorithm {
+	case CompressionNone, CompressionGzip, CompressionLZ4, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("Unknown compression '%s'", algorithm)
+	}
+}
+
+// CompressionExtension returns the file extension commonly used for data
+// compressed with the given algorithm.
+func CompressionExtension(algorithm string) string {
+	switch algorithm {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionLZ4:
+		return ".lz4"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// TLSClientConfig component
+//
+// The TLSClientConfig is a helper component to open TLS connections. Server
+// certificates are verified against the system CAs or a given CA bundle.
+// A client certificate can be sent to servers requiring mutual TLS.
+//
+// Parameters
+//
+// - TLS: When set to true, connections are opened using TLS.
+// By default this parameter is set to false.
+//
+// - ServerCA: Path to a PEM formatted bundle of CA certificates used to verify
+// the server certificate. If not set, the system CAs are used.
+// By default this parameter is set to "".
+//
+// - ServerName: Defines the name used to verify the server certificate. If not
+// set, the host part of the address connected to is used.
+// By default this parameter is set to "".
+//
+// - InsecureSkipVerify: If set to true, the server certificate is not
+// verified. This should only be used for testing.
+// By default this parameter is set to false.
+//
+// - Certificate: Path to an X509 formatted client certificate file. Requires
+// PrivateKey to be set.
+// By default this parameter is set to "".
+//
+// - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
+// conjunction with Certificate.
+// By default this parameter is set to "".
+//
+type TLSClientConfig struct {
+	enabled            bool   `config:"TLS" default:"false"`
+	serverCAFile       string `config:"ServerCA" default:""`
+	serverName         string `config:"ServerName" default:""`
+	insecureSkipVerify bool   `config:"InsecureSkipVerify" default:"false"`
+	certificateFile    string `config:"Certificate" default:""`
+	privateKeyFile     string `config:"PrivateKey" default:""`
+	config             *tls.Config
+}
+
+// Configure method for interface implementation
+func (client *TLSClientConfig) Configure(conf core.PluginConfigReader) {
+	if !client.enabled {
+		if client.certificateFile != "" || client.serverCAFile != "" {
+			conf.Errors.Pushf("Certificate and ServerCA require TLS to be enabled")
+		}
+		return // ### return, TLS disabled ###
+	}
+
+	if (client.certificateFile == "") != (client.privateKeyFile == "") {
+		conf.Errors.Pushf("There must always be a certificate and a private key or none of both")
+		return // ### return, incomplete config ###
+	}
+
+	config, err := client.newConfig()
+	if conf.Errors.Push(err) {
+		return // ### return, failed to load ###
+	}
+	client.config = config
+}
+
+func (client *TLSClientConfig) newConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         client.serverName,
+		InsecureSkipVerify: client.insecureSkipVerify,
+	}
+
+	if client.certificateFile != "" {
+		keypair, err := tls.LoadX509KeyPair(client.certificateFile, client.privateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{keypair}
+	}
+
+	if client.serverCAFile != "" {
+		pemData, err := ioutil.ReadFile(client.serverCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", client.serverCAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// IsEnabled returns true if TLS has been enabled
+func (client *TLSClientConfig) IsEnabled() bool {
+	return client.config != nil
+}
+
+// GetConfig returns the *tls.Config to be used by connections or nil if TLS
+// has not been configured.
+func (client *TLSClientConfig) GetConfig() *tls.Config {
+	return client.config
+}
+
+// Dial connects to the given address. If TLS is enabled, the handshake is
+// done before returning. If ServerName is not set, the host part of address
+// is used to verify the server certificate.
+func (client *TLSClientConfig) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	if client.config == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	config := client.config
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, network, address, config)
+}
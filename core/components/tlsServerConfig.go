@@ -0,0 +1,199 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// TLSServerConfig component
+//
+// The TLSServerConfig is a helper component to load server certificates and
+// to optionally verify client certificates against a CA bundle (mutual TLS).
+// Certificates can be reloaded at runtime without closing existing listeners.
+//
+// Parameters
+//
+// - Certificate: Path to an X509 formatted certificate file. If defined, turns
+// on TLS support. Requires PrivateKey to be set.
+// By default this parameter is set to "".
+//
+// - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
+// conjunction with Certificate.
+// By default this parameter is set to "".
+//
+// - ClientCA: Path to a PEM formatted bundle of CA certificates. If defined,
+// clients have to present a certificate signed by one of these CAs.
+// Meaningful only in conjunction with Certificate.
+// By default this parameter is set to "".
+//
+// - ClientCertOptional: If set to true, clients without a certificate are
+// accepted, too. Certificates that are sent are still verified against
+// ClientCA.
+// By default this parameter is set to false.
+//
+type TLSServerConfig struct {
+	certificateFile    string `config:"Certificate" default:""`
+	privateKeyFile     string `config:"PrivateKey" default:""`
+	clientCAFile       string `config:"ClientCA" default:""`
+	clientCertOptional bool   `config:"ClientCertOptional" default:"false"`
+	nextProtos         []string
+	config             *tls.Config
+	active             *tls.Config
+	activeGuard        *sync.RWMutex
+}
+
+// Configure method for interface implementation
+func (server *TLSServerConfig) Configure(conf core.PluginConfigReader) {
+	if server.certificateFile == "" && server.privateKeyFile == "" {
+		if server.clientCAFile != "" {
+			conf.Errors.Pushf("ClientCA requires Certificate and PrivateKey to be set")
+		}
+		return // ### return, TLS disabled ###
+	}
+
+	if server.certificateFile == "" || server.privateKeyFile == "" {
+		conf.Errors.Pushf("There must always be a certificate and a private key or none of both")
+		return // ### return, incomplete config ###
+	}
+
+	active, err := server.newConfig()
+	if conf.Errors.Push(err) {
+		return // ### return, failed to load ###
+	}
+
+	server.active = active
+	server.activeGuard = new(sync.RWMutex)
+
+	// Listeners use a config that always forwards to the currently active
+	// config so that Reload can swap certificates for new connections.
+	server.config = &tls.Config{
+		ClientAuth: active.ClientAuth,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			server.activeGuard.RLock()
+			defer server.activeGuard.RUnlock()
+			return server.active, nil
+		},
+	}
+}
+
+func (server *TLSServerConfig) newConfig() (*tls.Config, error) {
+	keypair, err := tls.LoadX509KeyPair(server.certificateFile, server.privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{keypair},
+		NextProtos:   server.nextProtos,
+	}
+
+	if server.clientCAFile != "" {
+		pemData, err := ioutil.ReadFile(server.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", server.clientCAFile)
+		}
+
+		if server.clientCertOptional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// Reload reads the certificate, private key and client CA files again.
+// New connections will use the reloaded files, existing connections are not
+// affected. If loading fails, the previous certificates are kept.
+func (server *TLSServerConfig) Reload() error {
+	if server.config == nil {
+		return nil // ### return, TLS disabled ###
+	}
+
+	active, err := server.newConfig()
+	if err != nil {
+		return err
+	}
+
+	server.activeGuard.Lock()
+	server.active = active
+	server.activeGuard.Unlock()
+	return nil
+}
+
+// SetNextProtos sets the application protocols offered during the TLS
+// handshake (ALPN). The protocols are kept when certificates are reloaded.
+func (server *TLSServerConfig) SetNextProtos(protos ...string) {
+	server.nextProtos = protos
+	if server.config == nil {
+		return // ### return, TLS disabled ###
+	}
+
+	server.activeGuard.Lock()
+	active := server.active.Clone()
+	active.NextProtos = protos
+	server.active = active
+	server.activeGuard.Unlock()
+}
+
+// IsEnabled returns true if a certificate has been configured
+func (server *TLSServerConfig) IsEnabled() bool {
+	return server.config != nil
+}
+
+// VerifiesClients returns true if client certificates are checked against
+// a CA bundle.
+func (server *TLSServerConfig) VerifiesClients() bool {
+	return server.config != nil && server.config.ClientAuth != tls.NoClientCert
+}
+
+// GetConfig returns the *tls.Config to be used by listeners or nil if TLS has
+// not been configured. The returned config always uses the certificates
+// loaded by the last successful call to Configure or Reload.
+func (server *TLSServerConfig) GetConfig() *tls.Config {
+	return server.config
+}
+
+// NewListener wraps the given listener so that all accepted connections use
+// TLS. If TLS is not configured, the listener is returned as-is.
+func (server *TLSServerConfig) NewListener(listener net.Listener) net.Listener {
+	if server.config == nil {
+		return listener
+	}
+	return tls.NewListener(listener, server.config)
+}
+
+// GetPeerSubject returns the subject of the verified client certificate of
+// the given connection state. The second return value is false if no client
+// certificate was presented.
+func GetPeerSubject(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	return state.PeerCertificates[0].Subject.String(), true
+}
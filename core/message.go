@@ -209,7 +209,7 @@ func (msg *Message) CloneOriginal() *Message {
 	clone.data.payload = MessageDataPool.Get(len(msg.orig.payload))
 	copy(clone.data.payload, msg.orig.payload)
 
-	if msg.orig.metadata == nil {
+	if msg.orig.metadata != nil {
 		clone.data.metadata = msg.orig.metadata.Clone()
 	} else {
 		clone.data.metadata = nil
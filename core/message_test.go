@@ -149,16 +149,20 @@ func TestMessageCloneOriginalMetadata(t *testing.T) {
 	msgString := "Test for clone original"
 	msgUpdateString := "Test for clone original - UPDATE"
 
-	msg := NewMessage(nil, []byte(msgString), nil, 1)
+	msg := NewMessage(nil, []byte(msgString), Metadata{"foo": []byte("orig")}, 1)
 	msg.FreezeOriginal()
 
 	msg.SetStreamID(MessageStreamID(10))
 	msg.StorePayload([]byte(msgUpdateString))
 	msg.GetMetadata().SetValue("foo", []byte("bar"))
 
-	msg.CloneOriginal()
+	msgClone := msg.CloneOriginal()
 
 	expect.Equal("bar", msg.GetMetadata().GetValueString("foo"))
+	expect.Equal("orig", msgClone.GetMetadata().GetValueString("foo"))
+
+	msgClone.GetMetadata().SetValue("foo", []byte("clone"))
+	expect.Equal("orig", msg.orig.metadata.GetValueString("foo"))
 }
 
 func TestMessageMetadata(t *testing.T) {
@@ -208,6 +208,21 @@ func (cons *SimpleConsumer) EnqueueWithMetadata(data []byte, metaData Metadata)
 	cons.enqueueMessage(msg)
 }
 
+// EnqueueToStream works like EnqueueWithMetadata but sends the message to the
+// given stream instead of the streams configured for this consumer.
+func (cons *SimpleConsumer) EnqueueToStream(data []byte, metaData Metadata, streamID MessageStreamID) {
+	msg := NewMessage(cons, data, metaData, streamID)
+	cons.enqueueMessage(msg)
+}
+
+// EnqueueWithTime works like EnqueueWithMetadata but sets the creation time of
+// the message to the given timestamp instead of the current time.
+func (cons *SimpleConsumer) EnqueueWithTime(data []byte, metaData Metadata, timestamp time.Time) {
+	msg := NewMessage(cons, data, metaData, InvalidStreamID)
+	msg.timestamp = timestamp
+	cons.enqueueMessage(msg)
+}
+
 func (cons *SimpleConsumer) parallelEnqueue(msg *Message) {
 	cons.modulatorQueue.Push(msg, 0)
 }
@@ -221,6 +236,9 @@ loop:
 }
 
 func (cons *SimpleConsumer) directEnqueue(msg *Message) {
+	// Messages enqueued via EnqueueToStream carry their target stream
+	hasTargetStream := msg.GetStreamID() != InvalidStreamID
+
 	// Execute configured modulators
 	switch cons.modulators.Modulate(msg) {
 	case ModulateResultDiscard:
@@ -237,6 +255,18 @@ func (cons *SimpleConsumer) directEnqueue(msg *Message) {
 	CountMessagesEnqueued()
 	MessageTrace(msg, cons.GetID(), "Enqueued by consumer")
 
+	// Messages enqueued via EnqueueToStream bypass the configured streams.
+	// The target is read after modulation so that modulators can change it.
+	if targetStreamID := msg.GetStreamID(); hasTargetStream && targetStreamID != InvalidStreamID {
+		router := StreamRegistry.GetRouterOrFallback(targetStreamID)
+		msg.SetlStreamIDAsOriginal(targetStreamID)
+
+		if err := Route(msg, router); err != nil {
+			cons.Logger.Error(err)
+		}
+		return
+	}
+
 	// Send message to all routers registered to this consumer
 	// Last message will not be cloned.
 	numRouters := len(cons.routers)
@@ -135,3 +135,59 @@ func TestSimpleConsumerStateMethods(t *testing.T) {
 	expect.True(mockSimpleConsumer.IsActiveOrStopping())
 	expect.True(mockSimpleConsumer.IsStopping())
 }
+
+func TestSimpleConsumerEnqueueToStream(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	boundRouter := getMockRouterMessageHelper("enqueueBoundStream")
+	StreamRegistry.Register(&boundRouter, boundRouter.GetStreamID())
+	targetRouter := getMockRouterMessageHelper("enqueueTargetStream")
+	StreamRegistry.Register(&targetRouter, targetRouter.GetStreamID())
+
+	mockConf := NewPluginConfig("mockSimpleConsumerEnqueueToStream", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"enqueueBoundStream"})
+
+	mockSimpleConsumer, err := getSimpleConsumer(mockConf)
+	expect.NoError(err)
+
+	mockSimpleConsumer.EnqueueToStream([]byte("targeted"), nil, targetRouter.GetStreamID())
+	expect.True(targetRouter.messageEnqued)
+	expect.Equal("targeted", targetRouter.lastMessageData)
+	expect.False(boundRouter.messageEnqued)
+
+	mockSimpleConsumer.Enqueue([]byte("bound"))
+	expect.True(boundRouter.messageEnqued)
+	expect.Equal("bound", boundRouter.lastMessageData)
+}
+
+type mockStreamModulator struct {
+	streamID MessageStreamID
+}
+
+func (modulator mockStreamModulator) Modulate(msg *Message) ModulateResult {
+	msg.SetStreamID(modulator.streamID)
+	return ModulateResultContinue
+}
+
+func TestSimpleConsumerEnqueueToStreamModulated(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	targetRouter := getMockRouterMessageHelper("enqueueModulatedTarget")
+	StreamRegistry.Register(&targetRouter, targetRouter.GetStreamID())
+	modulatedRouter := getMockRouterMessageHelper("enqueueModulatedStream")
+	StreamRegistry.Register(&modulatedRouter, modulatedRouter.GetStreamID())
+
+	mockConf := NewPluginConfig("mockSimpleConsumerEnqueueToStreamModulated", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"enqueueModulatedTarget"})
+
+	mockSimpleConsumer, err := getSimpleConsumer(mockConf)
+	expect.NoError(err)
+	mockSimpleConsumer.modulators = ModulatorArray{mockStreamModulator{modulatedRouter.GetStreamID()}}
+
+	// Stream changes done by modulators are used for routing
+	msg := NewMessage(&mockSimpleConsumer, []byte("modulated"), nil, targetRouter.GetStreamID())
+	mockSimpleConsumer.directEnqueue(msg)
+	expect.True(modulatedRouter.messageEnqued)
+	expect.Equal("modulated", modulatedRouter.lastMessageData)
+	expect.False(targetRouter.messageEnqued)
+}
@@ -223,6 +223,18 @@ func (prod *SimpleProducer) TryFallback(msg *Message) {
 	RouteOriginal(msg, prod.fallbackStream)
 }
 
+// TryFallbackWithMetadata works like TryFallback but adds the given metadata
+// to the message routed to the fallback stream, e.g. to pass the reason of a
+// failure.
+func (prod *SimpleProducer) TryFallbackWithMetadata(msg *Message, metadata Metadata) {
+	fallback := msg.CloneOriginal()
+	fallbackMetadata := fallback.GetMetadata()
+	for key, value := range metadata {
+		fallbackMetadata.SetValue(key, value)
+	}
+	Route(fallback, prod.fallbackStream)
+}
+
 // ControlLoop listens to the control channel and triggers callbacks for these
 // messags. Upon stop control message doExit will be set to true.
 func (prod *SimpleProducer) ControlLoop() {
@@ -20,13 +20,19 @@ import (
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/gollum/producer/awsS3"
+	"github.com/trivago/gollum/producer/file"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const defaultAwsEndpoint = "s3.amazonaws.com"
+const (
+	defaultAwsEndpoint = "s3.amazonaws.com"
+	awsS3Sequence      = "{seq}"
+)
 
 // AwsS3 producer plugin
 //
@@ -34,18 +40,49 @@ const defaultAwsEndpoint = "s3.amazonaws.com"
 //
 // Each "file" uses a configurable batch and sends the content by a
 // multipart upload to s3. This principle avoids temporary storage on disk.
+// Data is kept in memory until it has been uploaded. Failed uploads are
+// retried with an exponential backoff until they succeed or, when shutting
+// down, until the shutdown timeout is reached.
 //
 // Please keep in mind that Amazon S3 does not support appending to
 // existing objects. Therefore rotation is mandatory in this producer.
+// Objects are finalized, i.e. the multipart upload is completed, when one of
+// the Rotation limits is reached. This is also checked if no new messages
+// arrive for an object.
 //
 // Parameters
 //
-// - Bucket: The S3 bucket to upload to
+// - Bucket: The S3 bucket to upload to. A folder inside the bucket can be
+// given by using "bucket/folder".
 //
-// - File: This value is used as a template for final file names. The string
-// " * " will replaced with the active stream name.
+// - File: This value is used as a template for object keys. The string
+// "*" will replaced with the active stream name. Metadata values can be
+// inserted by using "{key}". Path separators in metadata values are replaced
+// by "_" and missing values are replaced by "unknown". The time the message
+// was created can be inserted by using "%Y" (year), "%y" (2 digit year), "%m"
+// (month), "%d" (day), "%H" (hour), "%M" (minute), "%S" (second) or "%j"
+// (day of the year). Use "%%" to insert "%". "{seq}" is replaced by a number
+// that is unique for each object. If "{seq}" is not used, the Rotation/Timestamp
+// is appended to the file name.
 // By default this parameter is set to "gollum_*.log"
 //
+// - TimeZone: Defines the time zone used for time placeholders in File, e.g.
+// "UTC" or "Europe/Berlin".
+// By default this parameter is set to "UTC".
+//
+// - Compression: Defines the compression applied to object bodies. Can be set
+// to "none", "gzip", "lz4" or "zstd". The file extension, e.g. ".gz", has to be
+// part of File.
+// By default this parameter is set to "none".
+//
+// - Upload/RetryDelayMs: Defines the number of milliseconds to wait before
+// retrying a failed upload. The delay is doubled for each failed attempt.
+// By default this parameter is set to "1000".
+//
+// - Upload/RetryMaxDelaySec: Defines the maximum number of seconds to wait
+// between two upload attempts.
+// By default this parameter is set to "60".
+//
 // Examples
 //
 // This example sends all received messages from all streams to S3, creating
@@ -73,6 +110,21 @@ const defaultAwsEndpoint = "s3.amazonaws.com"
 //      - format.Envelope:
 //        Postfix: "\n"
 //
+// This example writes gzip compressed objects partitioned by day, hour and
+// host, so that they can be queried by Athena or Hive. Objects are finalized
+// after 15 minutes or when reaching 128 MB:
+//
+//  S3Out:
+//    Type: producer.AwsS3
+//    Streams: "*"
+//    Region: eu-west-1
+//    Bucket: gollum-s3-test/logs
+//    File: dt=%Y-%m-%d/hour=%H/host={host}/part-{seq}.json.gz
+//    Compression: gzip
+//    Rotation:
+//      TimeoutMin: 15
+//      SizeMB: 128
+//
 type AwsS3 struct {
 	core.DirectProducer `gollumdoc:"embed_type"`
 
@@ -84,14 +136,19 @@ type AwsS3 struct {
 	BatchConfig    components.BatchedWriterConfig `gollumdoc:"embed_type"`
 
 	// configurations
-	bucket          string `config:"Bucket" default:""`
-	fileNamePattern string `config:"File" default:"gollum_*.log"`
+	bucket        string        `config:"Bucket" default:""`
+	timeZone      string        `config:"TimeZone" default:"UTC"`
+	compression   string        `config:"Compression" default:"none"`
+	retryDelay    time.Duration `config:"Upload/RetryDelayMs" default:"1000" metric:"ms"`
+	retryMaxDelay time.Duration `config:"Upload/RetryMaxDelaySec" default:"60" metric:"sec"`
 
 	// properties
-	filesByStream    map[core.MessageStreamID]*components.BatchedWriterAssembly
+	keyTemplates     []file.PathTemplate
+	hasSequence      bool
+	sequence         *int64
 	files            map[string]*components.BatchedWriterAssembly
-	hasWildcard      bool
-	batchedFileGuard *sync.RWMutex
+	uploads          *sync.WaitGroup
+	batchedFileGuard *sync.Mutex
 	s3Client         *s3.S3
 }
 
@@ -104,13 +161,29 @@ func (prod *AwsS3) Configure(conf core.PluginConfigReader) {
 	prod.SetRollCallback(prod.rotateTargetFiles)
 	prod.SetStopCallback(prod.close)
 
-	prod.filesByStream = make(map[core.MessageStreamID]*components.BatchedWriterAssembly)
 	prod.files = make(map[string]*components.BatchedWriterAssembly)
+	prod.uploads = new(sync.WaitGroup)
+	prod.sequence = new(int64)
 
-	prod.hasWildcard = strings.IndexByte(prod.fileNamePattern, '*') != -1
 	prod.Rotate.Enabled = true // force rotation
 
-	prod.batchedFileGuard = new(sync.RWMutex)
+	location, err := time.LoadLocation(prod.timeZone)
+	conf.Errors.Push(err)
+
+	// {seq} is resolved per object, so the template is split around it
+	fileNamePattern := conf.GetString("File", "gollum_*.log")
+	prod.hasSequence = strings.Contains(fileNamePattern, awsS3Sequence)
+	for _, pattern := range strings.Split(fileNamePattern, awsS3Sequence) {
+		keyTemplate, err := file.NewPathTemplate(pattern)
+		conf.Errors.Push(err)
+		keyTemplate.SetLocation(location)
+		prod.keyTemplates = append(prod.keyTemplates, keyTemplate)
+	}
+
+	prod.compression = strings.ToLower(prod.compression)
+	conf.Errors.Push(components.ValidateCompression(prod.compression))
+
+	prod.batchedFileGuard = new(sync.Mutex)
 }
 
 // Produce writes to a buffer that is send to S3 as a multipart upload.
@@ -141,56 +214,78 @@ func (prod *AwsS3) initS3Client() {
 	prod.s3Client = s3.New(sess, awsConfig)
 }
 
-func (prod *AwsS3) getBatchedFile(streamID core.MessageStreamID, forceRotate bool) (*components.BatchedWriterAssembly, error) {
-	// get batchedFile from filesByStream[streamID] map
-	prod.batchedFileGuard.RLock()
-	batchedFile, fileExists := prod.filesByStream[streamID]
-	prod.batchedFileGuard.RUnlock()
-	if fileExists {
-		if rotate, err := prod.needsRotate(batchedFile, forceRotate); !rotate {
-			return batchedFile, err // ### return, already open or error ###
-		}
-	}
+func (prod *AwsS3) getBatchedFile(msg *core.Message) (*components.BatchedWriterAssembly, error) {
+	baseFileName := prod.getBaseFileName(msg)
 
 	prod.batchedFileGuard.Lock()
 	defer prod.batchedFileGuard.Unlock()
 
-	// check again to avoid race conditions
-	if batchedFile, fileExists := prod.filesByStream[streamID]; fileExists {
-		if rotate, err := prod.needsRotate(batchedFile, forceRotate); !rotate {
+	batchedFile, fileExists := prod.files[baseFileName]
+	if fileExists {
+		if rotate, err := prod.needsRotate(batchedFile, false); !rotate {
 			return batchedFile, err // ### return, already open or error ###
 		}
-	}
-
-	baseFileName := prod.getBaseFileName(streamID)
-
-	// get batchedFile from files[path] and assure the file is correctly mapped
-	batchedFile, fileExists = prod.files[baseFileName]
-	if !fileExists {
+	} else {
 		batchedFile = components.NewBatchedWriterAssembly(
 			prod.BatchConfig,
 			prod,
 			prod.TryFallback,
 			prod.Logger,
 		)
-
-		prod.filesByStream[streamID] = batchedFile
 		prod.files[baseFileName] = batchedFile
 	}
 
+	prod.rotateBatchedFile(batchedFile, baseFileName)
+	return batchedFile, nil
+}
+
+// rotateBatchedFile finalizes the current object of the given batchedFile
+// and starts a new one. The caller has to hold batchedFileGuard.
+func (prod *AwsS3) rotateBatchedFile(batchedFile *components.BatchedWriterAssembly, baseFileName string) {
+	finalFileName := prod.getFinalFileName(baseFileName)
+
 	// Close existing batchedFile.writer
 	if batchedFile.HasWriter() {
 		oldAwsWriter := batchedFile.GetWriterAndUnset()
 
-		prod.Logger.Info("Rotated ", oldAwsWriter.Name(), " -> ", baseFileName)
-		go oldAwsWriter.Close() // close in subroutine for eventually compression in the background
+		// Assure no flush is writing to the object before it is finalized
+		batchedFile.Batch.WaitForFlush(0)
+
+		prod.Logger.Info("Rotated ", oldAwsWriter.Name(), " -> ", finalFileName)
+		prod.uploads.Add(1)
+		go func() {
+			defer prod.uploads.Done()
+			oldAwsWriter.Close() // upload remaining data in the background
+		}()
 	}
 
 	// Update BatchedWriterAssembly writer
-	writer := awsS3.NewBatchedFileWriter(prod.s3Client, prod.bucket, prod.getFinalFileName(baseFileName), prod.Logger)
+	writer := awsS3.NewBatchedFileWriter(prod.s3Client, prod.bucket, finalFileName, prod.getWriterConfig(), prod.Logger)
 	batchedFile.SetWriter(&writer)
+}
 
-	return batchedFile, nil
+// finalizeBatchedFile flushes the given batchedFile and completes the upload
+// of its object in the background. The caller has to hold batchedFileGuard.
+func (prod *AwsS3) finalizeBatchedFile(baseFileName string) {
+	batchedFile := prod.files[baseFileName]
+	delete(prod.files, baseFileName)
+
+	prod.Logger.Debug("Finalizing ", baseFileName)
+	prod.uploads.Add(1)
+	go func() {
+		defer prod.uploads.Done()
+		batchedFile.Close()
+	}()
+}
+
+func (prod *AwsS3) getWriterConfig() awsS3.WriterConfig {
+	return awsS3.WriterConfig{
+		Compression:     prod.compression,
+		RetryDelay:      prod.retryDelay,
+		RetryMaxDelay:   prod.retryMaxDelay,
+		ShutdownTimeout: prod.GetShutdownTimeout(),
+		IsStopping:      prod.IsStopping,
+	}
 }
 
 func (prod *AwsS3) needsRotate(batchedFile *components.BatchedWriterAssembly, forceRotate bool) (bool, error) {
@@ -211,17 +306,23 @@ func (prod *AwsS3) needsRotate(batchedFile *components.BatchedWriterAssembly, fo
 	return false, nil
 }
 
-func (prod *AwsS3) getBaseFileName(streamID core.MessageStreamID) string {
-	if prod.hasWildcard {
-		streamName := core.StreamRegistry.GetStreamName(streamID)
-		return strings.Replace(prod.fileNamePattern, "*", streamName, -1)
+// getBaseFileName returns the object key for the given message with "{seq}"
+// not being resolved.
+func (prod *AwsS3) getBaseFileName(msg *core.Message) string {
+	parts := make([]string, len(prod.keyTemplates))
+	for i, keyTemplate := range prod.keyTemplates {
+		parts[i] = keyTemplate.Resolve(msg)
 	}
-
-	return prod.fileNamePattern
+	return strings.Join(parts, awsS3Sequence)
 }
 
 //todo: introduce padding functionality (get list from aws)
 func (prod *AwsS3) getFinalFileName(baseFileName string) string {
+	if prod.hasSequence {
+		sequence := strconv.FormatInt(prod.nextSequence(), 10)
+		return strings.Replace(baseFileName, awsS3Sequence, sequence, -1)
+	}
+
 	fileExt := filepath.Ext(baseFileName)
 	fileName := baseFileName[:len(baseFileName)-len(fileExt)]
 
@@ -229,11 +330,25 @@ func (prod *AwsS3) getFinalFileName(baseFileName string) string {
 	signature := fmt.Sprintf("%s_%s", fileName, timestamp)
 
 	return fmt.Sprintf("%s%s", signature, fileExt)
+}
 
+// nextSequence returns a unique, increasing number. The number is based on
+// the current time in milliseconds so that it is not reused after a restart.
+func (prod *AwsS3) nextSequence() int64 {
+	for {
+		last := atomic.LoadInt64(prod.sequence)
+		next := time.Now().UnixNano() / int64(time.Millisecond)
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(prod.sequence, last, next) {
+			return next
+		}
+	}
 }
 
 func (prod *AwsS3) writeMessage(msg *core.Message) {
-	batchedFile, err := prod.getBatchedFile(msg.GetStreamID(), false)
+	batchedFile, err := prod.getBatchedFile(msg)
 	if err != nil {
 		prod.Logger.Error("Write error: ", err)
 		prod.TryFallback(msg)
@@ -244,23 +359,35 @@ func (prod *AwsS3) writeMessage(msg *core.Message) {
 }
 
 func (prod *AwsS3) writeBatchOnTimeOut() {
-	for _, batchedFile := range prod.files {
-		batchedFile.FlushOnTimeOut()
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for baseFileName, batchedFile := range prod.files {
+		if rotate, _ := prod.needsRotate(batchedFile, false); rotate && batchedFile.HasWriter() {
+			prod.finalizeBatchedFile(baseFileName)
+		} else {
+			batchedFile.FlushOnTimeOut()
+		}
 	}
 }
 
 func (prod *AwsS3) rotateTargetFiles() {
-	for streamID := range prod.filesByStream {
-		if _, err := prod.getBatchedFile(streamID, true); err != nil {
-			prod.Logger.Error("Rotate error: ", err)
-		}
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for baseFileName := range prod.files {
+		prod.finalizeBatchedFile(baseFileName)
 	}
 }
 
 func (prod *AwsS3) close() {
 	defer prod.WorkerDone()
 
-	for _, batchedFile := range prod.files {
-		batchedFile.Close()
+	prod.batchedFileGuard.Lock()
+	for baseFileName := range prod.files {
+		prod.finalizeBatchedFile(baseFileName)
 	}
+	prod.batchedFileGuard.Unlock()
+
+	prod.uploads.Wait()
 }
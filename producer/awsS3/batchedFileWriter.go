@@ -15,12 +15,16 @@
 package awsS3
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sirupsen/logrus"
 	"github.com/trivago/gollum/core/components"
 	"strings"
+	"sync"
+	"time"
 )
 
 const minUploadPartSize = 5 * 1024 * 1024
@@ -31,6 +35,16 @@ type BatchedFileWriterInterface interface {
 	GetUploadCount() int
 }
 
+// WriterConfig contains the compression and retry settings of a BatchedFileWriter.
+// Compression is one of the algorithms supported by components.NewStreamCompressor.
+type WriterConfig struct {
+	Compression     string
+	RetryDelay      time.Duration
+	RetryMaxDelay   time.Duration
+	ShutdownTimeout time.Duration
+	IsStopping      func() bool
+}
+
 // BatchedFileWriter is the file producer core.BatchedWriter implementation for the core.BatchedWriterAssembly
 type BatchedFileWriter struct {
 	s3Client    *s3.S3
@@ -38,19 +52,35 @@ type BatchedFileWriter struct {
 	s3SubFolder string
 	fileName    string
 	logger      logrus.FieldLogger
+	config      WriterConfig
+	compressor  components.StreamCompressor
+	guard       *sync.Mutex
 
 	currentMultiPart int64               // current multipart count
 	s3UploadID       *string             // upload id from s3 for active file
 	totalSize        int                 // total size off all writes to this writer (need for rotations)
 	completedParts   []*s3.CompletedPart // collection of uploaded parts
+	retry            int                 // number of failed requests in a row
+	nextRetry        time.Time           // time of the next request after a failed one
 
 	// need separate byte buffer for min 5mb part uploads.
 	// @see http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadComplete.html
 	activeBuffer *s3ByteBuffer
 }
 
+// bufferWriter appends (compressed) data to the active buffer of a writer
+type bufferWriter struct {
+	writer *BatchedFileWriter
+}
+
+func (b bufferWriter) Write(p []byte) (int, error) {
+	b.writer.activeBuffer.Write(p)
+	b.writer.totalSize += len(p)
+	return len(p), nil
+}
+
 // NewBatchedFileWriter returns a BatchedFileWriter instance
-func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, logger logrus.FieldLogger) BatchedFileWriter {
+func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, config WriterConfig, logger logrus.FieldLogger) BatchedFileWriter {
 	var s3Bucket, s3SubFolder string
 
 	if strings.Contains(bucket, "/") {
@@ -67,6 +97,8 @@ func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, logge
 		s3SubFolder: s3SubFolder,
 		fileName:    fileName,
 		logger:      logger,
+		config:      config,
+		guard:       new(sync.Mutex),
 	}
 
 	batchedFileWriter.init()
@@ -80,23 +112,43 @@ func (w *BatchedFileWriter) init() {
 	w.completedParts = []*s3.CompletedPart{}
 	w.activeBuffer = newS3ByteBuffer()
 
-	w.createMultipartUpload()
+	if err := w.createMultipartUpload(); err != nil {
+		w.scheduleRetry()
+	}
 }
 
-// Write is part of the BatchedWriter interface and wraps the file.Write() implementation
+// Write is part of the BatchedWriter interface and wraps the file.Write() implementation.
+// Data is kept in memory until it has been uploaded successfully.
 func (w *BatchedFileWriter) Write(p []byte) (n int, err error) {
-	w.activeBuffer.Write(p)
+	w.guard.Lock()
+	defer w.guard.Unlock()
+
+	if w.compressor == nil && w.config.Compression != "" && w.config.Compression != components.CompressionNone {
+		// The compressor is created here as the writer is copied after init
+		compressor, err := components.NewStreamCompressor(bufferWriter{w}, w.config.Compression, gzip.DefaultCompression)
+		if err != nil {
+			w.logger.WithError(err).Error("Failed to create compressor, writing uncompressed data")
+			w.config.Compression = components.CompressionNone
+		}
+		w.compressor = compressor
+	}
+
+	if w.compressor != nil {
+		w.compressor.Write(p)
+	} else {
+		bufferWriter{w}.Write(p)
+	}
 
 	if size, _ := w.activeBuffer.Size(); size >= minUploadPartSize {
 		w.logger.WithField("size", size).Debug("Buffer size ready for request")
-		w.uploadPartInput()
+		if time.Now().After(w.nextRetry) {
+			w.uploadPartInput()
+		}
 	} else {
 		w.logger.WithField("size", size).Debug("Buffer size not big enough vor request")
 	}
 
-	length := len(p)
-	w.totalSize += length
-	return length, nil
+	return len(p), nil
 }
 
 // Name is part of the BatchedWriter interface and wraps the file.Name() implementation
@@ -104,31 +156,95 @@ func (w *BatchedFileWriter) Name() string {
 	return w.fileName
 }
 
-// Size is part of the BatchedWriter interface and wraps the file.Stat().Size() implementation
+// Size is part of the BatchedWriter interface and returns the size of the
+// (compressed) object written so far.
 func (w *BatchedFileWriter) Size() int64 {
+	w.guard.Lock()
+	defer w.guard.Unlock()
 	return int64(w.totalSize)
 }
 
-// IsAccessible is part of the BatchedWriter interface and check if the writer can access his file
+// IsAccessible is part of the BatchedWriter interface and check if the writer can access his file.
+// Data is kept in memory until it has been uploaded, so the writer is always
+// accessible. Failed requests are retried with the next write or on close.
 func (w *BatchedFileWriter) IsAccessible() bool {
-	return w.s3UploadID != nil
+	return true
 }
 
-// Close is part of the Close interface and handle the file close or compression call
+// Close is part of the Close interface and uploads all remaining data.
+// Failed uploads are retried until they succeed. If the producer is shutting
+// down, retries stop after the shutdown timeout.
 func (w *BatchedFileWriter) Close() error {
-	// flush upload buffer
-	err := w.uploadPartInput()
+	w.guard.Lock()
+	defer w.guard.Unlock()
 
-	w.completeMultipartUpload()
+	if w.compressor != nil {
+		w.compressor.Close()
+		w.compressor = nil
+	}
 
-	return err
+	start := time.Now()
+	for {
+		err := w.finish()
+		if err == nil {
+			return nil // ### return, done ###
+		}
+
+		if w.config.IsStopping != nil && w.config.IsStopping() && time.Since(start) >= w.config.ShutdownTimeout {
+			size, _ := w.activeBuffer.Size()
+			w.logger.WithError(err).Errorf("Giving up to upload %s, %d bytes lost", w.Name(), size)
+			return err // ### return, shutting down ###
+		}
+
+		delay := w.scheduleRetry()
+		w.logger.WithError(err).Warningf("Upload of %s failed, retrying in %v", w.Name(), delay)
+
+		w.guard.Unlock()
+		time.Sleep(delay)
+		w.guard.Lock()
+	}
 }
 
 // GetUploadCount returns the count of completed part uploads
 func (w *BatchedFileWriter) GetUploadCount() int {
+	w.guard.Lock()
+	defer w.guard.Unlock()
 	return len(w.completedParts)
 }
 
+// scheduleRetry sets the time of the next attempt after a failed request and
+// returns the time to wait.
+func (w *BatchedFileWriter) scheduleRetry() time.Duration {
+	delay := w.config.RetryDelay
+	for i := 0; i < w.retry && delay < w.config.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.config.RetryMaxDelay {
+		delay = w.config.RetryMaxDelay
+	}
+
+	w.retry++
+	w.nextRetry = time.Now().Add(delay)
+	return delay
+}
+
+// finish uploads the remaining data and completes the multipart upload
+func (w *BatchedFileWriter) finish() error {
+	if size, _ := w.activeBuffer.Size(); size > 0 {
+		if err := w.uploadPartInput(); err != nil {
+			return err
+		}
+	}
+
+	if w.currentMultiPart < 1 {
+		w.logger.Debug("No completeMultipartUpload request necessary for zero parts")
+		w.abortMultipartUpload()
+		return nil
+	}
+
+	return w.completeMultipartUpload()
+}
+
 func (w *BatchedFileWriter) getS3Path() string {
 	if w.s3SubFolder != "" {
 		return fmt.Sprintf("%s/%s", w.s3SubFolder, w.Name())
@@ -137,32 +253,36 @@ func (w *BatchedFileWriter) getS3Path() string {
 	return w.Name()
 }
 
-func (w *BatchedFileWriter) uploadPartInput() (err error) {
+func (w *BatchedFileWriter) uploadPartInput() error {
 	if size, _ := w.activeBuffer.Size(); size < 1 {
 		w.logger.Warning("uploadPartInput(): empty buffer - no upload necessary")
-		return
+		return nil
 	}
 
-	// increase and get currentMultiPart count
-	w.currentMultiPart++
-	currentMultiPart := w.currentMultiPart
+	if w.s3UploadID == nil {
+		if err := w.createMultipartUpload(); err != nil {
+			w.scheduleRetry()
+			return err
+		}
+	}
 
-	// get and reset active buffer
-	buffer := w.activeBuffer
-	w.activeBuffer = newS3ByteBuffer()
+	currentMultiPart := w.currentMultiPart + 1
+	data, _ := w.activeBuffer.Bytes()
 
 	input := &s3.UploadPartInput{
-		Body:       buffer,
+		Body:       bytes.NewReader(data),
 		Bucket:     aws.String(w.s3Bucket),
 		Key:        aws.String(w.getS3Path()),
 		PartNumber: aws.Int64(currentMultiPart),
 		UploadId:   w.s3UploadID,
 	}
 
+	// The buffer is kept until the upload succeeded
 	result, err := w.s3Client.UploadPart(input)
 	if err != nil {
-		w.logger.WithError(err).WithField("input", input).Errorf("Can't upload part '%d'", currentMultiPart)
-		return
+		w.logger.WithError(err).WithField("file", w.Name()).Errorf("Can't upload part '%d'", currentMultiPart)
+		w.scheduleRetry()
+		return err
 	}
 
 	w.logger.
@@ -174,12 +294,15 @@ func (w *BatchedFileWriter) uploadPartInput() (err error) {
 	completedPart.SetETag(*result.ETag)
 	completedPart.SetPartNumber(currentMultiPart)
 
+	w.currentMultiPart = currentMultiPart
 	w.completedParts = append(w.completedParts, &completedPart)
+	w.activeBuffer = newS3ByteBuffer()
+	w.retry = 0
 
-	return
+	return nil
 }
 
-func (w *BatchedFileWriter) createMultipartUpload() {
+func (w *BatchedFileWriter) createMultipartUpload() error {
 	input := &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(w.s3Bucket),
 		Key:    aws.String(w.getS3Path()),
@@ -188,19 +311,16 @@ func (w *BatchedFileWriter) createMultipartUpload() {
 	result, err := w.s3Client.CreateMultipartUpload(input)
 	if err != nil {
 		w.logger.WithError(err).WithField("file", w.Name()).Error("Can't create multipart upload")
-		return
+		return err
 	}
 
 	w.s3UploadID = result.UploadId
+	w.retry = 0
 	w.logger.WithField("uploadId", result.UploadId).Debug("successfully created multipart upload")
+	return nil
 }
 
-func (w *BatchedFileWriter) completeMultipartUpload() {
-	if w.currentMultiPart < 1 {
-		w.logger.Warning("No completeMultipartUpload request necessary for zero parts")
-		return
-	}
-
+func (w *BatchedFileWriter) completeMultipartUpload() error {
 	input := &s3.CompleteMultipartUploadInput{
 		Bucket:   aws.String(w.s3Bucket),
 		Key:      aws.String(w.getS3Path()),
@@ -213,15 +333,33 @@ func (w *BatchedFileWriter) completeMultipartUpload() {
 	result, err := w.s3Client.CompleteMultipartUpload(input)
 	if err != nil {
 		w.logger.WithError(err).
-			WithField("input", input).
-			WithField("response", result).
+			WithField("file", w.Name()).
 			Error("Can't complete multipart upload")
-		return
+		return err
 	}
 
 	w.logger.
-		WithField("location", *result.Location).
+		WithField("location", aws.StringValue(result.Location)).
 		WithField("parts", len(w.completedParts)).
 		Debug("successfully completed MultipartUpload")
 	w.s3UploadID = nil // reset upload id
+	return nil
+}
+
+// abortMultipartUpload removes an unused multipart upload
+func (w *BatchedFileWriter) abortMultipartUpload() {
+	if w.s3UploadID == nil {
+		return // ### return, nothing to abort ###
+	}
+
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.s3Bucket),
+		Key:      aws.String(w.getS3Path()),
+		UploadId: w.s3UploadID,
+	}
+
+	if _, err := w.s3Client.AbortMultipartUpload(input); err != nil {
+		w.logger.WithError(err).WithField("file", w.Name()).Warning("Can't abort multipart upload")
+	}
+	w.s3UploadID = nil
 }
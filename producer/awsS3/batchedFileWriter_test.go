@@ -0,0 +1,177 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsS3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3StandIn implements the multipart upload requests of S3. Completed
+// objects are stored by path. The given number of part uploads fail.
+type s3StandIn struct {
+	guard       sync.Mutex
+	parts       map[string][]byte
+	objects     map[string][]byte
+	failedParts int
+	aborted     int
+}
+
+func newS3StandIn() *s3StandIn {
+	return &s3StandIn{
+		parts:   make(map[string][]byte),
+		objects: make(map[string][]byte),
+	}
+}
+
+func (standIn *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	standIn.guard.Lock()
+	defer standIn.guard.Unlock()
+
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "POST" && query.Get("uploadId") == "":
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", r.URL.Path)
+
+	case r.Method == "PUT":
+		if standIn.failedParts > 0 {
+			standIn.failedParts--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		standIn.parts[r.URL.Path] = append(standIn.parts[r.URL.Path], body...)
+		w.Header().Set("ETag", "\"etag\"")
+
+	case r.Method == "POST":
+		standIn.objects[r.URL.Path] = standIn.parts[r.URL.Path]
+		delete(standIn.parts, r.URL.Path)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Location>%s</Location></CompleteMultipartUploadResult>", r.URL.Path)
+
+	case r.Method == "DELETE":
+		standIn.aborted++
+		delete(standIn.parts, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestS3Client(url string) *s3.S3 {
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithEndpoint(url).
+		WithS3ForcePathStyle(true).
+		WithMaxRetries(0).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+	return s3.New(sess)
+}
+
+func TestBatchedFileWriterGzip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := newS3StandIn()
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	config := WriterConfig{
+		Compression:   components.CompressionGzip,
+		RetryDelay:    time.Millisecond,
+		RetryMaxDelay: time.Millisecond,
+	}
+	writer := NewBatchedFileWriter(newTestS3Client(server.URL), "logs/folder", "dt=2017-03-04/part-1.gz", config, logrus.StandardLogger())
+
+	writer.Write([]byte("first\n"))
+	writer.Write([]byte("second\n"))
+	expect.True(writer.IsAccessible())
+	expect.NoError(writer.Close())
+	expect.True(writer.Size() > 0)
+	expect.Equal(1, writer.GetUploadCount())
+
+	data, exists := standIn.objects["/logs/folder/dt=2017-03-04/part-1.gz"]
+	expect.True(exists)
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	expect.NoError(err)
+	content, err := ioutil.ReadAll(reader)
+	expect.NoError(err)
+	expect.Equal("first\nsecond\n", string(content))
+
+	config.Compression = components.CompressionZstd
+	writer = NewBatchedFileWriter(newTestS3Client(server.URL), "logs", "part-2.zst", config, logrus.StandardLogger())
+	writer.Write([]byte("first\n"))
+	writer.Write([]byte("second\n"))
+	expect.NoError(writer.Close())
+
+	data, exists = standIn.objects["/logs/part-2.zst"]
+	expect.True(exists)
+
+	decoder, err := zstd.NewReader(bytes.NewReader(data))
+	expect.NoError(err)
+	defer decoder.Close()
+	content, err = ioutil.ReadAll(decoder)
+	expect.NoError(err)
+	expect.Equal("first\nsecond\n", string(content))
+}
+
+func TestBatchedFileWriterRetry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := newS3StandIn()
+	standIn.failedParts = 2
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	config := WriterConfig{
+		Compression:   components.CompressionNone,
+		RetryDelay:    time.Millisecond,
+		RetryMaxDelay: 2 * time.Millisecond,
+	}
+	writer := NewBatchedFileWriter(newTestS3Client(server.URL), "logs", "test.log", config, logrus.StandardLogger())
+
+	// Data has to be kept until the upload succeeded
+	writer.Write([]byte("data\n"))
+	expect.NoError(writer.Close())
+	expect.Equal(0, standIn.failedParts)
+	expect.Equal("data\n", string(standIn.objects["/logs/test.log"]))
+
+	// Empty objects are not created
+	writer = NewBatchedFileWriter(newTestS3Client(server.URL), "logs", "empty.log", config, logrus.StandardLogger())
+	expect.NoError(writer.Close())
+	expect.Equal(1, standIn.aborted)
+	_, exists := standIn.objects["/logs/empty.log"]
+	expect.False(exists)
+
+	// Give up when shutting down
+	standIn.failedParts = 1000
+	config.IsStopping = func() bool { return true }
+	writer = NewBatchedFileWriter(newTestS3Client(server.URL), "logs", "lost.log", config, logrus.StandardLogger())
+	writer.Write([]byte("data\n"))
+	expect.NotNil(writer.Close())
+}
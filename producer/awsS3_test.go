@@ -0,0 +1,64 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAwsS3ObjectKeys(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testAwsS3ObjectKeys", "producer.AwsS3")
+	config.Override("Bucket", "logs")
+	config.Override("File", "dt=%Y-%m-%d/hour=%H/host={host}/part-{seq}.json.gz")
+	config.Override("Compression", "gzip")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*AwsS3)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{"host": []byte("web/1")}, core.InvalidStreamID)
+	timestamp := msg.GetCreationTime().In(time.UTC)
+
+	baseFileName := prod.getBaseFileName(msg)
+	expect.Equal(timestamp.Format("dt=2006-01-02/hour=15")+"/host=web_1/part-{seq}.json.gz", baseFileName)
+
+	first := prod.getFinalFileName(baseFileName)
+	second := prod.getFinalFileName(baseFileName)
+	expect.True(strings.HasPrefix(first, timestamp.Format("dt=2006-01-02/hour=15")+"/host=web_1/part-"))
+	expect.True(strings.HasSuffix(first, ".json.gz"))
+	expect.Neq(first, second)
+
+	// Without {seq} the rotation timestamp is appended
+	prod.hasSequence = false
+	prod.Rotate.Timestamp = "2006"
+	expect.Equal("dir/test_"+time.Now().Format("2006")+".log", prod.getFinalFileName("dir/test.log"))
+
+	config = core.NewPluginConfig("testAwsS3ObjectKeysZstd", "producer.AwsS3")
+	config.Override("Compression", "zstd")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	config = core.NewPluginConfig("testAwsS3ObjectKeysRar", "producer.AwsS3")
+	config.Override("Compression", "rar")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,365 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sqsMaxBatchEntries = 10
+	sqsMaxBatchSize    = 256 * 1024
+	sqsMaxAttributes   = 10
+)
+
+// AwsSQS producer plugin
+//
+// This producer sends messages to AWS SQS queues. Messages are sent in
+// batches of up to 10 messages using SendMessageBatch. Messages that could not
+// be sent because of a server side error are retried. Messages that still
+// fail after all retries or that are rejected by SQS are passed to the
+// fallback.
+//
+// When sending to a FIFO queue (the queue name ends with ".fifo"), the message
+// group id and deduplication id are read from the message metadata.
+//
+// Parameters
+//
+// - QueueMapping: This value defines a translation from gollum stream names
+// to SQS queue names or queue urls. If no mapping is given, the gollum stream
+// name is used as the queue name.
+// By default this parameter is set to "empty"
+//
+// - GroupIdFrom: This value defines the metadata key holding the message
+// group id used for FIFO queues. If the key is not set or not present, the
+// value of DefaultGroupId is used.
+// By default this parameter is set to "".
+//
+// - DefaultGroupId: This value defines the message group id used for FIFO
+// queues if no group id is found in the metadata.
+// By default this parameter is set to "gollum".
+//
+// - DeduplicationIdFrom: This value defines the metadata key holding the
+// message deduplication id used for FIFO queues. If the key is not set or not
+// present, no deduplication id is sent and the queue has to use content based
+// deduplication.
+// By default this parameter is set to "".
+//
+// - AttributesFrom: This value defines a list of metadata keys that are sent
+// as string message attributes. At most 10 attributes are allowed.
+// By default this parameter is set to "".
+//
+// - RetryCount: This value defines the number of times messages failing with
+// a server side error are resent.
+// By default this parameter is set to "3".
+//
+// - RetryDelayMs: This value defines the number of milliseconds to wait before
+// resending failed messages. The delay is multiplied by the number of
+// the retry.
+// By default this parameter is set to "1000".
+//
+// Examples
+//
+// This example sends messages to a FIFO queue using the metadata field
+// "user" as message group id:
+//
+//  SqsOut:
+//    Type: producer.AwsSQS
+//    Streams: "*"
+//    Region: eu-west-1
+//    QueueMapping:
+//      "*": "events.fifo"
+//    GroupIdFrom: user
+//    DeduplicationIdFrom: eventId
+//    AttributesFrom:
+//      - source
+type AwsSQS struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+
+	// AwsMultiClient is public to make AwsMultiClient.Configure() callable (bug in treflect package)
+	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
+
+	groupIDField    string        `config:"GroupIdFrom"`
+	defaultGroupID  string        `config:"DefaultGroupId" default:"gollum"`
+	dedupIDField    string        `config:"DeduplicationIdFrom"`
+	attributeFields []string      `config:"AttributesFrom"`
+	retryCount      int           `config:"RetryCount" default:"3"`
+	retryDelay      time.Duration `config:"RetryDelayMs" default:"1000" metric:"ms"`
+
+	client     *sqs.SQS
+	queueMap   map[core.MessageStreamID]string
+	queueURLs  map[string]string
+	queueGuard *sync.Mutex
+}
+
+// sqsEntry links a batch request entry to the message it was created from
+type sqsEntry struct {
+	request *sqs.SendMessageBatchRequestEntry
+	msg     *core.Message
+	size    int
+}
+
+func init() {
+	core.TypeRegistry.Register(AwsSQS{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *AwsSQS) Configure(conf core.PluginConfigReader) {
+	prod.queueMap = conf.GetStreamMap("QueueMapping", "")
+	prod.queueURLs = make(map[string]string)
+	prod.queueGuard = new(sync.Mutex)
+
+	if len(prod.attributeFields) > sqsMaxAttributes {
+		conf.Errors.Pushf("AttributesFrom must not contain more than %d keys", sqsMaxAttributes)
+	}
+	if prod.retryCount < 0 {
+		prod.retryCount = 0
+	}
+}
+
+// Produce sends batches of messages to SQS
+func (prod *AwsSQS) Produce(workers *sync.WaitGroup) {
+	defer prod.WorkerDone()
+
+	prod.AddMainWorker(workers)
+	prod.initSQSClient()
+	prod.BatchMessageLoop(workers, prod.sendBatch)
+}
+
+func (prod *AwsSQS) initSQSClient() {
+	sess, err := prod.AwsMultiClient.NewSessionWithOptions()
+	if err != nil {
+		prod.Logger.WithError(err).Error("Can't get proper aws config")
+	}
+
+	awsConfig := prod.AwsMultiClient.GetConfig()
+
+	// set auto endpoint to sqs if setting is empty
+	if awsConfig.Endpoint == nil || *awsConfig.Endpoint == "" {
+		awsConfig.WithEndpoint(fmt.Sprintf("sqs.%s.amazonaws.com", *awsConfig.Region))
+	}
+
+	prod.client = sqs.New(sess, awsConfig)
+}
+
+// getQueueURL returns the url of the queue the given stream is mapped to.
+// Queue names are resolved using GetQueueUrl and cached.
+func (prod *AwsSQS) getQueueURL(streamID core.MessageStreamID) (string, error) {
+	queue, isMapped := prod.queueMap[streamID]
+	if !isMapped || queue == "" {
+		queue = prod.queueMap[core.WildcardStreamID]
+	}
+	if queue == "" {
+		queue = core.StreamRegistry.GetStreamName(streamID)
+	}
+
+	if strings.HasPrefix(queue, "https://") || strings.HasPrefix(queue, "http://") {
+		return queue, nil
+	}
+
+	prod.queueGuard.Lock()
+	defer prod.queueGuard.Unlock()
+
+	if url, isKnown := prod.queueURLs[queue]; isKnown {
+		return url, nil
+	}
+
+	result, err := prod.client.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+	if err != nil {
+		return "", err
+	}
+
+	url := aws.StringValue(result.QueueUrl)
+	prod.queueURLs[queue] = url
+	return url, nil
+}
+
+// newSQSEntry creates a batch request entry for the given message
+func (prod *AwsSQS) newSQSEntry(msg *core.Message, isFifo bool) sqsEntry {
+	body := string(msg.GetPayload())
+	entry := sqsEntry{
+		request: &sqs.SendMessageBatchRequestEntry{
+			MessageBody: aws.String(body),
+		},
+		msg:  msg,
+		size: len(body),
+	}
+
+	metadata := msg.TryGetMetadata()
+	getValue := func(key string) string {
+		if metadata == nil || key == "" {
+			return ""
+		}
+		return metadata.GetValueString(key)
+	}
+
+	if isFifo {
+		groupID := getValue(prod.groupIDField)
+		if groupID == "" {
+			groupID = prod.defaultGroupID
+		}
+		entry.request.MessageGroupId = aws.String(groupID)
+
+		if dedupID := getValue(prod.dedupIDField); dedupID != "" {
+			entry.request.MessageDeduplicationId = aws.String(dedupID)
+		}
+	}
+
+	for _, key := range prod.attributeFields {
+		value := getValue(key)
+		if value == "" {
+			continue // ### continue, attributes must not be empty ###
+		}
+		if entry.request.MessageAttributes == nil {
+			entry.request.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+		}
+		entry.request.MessageAttributes[key] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+		entry.size += len(key) + len("String") + len(value)
+	}
+
+	return entry
+}
+
+// splitSQSBatches splits the given entries into batches that respect the
+// SendMessageBatch limits. Entries that exceed the size limit on their own
+// are returned separately.
+func splitSQSBatches(entries []sqsEntry) (batches [][]sqsEntry, oversized []sqsEntry) {
+	batch := []sqsEntry{}
+	batchSize := 0
+
+	for _, entry := range entries {
+		if entry.size > sqsMaxBatchSize {
+			oversized = append(oversized, entry)
+			continue // ### continue, too large ###
+		}
+
+		if len(batch) == sqsMaxBatchEntries || batchSize+entry.size > sqsMaxBatchSize {
+			batches = append(batches, batch)
+			batch = []sqsEntry{}
+			batchSize = 0
+		}
+
+		batch = append(batch, entry)
+		batchSize += entry.size
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, oversized
+}
+
+func (prod *AwsSQS) sendBatch() core.AssemblyFunc {
+	return prod.sendMessages
+}
+
+func (prod *AwsSQS) sendMessages(messages []*core.Message) {
+	queues := make(map[string][]sqsEntry)
+	queueOrder := []string{}
+
+	for _, msg := range messages {
+		url, err := prod.getQueueURL(msg.GetStreamID())
+		if err != nil {
+			prod.Logger.WithError(err).Errorf("Failed to resolve queue url for stream %s", msg.GetStreamID().GetName())
+			prod.TryFallback(msg)
+			continue // ### continue, unknown queue ###
+		}
+
+		if _, isKnown := queues[url]; !isKnown {
+			queueOrder = append(queueOrder, url)
+		}
+		queues[url] = append(queues[url], prod.newSQSEntry(msg, strings.HasSuffix(url, ".fifo")))
+	}
+
+	for _, url := range queueOrder {
+		batches, oversized := splitSQSBatches(queues[url])
+		for _, entry := range oversized {
+			prod.Logger.Errorf("Message of %d bytes exceeds the SQS size limit", entry.size)
+			prod.TryFallback(entry.msg)
+		}
+
+		for _, batch := range batches {
+			prod.sendSQSBatch(url, batch)
+		}
+	}
+}
+
+// sendSQSBatch sends a batch of entries to the given queue. Entries failing
+// with a server side error are resent up to RetryCount times.
+func (prod *AwsSQS) sendSQSBatch(url string, batch []sqsEntry) {
+	pending := batch
+	for retry := 0; len(pending) > 0; retry++ {
+		input := &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(url),
+			Entries:  make([]*sqs.SendMessageBatchRequestEntry, 0, len(pending)),
+		}
+
+		entries := make(map[string]sqsEntry, len(pending))
+		for idx, entry := range pending {
+			id := strconv.Itoa(idx)
+			entry.request.Id = aws.String(id)
+			entries[id] = entry
+			input.Entries = append(input.Entries, entry.request)
+		}
+
+		result, err := prod.client.SendMessageBatch(input)
+		failed := []sqsEntry{}
+
+		if err != nil {
+			prod.Logger.WithError(err).Errorf("Failed to send messages to %s", url)
+			failed = pending
+		} else {
+			for _, failure := range result.Failed {
+				entry, isKnown := entries[aws.StringValue(failure.Id)]
+				if !isKnown {
+					continue // ### continue, unknown entry ###
+				}
+
+				if aws.BoolValue(failure.SenderFault) {
+					prod.Logger.Errorf("Message rejected by %s: %s", url, aws.StringValue(failure.Message))
+					prod.TryFallback(entry.msg)
+					continue // ### continue, not retryable ###
+				}
+				failed = append(failed, entry)
+			}
+		}
+
+		if len(failed) == 0 {
+			return // ### return, done ###
+		}
+
+		if retry >= prod.retryCount {
+			prod.Logger.Errorf("Failed to send %d messages to %s after %d retries", len(failed), url, retry)
+			for _, entry := range failed {
+				prod.TryFallback(entry.msg)
+			}
+			return // ### return, retries exceeded ###
+		}
+
+		time.Sleep(prod.retryDelay * time.Duration(retry+1))
+		pending = failed
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sqsStandIn implements SendMessageBatch. The first attempt to send a body
+// listed in failOnce fails with a server side error.
+type sqsStandIn struct {
+	failOnce map[string]bool
+	bodies   []string
+	groupIDs []string
+	guard    sync.Mutex
+}
+
+func (queue *sqsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	queue.guard.Lock()
+	defer queue.guard.Unlock()
+
+	r.ParseForm()
+	response := "<SendMessageBatchResponse><SendMessageBatchResult>"
+	for i := 1; r.Form.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+		prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i)
+		id := r.Form.Get(prefix + "Id")
+		body := r.Form.Get(prefix + "MessageBody")
+
+		if queue.failOnce[body] {
+			delete(queue.failOnce, body)
+			response += "<BatchResultErrorEntry><Id>" + id + "</Id><Code>InternalError</Code><Message>failed</Message><SenderFault>false</SenderFault></BatchResultErrorEntry>"
+			continue
+		}
+
+		queue.bodies = append(queue.bodies, body)
+		queue.groupIDs = append(queue.groupIDs, r.Form.Get(prefix+"MessageGroupId"))
+		checksum := md5.Sum([]byte(body))
+		response += "<SendMessageBatchResultEntry><Id>" + id + "</Id><MessageId>" + id + "</MessageId><MD5OfMessageBody>" + hex.EncodeToString(checksum[:]) + "</MD5OfMessageBody></SendMessageBatchResultEntry>"
+	}
+	response += "</SendMessageBatchResult><ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></SendMessageBatchResponse>"
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(response))
+}
+
+func newTestSQSMessage(payload, group string) *core.Message {
+	metadata := core.Metadata{}
+	if group != "" {
+		metadata.SetValue("group", []byte(group))
+	}
+	return core.NewMessage(nil, []byte(payload), metadata, core.InvalidStreamID)
+}
+
+func TestSQSBatches(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	entries := []sqsEntry{}
+	for i := 0; i < 12; i++ {
+		entries = append(entries, sqsEntry{size: 1024})
+	}
+	entries = append(entries, sqsEntry{size: sqsMaxBatchSize + 1})
+	entries = append(entries, sqsEntry{size: sqsMaxBatchSize - 1024})
+
+	batches, oversized := splitSQSBatches(entries)
+	expect.Equal(1, len(oversized))
+	expect.Equal(3, len(batches))
+	expect.Equal(10, len(batches[0]))
+	expect.Equal(2, len(batches[1]))
+	expect.Equal(1, len(batches[2]))
+}
+
+func TestSQSSendRetry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &sqsStandIn{failOnce: map[string]bool{"b": true}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	config := core.NewPluginConfig("testSQSSendRetry", "producer.AwsSQS")
+	config.Override("QueueMapping", map[string]string{"*": server.URL + "/123/events.fifo"})
+	config.Override("GroupIdFrom", "group")
+	config.Override("RetryDelayMs", 1)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*AwsSQS)
+	expect.True(casted)
+
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithEndpoint(server.URL).
+		WithMaxRetries(0).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+	prod.client = sqs.New(sess)
+
+	prod.sendMessages([]*core.Message{
+		newTestSQSMessage("a", "user1"),
+		newTestSQSMessage("b", "user2"),
+		newTestSQSMessage("c", ""),
+	})
+
+	expect.Equal("a,c,b", strings.Join(standIn.bodies, ","))
+	expect.Equal("user1,gollum,user2", strings.Join(standIn.groupIDs, ","))
+}
@@ -16,7 +16,11 @@ package producer
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -24,6 +28,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/producer/file"
 	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/tcontainer"
 	"gopkg.in/olivere/elastic.v5"
@@ -34,16 +39,51 @@ import (
 // The ElasticSearch producer sends messages to elastic search using the bulk
 // http API. The producer expects a json payload.
 //
+// The result of each document in a bulk request is checked. Documents
+// rejected with a retryable status (429 or 5xx) are sent again. Documents
+// that cannot be written, e.g. because of a mapping conflict, or that still
+// fail after all retries are sent to the fallback stream. The following
+// metadata is added to these messages:
+//
+// - error: The reason reported by Elasticsearch
+//
+// - error_type: The error type reported by Elasticsearch, e.g.
+// "mapper_parsing_exception"
+//
+// - status_code: The http status of the document, if available
+//
 // Parameters
 //
 // - Retry/Count: Set the amount of retries before a Elasticsearch request
-// fail finally.
+// fail finally. This value also defines how often documents rejected with a
+// retryable status are sent again.
 // By default this parameter is set to "3".
 //
 // - Retry/TimeToWaitSec: This value denotes the time in seconds after which a
 // failed dataset will be  transmitted again.
 // By default this parameter is set to "3".
 //
+// - IdFrom: This value defines the metadata key holding the document id. If
+// the key is not set or not present, Elasticsearch generates an id.
+// Setting an id allows idempotent writes.
+// By default this parameter is set to "".
+//
+// - RoutingFrom: This value defines the metadata key holding the routing
+// value of the document. If the key is not set or not present, no routing is
+// sent.
+// By default this parameter is set to "".
+//
+// - OpType: This value defines how documents are written. Valid values are
+// "index" (create or replace), "create" (only write documents not existing
+// yet) and "upsert" (create or merge into an existing document). Documents
+// rejected by "create" because they already exist are treated as written.
+// "upsert" requires a document id.
+// By default this parameter is set to "index".
+//
+// - OpTypeFrom: This value defines the metadata key holding the op type to use
+// for a message. If the key is not set or not present, OpType is used.
+// By default this parameter is set to "".
+//
 // - SetGzip: This value enables or disables gzip compression for Elasticsearch
 // requests (disabled by default). This option is used one to one for the library
 // package. See http://godoc.org/gopkg.in/olivere/elastic.v5#SetGzip
@@ -61,21 +101,37 @@ import (
 // As index use the stream name here.
 //
 // - StreamProperties/<streamName>/Index: The value defines the Elasticsearch
-// index used for the stream.
+// index used for the stream. The name uses the placeholders of producer.File:
+// "{field}" is replaced by a metadata value or, if no such metadata key
+// exists, by a field of the json payload. Nested fields are separated by
+// dots. Inserted values are converted to lowercase. "*" is replaced by the
+// stream name. The time verbs %Y, %y, %m, %d, %H, %M, %S and %j insert the
+// time read from TimestampFrom, e.g. "logs-{service}-%Y.%m.%d".
 //
 // - StreamProperties/<streamName>/Type: This value defines the document type
-// used for the stream.
+// used for the stream. Leave this value empty for Elasticsearch 7 and later.
+//
+// - StreamProperties/<streamName>/DataStream: When set to "true", Index names
+// a data stream. All documents are written using the "create" op type and
+// no indices are created by the producer. Data streams require Elasticsearch
+// 7.9 or later and an index template enabling data streams for the name.
+// By default this parameter is set to "false".
 //
 // - StreamProperties/<streamName>/TimeBasedIndex: This value can be set to "true"
 // to append the date of the message to the index as in "<index>_<TimeBasedFormat>".
-// NOTE: This setting incurs a performance penalty because it is necessary to
-// check if an index exists for each message!
 // By default this parameter is set to "false".
 //
 // - StreamProperties/<streamName>/TimeBasedFormat: This value can be set to a valid
 // go time format string to be used with DayBasedIndex.
 // By default this parameter is set to "2006-01-02".
 //
+// - StreamProperties/<streamName>/TimestampFrom: This value defines the
+// metadata key or payload field holding the time used by TimeBasedIndex and
+// the time verbs of Index. RFC3339 and unix timestamps are supported and
+// converted to UTC. If not set or if the field does not contain a valid time,
+// the time the message was created is used.
+// By default this parameter is set to "".
+//
 // - StreamProperties/<streamName>/Mapping: This value is a map which is used
 // for the document field mapping. As document type, the already defined type is
 // reused for the field mapping. See
@@ -85,6 +141,32 @@ import (
 // for the index settings. See
 // https://www.elastic.co/guide/en/elasticsearch/reference/5.4/indices-create-index.html#mappings
 //
+// For streams writing to changing indices, i.e. streams using placeholders,
+// TimeBasedIndex or DataStream, Mapping and Settings are installed as an
+// index template named "gollum-<streamName>" when the producer starts. For data
+// streams, this template also enables the data stream. If the template cannot
+// be installed, the indices are created when they are first written to.
+// Existing indices are remembered, so each index is only checked once.
+//
+// - IndexTemplates: This value defines a map of index templates that are
+// installed when the producer starts. The key is the template name and the
+// value is the template as expected by Elasticsearch. Templates that could not
+// be installed are installed before the next batch is sent. Messages for data
+// streams are not sent until their template has been installed.
+// By default this parameter is set to "empty".
+//
+// - LegacyTemplates: When set to "true", index templates are installed using
+// the "_template" API instead of the "_index_template" API available since
+// Elasticsearch 7.8. Data streams cannot be enabled using legacy templates.
+// By default this parameter is set to "false".
+//
+// - TemplatePriority: This value defines the priority of the index templates
+// installed for StreamProperties. It has to be higher than the priority of
+// other templates matching the same indices, e.g. the built-in "logs-*-*"
+// template of Elasticsearch, which uses a priority of 100. Legacy templates
+// do not have a priority.
+// By default this parameter is set to "200".
+//
 // Examples
 //
 // This example starts a simple twitter example producer for local running ElasticSearch:
@@ -107,18 +189,84 @@ import (
 //        Settings:
 //          number_of_shards: 1
 //          number_of_replicas: 1
+//
+// This example writes documents idempotently using the id stored in the
+// metadata field "uuid":
+//
+//  producerElasticSearch:
+//    Type: producer.ElasticSearch
+//    Streams: events
+//    FallbackStream: events_failed
+//    IdFrom: uuid
+//    OpType: create
+//    StreamProperties:
+//      events:
+//        Index: events
+//        Type: event
+//
+// This example writes to one data stream per service using the service name
+// stored in the metadata:
+//
+//  producerElasticSearch:
+//    Type: producer.ElasticSearch
+//    Streams: logs
+//    StreamProperties:
+//      logs:
+//        Index: "logs-{service}-default"
+//        DataStream: true
+//        Mapping:
+//          "@timestamp": date
+//          message: text
 type ElasticSearch struct {
 	core.BatchedProducer `gollumdoc:"embed_type"`
 	connection           elasticConnection
 	indexMap             map[core.MessageStreamID]*indexMapItem
+	idField              string
+	routingField         string
+	opType               string
+	opTypeField          string
+	indexTemplates       tcontainer.MarshalMap
+	legacyTemplates      bool
+	templatePriority     int64
+	installedTemplates   map[string]bool
+	templatesPending     bool
+	knownIndices         map[string]bool
+	knownIndicesGuard    *sync.Mutex
+}
+
+const elasticMaxKnownIndices = 1000
+
+const (
+	elasticOpIndex  = "index"
+	elasticOpCreate = "create"
+	elasticOpUpsert = "upsert"
+)
+
+// elasticBulkItem links a bulk request to the message it was created from
+type elasticBulkItem struct {
+	msg     *core.Message
+	opType  string
+	request elastic.BulkableRequest
+}
+
+// elasticFailure holds a message that could not be written and the reason
+type elasticFailure struct {
+	msg       *core.Message
+	status    int
+	errorType string
+	reason    string
 }
 
 type indexMapItem struct {
-	name         string
-	typeName     string
-	settings     *elasticIndex
-	useTimeIndex bool
-	timeFormat   string
+	name              string
+	template          file.PathTemplate
+	typeName          string
+	settings          *elasticIndex
+	useTimeIndex      bool
+	timeFormat        string
+	timestampField    string
+	dataStream        bool
+	templateInstalled bool
 }
 
 func newIndexMapItem() *indexMapItem {
@@ -127,11 +275,53 @@ func newIndexMapItem() *indexMapItem {
 	}
 }
 
-func (item *indexMapItem) GetIndexName(t time.Time) string {
+// GetIndexName returns the name of the index the given message is written to
+func (item *indexMapItem) GetIndexName(msg *core.Message) string {
+	if !item.isDynamic() {
+		return item.name
+	}
+
+	fields := newElasticMessageFields(msg)
+	timestamp := msg.GetCreationTime()
+	if item.timestampField != "" {
+		timestamp = fields.getTime(item.timestampField)
+	}
+
+	name := item.template.Format(msg, func(field string) string {
+		value, _ := fields.get(field)
+		return sanitizeElasticIndexName(value)
+	}, timestamp)
+
 	if item.useTimeIndex {
-		return item.name + t.Format(item.timeFormat)
+		name += timestamp.Format(item.timeFormat)
+	}
+	return name
+}
+
+// isDynamic returns true if messages of this stream may be written to
+// different indices
+func (item *indexMapItem) isDynamic() bool {
+	return item.useTimeIndex || item.template.IsDynamic()
+}
+
+// hasTemplate returns true if an index template should be installed for this
+// stream when the producer starts
+func (item *indexMapItem) hasTemplate() bool {
+	if !item.isDynamic() && !item.dataStream {
+		return false
+	}
+	if item.dataStream {
+		return true
+	}
+	if item.settings == nil {
+		return false
+	}
+	for _, mapping := range item.settings.Mappings {
+		if len(mapping.Properties) > 0 {
+			return true
+		}
 	}
-	return item.name
+	return len(item.settings.Settings) > 0
 }
 
 type elasticIndex struct {
@@ -185,6 +375,22 @@ func (prod *ElasticSearch) Configure(conf core.PluginConfigReader) {
 	prod.connection.setGzip = conf.GetBool("SetGzip", false)
 	prod.connection.isConnectedStatus = false
 
+	prod.idField = conf.GetString("IdFrom", "")
+	prod.routingField = conf.GetString("RoutingFrom", "")
+	prod.opTypeField = conf.GetString("OpTypeFrom", "")
+	prod.opType = strings.ToLower(conf.GetString("OpType", elasticOpIndex))
+	if !isElasticOpType(prod.opType) {
+		conf.Errors.Pushf("Unknown op type '%s'", prod.opType)
+	}
+
+	prod.indexTemplates = conf.GetMap("IndexTemplates", tcontainer.NewMarshalMap())
+	prod.legacyTemplates = conf.GetBool("LegacyTemplates", false)
+	prod.templatePriority = conf.GetInt("TemplatePriority", 200)
+	prod.installedTemplates = make(map[string]bool)
+	prod.templatesPending = true
+	prod.knownIndices = make(map[string]bool)
+	prod.knownIndicesGuard = new(sync.Mutex)
+
 	prod.configureIndexSettings(conf.GetMap("StreamProperties", tcontainer.NewMarshalMap()), conf.Errors)
 	prod.configureRetrySettings(conf.GetInt("Retry/Count", 3), conf.GetInt("Retry/TimeToWaitSec", 3))
 }
@@ -223,7 +429,15 @@ func (prod *ElasticSearch) configureIndexSettings(properties tcontainer.MarshalM
 			continue
 		}
 
+		indexMapItem.template, err = file.NewPathTemplate(indexMapItem.name)
+		if err != nil {
+			errors.Push(err)
+			continue
+		}
+
 		indexMapItem.useTimeIndex, _ = property.Bool("TimeBasedIndex")
+		indexMapItem.timestampField, _ = property.String("TimestampFrom")
+		indexMapItem.dataStream, _ = property.Bool("DataStream")
 		timeFormat, _ := property.String("TimeBasedFormat")
 		if len(timeFormat) == 0 {
 			timeFormat = "2006-01-02"
@@ -231,7 +445,7 @@ func (prod *ElasticSearch) configureIndexSettings(properties tcontainer.MarshalM
 		indexMapItem.timeFormat = "_" + timeFormat
 
 		indexMapItem.typeName, err = property.String("Type")
-		if err != nil {
+		if err != nil && !indexMapItem.dataStream {
 			prod.Logger.Errorf("no data type configured for stream '%s'. Please check your config.", streamName)
 		}
 
@@ -262,7 +476,80 @@ func (prod *ElasticSearch) indexExists(client *elastic.Client, indexName string)
 	return exists
 }
 
+// isKnownIndex returns true if the given index is known to exist
+func (prod *ElasticSearch) isKnownIndex(indexName string) bool {
+	prod.knownIndicesGuard.Lock()
+	defer prod.knownIndicesGuard.Unlock()
+	return prod.knownIndices[indexName]
+}
+
+// setKnownIndex remembers an existing index. The cache is reset when it grows
+// too large, e.g. when writing to daily indices for a long time.
+func (prod *ElasticSearch) setKnownIndex(indexName string) {
+	prod.knownIndicesGuard.Lock()
+	defer prod.knownIndicesGuard.Unlock()
+	if len(prod.knownIndices) >= elasticMaxKnownIndices {
+		prod.knownIndices = make(map[string]bool)
+	}
+	prod.knownIndices[indexName] = true
+}
+
+// installTemplates installs the configured index templates and the templates
+// generated for streams writing to changing indices. Templates that have been
+// installed before are skipped.
+func (prod *ElasticSearch) installTemplates() {
+	client := prod.getClient()
+	if client == nil {
+		return // ### return, not connected ###
+	}
+
+	api := "/_index_template/"
+	if prod.legacyTemplates {
+		api = "/_template/"
+	}
+
+	isComplete := true
+	for name := range prod.indexTemplates {
+		if prod.installedTemplates[name] {
+			continue // ### continue, already installed ###
+		}
+
+		template, _ := prod.indexTemplates.Value(name)
+		if _, err := client.PerformRequest(context.Background(), "PUT", api+name, nil, template); err != nil {
+			prod.Logger.WithError(err).Errorf("Failed to install index template %s", name)
+			isComplete = false
+			continue // ### continue, retry later ###
+		}
+
+		prod.Logger.Debugf("Installed index template %s", name)
+		prod.installedTemplates[name] = true
+	}
+
+	for streamID, item := range prod.indexMap {
+		if !item.hasTemplate() || item.templateInstalled {
+			continue // ### continue, no template required ###
+		}
+
+		name := "gollum-" + strings.ToLower(streamID.GetName())
+		template := item.newIndexTemplate(prod.legacyTemplates, prod.templatePriority)
+		if _, err := client.PerformRequest(context.Background(), "PUT", api+name, nil, template); err != nil {
+			prod.Logger.WithError(err).Errorf("Failed to install index template %s", name)
+			isComplete = false
+			continue // ### continue, create indices until installed ###
+		}
+
+		prod.Logger.Debugf("Installed index template %s", name)
+		item.templateInstalled = true
+	}
+
+	prod.templatesPending = !isComplete
+}
+
 func (prod *ElasticSearch) createIndexIfRequired(indexName string, settings *elasticIndex) bool {
+	if prod.isKnownIndex(indexName) {
+		return true
+	}
+
 	client := prod.getClient()
 	if client == nil {
 		return false
@@ -278,6 +565,7 @@ func (prod *ElasticSearch) createIndexIfRequired(indexName string, settings *ela
 
 	if settings == nil {
 		prod.Logger.Debugf("No settings for index %s", indexName)
+		prod.setKnownIndex(indexName)
 		return true
 	}
 
@@ -295,29 +583,193 @@ func (prod *ElasticSearch) createIndexIfRequired(indexName string, settings *ela
 		}
 	}
 
+	prod.setKnownIndex(indexName)
 	return true
 }
 
+func isElasticOpType(opType string) bool {
+	switch opType {
+	case elasticOpIndex, elasticOpCreate, elasticOpUpsert:
+		return true
+	default:
+		return false
+	}
+}
+
+// newBulkItem creates the bulk request for a message written to the given
+// index. Id, routing and op type are read from the message metadata if
+// configured.
+func (prod *ElasticSearch) newBulkItem(msg *core.Message, indexMapItem *indexMapItem, index string) (elasticBulkItem, error) {
+	metadata := msg.TryGetMetadata()
+	getValue := func(key string) string {
+		if metadata == nil || key == "" {
+			return ""
+		}
+		return metadata.GetValueString(key)
+	}
+
+	opType := prod.opType
+	if value := getValue(prod.opTypeField); value != "" {
+		opType = strings.ToLower(value)
+	}
+	id := getValue(prod.idField)
+	routing := getValue(prod.routingField)
+
+	if indexMapItem.dataStream {
+		if opType == elasticOpUpsert {
+			return elasticBulkItem{}, errors.New("Data streams do not support upserts")
+		}
+		opType = elasticOpCreate
+	}
+
+	switch opType {
+	case elasticOpIndex, elasticOpCreate:
+		request := elastic.NewBulkIndexRequest().
+			Index(index).
+			Type(indexMapItem.typeName).
+			OpType(opType).
+			Doc(msg.String())
+		if id != "" {
+			request.Id(id)
+		}
+		if routing != "" {
+			request.Routing(routing)
+		}
+		return elasticBulkItem{msg: msg, opType: opType, request: request}, nil
+
+	case elasticOpUpsert:
+		if id == "" {
+			return elasticBulkItem{}, errors.New("Upsert requires a document id")
+		}
+		if !json.Valid(msg.GetPayload()) {
+			return elasticBulkItem{}, errors.New("Upsert requires a json document")
+		}
+		request := elastic.NewBulkUpdateRequest().
+			Index(index).
+			Type(indexMapItem.typeName).
+			Id(id).
+			Doc(json.RawMessage(msg.GetPayload())).
+			DocAsUpsert(true)
+		if routing != "" {
+			request.Routing(routing)
+		}
+		return elasticBulkItem{msg: msg, opType: opType, request: request}, nil
+
+	default:
+		return elasticBulkItem{}, fmt.Errorf("Unknown op type '%s'", opType)
+	}
+}
+
+// isElasticRetryable returns true if a document rejected with the given
+// status may succeed when sent again.
+func isElasticRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// getBulkItemResult returns the result of the bulk response item
+// at the given position.
+func getBulkItemResult(response *elastic.BulkResponse, idx int) *elastic.BulkResponseItem {
+	if response == nil || idx >= len(response.Items) {
+		return nil
+	}
+	for _, result := range response.Items[idx] {
+		return result
+	}
+	return nil
+}
+
+// sendBulk sends the given items and resends documents rejected with a
+// retryable status. Documents that could not be written are returned.
+func (prod *ElasticSearch) sendBulk(client *elastic.Client, items []elasticBulkItem) []elasticFailure {
+	failures := []elasticFailure{}
+	pending := items
+
+	for retry := 0; len(pending) > 0; retry++ {
+		bulkRequest := client.Bulk()
+		for _, item := range pending {
+			bulkRequest.Add(item.request)
+		}
+
+		// NumberOfActions contains the number of requests in a bulk
+		prod.Logger.Debugf("bulkRequest.NumberOfActions: %d", bulkRequest.NumberOfActions())
+
+		// Do sends the bulk requests to Elasticsearch. Connection errors
+		// have already been retried by the client.
+		bulkResponse, err := bulkRequest.Do(context.Background())
+		if err != nil {
+			prod.Logger.WithError(err).Errorf("Could not send '%d' messages to Elasticsearch", len(pending))
+			for _, item := range pending {
+				failures = append(failures, elasticFailure{msg: item.msg, reason: err.Error()})
+			}
+			return failures
+		}
+
+		retryable := []elasticBulkItem{}
+		lastFailures := []elasticFailure{}
+		numFailed := len(failures)
+		for idx, item := range pending {
+			result := getBulkItemResult(bulkResponse, idx)
+			switch {
+			case result == nil:
+				failures = append(failures, elasticFailure{msg: item.msg, reason: "No result returned for document"})
+
+			case result.Status >= 200 && result.Status < 300:
+				// ok
+
+			case result.Status == http.StatusConflict && item.opType == elasticOpCreate:
+				prod.Logger.Debugf("Document %s already exists in %s", result.Id, result.Index)
+
+			default:
+				failure := elasticFailure{msg: item.msg, status: result.Status}
+				if result.Error != nil {
+					failure.errorType = result.Error.Type
+					failure.reason = result.Error.Reason
+				}
+
+				if isElasticRetryable(result.Status) {
+					retryable = append(retryable, item)
+					lastFailures = append(lastFailures, failure)
+				} else {
+					prod.Logger.Warningf("Document rejected by %s with status %d: %s", result.Index, result.Status, failure.reason)
+					failures = append(failures, failure)
+				}
+			}
+		}
+
+		numFailed = len(failures) - numFailed + len(retryable)
+		prod.Logger.Debugf("%d of %d messages written to Elasticsearch", len(pending)-numFailed, len(pending))
+
+		if len(retryable) > 0 && retry >= prod.connection.retrier.retry {
+			prod.Logger.Errorf("Failed to write %d documents after %d retries", len(retryable), retry)
+			return append(failures, lastFailures...)
+		}
+
+		if len(retryable) > 0 {
+			wait, _ := prod.connection.retrier.backoff.Next(retry)
+			time.Sleep(wait)
+		}
+		pending = retryable
+	}
+
+	return failures
+}
+
 func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 	client := prod.getClient()
 	if client == nil {
 		prod.Logger.Error("Failed to get client. Cannot send messages")
-	}
-
-	// Handle time based index creation
-	timeBasedIndexes := make(map[string]*elasticIndex)
-	for _, msg := range messages {
-		if item, isSet := prod.indexMap[msg.GetStreamID()]; isSet && item.useTimeIndex {
-			timeBasedIndexes[item.GetIndexName(msg.GetCreationTime())] = item.settings
+		for _, msg := range messages {
+			prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte("No connection to Elasticsearch")})
 		}
+		return // ### return, not connected ###
 	}
 
-	for indexName, settings := range timeBasedIndexes {
-		prod.createIndexIfRequired(indexName, settings)
+	if prod.templatesPending {
+		prod.installTemplates()
 	}
 
-	// Send messages
-	bulkRequest := client.Bulk()
+	// Create requests and indices not covered by an index template
+	items := make([]elasticBulkItem, 0, len(messages))
 	for _, msg := range messages {
 		indexMapItem, isSet := prod.indexMap[msg.GetStreamID()]
 		if !isSet {
@@ -325,37 +777,39 @@ func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 			continue
 		}
 
-		bulkIndexRequest := elastic.NewBulkIndexRequest()
-		bulkIndexRequest.Index(indexMapItem.GetIndexName(msg.GetCreationTime())).
-			Type(indexMapItem.typeName).
-			Doc(msg.String())
-
-		bulkRequest.Add(bulkIndexRequest)
-	}
+		// Writing to a data stream without template creates a plain index
+		if indexMapItem.dataStream && !indexMapItem.templateInstalled {
+			prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte("Index template for data stream not installed")})
+			continue
+		}
 
-	// NumberOfActions contains the number of requests in a bulk
-	prod.Logger.Debugf("bulkRequest.NumberOfActions: %d", bulkRequest.NumberOfActions())
+		index := indexMapItem.GetIndexName(msg)
+		if indexMapItem.isDynamic() && !indexMapItem.dataStream && !indexMapItem.templateInstalled {
+			prod.createIndexIfRequired(index, indexMapItem.settings)
+		}
 
-	// Do sends the bulk requests to Elasticsearch
-	bulkResponse, err := bulkRequest.Do(context.Background())
-	if err != nil {
-		prod.Logger.Error(err)
+		item, err := prod.newBulkItem(msg, indexMapItem, index)
+		if err != nil {
+			prod.Logger.WithError(err).Warning("Cannot create request for message")
+			prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte(err.Error())})
+			continue
+		}
+		items = append(items, item)
 	}
 
-	// Bulk request actions get cleared
-	numberOfActionsAfter := bulkRequest.NumberOfActions()
-	if numberOfActionsAfter != 0 {
-		prod.Logger.Errorf("Could not send '%d' messages to Elasticsearch", numberOfActionsAfter)
+	if len(items) == 0 {
+		return // ### return, nothing to send ###
 	}
 
-	if bulkResponse != nil {
-		// Indexed returns information abount indexed documents
-		indexed := bulkResponse.Indexed()
-		prod.Logger.Debugf("%d messages indexed successfully in Elasticsearch", len(indexed))
-
-		// Created returns information about created documents
-		created := bulkResponse.Created()
-		prod.Logger.Debugf("%d messages created successfully in Elasticsearch", len(created))
+	for _, failure := range prod.sendBulk(client, items) {
+		metadata := core.Metadata{"error": []byte(failure.reason)}
+		if failure.errorType != "" {
+			metadata.SetValue("error_type", []byte(failure.errorType))
+		}
+		if failure.status != 0 {
+			metadata.SetValue("status_code", []byte(strconv.Itoa(failure.status)))
+		}
+		prod.TryFallbackWithMetadata(failure.msg, metadata)
 	}
 }
 
@@ -363,9 +817,11 @@ func (prod *ElasticSearch) submitMessages(messages []*core.Message) {
 func (prod *ElasticSearch) Produce(workers *sync.WaitGroup) {
 	defer prod.WorkerDone()
 
+	prod.installTemplates()
+
 	// create all indexes that are not time based
 	for _, item := range prod.indexMap {
-		if !item.useTimeIndex {
+		if !item.isDynamic() && !item.dataStream {
 			prod.createIndexIfRequired(item.name, item.settings)
 		}
 	}
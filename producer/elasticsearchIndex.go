@@ -0,0 +1,178 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// elasticMessageFields reads field values from the metadata or the json
+// payload of a message. The payload is parsed only once and only if needed.
+type elasticMessageFields struct {
+	msg     *core.Message
+	payload map[string]interface{}
+	parsed  bool
+}
+
+// sanitizeElasticIndexName converts a value to lowercase and replaces all
+// characters not allowed in index names.
+func sanitizeElasticIndexName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':':
+			return '_'
+		default:
+			return r
+		}
+	}, strings.ToLower(value))
+}
+
+func newElasticMessageFields(msg *core.Message) *elasticMessageFields {
+	return &elasticMessageFields{msg: msg}
+}
+
+// get returns the value of a metadata key or, if not present, of a field in
+// the json payload. Nested fields are separated by dots.
+func (fields *elasticMessageFields) get(field string) (string, bool) {
+	if metadata := fields.msg.TryGetMetadata(); metadata != nil {
+		if value, isSet := metadata[field]; isSet {
+			return string(value), true
+		}
+	}
+
+	if !fields.parsed {
+		fields.parsed = true
+		if err := json.Unmarshal(fields.msg.GetPayload(), &fields.payload); err != nil {
+			fields.payload = nil
+		}
+	}
+
+	var value interface{} = fields.payload
+	if direct, isSet := fields.payload[field]; isSet {
+		value = direct
+	} else {
+		for _, key := range strings.Split(field, ".") {
+			object, isObject := value.(map[string]interface{})
+			if !isObject {
+				return "", false
+			}
+			if value, isObject = object[key]; !isObject {
+				return "", false
+			}
+		}
+	}
+
+	switch typed := value.(type) {
+	case string:
+		return typed, true
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64), true
+	case nil:
+		return "", false
+	default:
+		encoded, _ := json.Marshal(typed)
+		return string(encoded), true
+	}
+}
+
+// getTime returns the time stored in the given field in UTC or the creation
+// time of the message if the field is not present or not a valid time.
+func (fields *elasticMessageFields) getTime(field string) time.Time {
+	if value, isSet := fields.get(field); isSet {
+		if parsed, isValid := parseElasticTime(value); isValid {
+			return parsed.UTC()
+		}
+	}
+	return fields.msg.GetCreationTime().UTC()
+}
+
+// parseElasticTime parses RFC3339 timestamps and unix timestamps in seconds,
+// milliseconds or microseconds.
+func parseElasticTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, true
+		}
+	}
+
+	epoch, err := strconv.ParseFloat(value, 64)
+	if err != nil || epoch <= 0 {
+		return time.Time{}, false
+	}
+
+	switch {
+	case epoch < 1e11:
+		return time.Unix(0, int64(epoch*float64(time.Second))), true
+	case epoch < 1e14:
+		return time.Unix(0, int64(epoch*float64(time.Millisecond))), true
+	default:
+		return time.Unix(0, int64(epoch*float64(time.Microsecond))), true
+	}
+}
+
+// newIndexTemplate returns an index template matching all indices written
+// by the given stream, containing its mapping and settings. The priority is
+// only set for composable templates.
+func (item *indexMapItem) newIndexTemplate(legacy bool, priority int64) map[string]interface{} {
+	pattern := item.template.Pattern()
+	if item.useTimeIndex && !strings.HasSuffix(pattern, "*") {
+		pattern += "*"
+	}
+
+	settings := map[string]interface{}{}
+	mappings := map[string]interface{}{}
+	if item.settings != nil {
+		for key, value := range item.settings.Settings {
+			settings[key] = value
+		}
+		for typeName, mapping := range item.settings.Mappings {
+			if len(mapping.Properties) == 0 {
+				continue // ### continue, no mapping ###
+			}
+			if legacy {
+				mappings[typeName] = mapping
+			} else {
+				mappings["properties"] = mapping.Properties
+			}
+		}
+	}
+
+	content := map[string]interface{}{}
+	if len(settings) > 0 {
+		content["settings"] = settings
+	}
+	if len(mappings) > 0 {
+		content["mappings"] = mappings
+	}
+
+	if legacy {
+		content["index_patterns"] = []string{pattern}
+		return content
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"priority":       priority,
+		"template":       content,
+	}
+	if item.dataStream {
+		template["data_stream"] = map[string]interface{}{}
+	}
+	return template
+}
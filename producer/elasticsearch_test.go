@@ -0,0 +1,308 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/producer/file"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// elasticStandIn answers bulk requests. Documents containing "reject" fail
+// with a mapping error, documents containing "busy" fail with 429 once. The
+// first failTemplates template requests fail with 500.
+type elasticStandIn struct {
+	guard         sync.Mutex
+	actions       []string
+	busy          map[string]bool
+	templates     map[string]string
+	failTemplates int
+}
+
+func (standIn *elasticStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	standIn.guard.Lock()
+	defer standIn.guard.Unlock()
+
+	if r.URL.Path != "/_bulk" {
+		if r.Method == "PUT" && standIn.failTemplates > 0 {
+			standIn.failTemplates--
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error":"unavailable"}`)
+			return
+		}
+		if r.Method == "PUT" && standIn.templates != nil {
+			body, _ := ioutil.ReadAll(r.Body)
+			standIn.templates[r.URL.Path] = string(body)
+		}
+		fmt.Fprint(w, "{}")
+		return
+	}
+
+	items := []map[string]interface{}{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		action := scanner.Text()
+		scanner.Scan()
+		doc := scanner.Text()
+		standIn.actions = append(standIn.actions, action)
+
+		opType := "index"
+		for op := range map[string]bool{"index": true, "create": true, "update": true} {
+			if strings.HasPrefix(action, `{"`+op+`"`) {
+				opType = op
+			}
+		}
+
+		result := map[string]interface{}{"_index": "test", "status": 201}
+		switch {
+		case strings.Contains(doc, "reject"):
+			result["status"] = 400
+			result["error"] = map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse"}
+		case strings.Contains(doc, "exists"):
+			result["status"] = 409
+			result["error"] = map[string]string{"type": "version_conflict_engine_exception", "reason": "document already exists"}
+		case strings.Contains(doc, "busy") && !standIn.busy[doc]:
+			standIn.busy[doc] = true
+			result["status"] = 429
+			result["error"] = map[string]string{"type": "es_rejected_execution_exception", "reason": "queue full"}
+		}
+		items = append(items, map[string]interface{}{opType: result})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": true, "items": items})
+}
+
+func newTestElasticMessage(payload string, metadata core.Metadata) *core.Message {
+	return core.NewMessage(nil, []byte(payload), metadata, core.GetStreamID("elastic"))
+}
+
+func TestElasticSearchBulkFailures(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &elasticStandIn{busy: make(map[string]bool)}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	config := core.NewPluginConfig("testElasticSearchBulkFailures", "producer.ElasticSearch")
+	config.Override("Servers", []string{server.URL})
+	config.Override("Retry/TimeToWaitSec", 0)
+	config.Override("IdFrom", "id")
+	config.Override("RoutingFrom", "user")
+	config.Override("OpType", "create")
+	config.Override("StreamProperties", map[string]interface{}{
+		"elastic": map[string]interface{}{"Index": "test", "Type": "log"},
+	})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*ElasticSearch)
+	expect.True(casted)
+
+	client := prod.getClient()
+	expect.NotNil(client)
+
+	messages := []*core.Message{
+		newTestElasticMessage(`{"msg":"ok"}`, core.Metadata{"id": []byte("1"), "user": []byte("alice")}),
+		newTestElasticMessage(`{"msg":"reject"}`, nil),
+		newTestElasticMessage(`{"msg":"busy"}`, nil),
+		newTestElasticMessage(`{"msg":"exists"}`, core.Metadata{"id": []byte("2")}),
+	}
+
+	items := []elasticBulkItem{}
+	for _, msg := range messages {
+		item, err := prod.newBulkItem(msg, prod.indexMap[msg.GetStreamID()], "test")
+		expect.NoError(err)
+		items = append(items, item)
+	}
+
+	failures := prod.sendBulk(client, items)
+	expect.Equal(1, len(failures))
+	expect.Equal(messages[1], failures[0].msg)
+	expect.Equal(400, failures[0].status)
+	expect.Equal("mapper_parsing_exception", failures[0].errorType)
+
+	expect.Equal(5, len(standIn.actions))
+	expect.Equal(`{"create":{"_id":"1","_index":"test","_type":"log","_routing":"alice"}}`, standIn.actions[0])
+	expect.Equal(`{"create":{"_index":"test","_type":"log"}}`, standIn.actions[2])
+	expect.Equal(`{"create":{"_index":"test","_type":"log"}}`, standIn.actions[4])
+}
+
+func TestElasticSearchOpTypes(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testElasticSearchOpTypes", "producer.ElasticSearch")
+	config.Override("IdFrom", "id")
+	config.Override("OpTypeFrom", "op")
+	config.Override("StreamProperties", map[string]interface{}{
+		"elastic": map[string]interface{}{"Index": "test", "Type": "log"},
+	})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*ElasticSearch)
+	expect.True(casted)
+	indexMapItem := prod.indexMap[core.GetStreamID("elastic")]
+
+	item, err := prod.newBulkItem(newTestElasticMessage(`{"a":1}`, nil), indexMapItem, "test")
+	expect.NoError(err)
+	expect.Equal(elasticOpIndex, item.opType)
+
+	item, err = prod.newBulkItem(newTestElasticMessage(`{"a":1}`, core.Metadata{"op": []byte("UPSERT"), "id": []byte("7")}), indexMapItem, "test")
+	expect.NoError(err)
+	source, err := item.request.Source()
+	expect.NoError(err)
+	expect.Equal(`{"update":{"_id":"7","_index":"test","_type":"log"}}`, source[0])
+	expect.Equal(`{"doc":{"a":1},"doc_as_upsert":true}`, source[1])
+
+	_, err = prod.newBulkItem(newTestElasticMessage(`{"a":1}`, core.Metadata{"op": []byte("upsert")}), indexMapItem, "test")
+	expect.NotNil(err)
+
+	_, err = prod.newBulkItem(newTestElasticMessage(`not json`, core.Metadata{"op": []byte("upsert"), "id": []byte("7")}), indexMapItem, "test")
+	expect.NotNil(err)
+
+	_, err = prod.newBulkItem(newTestElasticMessage(`{"a":1}`, core.Metadata{"op": []byte("delete")}), indexMapItem, "test")
+	expect.NotNil(err)
+
+	expect.True(isElasticRetryable(429))
+	expect.True(isElasticRetryable(503))
+	expect.False(isElasticRetryable(400))
+}
+
+func TestElasticSearchIndexName(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	var err error
+	item := newIndexMapItem()
+	item.timestampField = "@timestamp"
+	item.template, err = file.NewPathTemplate("logs-{service}-%Y.%m.%d")
+	expect.NoError(err)
+	expect.True(item.isDynamic())
+
+	msg := newTestElasticMessage(`{"@timestamp":"2017-03-04T23:30:00-02:00","app":{"name":"Web Shop"}}`, core.Metadata{"service": []byte("Billing")})
+	expect.Equal("logs-billing-2017.03.05", item.GetIndexName(msg))
+
+	item.template, err = file.NewPathTemplate("{app.name}_{missing}")
+	expect.NoError(err)
+	expect.Equal("web_shop_", item.GetIndexName(msg))
+
+	item.name = "static"
+	item.template, err = file.NewPathTemplate(item.name)
+	expect.NoError(err)
+	expect.False(item.isDynamic())
+	expect.Equal("static", item.GetIndexName(msg))
+
+	for _, value := range []string{"1488670200", "1488670200000", "1488670200000000", "2017-03-04T23:30:00Z"} {
+		parsed, isValid := parseElasticTime(value)
+		expect.True(isValid)
+		expect.Equal(int64(1488670200), parsed.Unix())
+	}
+	_, isValid := parseElasticTime("yesterday")
+	expect.False(isValid)
+}
+
+func TestElasticSearchTemplates(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &elasticStandIn{busy: make(map[string]bool), templates: make(map[string]string)}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	config := core.NewPluginConfig("testElasticSearchTemplates", "producer.ElasticSearch")
+	config.Override("Servers", []string{server.URL})
+	config.Override("IndexTemplates", map[string]interface{}{
+		"custom": map[string]interface{}{"index_patterns": []string{"custom-*"}},
+	})
+	config.Override("StreamProperties", map[string]interface{}{
+		"elastic": map[string]interface{}{
+			"Index":         "logs-{service}",
+			"DataStream":    true,
+			"TimestampFrom": "@timestamp",
+			"Mapping":       map[string]interface{}{"message": "text"},
+		},
+		"static": map[string]interface{}{"Index": "static"},
+	})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*ElasticSearch)
+	expect.True(casted)
+
+	prod.installTemplates()
+	expect.Equal(2, len(standIn.templates))
+	expect.Equal(`{"index_patterns":["custom-*"]}`, strings.TrimSpace(standIn.templates["/_index_template/custom"]))
+	expect.Equal(`{"data_stream":{},"index_patterns":["logs-*"],"priority":200,"template":{"mappings":{"properties":{"message":{"type":"text"}}}}}`,
+		strings.TrimSpace(standIn.templates["/_index_template/gollum-elastic"]))
+
+	indexMapItem := prod.indexMap[core.GetStreamID("elastic")]
+	expect.True(indexMapItem.templateInstalled)
+	expect.False(prod.indexMap[core.GetStreamID("static")].hasTemplate())
+
+	msg := newTestElasticMessage(`{"a":1}`, core.Metadata{"service": []byte("api")})
+	index := indexMapItem.GetIndexName(msg)
+	expect.Equal("logs-api", index)
+
+	item, err := prod.newBulkItem(msg, indexMapItem, index)
+	expect.NoError(err)
+	expect.Equal(elasticOpCreate, item.opType)
+
+	expect.False(prod.isKnownIndex("static"))
+	expect.True(prod.createIndexIfRequired("static", nil))
+	expect.True(prod.isKnownIndex("static"))
+}
+
+func TestElasticSearchTemplateRetry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &elasticStandIn{busy: make(map[string]bool), templates: make(map[string]string), failTemplates: 2}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	config := core.NewPluginConfig("testElasticSearchTemplateRetry", "producer.ElasticSearch")
+	config.Override("Servers", []string{server.URL})
+	config.Override("StreamProperties", map[string]interface{}{
+		"elastic": map[string]interface{}{"Index": "logs-{service}", "DataStream": true},
+	})
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*ElasticSearch)
+	expect.True(casted)
+
+	prod.installTemplates()
+	expect.True(prod.templatesPending)
+	expect.False(prod.indexMap[core.GetStreamID("elastic")].templateInstalled)
+
+	// Data streams are not written to without template
+	msg := newTestElasticMessage(`{"a":1}`, core.Metadata{"service": []byte("api")})
+	prod.submitMessages([]*core.Message{msg})
+	expect.True(prod.templatesPending)
+	expect.Equal(0, len(standIn.actions))
+
+	// The template is installed before the next batch
+	prod.submitMessages([]*core.Message{msg})
+	expect.False(prod.templatesPending)
+	expect.True(prod.indexMap[core.GetStreamID("elastic")].templateInstalled)
+	expect.Equal(1, len(standIn.templates))
+	expect.Equal(1, len(standIn.actions))
+}
@@ -19,10 +19,12 @@ import (
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/gollum/producer/file"
+	"github.com/trivago/tgo/tio"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // File producer plugin
@@ -31,14 +33,32 @@ import (
 // rotation and compression of the rotated logs. Folders in the file path will
 // be created if necessary.
 //
-// Each target file will handled with separated batch processing.
+// Each target file will handled with separated batch processing. Rotation
+// and pruning are applied to each file separately. Pruning only considers
+// the rotated versions of a file, so files created for other placeholder
+// values, e.g. for previous days, are not pruned.
 //
 // Parameters
 //
 // - File: This value contains the path to the log file to write. The wildcard character "*"
-// can be used as a placeholder for the stream name.
+// can be used as a placeholder for the stream name. Metadata values can be
+// inserted by using "{key}". Path separators in metadata values are replaced
+// by "_" and missing values are replaced by "unknown". The time the message
+// was created can be inserted by using "%Y" (year), "%y" (2 digit year), "%m"
+// (month), "%d" (day), "%H" (hour), "%M" (minute), "%S" (second) or "%j"
+// (day of the year). Use "%%" to insert "%".
 // By default this parameter is set to "/var/log/gollum.log".
 //
+// - MaxOpenFiles: This value defines the maximum number of files kept open.
+// If this limit is reached, the least recently used file is closed. Set this
+// value to "0" to not limit the number of open files.
+// By default this parameter is set to "128".
+//
+// - IdleTimeoutSec: This value defines the number of seconds after which a
+// file that has not been written to is closed. Files are opened again when
+// required. Set this value to "0" to keep files open.
+// By default this parameter is set to "0".
+//
 // - FileOverwrite: This value causes the file to be overwritten instead of appending new data
 // to it.
 // By default this parameter is set to "false".
@@ -51,6 +71,25 @@ import (
 // the folders as an octal number.
 // By default this paramater is set to "0755".
 //
+// - Compression: Defines the compression used when writing files. Can be set
+// to "none", "gzip", "lz4" or "zstd". Files are compressed while being written
+// and the matching extension, i.e. ".gz", ".lz4" or ".zst", is appended to the
+// file name. Compressed data is flushed after each batch, so files can be read
+// up to the last batch written. For zstd, each batch is written as a separate
+// frame. When compression is set, Rotation/Compress is ignored.
+// By default this parameter is set to "none".
+//
+// - CompressionLevel: Defines the gzip compression level from 1 (fastest) to 9
+// (best). For lz4, a level of 9 enables high compression. For zstd, levels 1-2
+// select the fastest, 3-5 the default and 6-9 better compression.
+// By default this parameter is set to "-1" (default compression).
+//
+// - StreamCompression: Defines a map of stream names to compression
+// algorithms to override Compression for specific streams. Streams writing
+// to the same file with different compression settings write to separate
+// files.
+// By default this parameter is set to "empty".
+//
 // Examples
 //
 // This example will write the messages from all streams to `/tmp/gollum.log`
@@ -65,6 +104,35 @@ import (
 //      FlushCount: 64
 //      TimeoutSec: 60
 //      FlushTimeoutSec: 3
+//
+// This example writes one lz4 compressed file per stream and gzip compresses
+// the stream "access". Files are rotated every hour:
+//
+//  fileOut:
+//    Type: producer.File
+//    Streams: "*"
+//    File: /var/log/gollum/*.log
+//    Compression: lz4
+//    StreamCompression:
+//      access: gzip
+//    Rotation:
+//      Enable: true
+//      TimeoutMin: 60
+//
+// This example writes one file per host and service. Files are rotated once a
+// day and only the last seven rotated files are kept. Files not written to for
+// ten minutes are closed:
+//
+//  fileOut:
+//    Type: producer.File
+//    Streams: "*"
+//    File: /var/log/gollum/{host}/{service}.log
+//    IdleTimeoutSec: 600
+//    Rotation:
+//      Enable: true
+//      At: "00:00"
+//    Prune:
+//      Count: 7
 type File struct {
 	core.DirectProducer `gollumdoc:"embed_type"`
 
@@ -76,41 +144,63 @@ type File struct {
 	BatchConfig components.BatchedWriterConfig `gollumdoc:"embed_type"`
 
 	// configuration
-	overwriteFile     bool        `config:"FileOverwrite"`
-	filePermissions   os.FileMode `config:"Permissions" default:"0644"`
-	folderPermissions os.FileMode `config:"FolderPermissions" default:"0755"`
+	overwriteFile     bool          `config:"FileOverwrite"`
+	filePermissions   os.FileMode   `config:"Permissions" default:"0644"`
+	folderPermissions os.FileMode   `config:"FolderPermissions" default:"0755"`
+	compression       string        `config:"Compression" default:"none"`
+	compressionLevel  int           `config:"CompressionLevel" default:"-1"`
+	maxOpenFiles      int           `config:"MaxOpenFiles" default:"128"`
+	idleTimeout       time.Duration `config:"IdleTimeoutSec" default:"0" metric:"sec"`
+	streamCompression map[core.MessageStreamID]string
 
 	// properties
-	filesByStream    map[core.MessageStreamID]*components.BatchedWriterAssembly // mapped files by stream
-	files            map[string]*components.BatchedWriterAssembly               // unique files by target path
-	fileDir          string
-	fileName         string
-	fileExt          string
-	wildcardPath     bool
+	files            map[string]*fileTarget // open files by target path
+	path             file.PathTemplate
 	batchedFileGuard *sync.RWMutex
 }
 
+// fileTarget is an open file written by the file producer
+type fileTarget struct {
+	lastUsed    int64 // unix nano, accessed atomically
+	batchedFile *components.BatchedWriterAssembly
+	target      file.TargetFile
+}
+
+// touch marks the file as being used now
+func (openFile *fileTarget) touch() {
+	atomic.StoreInt64(&openFile.lastUsed, time.Now().UnixNano())
+}
+
+// getLastUsed returns the time the file has last been used
+func (openFile *fileTarget) getLastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&openFile.lastUsed))
+}
+
 func init() {
 	core.TypeRegistry.Register(File{})
 }
 
 // Configure initializes this producer with values from a plugin config.
 func (prod *File) Configure(conf core.PluginConfigReader) {
+	var err error
 	prod.Pruner.Logger = prod.Logger
 
 	prod.SetRollCallback(prod.rotateLog)
 	prod.SetStopCallback(prod.close)
 
-	prod.filesByStream = make(map[core.MessageStreamID]*components.BatchedWriterAssembly)
-	prod.files = make(map[string]*components.BatchedWriterAssembly)
+	prod.files = make(map[string]*fileTarget)
 
-	logFile := conf.GetString("File", "/var/log/gollum.log")
-	prod.wildcardPath = strings.IndexByte(logFile, '*') != -1
+	prod.path, err = file.NewPathTemplate(conf.GetString("File", "/var/log/gollum.log"))
+	conf.Errors.Push(err)
 
-	prod.fileDir = filepath.Dir(logFile)
-	prod.fileExt = filepath.Ext(logFile)
-	prod.fileName = filepath.Base(logFile)
-	prod.fileName = prod.fileName[:len(prod.fileName)-len(prod.fileExt)]
+	prod.compression = strings.ToLower(prod.compression)
+	conf.Errors.Push(components.ValidateCompression(prod.compression))
+
+	prod.streamCompression = conf.GetStreamMap("StreamCompression", "")
+	for streamID, compression := range prod.streamCompression {
+		prod.streamCompression[streamID] = strings.ToLower(compression)
+		conf.Errors.Push(components.ValidateCompression(strings.ToLower(compression)))
+	}
 
 	prod.batchedFileGuard = new(sync.RWMutex)
 }
@@ -121,16 +211,18 @@ func (prod *File) Produce(workers *sync.WaitGroup) {
 	prod.TickerMessageControlLoop(prod.writeMessage, prod.BatchConfig.BatchTimeout, prod.writeBatchOnTimeOut)
 }
 
-func (prod *File) getBatchedFile(streamID core.MessageStreamID) (*components.BatchedWriterAssembly, error) {
-	var err error
+func (prod *File) getBatchedFile(msg *core.Message) (*components.BatchedWriterAssembly, error) {
+	streamTargetFile := prod.newTargetFile(msg)
+	targetPath := streamTargetFile.GetCompressedPath()
 
-	// get batchedFile from filesByStream[streamID] map
+	// get batchedFile from files[path] and check for rotation
 	prod.batchedFileGuard.RLock()
-	batchedFile, fileIsLinked := prod.filesByStream[streamID]
+	openFile, fileExists := prod.files[targetPath]
 	prod.batchedFileGuard.RUnlock()
-	if fileIsLinked {
-		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
-			return batchedFile, err // ### return, already open or error ###
+	if fileExists {
+		openFile.touch()
+		if rotate, err := openFile.batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
+			return openFile.batchedFile, err // ### return, already open or error ###
 		}
 	}
 
@@ -138,39 +230,60 @@ func (prod *File) getBatchedFile(streamID core.MessageStreamID) (*components.Bat
 	defer prod.batchedFileGuard.Unlock()
 
 	// check again to avoid race conditions
-	batchedFile, fileIsLinked = prod.filesByStream[streamID]
-	if fileIsLinked {
-		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
-			return batchedFile, err // ### return, already open or error ###
+	openFile, fileExists = prod.files[targetPath]
+	if fileExists {
+		openFile.touch()
+		if rotate, err := openFile.batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
+			return openFile.batchedFile, err // ### return, already open or error ###
 		}
+		return openFile.batchedFile, prod.rotateBatchedFile(openFile.batchedFile, openFile.target)
 	}
 
-	streamTargetFile := prod.newStreamTargetFile(streamID)
+	// make room for the new file
+	if prod.maxOpenFiles > 0 && len(prod.files) >= prod.maxOpenFiles {
+		prod.closeLeastRecentlyUsed()
+	}
 
-	// get batchedFile from files[path] and assure the file is correctly mapped
-	batchedFile, fileExists := prod.files[streamTargetFile.GetOriginalPath()]
-	if !fileExists {
-		batchedFile = components.NewBatchedWriterAssembly(
+	openFile = &fileTarget{
+		batchedFile: components.NewBatchedWriterAssembly(
 			prod.BatchConfig,
 			prod,
 			prod.TryFallback,
 			prod.Logger,
-		)
-
-		prod.files[streamTargetFile.GetOriginalPath()] = batchedFile
-		prod.filesByStream[streamID] = batchedFile
-	} else if !fileIsLinked {
-		// in this case two streams target the same file
-		// need to link and check rotation again
-		prod.filesByStream[streamID] = batchedFile
-		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, false); !rotate {
-			return batchedFile, err // ### return, already open or error ###
+		),
+		target: streamTargetFile,
+	}
+	openFile.touch()
+	prod.files[targetPath] = openFile
+
+	err := prod.rotateBatchedFile(openFile.batchedFile, streamTargetFile)
+	return openFile.batchedFile, err
+}
+
+// closeLeastRecentlyUsed closes the file that has not been written to for
+// the longest time. The caller has to hold batchedFileGuard.
+func (prod *File) closeLeastRecentlyUsed() {
+	oldestPath := ""
+	oldestTime := time.Now()
+	for targetPath, openFile := range prod.files {
+		if lastUsed := openFile.getLastUsed(); oldestPath == "" || lastUsed.Before(oldestTime) {
+			oldestPath = targetPath
+			oldestTime = lastUsed
 		}
 	}
 
-	err = prod.rotateBatchedFile(batchedFile, streamTargetFile)
+	if oldestPath != "" {
+		prod.Logger.Debug("Closing least recently used file ", oldestPath)
+		prod.closeFile(oldestPath)
+	}
+}
 
-	return batchedFile, err
+// closeFile flushes and closes an open file. The caller has to hold
+// batchedFileGuard.
+func (prod *File) closeFile(targetPath string) {
+	openFile := prod.files[targetPath]
+	delete(prod.files, targetPath)
+	openFile.batchedFile.Close()
 }
 
 func (prod *File) rotateBatchedFile(batchedFile *components.BatchedWriterAssembly, streamTargetFile file.TargetFile) error {
@@ -185,12 +298,15 @@ func (prod *File) rotateBatchedFile(batchedFile *components.BatchedWriterAssembl
 	if batchedFile.HasWriter() {
 		currentLog := batchedFile.GetWriterAndUnset()
 
+		// Assure no flush is writing to the file before it is closed
+		batchedFile.Batch.WaitForFlush(0)
+
 		prod.Logger.Info("Rotated ", currentLog.Name(), " -> ", finalPath)
 		go currentLog.Close() // close in subroutine for eventually compression in the background
 	}
 
 	// Update BatchedWriterAssembly writer and creation time
-	fileWriter, err := prod.newFileStateWriterDisk(finalPath)
+	fileWriter, err := prod.newFileStateWriterDisk(finalPath, streamTargetFile.GetCompression())
 	if err != nil {
 		return err // ### return error ###
 	}
@@ -215,7 +331,7 @@ func (prod *File) createCurrentSymlink(source, target string) {
 	os.Rename(symLinkNameTemporary, target)
 }
 
-func (prod *File) newFileStateWriterDisk(path string) (*file.BatchedFileWriter, error) {
+func (prod *File) newFileStateWriterDisk(path, compression string) (*file.BatchedFileWriter, error) {
 	openFlags := os.O_RDWR | os.O_CREATE | os.O_APPEND
 	if prod.overwriteFile {
 		openFlags |= os.O_TRUNC
@@ -228,61 +344,59 @@ func (prod *File) newFileStateWriterDisk(path string) (*file.BatchedFileWriter,
 		return nil, err // ### return error ###
 	}
 
+	if compression != components.CompressionNone {
+		batchedFileWriter, err := file.NewCompressedFileWriter(fileHandler, compression, prod.compressionLevel, prod.Logger)
+		if err != nil {
+			fileHandler.Close()
+			return nil, err // ### return error ###
+		}
+		return &batchedFileWriter, nil
+	}
+
 	batchedFileWriter := file.NewBatchedFileWriter(fileHandler, prod.Rotate.Compress, prod.Logger)
 	return &batchedFileWriter, nil
 }
 
-func (prod *File) newStreamTargetFile(streamID core.MessageStreamID) file.TargetFile {
-	var fileDir, fileName, fileExt string
-
-	if prod.wildcardPath {
-		// Get state from filename (without timestamp, etc.)
-		var streamName string
-		switch streamID {
-		case core.WildcardStreamID:
-			streamName = "ALL"
-		default:
-			streamName = core.StreamRegistry.GetStreamName(streamID)
-		}
+// newTargetFile returns the target file for the given message
+func (prod *File) newTargetFile(msg *core.Message) file.TargetFile {
+	fileDir, fileName, fileExt := tio.SplitPath(prod.path.Resolve(msg))
+	return file.NewTargetFile(fileDir, fileName, fileExt, prod.getCompression(msg.GetStreamID()), prod.folderPermissions)
+}
 
-		fileDir = strings.Replace(prod.fileDir, "*", streamName, -1)
-		fileName = strings.Replace(prod.fileName, "*", streamName, -1)
-		fileExt = strings.Replace(prod.fileExt, "*", streamName, -1)
-	} else {
-		// Simple case: only one file used
-		fileDir = prod.fileDir
-		fileName = prod.fileName
-		fileExt = prod.fileExt
+// getCompression returns the compression used for files of the given stream
+func (prod *File) getCompression(streamID core.MessageStreamID) string {
+	if compression, isSet := prod.streamCompression[streamID]; isSet {
+		return compression
 	}
-
-	return file.NewTargetFile(fileDir, fileName, fileExt, prod.folderPermissions)
+	return prod.compression
 }
 
 func (prod *File) rotateLog() {
 	prod.batchedFileGuard.Lock()
 	defer prod.batchedFileGuard.Unlock()
 
-	// create unique batchedFile map from prod.filesByStream
-	flushMap := map[file.TargetFile]*components.BatchedWriterAssembly{}
-	for streamID, batchedFile := range prod.filesByStream {
-		streamTargetFile := prod.newStreamTargetFile(streamID)
-		flushMap[streamTargetFile] = batchedFile
-	}
-
-	// rotate every unique batchedFile
-	for streamTargetFile, batchedFile := range flushMap {
-		prod.rotateBatchedFile(batchedFile, streamTargetFile)
+	// rotate every open file
+	for _, openFile := range prod.files {
+		prod.rotateBatchedFile(openFile.batchedFile, openFile.target)
 	}
 }
 
 func (prod *File) writeBatchOnTimeOut() {
-	for _, batchedFile := range prod.files {
-		batchedFile.FlushOnTimeOut()
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for targetPath, openFile := range prod.files {
+		if prod.idleTimeout > 0 && time.Since(openFile.getLastUsed()) >= prod.idleTimeout {
+			prod.Logger.Debug("Closing idle file ", targetPath)
+			prod.closeFile(targetPath)
+		} else {
+			openFile.batchedFile.FlushOnTimeOut()
+		}
 	}
 }
 
 func (prod *File) writeMessage(msg *core.Message) {
-	batchedFile, err := prod.getBatchedFile(msg.GetStreamID())
+	batchedFile, err := prod.getBatchedFile(msg)
 	if err != nil {
 		prod.Logger.Error("Write error: ", err)
 		prod.TryFallback(msg)
@@ -295,7 +409,10 @@ func (prod *File) writeMessage(msg *core.Message) {
 func (prod *File) close() {
 	defer prod.WorkerDone()
 
-	for _, batchedFile := range prod.files {
-		batchedFile.Close()
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	for _, openFile := range prod.files {
+		openFile.batchedFile.Close()
 	}
 }
@@ -18,10 +18,12 @@ import (
 	"compress/gzip"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo/tio"
 	"github.com/trivago/tgo/tsync"
 	"io"
 	"os"
+	"sync/atomic"
 )
 
 // BatchedFileWriter is the file producer core.BatchedWriter implementation for the core.BatchedWriterAssembly
@@ -30,6 +32,20 @@ type BatchedFileWriter struct {
 	compressOnClose bool
 	stats           os.FileInfo
 	logger          logrus.FieldLogger
+	compressor      components.StreamCompressor
+	size            *int64
+}
+
+// sizeWriter counts the bytes written to the file
+type sizeWriter struct {
+	writer io.Writer
+	size   *int64
+}
+
+func (w sizeWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.AddInt64(w.size, int64(n))
+	return n, err
 }
 
 // NewBatchedFileWriter returns a BatchedFileWriter instance
@@ -39,12 +55,43 @@ func NewBatchedFileWriter(file *os.File, compressOnClose bool, logger logrus.Fie
 		compressOnClose,
 		nil,
 		logger,
+		nil,
+		getFileSize(file),
+	}
+}
+
+// NewCompressedFileWriter returns a BatchedFileWriter instance compressing
+// all data written using the given algorithm. Every write is flushed, so the
+// file can be decompressed up to the last write at all times. If data is
+// appended to an existing file, a new compression stream is started.
+func NewCompressedFileWriter(file *os.File, algorithm string, level int, logger logrus.FieldLogger) (BatchedFileWriter, error) {
+	writer := NewBatchedFileWriter(file, false, logger)
+	compressor, err := components.NewStreamCompressor(sizeWriter{file, writer.size}, algorithm, level)
+	writer.compressor = compressor
+	return writer, err
+}
+
+func getFileSize(file *os.File) *int64 {
+	size := new(int64)
+	if stats, err := file.Stat(); err == nil {
+		*size = stats.Size()
 	}
+	return size
 }
 
-// Write is part of the BatchedWriter interface and wraps the file.Write() implementation
+// Write is part of the BatchedWriter interface and wraps the file.Write() implementation.
+// If compression is enabled, the compressed data is flushed after each write.
 func (w *BatchedFileWriter) Write(p []byte) (n int, err error) {
-	return w.file.Write(p)
+	if w.compressor == nil {
+		n, err = w.file.Write(p)
+		atomic.AddInt64(w.size, int64(n))
+		return n, err
+	}
+
+	if n, err = w.compressor.Write(p); err != nil {
+		return n, err
+	}
+	return n, w.compressor.Flush()
 }
 
 // Name is part of the BatchedWriter interface and wraps the file.Name() implementation
@@ -52,13 +99,10 @@ func (w *BatchedFileWriter) Name() string {
 	return w.file.Name()
 }
 
-// Size is part of the BatchedWriter interface and wraps the file.Stat().Size() implementation
+// Size is part of the BatchedWriter interface and returns the number of
+// bytes stored on disk, i.e. the compressed size if compression is enabled.
 func (w *BatchedFileWriter) Size() int64 {
-	stats, err := w.getStats()
-	if err != nil {
-		return 0
-	}
-	return stats.Size()
+	return atomic.LoadInt64(w.size)
 }
 
 // IsAccessible is part of the BatchedWriter interface and check if the writer can access his file
@@ -73,6 +117,13 @@ func (w *BatchedFileWriter) IsAccessible() bool {
 
 // Close is part of the Close interface and handle the file close or compression call
 func (w *BatchedFileWriter) Close() error {
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			w.logger.Error("Failed to finish compression of ", w.Name(), ": ", err)
+		}
+		return w.file.Close()
+	}
+
 	if w.compressOnClose {
 		return w.compressAndCloseLog()
 	}
@@ -0,0 +1,148 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/ttesting"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readCompressedFile(path, algorithm string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var reader io.Reader
+	switch algorithm {
+	case components.CompressionGzip:
+		if reader, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+	case components.CompressionLZ4:
+		reader = lz4.NewReader(bytes.NewReader(data))
+	case components.CompressionZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		reader = bytes.NewReader(data)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	return string(content), err
+}
+
+func openTestFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+func TestCompressedFileWriter(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, algorithm := range []string{components.CompressionNone, components.CompressionGzip, components.CompressionLZ4, components.CompressionZstd} {
+		path := filepath.Join(dir, "test.log"+components.CompressionExtension(algorithm))
+
+		handle, err := openTestFile(path)
+		expect.NoError(err)
+		writer, err := NewCompressedFileWriter(handle, algorithm, gzip.DefaultCompression, logrus.StandardLogger())
+		expect.NoError(err)
+
+		_, err = writer.Write([]byte("first\n"))
+		expect.NoError(err)
+
+		// Data must be readable after each write
+		stats, err := os.Stat(path)
+		expect.NoError(err)
+		expect.Equal(stats.Size(), writer.Size())
+		expect.True(writer.Size() > 0)
+
+		if algorithm != components.CompressionGzip {
+			content, err := readCompressedFile(path, algorithm)
+			expect.NoError(err)
+			expect.Equal("first\n", content)
+		}
+
+		_, err = writer.Write([]byte("second\n"))
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+
+		// Appending starts a new stream
+		handle, err = openTestFile(path)
+		expect.NoError(err)
+		writer, err = NewCompressedFileWriter(handle, algorithm, gzip.BestCompression, logrus.StandardLogger())
+		expect.NoError(err)
+		_, err = writer.Write([]byte("third\n"))
+		expect.NoError(err)
+		expect.NoError(writer.Close())
+
+		content, err := readCompressedFile(path, algorithm)
+		expect.NoError(err)
+		expect.Equal("first\nsecond\nthird\n", content)
+	}
+
+	_, err = NewCompressedFileWriter(nil, "rar", gzip.DefaultCompression, logrus.StandardLogger())
+	expect.NotNil(err)
+	expect.NoError(components.ValidateCompression(components.CompressionZstd))
+	expect.NotNil(components.ValidateCompression("rar"))
+}
+
+func TestTargetFileCompression(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	target := NewTargetFile(dir, "test", ".log", components.CompressionGzip, 0755)
+	expect.Equal(dir+"/test.log", target.GetOriginalPath())
+	expect.Equal(dir+"/test.log.gz", target.GetCompressedPath())
+	expect.Equal(dir+"/test.log.gz", target.GetFinalPath(components.NewRotateConfig()))
+	expect.Equal(dir+"/test_current.log.gz", target.GetSymlinkPath())
+
+	for _, name := range []string{"test_1.log.gz", "test_2.log.lz4", "test.log", "other_test.log.gz"} {
+		expect.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644))
+	}
+
+	pruner := Pruner{Logger: logrus.StandardLogger()}
+	_, files, err := pruner.listFiles(target.GetOriginalPath())
+	expect.NoError(err)
+	expect.Equal(3, len(files))
+
+	pruner.pruneByCount(target.GetOriginalPath(), 1)
+	_, files, err = pruner.listFiles(target.GetOriginalPath())
+	expect.NoError(err)
+	expect.Equal(1, len(files))
+
+	_, err = os.Stat(filepath.Join(dir, "other_test.log.gz"))
+	expect.NoError(err)
+}
@@ -0,0 +1,205 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"strings"
+	"time"
+)
+
+const (
+	pathPartText = pathPartType(iota)
+	pathPartStream
+	pathPartMetadata
+	pathPartTime
+)
+
+// pathMissingValue replaces empty or invalid metadata values
+const pathMissingValue = "unknown"
+
+type pathPartType int
+
+type pathPart struct {
+	partType pathPartType
+	value    string
+}
+
+// PathTemplate is a file path containing placeholders for the stream name
+// ("*"), metadata values ("{key}") and the message time ("%Y").
+type PathTemplate struct {
+	parts    []pathPart
+	location *time.Location
+}
+
+// pathTimeVerbs maps strftime style verbs to go time layouts
+var pathTimeVerbs = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+	'j': "002",
+}
+
+// NewPathTemplate parses a path template. Supported time verbs are %Y, %y,
+// %m, %d, %H, %M, %S and %j. "%%" is replaced by "%".
+func NewPathTemplate(path string) (PathTemplate, error) {
+	tpl := PathTemplate{}
+	text := ""
+
+	addPart := func(partType pathPartType, value string) {
+		if text != "" {
+			tpl.parts = append(tpl.parts, pathPart{pathPartText, text})
+			text = ""
+		}
+		tpl.parts = append(tpl.parts, pathPart{partType, value})
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '*':
+			addPart(pathPartStream, "")
+
+		case c == '{':
+			end := strings.IndexByte(path[i:], '}')
+			if end < 0 {
+				return tpl, fmt.Errorf("Unclosed placeholder in path '%s'", path)
+			}
+			key := strings.TrimSpace(path[i+1 : i+end])
+			if key == "" {
+				return tpl, fmt.Errorf("Empty placeholder in path '%s'", path)
+			}
+			addPart(pathPartMetadata, key)
+			i += end
+
+		case c == '%' && i+1 < len(path):
+			if path[i+1] == '%' {
+				text += "%"
+				i++
+			} else if layout, isVerb := pathTimeVerbs[path[i+1]]; isVerb {
+				addPart(pathPartTime, layout)
+				i++
+			} else {
+				text += "%"
+			}
+
+		default:
+			text += string(c)
+		}
+	}
+
+	if text != "" {
+		tpl.parts = append(tpl.parts, pathPart{pathPartText, text})
+	}
+	return tpl, nil
+}
+
+// SetLocation sets the time zone used for time placeholders. By default the
+// local time zone is used.
+func (tpl *PathTemplate) SetLocation(location *time.Location) {
+	tpl.location = location
+}
+
+// Resolve returns the path for the given message. Metadata values are
+// sanitized so they cannot change the directory structure. Missing values
+// are replaced by "unknown".
+func (tpl PathTemplate) Resolve(msg *core.Message) string {
+	timestamp := msg.GetCreationTime()
+	if tpl.location != nil {
+		timestamp = timestamp.In(tpl.location)
+	}
+
+	return tpl.Format(msg, func(key string) string {
+		value := ""
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			value = metadata.GetValueString(key)
+		}
+		return sanitizePathValue(value)
+	}, timestamp)
+}
+
+// Format returns the path for the given message using getValue to look up
+// the values of "{key}" placeholders and the given time for time
+// placeholders. Values are inserted as returned by getValue.
+func (tpl PathTemplate) Format(msg *core.Message, getValue func(key string) string, timestamp time.Time) string {
+	path := ""
+	for _, part := range tpl.parts {
+		switch part.partType {
+		case pathPartText:
+			path += part.value
+
+		case pathPartStream:
+			switch streamID := msg.GetStreamID(); streamID {
+			case core.WildcardStreamID:
+				path += "ALL"
+			default:
+				path += core.StreamRegistry.GetStreamName(streamID)
+			}
+
+		case pathPartMetadata:
+			path += getValue(part.value)
+
+		case pathPartTime:
+			path += timestamp.Format(part.value)
+		}
+	}
+	return path
+}
+
+// IsDynamic returns true if the template contains placeholders
+func (tpl PathTemplate) IsDynamic() bool {
+	for _, part := range tpl.parts {
+		if part.partType != pathPartText {
+			return true
+		}
+	}
+	return false
+}
+
+// Pattern returns the template with all placeholders replaced by "*"
+func (tpl PathTemplate) Pattern() string {
+	pattern := ""
+	for _, part := range tpl.parts {
+		switch {
+		case part.partType == pathPartText:
+			pattern += part.value
+		case !strings.HasSuffix(pattern, "*"):
+			pattern += "*"
+		}
+	}
+	return pattern
+}
+
+// sanitizePathValue replaces path separators and other characters that are
+// not valid as part of a file name.
+func sanitizePathValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '_'
+		default:
+			return r
+		}
+	}, value)
+
+	if value == "" || value == "." || value == ".." {
+		return pathMissingValue
+	}
+	return value
+}
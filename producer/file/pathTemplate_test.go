@@ -0,0 +1,63 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+	"time"
+)
+
+func TestPathTemplate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	tpl, err := NewPathTemplate("/logs/{host}/{ service }/*/%Y/%m/%d_%H%M%S_%j_%y_%%_%q.log")
+	expect.NoError(err)
+
+	metadata := core.Metadata{"host": []byte("web-1"), "service": []byte("../etc/passwd")}
+	msg := core.NewMessage(nil, []byte("test"), metadata, core.GetStreamID("access"))
+	date := msg.GetCreationTime().Format("2006/01/02_150405_002_06")
+	expect.Equal("/logs/web-1/.._etc_passwd/access/"+date+"_%_%q.log", tpl.Resolve(msg))
+
+	msg = core.NewMessage(nil, []byte("test"), nil, core.WildcardStreamID)
+	date = msg.GetCreationTime().Format("2006/01/02_150405_002_06")
+	expect.Equal("/logs/unknown/unknown/ALL/"+date+"_%_%q.log", tpl.Resolve(msg))
+
+	metadata = core.Metadata{"host": []byte(".."), "service": []byte("")}
+	msg = core.NewMessage(nil, []byte("test"), metadata, core.GetStreamID("access"))
+	tpl, err = NewPathTemplate("/logs/{host}/{service}.log")
+	expect.NoError(err)
+	expect.Equal("/logs/unknown/unknown.log", tpl.Resolve(msg))
+	expect.True(tpl.IsDynamic())
+	expect.Equal("/logs/*/*.log", tpl.Pattern())
+
+	tpl, err = NewPathTemplate("logs-{service}-%Y.%m.%d")
+	expect.NoError(err)
+	expect.Equal("logs-*-*.*.*", tpl.Pattern())
+	timestamp := time.Date(2017, 3, 5, 1, 30, 0, 0, time.UTC)
+	getValue := func(key string) string { return key + "-value" }
+	expect.Equal("logs-service-value-2017.03.05", tpl.Format(msg, getValue, timestamp))
+
+	tpl, err = NewPathTemplate("static")
+	expect.NoError(err)
+	expect.False(tpl.IsDynamic())
+	expect.Equal("static", tpl.Pattern())
+
+	_, err = NewPathTemplate("/logs/{host.log")
+	expect.NotNil(err)
+	_, err = NewPathTemplate("/logs/{}.log")
+	expect.NotNil(err)
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo/tio"
 	"os"
+	"regexp"
 	"time"
 )
 
@@ -43,6 +44,9 @@ import (
 // Set this value to "0" to disable pruning by file size.
 // By default this parameter is set to "0".
 //
+// Compressed files are pruned like uncompressed files. Sizes are the sizes on
+// disk, i.e. the compressed sizes.
+//
 type Pruner struct {
 	pruneCount int   `config:"Prune/Count" default:"0"`
 	pruneHours int   `config:"Prune/AfterHours" default:"0"`
@@ -75,10 +79,17 @@ func (pruner *Pruner) Prune(baseFilePath string) {
 	}
 }
 
-func (pruner *Pruner) pruneByHour(baseFilePath string, hours int) {
+// listFiles returns all files written for the given path sorted by date.
+// This includes rotated files as well as compressed files, i.e. all files
+// starting with the base name of the given path.
+func (pruner *Pruner) listFiles(baseFilePath string) (string, []os.FileInfo, error) {
 	baseDir, baseName, _ := tio.SplitPath(baseFilePath)
+	files, err := tio.ListFilesByDateMatching(baseDir, "^"+regexp.QuoteMeta(baseName)+".*")
+	return baseDir, files, err
+}
 
-	files, err := tio.ListFilesByDateMatching(baseDir, baseName+".*")
+func (pruner *Pruner) pruneByHour(baseFilePath string, hours int) {
+	baseDir, files, err := pruner.listFiles(baseFilePath)
 	if err != nil {
 		pruner.Logger.Error("Error pruning files: ", err)
 		return // ### return, error ###
@@ -97,9 +108,7 @@ func (pruner *Pruner) pruneByHour(baseFilePath string, hours int) {
 }
 
 func (pruner *Pruner) pruneByCount(baseFilePath string, count int) {
-	baseDir, baseName, _ := tio.SplitPath(baseFilePath)
-
-	files, err := tio.ListFilesByDateMatching(baseDir, baseName+".*")
+	baseDir, files, err := pruner.listFiles(baseFilePath)
 	if err != nil {
 		pruner.Logger.Error("Error pruning files: ", err)
 		return // ### return, error ###
@@ -121,9 +130,7 @@ func (pruner *Pruner) pruneByCount(baseFilePath string, count int) {
 }
 
 func (pruner *Pruner) pruneToSize(baseFilePath string, maxSize int64) {
-	baseDir, baseName, _ := tio.SplitPath(baseFilePath)
-
-	files, err := tio.ListFilesByDateMatching(baseDir, baseName+".*")
+	baseDir, files, err := pruner.listFiles(baseFilePath)
 	if err != nil {
 		pruner.Logger.Error("Error pruning files: ", err)
 		return // ### return, error ###
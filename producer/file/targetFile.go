@@ -31,16 +31,19 @@ type TargetFile struct {
 	ext               string
 	originalPath      string
 	folderPermissions os.FileMode
+	compression       string
 }
 
-// NewTargetFile returns a new TargetFile instance
-func NewTargetFile(fileDir, fileName, fileExt string, permissions os.FileMode) TargetFile {
+// NewTargetFile returns a new TargetFile instance. If compression is set, the
+// matching file extension is appended to all generated file names.
+func NewTargetFile(fileDir, fileName, fileExt, compression string, permissions os.FileMode) TargetFile {
 	return TargetFile{
 		fileDir,
 		fileName,
 		fileExt,
 		fmt.Sprintf("%s/%s%s", fileDir, fileName, fileExt),
 		permissions,
+		compression,
 	}
 }
 
@@ -49,6 +52,17 @@ func (streamFile *TargetFile) GetOriginalPath() string {
 	return streamFile.originalPath
 }
 
+// GetCompression returns the streaming compression used for this file
+func (streamFile *TargetFile) GetCompression() string {
+	return streamFile.compression
+}
+
+// GetCompressedPath returns the base path from instantiation including the
+// extension of the compression used
+func (streamFile *TargetFile) GetCompressedPath() string {
+	return streamFile.originalPath + components.CompressionExtension(streamFile.compression)
+}
+
 // GetFinalPath returns the final file path with possible rotations
 func (streamFile *TargetFile) GetFinalPath(rotate components.RotateConfig) string {
 	return fmt.Sprintf("%s/%s", streamFile.dir, streamFile.GetFinalName(rotate))
@@ -95,7 +109,7 @@ func (streamFile *TargetFile) GetFinalName(rotate components.RotateConfig) strin
 		}
 	}
 
-	return logFileName
+	return logFileName + components.CompressionExtension(streamFile.compression)
 }
 
 // GetDir create file directory if it not exists and returns the dir name
@@ -110,9 +124,9 @@ func (streamFile *TargetFile) GetDir() (string, error) {
 
 // GetSymlinkPath returns a symlink path for the current file
 func (streamFile *TargetFile) GetSymlinkPath() string {
-	return fmt.Sprintf("%s/%s_current%s", streamFile.dir, streamFile.name, streamFile.ext)
+	return fmt.Sprintf("%s/%s_current%s%s", streamFile.dir, streamFile.name, streamFile.ext, components.CompressionExtension(streamFile.compression))
 }
 
 func (streamFile *TargetFile) String() string {
-	return streamFile.GetOriginalPath()
+	return streamFile.GetCompressedPath()
 }
@@ -0,0 +1,73 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileOpenFiles(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-file")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := core.NewPluginConfig("testFileOpenFiles", "producer.File")
+	config.Override("File", dir+"/{host}/*.log")
+	config.Override("MaxOpenFiles", 2)
+	config.Override("IdleTimeoutSec", 1)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*File)
+	expect.True(casted)
+
+	newMessage := func(host string) *core.Message {
+		return core.NewMessage(nil, []byte(host+"\n"), core.Metadata{"host": []byte(host)}, core.GetStreamID("test"))
+	}
+
+	for _, host := range []string{"a", "b", "a", "c"} {
+		msg := newMessage(host)
+		batchedFile, err := prod.getBatchedFile(msg)
+		expect.NoError(err)
+		batchedFile.Batch.Append(msg)
+	}
+
+	// "b" is the least recently used file
+	expect.Equal(2, len(prod.files))
+	_, isOpen := prod.files[dir+"/b/test.log"]
+	expect.False(isOpen)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "b", "test.log"))
+	expect.NoError(err)
+	expect.Equal("b\n", string(content))
+
+	for _, openFile := range prod.files {
+		openFile.lastUsed = time.Now().Add(-time.Minute).UnixNano()
+	}
+	prod.writeBatchOnTimeOut()
+	expect.Equal(0, len(prod.files))
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "a", "test.log"))
+	expect.NoError(err)
+	expect.Equal("a\na\n", string(content))
+}
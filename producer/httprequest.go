@@ -17,16 +17,28 @@ package producer
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/tgo/thealthcheck"
+	"github.com/trivago/tgo/tmath"
 	"github.com/trivago/tgo/tnet"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	httpBatchNone   = "none"
+	httpBatchNDJSON = "ndjson"
+	httpBatchJSON   = "json"
 )
 
 // HTTPRequest producer
@@ -48,12 +60,36 @@ import (
 // sent to the destination server (virtually) unchanged. If the message
 // cannot be parsed as an HTTP request, an error is logged. Only the scheme,
 // host and port components of the "Address" URL are used; any path and query
-// parameters are ignored. The "Encoding" parameter is ignored.
+// parameters are ignored. The "Encoding", "Method", "Headers", "Gzip" and
+// "Batch" parameters are ignored.
+//
+// If RawData mode is off, a request is made to the destination server
+// for each incoming message or batch of messages, using the complete URL in
+// "Address". The incoming message's contents are delivered in the request's
+// body and Content-type is set to the value of "Encoding".
+//
+// Address, Method and the values of Headers are go templates that are
+// executed with the metadata of each message, e.g. "{{.service}}" inserts
+// the value of the metadata key "service". Missing keys are replaced by an
+// empty string. Values inserted into the URL should be escaped using
+// "{{urlquery .key}}". The template language is described in the go
+// documentation: https://golang.org/pkg/text/template/#hdr-Actions
+//
+// Requests answered with a status code listed in SuccessCodes are treated as
+// successful. Requests failing because of a network error or a status code of
+// 429 or 5xx are retried. The time to wait before a retry is doubled with each
+// attempt unless the server sends a Retry-After header. The producers Loki and
+// SplunkHEC retry requests the same way. Messages that could not be delivered
+// are sent to the fallback stream.
+//
+// Metadata
+//
+// NOTE: The metadata fields below are set on messages sent to the fallback
+// stream.
+//
+// - error: The reason why the request failed
 //
-// If RawData mode is off, a POST request is made to the destination server
-// for each incoming message, using the complete URL in "Address". The
-// incoming message's contents are delivered in the POST request's body
-// and Content-type is set to the value of "Encoding"
+// - status_code: The http status of the last response, if available
 //
 // Parameters
 //
@@ -64,6 +100,54 @@ import (
 // - RawData: Turns "RawData" mode on. See the description above.
 //
 // - Encoding: Defines the payload encoding when RawData is set to false.
+// By default this parameter is set to "text/plain; charset=utf-8" or to
+// the content type matching Batch/Format.
+//
+// - Method: Defines the http method used when RawData is set to false.
+// By default this parameter is set to "POST".
+//
+// - Headers: Defines a map of additional http headers sent with each request
+// when RawData is set to false.
+// By default this parameter is set to "empty".
+//
+// - Gzip: When set to "true", request bodies are gzip compressed and the
+// Content-Encoding header is set accordingly.
+// By default this parameter is set to "false".
+//
+// - SuccessCodes: Defines the list of status codes treated as success. A
+// whole class of codes can be given as e.g. "2xx".
+// By default this parameter is set to "2xx".
+//
+// - Retry/Count: Defines how often a failed request is retried before its
+// messages are sent to the fallback stream. Set to 0 to disable retries.
+// By default this parameter is set to "3".
+//
+// - Retry/DelayMs: Defines the time in milliseconds to wait before the first
+// retry. This time is doubled for every following retry.
+// By default this parameter is set to "500".
+//
+// - Retry/MaxDelaySec: Defines the maximum time in seconds to wait before a
+// retry. This limit also applies to Retry-After headers.
+// By default this parameter is set to "30".
+//
+// - Batch/Format: Defines how messages are combined into a single request
+// when RawData is set to false. Set to "none" to send one request per message,
+// to "ndjson" to send newline delimited messages or to "json" to send a json
+// array of messages. In "json" mode, messages that are not valid json are sent
+// to the fallback stream. Messages resulting in different URLs, methods or
+// headers are sent in separate requests.
+// By default this parameter is set to "none".
+//
+// - Batch/MaxCount: Defines the maximum number of messages per request.
+// By default this parameter is set to "1024".
+//
+// - Batch/FlushCount: Defines the number of messages to be buffered before a
+// request is sent. This setting is clamped to Batch/MaxCount.
+// By default this parameter is set to "512".
+//
+// - Batch/TimeoutSec: Defines the maximum number of seconds messages are
+// buffered before a request is sent.
+// By default this parameter is set to "1".
 //
 // Examples
 //
@@ -73,14 +157,51 @@ import (
 //    Address: "http://localhost:8099/test"
 //    RawData: true
 //
+// This example sends batches of json messages to an index depending on the
+// "service" metadata key:
+//
+//  HttpOut02:
+//    Type: producer.HTTPRequest
+//    Streams: http_02
+//    Address: "http://localhost:8099/{{urlquery .service}}/_ingest"
+//    RawData: false
+//    Gzip: true
+//    Headers:
+//      Authorization: "Bearer secret"
+//      X-Service: "{{.service}}"
+//    Batch:
+//      Format: ndjson
+//      TimeoutSec: 2
+//
 type HTTPRequest struct {
 	core.BufferedProducer `gollumdoc:"embed_type"`
 
-	destinationURL *url.URL
-	encoding       string `config:"Encoding" default:"text/plain; charset=utf-8"`
-	rawPackets     bool   `config:"RawData" default:"true"`
-	listen         *tnet.StopListener
-	lastError      error
+	destinationURL  *url.URL
+	address         *template.Template
+	method          *template.Template
+	headers         map[string]*template.Template
+	successCodes    []string `config:"SuccessCodes" default:"2xx"`
+	encoding        string   `config:"Encoding" default:"text/plain; charset=utf-8"`
+	rawPackets      bool     `config:"RawData" default:"true"`
+	gzip            bool     `config:"Gzip"`
+	sender          httpRetrySender
+	batchFormat     string        `config:"Batch/Format" default:"none"`
+	batchMaxCount   int           `config:"Batch/MaxCount" default:"1024"`
+	batchFlushCount int           `config:"Batch/FlushCount" default:"512"`
+	batchTimeout    time.Duration `config:"Batch/TimeoutSec" default:"1" metric:"sec"`
+	batch           core.MessageBatch
+	inflight        *sync.WaitGroup
+	listen          *tnet.StopListener
+	lastError       error
+}
+
+// httpRequestTarget holds the rendered method, url and headers of a request.
+// Messages with the same target can be sent in the same request.
+type httpRequestTarget struct {
+	method string
+	url    string
+	host   string
+	header http.Header
 }
 
 func init() {
@@ -96,9 +217,58 @@ func (prod *HTTPRequest) Configure(conf core.PluginConfigReader) {
 	if strings.Index(address, "://") == -1 {
 		address = "http://" + address
 	}
-	prod.destinationURL, err = url.Parse(address)
+
+	prod.address, err = newMetadataTemplate("Address", address)
+	conf.Errors.Push(err)
+	prod.method, err = newMetadataTemplate("Method", conf.GetString("Method", "POST"))
 	conf.Errors.Push(err)
 
+	prod.headers = make(map[string]*template.Template)
+	for name, value := range conf.GetStringMap("Headers", map[string]string{}) {
+		prod.headers[name], err = newMetadataTemplate(name, value)
+		conf.Errors.Push(err)
+	}
+
+	// Metadata placeholders are removed from the address used for raw data
+	// and health checks
+	if prod.address != nil {
+		address, err := executeMetadataTemplate(prod.address, nil)
+		if !conf.Errors.Push(err) {
+			prod.destinationURL, err = url.Parse(address)
+			conf.Errors.Push(err)
+		}
+	}
+
+	for _, code := range prod.successCodes {
+		if _, err := strconv.Atoi(strings.Replace(strings.ToLower(code), "x", "0", -1)); err != nil || len(code) != 3 {
+			conf.Errors.Pushf("Invalid success code '%s'", code)
+		}
+	}
+
+	prod.batchFormat = strings.ToLower(prod.batchFormat)
+	switch prod.batchFormat {
+	case httpBatchNone:
+	case httpBatchNDJSON:
+		if !conf.HasValue("Encoding") {
+			prod.encoding = "application/x-ndjson"
+		}
+	case httpBatchJSON:
+		if !conf.HasValue("Encoding") {
+			prod.encoding = "application/json"
+		}
+	default:
+		conf.Errors.Pushf("Unknown batch format '%s'", prod.batchFormat)
+	}
+
+	if prod.rawPackets && prod.batchFormat != httpBatchNone {
+		conf.Errors.Pushf("Batch/Format cannot be used with RawData")
+	}
+
+	prod.batchFlushCount = tmath.MinI(prod.batchFlushCount, prod.batchMaxCount)
+	prod.batch = core.NewMessageBatch(prod.batchMaxCount)
+	prod.inflight = new(sync.WaitGroup)
+	prod.sender.init(http.DefaultClient, prod.isSuccess, &prod.SimpleProducer)
+
 	// Default health check to ping the backend with an HTTP GET
 	prod.AddHealthCheck(prod.healthcheckPingBackend)
 
@@ -148,68 +318,272 @@ func httpRequestWrapper(resp *http.Response, err error) (int, string, error) {
 	return resp.StatusCode, respBodyString, err
 }
 
-func (prod *HTTPRequest) isHostUp() bool {
-	resp, err := http.Get(prod.destinationURL.String())
-	return err != nil && resp != nil && resp.StatusCode < 400
+// isSuccess returns true if the given status code matches SuccessCodes
+func (prod *HTTPRequest) isSuccess(status int) bool {
+	code := strconv.Itoa(status)
+	for _, pattern := range prod.successCodes {
+		if len(pattern) != len(code) {
+			continue
+		}
+		matches := true
+		for i := range pattern {
+			if pattern[i] != 'x' && pattern[i] != 'X' && pattern[i] != code[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// getTarget renders the method, url and headers of the request for the given
+// message.
+func (prod *HTTPRequest) getTarget(msg *core.Message) (httpRequestTarget, error) {
+	values := getTemplateValues(msg)
+	target := httpRequestTarget{header: http.Header{}}
+
+	method, err := executeMetadataTemplate(prod.method, values)
+	if err != nil {
+		return target, err
+	}
+	target.method = strings.ToUpper(method)
+
+	if target.url, err = executeMetadataTemplate(prod.address, values); err != nil {
+		return target, err
+	}
+
+	target.header.Set("Content-Type", prod.encoding)
+	for name, tpl := range prod.headers {
+		value, err := executeMetadataTemplate(tpl, values)
+		if err != nil {
+			return target, err
+		}
+		target.header.Set(name, value)
+	}
+	return target, nil
+}
+
+// key returns a string identifying requests with the same target
+func (target httpRequestTarget) key() string {
+	names := make([]string, 0, len(target.header))
+	for name := range target.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := target.method + " " + target.url
+	for _, name := range names {
+		key += "\n" + name + ": " + strings.Join(target.header[name], ",")
+	}
+	return key
+}
+
+// getRawTarget parses a message containing a request in wire format
+func (prod *HTTPRequest) getRawTarget(msg *core.Message) (httpRequestTarget, []byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(msg.GetPayload())))
+	if err != nil {
+		return httpRequestTarget{}, nil, err
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return httpRequestTarget{}, nil, err
+	}
+
+	req.URL.Host = prod.destinationURL.Host
+	req.URL.Scheme = prod.destinationURL.Scheme
+	return httpRequestTarget{method: req.Method, url: req.URL.String(), host: req.Host, header: req.Header}, body, nil
+}
+
+// encodeBody creates the request body for the given messages. Messages
+// that cannot be encoded are returned with the corresponding error.
+func (prod *HTTPRequest) encodeBody(messages []*core.Message) ([]byte, []*core.Message, map[*core.Message]error) {
+	body := bytes.Buffer{}
+	encoded := make([]*core.Message, 0, len(messages))
+	rejected := make(map[*core.Message]error)
+
+	switch prod.batchFormat {
+	case httpBatchNDJSON:
+		for _, msg := range messages {
+			payload := msg.GetPayload()
+			body.Write(payload)
+			if len(payload) == 0 || payload[len(payload)-1] != '\n' {
+				body.WriteByte('\n')
+			}
+			encoded = append(encoded, msg)
+		}
+
+	case httpBatchJSON:
+		body.WriteByte('[')
+		for _, msg := range messages {
+			if !json.Valid(msg.GetPayload()) {
+				rejected[msg] = fmt.Errorf("Message is not valid json")
+				continue // ### continue, invalid message ###
+			}
+			if len(encoded) > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(msg.GetPayload())
+			encoded = append(encoded, msg)
+		}
+		body.WriteByte(']')
+
+	default:
+		for _, msg := range messages {
+			body.Write(msg.GetPayload())
+			encoded = append(encoded, msg)
+		}
+	}
+
+	if !prod.gzip {
+		return body.Bytes(), encoded, rejected
+	}
+
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(body.Bytes())
+	writer.Close()
+	return compressed.Bytes(), encoded, rejected
+}
+
+// send sends a request and retries it if necessary. The status of the last
+// response is returned along with an error if the request failed.
+func (prod *HTTPRequest) send(target httpRequestTarget, body []byte) (int, error) {
+	status, _, err := prod.sender.send(func() (*http.Request, error) {
+		req, err := http.NewRequest(target.method, target.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range target.header {
+			req.Header[name] = values
+		}
+		if target.host != "" {
+			req.Host = target.host
+		}
+		if prod.gzip && !prod.rawPackets {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		return req, nil
+	})
+	return status, err
+}
+
+// sendMessages sends the given messages in a single request. If the request
+// fails, all messages are sent to the fallback.
+func (prod *HTTPRequest) sendMessages(target httpRequestTarget, body []byte, messages []*core.Message) {
+	status, err := prod.send(target, body)
+	prod.lastError = err
+	if err == nil {
+		return // ### return, success ###
+	}
+
+	prod.Logger.Error("Send failed: ", err)
+	for _, msg := range messages {
+		prod.tryFallback(msg, status, err)
+	}
+}
+
+func (prod *HTTPRequest) tryFallback(msg *core.Message, status int, err error) {
+	prod.TryFallbackWithMetadata(msg, newHTTPFallbackMetadata(status, err))
 }
 
 // The onMessage callback
 func (prod *HTTPRequest) sendReq(msg *core.Message) {
 	var (
-		req *http.Request
-		err error
+		target httpRequestTarget
+		body   []byte
+		err    error
 	)
 
-	requestData := bytes.NewBuffer(msg.GetPayload())
-
 	if prod.rawPackets {
 		// Assume the message already contains an HTTP request in wire format.
-		// Create a Request object, override host, port and scheme, and send it out.
-		req, err = http.ReadRequest(bufio.NewReader(requestData))
-		if req != nil {
-			req.URL.Host = prod.destinationURL.Host
-			req.URL.Scheme = prod.destinationURL.Scheme
-			req.RequestURI = ""
-		}
+		// Override host, port and scheme, and send it out.
+		target, body, err = prod.getRawTarget(msg)
 	} else {
-		// Encapsulate the message in a POST request
-		req, err = http.NewRequest("POST", prod.destinationURL.String(), requestData)
-		if req != nil {
-			req.Header.Add("Content-type", prod.encoding)
-		}
+		target, err = prod.getTarget(msg)
+		body, _, _ = prod.encodeBody([]*core.Message{msg})
 	}
 
 	if err != nil {
 		prod.Logger.Error("Invalid request: ", err)
-		prod.TryFallback(msg)
+		prod.tryFallback(msg, 0, err)
 		prod.lastError = err
 		return // ### return, malformed request ###
 	}
 
+	prod.inflight.Add(1)
 	go func() {
-		_, _, err := httpRequestWrapper(http.DefaultClient.Do(req))
-		prod.lastError = err
+		defer prod.inflight.Done()
+		prod.sendMessages(target, body, []*core.Message{msg})
+	}()
+}
+
+// sendBatch groups messages by target and sends one request per group
+func (prod *HTTPRequest) sendBatch(messages []*core.Message) {
+	targets := make(map[string]httpRequestTarget)
+	groups := make(map[string][]*core.Message)
+	keys := []string{}
+
+	for _, msg := range messages {
+		target, err := prod.getTarget(msg)
 		if err != nil {
-			// Fail
-			prod.Logger.Error("Send failed: ", err)
-			if !prod.isHostUp() {
-				// TBD: health check? (ex-fuse breaker)
-			}
-			prod.TryFallback(msg)
-			return
+			prod.Logger.Error("Invalid request: ", err)
+			prod.tryFallback(msg, 0, err)
+			continue
 		}
-		// Success
-		// TBD: health check? (ex-fuse breaker)
-	}()
+
+		key := target.key()
+		if _, isSet := groups[key]; !isSet {
+			targets[key] = target
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], msg)
+	}
+
+	for _, key := range keys {
+		body, encoded, rejected := prod.encodeBody(groups[key])
+		for msg, err := range rejected {
+			prod.tryFallback(msg, 0, err)
+		}
+		if len(encoded) > 0 {
+			prod.sendMessages(targets[key], body, encoded)
+		}
+	}
+}
+
+func (prod *HTTPRequest) appendMessage(msg *core.Message) {
+	prod.batch.AppendOrFlush(msg, prod.flushBatch, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *HTTPRequest) flushBatch() {
+	prod.batch.Flush(prod.sendBatch)
+}
+
+func (prod *HTTPRequest) flushBatchOnTimeOut() {
+	if prod.batch.ReachedTimeThreshold(prod.batchTimeout) || prod.batch.ReachedSizeThreshold(prod.batchFlushCount) {
+		prod.flushBatch()
+	}
 }
 
 func (prod *HTTPRequest) close() {
 	defer prod.WorkerDone()
 	prod.DefaultClose()
+
+	if prod.batchFormat != httpBatchNone {
+		prod.batch.Close(prod.sendBatch, prod.GetShutdownTimeout())
+	}
+	prod.inflight.Wait()
 }
 
-// Produce writes to stdout or stderr.
+// Produce sends messages as http requests.
 func (prod *HTTPRequest) Produce(workers *sync.WaitGroup) {
 	prod.AddMainWorker(workers)
-	prod.MessageControlLoop(prod.sendReq)
+	if prod.batchFormat == httpBatchNone {
+		prod.MessageControlLoop(prod.sendReq)
+	} else {
+		prod.TickerMessageControlLoop(prod.appendMessage, prod.batchTimeout, prod.flushBatchOnTimeOut)
+	}
 }
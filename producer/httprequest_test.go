@@ -0,0 +1,156 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type httpRequestRecord struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// httpRequestStandIn records all requests. The given status codes are
+// returned in order, followed by 200.
+type httpRequestStandIn struct {
+	guard    sync.Mutex
+	requests []httpRequestRecord
+	statuses []int
+}
+
+func (standIn *httpRequestStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	standIn.guard.Lock()
+	defer standIn.guard.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		if reader, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			body, _ = ioutil.ReadAll(reader)
+		}
+	}
+	standIn.requests = append(standIn.requests, httpRequestRecord{r.Method, r.URL.Path, r.Header, string(body)})
+
+	if len(standIn.statuses) > 0 {
+		status := standIn.statuses[0]
+		standIn.statuses = standIn.statuses[1:]
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+	}
+}
+
+func TestHTTPRequestBatch(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &httpRequestStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.HTTPRequest", "testHTTPRequestBatch", map[string]interface{}{
+		"Address":      server.URL + "/{{.service}}/_ingest",
+		"Method":       "put",
+		"RawData":      false,
+		"Gzip":         true,
+		"Headers":      map[string]string{"X-Service": "{{.service}}"},
+		"Batch/Format": "ndjson",
+	}).(*HTTPRequest)
+	expect.Equal("application/x-ndjson", prod.encoding)
+
+	prod.sendBatch([]*core.Message{
+		core.NewMessage(nil, []byte(`{"a":1}`), core.Metadata{"service": []byte("web")}, core.InvalidStreamID),
+		core.NewMessage(nil, []byte(`{"b":2}`), core.Metadata{"service": []byte("db")}, core.InvalidStreamID),
+		core.NewMessage(nil, []byte("{\"c\":3}\n"), core.Metadata{"service": []byte("web")}, core.InvalidStreamID),
+	})
+
+	expect.Equal(2, len(standIn.requests))
+	expect.Equal("PUT", standIn.requests[0].method)
+	expect.Equal("/web/_ingest", standIn.requests[0].path)
+	expect.Equal("web", standIn.requests[0].header.Get("X-Service"))
+	expect.Equal("application/x-ndjson", standIn.requests[0].header.Get("Content-Type"))
+	expect.Equal("{\"a\":1}\n{\"c\":3}\n", standIn.requests[0].body)
+	expect.Equal("/db/_ingest", standIn.requests[1].path)
+	expect.Equal("{\"b\":2}\n", standIn.requests[1].body)
+
+	prod.batchFormat = httpBatchJSON
+	prod.gzip = false
+	body, encoded, rejected := prod.encodeBody([]*core.Message{
+		core.NewMessage(nil, []byte(`{"a":1}`), nil, core.InvalidStreamID),
+		core.NewMessage(nil, []byte(`broken`), nil, core.InvalidStreamID),
+		core.NewMessage(nil, []byte(`[2]`), nil, core.InvalidStreamID),
+	})
+	expect.Equal(`[{"a":1},[2]]`, string(body))
+	expect.Equal(2, len(encoded))
+	expect.Equal(1, len(rejected))
+}
+
+func TestHTTPRequestRetry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &httpRequestStandIn{statuses: []int{503, 429}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.HTTPRequest", "testHTTPRequestRetry", map[string]interface{}{
+		"Address":       server.URL,
+		"RawData":       false,
+		"Retry/DelayMs": 1,
+		"SuccessCodes":  []string{"200"},
+	}).(*HTTPRequest)
+
+	target, err := prod.getTarget(core.NewMessage(nil, nil, nil, core.InvalidStreamID))
+	expect.NoError(err)
+	status, err := prod.send(target, []byte("test"))
+	expect.NoError(err)
+	expect.Equal(200, status)
+	expect.Equal(3, len(standIn.requests))
+	expect.Equal("test", standIn.requests[2].body)
+	expect.Equal("text/plain; charset=utf-8", standIn.requests[2].header.Get("Content-Type"))
+
+	standIn.statuses = []int{400}
+	status, err = prod.send(target, []byte("test"))
+	expect.NotNil(err)
+	expect.Equal(400, status)
+	expect.Equal(4, len(standIn.requests))
+
+	standIn.statuses = []int{500, 500, 500, 500, 500}
+	status, err = prod.send(target, []byte("test"))
+	expect.NotNil(err)
+	expect.Equal(500, status)
+	expect.Equal(8, len(standIn.requests))
+}
+
+func TestHTTPRequestSettings(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestProducer(t, "producer.HTTPRequest", "testHTTPRequestSettings", map[string]interface{}{
+		"SuccessCodes": []string{"2xx", "404"},
+	}).(*HTTPRequest)
+	expect.True(prod.isSuccess(200))
+	expect.True(prod.isSuccess(204))
+	expect.True(prod.isSuccess(404))
+	expect.False(prod.isSuccess(400))
+	expect.False(prod.isSuccess(500))
+
+}
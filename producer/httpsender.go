@@ -0,0 +1,138 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpRetrySender sends http requests for the producers talking to http
+// APIs. Requests failing because of a network error or a status code of 429
+// or 5xx are retried. The time to wait before a retry is doubled with each
+// attempt unless the server sends a Retry-After header.
+type httpRetrySender struct {
+	retryCount    int           `config:"Retry/Count" default:"3"`
+	retryDelay    time.Duration `config:"Retry/DelayMs" default:"500" metric:"ms"`
+	retryMaxDelay time.Duration `config:"Retry/MaxDelaySec" default:"30" metric:"sec"`
+	client        *http.Client
+	isSuccess     func(status int) bool
+	producer      *core.SimpleProducer
+}
+
+// init sets the client used to send requests and the producer used for
+// logging and stop checks. If isSuccess is nil, 2xx codes denote success.
+func (sender *httpRetrySender) init(client *http.Client, isSuccess func(status int) bool, producer *core.SimpleProducer) {
+	sender.client = client
+	sender.isSuccess = isSuccess
+	sender.producer = producer
+
+	if sender.isSuccess == nil {
+		sender.isSuccess = func(status int) bool {
+			return status >= 200 && status < 300
+		}
+	}
+}
+
+// isHTTPRetryable returns true if a request failing with the given status
+// should be retried. A status of 0 denotes a network error.
+func isHTTPRetryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// parseRetryAfter returns the duration denoted by a Retry-After header given
+// either in seconds or as a http date. 0 is returned if the header is not set
+// or not valid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// getRetryDelay returns the time to wait before the given retry
+func (sender *httpRetrySender) getRetryDelay(retry int, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay == 0 {
+		delay = sender.retryDelay
+		for i := 0; i < retry && delay < sender.retryMaxDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > sender.retryMaxDelay {
+		return sender.retryMaxDelay
+	}
+	return delay
+}
+
+// send sends the request created by newRequest and retries it if necessary.
+// A new request is created for every attempt. The status and body of the
+// last response are returned along with an error if the request failed.
+func (sender *httpRetrySender) send(newRequest func() (*http.Request, error)) (int, []byte, error) {
+	for retry := 0; ; retry++ {
+		req, err := newRequest()
+		if err != nil {
+			return 0, nil, err // ### return, malformed request ###
+		}
+
+		status, retryAfter := 0, time.Duration(0)
+		var respBody []byte
+
+		resp, err := sender.client.Do(req)
+		if err == nil {
+			status = resp.StatusCode
+			respBody, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if sender.isSuccess(status) {
+				return status, respBody, nil // ### return, success ###
+			}
+			err = fmt.Errorf("%d %s", status, strings.TrimSpace(string(respBody)))
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+
+		if !isHTTPRetryable(status) || retry >= sender.retryCount || sender.producer.IsStopping() {
+			return status, respBody, err // ### return, failed ###
+		}
+
+		delay := sender.getRetryDelay(retry, retryAfter)
+		sender.producer.Logger.WithError(err).Warningf("Request failed, retrying in %v", delay)
+		time.Sleep(delay)
+	}
+}
+
+// newHTTPFallbackMetadata returns the metadata set on messages sent to the
+// fallback after a request failed.
+func newHTTPFallbackMetadata(status int, err error) core.Metadata {
+	metadata := core.Metadata{"error": []byte(err.Error())}
+	if status != 0 {
+		metadata.SetValue("status_code", []byte(strconv.Itoa(status)))
+	}
+	return metadata
+}
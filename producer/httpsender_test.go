@@ -0,0 +1,50 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+	"time"
+)
+
+func TestHTTPRetrySender(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	expect.True(isHTTPRetryable(0))
+	expect.True(isHTTPRetryable(429))
+	expect.True(isHTTPRetryable(502))
+	expect.False(isHTTPRetryable(404))
+
+	now := time.Date(2017, 3, 4, 12, 0, 0, 0, time.UTC)
+	expect.Equal(5*time.Second, parseRetryAfter("5", now))
+	expect.Equal(time.Minute, parseRetryAfter("Sat, 04 Mar 2017 12:01:00 GMT", now))
+	expect.Equal(time.Duration(0), parseRetryAfter("soon", now))
+	expect.Equal(time.Duration(0), parseRetryAfter("", now))
+
+	sender := httpRetrySender{retryDelay: 500 * time.Millisecond, retryMaxDelay: 30 * time.Second}
+	expect.Equal(500*time.Millisecond, sender.getRetryDelay(0, 0))
+	expect.Equal(2*time.Second, sender.getRetryDelay(2, 0))
+	expect.Equal(30*time.Second, sender.getRetryDelay(10, 0))
+	expect.Equal(3*time.Second, sender.getRetryDelay(0, 3*time.Second))
+	expect.Equal(30*time.Second, sender.getRetryDelay(0, time.Hour))
+
+	metadata := newHTTPFallbackMetadata(503, fmt.Errorf("unavailable"))
+	expect.Equal("unavailable", metadata.GetValueString("error"))
+	expect.Equal("503", metadata.GetValueString("status_code"))
+	_, hasStatus := newHTTPFallbackMetadata(0, fmt.Errorf("timeout"))["status_code"]
+	expect.False(hasStatus)
+}
@@ -17,11 +17,15 @@ package producer
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	kafka "github.com/Shopify/sarama"
@@ -38,12 +42,39 @@ const (
 	compressSnappy = "snappy"
 )
 
+const (
+	topicUnregistered = int32(iota)
+	topicRegistering
+	topicReady
+	topicFailed
+)
+
+// kafkaMaxTopicLength is the maximum length of a topic name accepted by kafka
+const kafkaMaxTopicLength = 249
+
 // Kafka producer
 //
 // This producer writes messages to a kafka cluster. This producer is backed by
 // the sarama library (https://github.com/Shopify/sarama) so most settings
 // directly relate to the settings of that library.
 //
+// For Kafka versions >= 0.10 the creation time of a message is used as the
+// timestamp of the record. Metadata fields can be written as record headers
+// for Kafka versions >= 0.11 by using HeadersFrom.
+//
+// The topic of a message can be taken from a metadata field (TopicFrom) or a
+// go template executed with the metadata of each message (TopicTemplate), so
+// that a single producer can write to many topics. Dynamic topic names must
+// match one of the AllowedTopics patterns, otherwise the message is sent to
+// the fallback. Messages with an empty dynamic topic use the Topics mapping.
+//
+// Dynamic topics are registered in the background. Until a topic is known to
+// the cluster, up to TopicBufferCount messages are kept for it while messages
+// for other topics continue to be sent. Brokers configured to automatically
+// create topics will create the topic during registration. If the
+// registration fails, the buffered messages are sent to the fallback. Topics
+// given by Topics or the stream name are sent to directly.
+//
 // Parameters
 //
 // - Servers: Defines a list of ideally all brokers in the cluster. At least one
@@ -62,6 +93,32 @@ const (
 // this topic (including _GOLLUM_).
 // By default this parameter is set to an empty list.
 //
+// - TopicFrom: Defines the metadata field that contains the topic to write to.
+// When set to an empty string or when the field is not set, TopicTemplate or
+// Topics is used.
+// By default this parameter is set to "".
+//
+// - TopicTemplate: Defines a go template used to generate the topic name from
+// the metadata of a message, e.g. "logs-{{.tenant}}". Missing keys are
+// replaced by an empty string. When set to an empty string, Topics is used.
+// By default this parameter is set to "".
+//
+// - AllowedTopics: Defines a list of topic names dynamic topics are restricted
+// to. Entries may use the wildcards "*" and "?", e.g. "logs-*". This parameter
+// is required when TopicFrom or TopicTemplate is set, as each topic written to
+// is kept in memory. Use "*" to allow all valid topic names.
+// By default this parameter is set to an empty list.
+//
+// - TopicBufferCount: Defines the maximum number of messages buffered for a
+// topic that is being registered. Additional messages are sent to the
+// fallback.
+// By default this parameter is set to 1024.
+//
+// - PartitionFrom: Defines the metadata field that contains the partition
+// number to write to. Messages without this field use the Partitioner. If
+// the partition does not exist, the message is sent to the fallback.
+// By default this parameter is set to "".
+//
 // - ClientId: Sets the kafka client id used by this producer.
 // By default this parameter is set to "gollum".
 //
@@ -76,6 +133,11 @@ const (
 // the key passed to kafka. When set to an empty string no key is used.
 // By default this parameter is set to "".
 //
+// - HeadersFrom: Defines a list of metadata fields to be written as record
+// headers. Use "*" to write all metadata fields. Metadata fields that are not
+// set are skipped. This setting requires Kafka version >= 0.11.
+// By default this parameter is set to an empty list.
+//
 // - Compression: Defines the compression algorithm to use.
 // Possible values are "none", "zip" and "snappy".
 // By default this parameter is set to "none".
@@ -194,6 +256,20 @@ const (
 //      - "kafka02:9092"
 //      - "kafka03:9092"
 //      - "kafka04:9092"
+//
+// This example writes messages to one topic per tenant, using the partition
+// given by the metadata field "partition" if present:
+//
+//  kafkaTenants:
+//    Type: producer.Kafka
+//    Streams: tenants
+//    TopicTemplate: "logs-{{.tenant}}"
+//    AllowedTopics:
+//      - "logs-*"
+//    PartitionFrom: partition
+//    Servers:
+//      - "kafka01:9092"
+//      - "kafka02:9092"
 type Kafka struct {
 	core.BufferedProducer `gollumdoc:"embed_type"`
 	topicGuard            *sync.RWMutex
@@ -207,8 +283,15 @@ type Kafka struct {
 	config                *kafka.Config
 	producer              kafka.AsyncProducer
 	missCount             int64
-	nilValueAllowed       bool   `config:"AllowNilValue" default:"false"`
-	keyField              string `config:"KeyFrom"`
+	nilValueAllowed       bool     `config:"AllowNilValue" default:"false"`
+	keyField              string   `config:"KeyFrom"`
+	headerFields          []string `config:"HeadersFrom"`
+	topicField            string   `config:"TopicFrom"`
+	allowedTopics         []string `config:"AllowedTopics"`
+	topicBufferCount      int      `config:"TopicBufferCount" default:"1024"`
+	partitionField        string   `config:"PartitionFrom"`
+	topicTemplate         *template.Template
+	registrations         *sync.WaitGroup
 }
 
 type topicHandle struct {
@@ -217,6 +300,10 @@ type topicHandle struct {
 	sent          int64
 	delivered     int64
 	lastHeartBeat time.Time
+	guard         *sync.Mutex
+	state         int32
+	failedAt      time.Time
+	pending       []*core.Message
 }
 
 const (
@@ -237,6 +324,30 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 	prod.streamToTopic = conf.GetStreamMap("Topics", "")
 	prod.topic = make(map[core.MessageStreamID]*topicHandle)
 	prod.topicHandles = make(map[string]*topicHandle)
+	prod.registrations = new(sync.WaitGroup)
+
+	if topicTemplate := conf.GetString("TopicTemplate", ""); topicTemplate != "" {
+		tpl, err := newMetadataTemplate("TopicTemplate", topicTemplate)
+		conf.Errors.Push(err)
+		prod.topicTemplate = tpl
+	}
+
+	if (prod.topicField != "" || prod.topicTemplate != nil) && len(prod.allowedTopics) == 0 {
+		conf.Errors.Pushf("AllowedTopics must be set when using TopicFrom or TopicTemplate")
+	}
+
+	for _, pattern := range prod.allowedTopics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			conf.Errors.Pushf("Invalid AllowedTopics pattern '%s': %s", pattern, err.Error())
+		}
+	}
+
+	// Statically mapped topics are sent to without registration
+	for streamID, topicName := range prod.streamToTopic {
+		if streamID != core.WildcardStreamID {
+			prod.registerNewTopic(topicName, streamID)
+		}
+	}
 
 	prod.config = kafka.NewConfig()
 	prod.config.ClientID = prod.clientID
@@ -255,24 +366,44 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 		prod.config.Version = kafka.V0_9_0_1
 	case "0.10", "0.10.0", "0.10.0.0":
 		prod.config.Version = kafka.V0_10_0_0
+	case "0.10.0.1":
+		prod.config.Version = kafka.V0_10_0_1
+	case "0.10.1", "0.10.1.0":
+		prod.config.Version = kafka.V0_10_1_0
+	case "0.10.2", "0.10.2.0":
+		prod.config.Version = kafka.V0_10_2_0
+	case "0.11", "0.11.0", "0.11.0.0":
+		prod.config.Version = kafka.V0_11_0_0
+	case "1", "1.0", "1.0.0", "1.0.0.0":
+		prod.config.Version = kafka.V1_0_0_0
 	default:
 		prod.Logger.Warning("Unknown kafka version given: ", ver)
 		parts := strings.Split(ver, ".")
-		if len(parts) < 2 {
+		major, _ := strconv.ParseUint(parts[0], 10, 8)
+		switch {
+		case major >= 1:
+			prod.config.Version = kafka.V1_0_0_0
+		case len(parts) < 2:
 			prod.config.Version = kafka.V0_8_2_2
-		} else {
+		default:
 			minor, _ := strconv.ParseUint(parts[1], 10, 8)
 			switch {
 			case minor <= 8:
 				prod.config.Version = kafka.V0_8_2_2
 			case minor == 9:
 				prod.config.Version = kafka.V0_9_0_1
-			case minor >= 10:
+			case minor == 10:
 				prod.config.Version = kafka.V0_10_0_0
+			case minor >= 11:
+				prod.config.Version = kafka.V0_11_0_0
 			}
 		}
 	}
 
+	if len(prod.headerFields) > 0 && !prod.config.Version.IsAtLeast(kafka.V0_11_0_0) {
+		prod.Logger.Warning("HeadersFrom requires Kafka version 0.11 or later. Headers will not be sent.")
+	}
+
 	prod.config.Net.MaxOpenRequests = int(conf.GetInt("MaxOpenRequests", 5))
 	prod.config.Net.DialTimeout = time.Duration(int(conf.GetInt("ServerTimeoutSec", 30))) * time.Second
 	prod.config.Net.ReadTimeout = prod.config.Net.DialTimeout
@@ -375,15 +506,23 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 		}
 
 	}
+
+	if prod.partitionField != "" {
+		prod.config.Producer.Partitioner = NewExplicitPartitioner(prod.config.Producer.Partitioner)
+	}
 }
 
-func (prod *Kafka) storeRTT(msg *core.Message) {
+func (prod *Kafka) storeRTT(topicName string, msg *core.Message) {
 	rtt := time.Since(msg.GetCreationTime())
 
 	prod.topicGuard.RLock()
-	topic := prod.topic[msg.GetStreamID()]
+	topic, exists := prod.topicHandles[topicName]
 	prod.topicGuard.RUnlock()
 
+	if !exists {
+		return // ### return, unknown topic ###
+	}
+
 	atomic.AddInt64(&topic.rttSum, rtt.Nanoseconds()/1000) // microseconds
 	atomic.AddInt64(&topic.delivered, 1)
 }
@@ -396,21 +535,21 @@ func (prod *Kafka) pollResults() {
 		select {
 		case result, hasMore := <-prod.producer.Successes():
 			if hasMore {
-				if msg, hasMsg := result.Metadata.(core.Message); hasMsg {
-					prod.storeRTT(&msg)
+				if msg, hasMsg := result.Metadata.(*core.Message); hasMsg {
+					prod.storeRTT(result.Topic, msg)
 				}
 			}
 
 		case err, hasMore := <-prod.producer.Errors():
 			if hasMore {
-				if msg, hasMsg := err.Msg.Metadata.(core.Message); hasMsg {
+				if msg, hasMsg := err.Msg.Metadata.(*core.Message); hasMsg {
 					prod.Logger.Warning("Kafka producer error on return: ", err)
-					prod.storeRTT(&msg)
-					if err == kafka.ErrMessageTooLarge {
+					prod.storeRTT(err.Msg.Topic, msg)
+					if err.Err == kafka.ErrMessageTooLarge {
 						prod.Logger.Error("Message discarded as too large.")
 						core.CountMessageDiscarded()
 					} else {
-						prod.TryFallback(&msg)
+						prod.TryFallback(msg)
 					}
 				}
 			}
@@ -424,7 +563,7 @@ func (prod *Kafka) pollResults() {
 	defer prod.topicGuard.RUnlock()
 
 	// Update metrics
-	for _, topic := range prod.topic {
+	for _, topic := range prod.topicHandles {
 		rttSum := atomic.SwapInt64(&topic.rttSum, 0)
 		delivered := atomic.SwapInt64(&topic.delivered, 0)
 		topicName := topic.name
@@ -438,33 +577,104 @@ func (prod *Kafka) pollResults() {
 	}
 }
 
+// registerNewTopic maps the given stream to a statically configured topic.
+// Static topics are not registered in the background but marked as ready, so
+// that messages are sent to them directly.
 func (prod *Kafka) registerNewTopic(topicName string, streamID core.MessageStreamID) *topicHandle {
 	prod.topicGuard.Lock()
 	defer prod.topicGuard.Unlock()
 
+	topic := prod.getTopicHandle(topicName)
+	prod.topic[streamID] = topic
+
+	topic.guard.Lock()
+	if topic.state != topicRegistering {
+		topic.state = topicReady
+	}
+	topic.guard.Unlock()
+	return topic
+}
+
+// getTopicHandle returns the handle for the given topic name and creates it if
+// necessary. The caller has to hold topicGuard.
+func (prod *Kafka) getTopicHandle(topicName string) *topicHandle {
 	if topic, exists := prod.topicHandles[topicName]; exists {
-		prod.topic[streamID] = topic
 		return topic
 	}
 
 	topic := &topicHandle{
-		name: topicName,
+		name:  topicName,
+		guard: new(sync.Mutex),
 	}
 
 	prod.topicHandles[topicName] = topic
-	prod.topic[streamID] = topic
-
 	tgo.Metric.New(kafkaMetricRoundtrip + topicName)
 
 	return topic
 }
 
-func (prod *Kafka) produceMessage(msg *core.Message) {
-	if !prod.nilValueAllowed && len(msg.GetPayload()) == 0 {
-		streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
-		prod.Logger.Errorf("0 byte message detected on %s. Discarded", streamName)
-		core.CountMessageDiscarded()
-		return // ### return, invalid data ###
+// getDynamicTopicName returns the topic name set by TopicFrom or TopicTemplate
+// for the given message. An empty string is returned if no dynamic topic is
+// set.
+func (prod *Kafka) getDynamicTopicName(msg *core.Message) (string, error) {
+	if metadata := msg.TryGetMetadata(); prod.topicField != "" && metadata != nil {
+		if topicName := metadata.GetValueString(prod.topicField); topicName != "" {
+			return topicName, nil
+		}
+	}
+
+	if prod.topicTemplate != nil {
+		return executeMetadataTemplate(prod.topicTemplate, getTemplateValues(msg))
+	}
+
+	return "", nil
+}
+
+// isAllowedTopic returns an error if the given dynamic topic name is not a
+// valid kafka topic or not listed in AllowedTopics.
+func (prod *Kafka) isAllowedTopic(topicName string) error {
+	if len(topicName) > kafkaMaxTopicLength || topicName == "." || topicName == ".." {
+		return fmt.Errorf("Invalid topic name '%s'", topicName)
+	}
+
+	for _, r := range topicName {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return fmt.Errorf("Invalid topic name '%s'", topicName)
+		}
+	}
+
+	for _, pattern := range prod.allowedTopics {
+		if matched, _ := path.Match(pattern, topicName); matched {
+			return nil // ### return, allowed ###
+		}
+	}
+	return fmt.Errorf("Topic '%s' is not allowed", topicName)
+}
+
+// getTopic returns the topic handle for the given message
+func (prod *Kafka) getTopic(msg *core.Message) (*topicHandle, error) {
+	topicName, err := prod.getDynamicTopicName(msg)
+	if err != nil {
+		return nil, err // ### return, template failed ###
+	}
+
+	if topicName != "" {
+		if err := prod.isAllowedTopic(topicName); err != nil {
+			return nil, err // ### return, not allowed ###
+		}
+
+		prod.topicGuard.RLock()
+		topic, exists := prod.topicHandles[topicName]
+		prod.topicGuard.RUnlock()
+
+		if !exists {
+			prod.topicGuard.Lock()
+			topic = prod.getTopicHandle(topicName)
+			prod.topicGuard.Unlock()
+		}
+		return topic, nil
 	}
 
 	prod.topicGuard.RLock()
@@ -482,6 +692,98 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 		topic = prod.registerNewTopic(topicName, msg.GetStreamID())
 	}
 
+	return topic, nil
+}
+
+// isTopicReady returns true if messages can be sent to the given topic.
+// If the topic is not known yet, a registration is started in the background
+// and the message is kept until the registration is done.
+func (prod *Kafka) isTopicReady(topic *topicHandle, msg *core.Message) bool {
+	topic.guard.Lock()
+	defer topic.guard.Unlock()
+
+	switch topic.state {
+	case topicReady:
+		return true
+
+	case topicRegistering:
+		if len(topic.pending) >= prod.topicBufferCount {
+			prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte("Topic buffer is full")})
+		} else {
+			topic.pending = append(topic.pending, msg)
+		}
+		return false
+
+	case topicFailed:
+		if time.Since(topic.failedAt) < prod.config.Net.DialTimeout {
+			prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte("Topic registration failed")})
+			return false // ### return, wait before retrying ###
+		}
+	}
+
+	if !prod.tryOpenConnection() {
+		prod.TryFallback(msg)
+		return false // ### return, not connected ###
+	}
+
+	topic.state = topicRegistering
+	topic.pending = append(topic.pending, msg)
+
+	prod.registrations.Add(1)
+	go prod.registerTopic(topic)
+	return false
+}
+
+// registerTopic fetches the partitions of the given topic which causes the
+// topic to be created if the cluster allows it. Messages buffered during the
+// registration are sent afterwards.
+func (prod *Kafka) registerTopic(topic *topicHandle) {
+	defer prod.registrations.Done()
+
+	_, err := prod.client.Partitions(topic.name)
+
+	topic.guard.Lock()
+	defer topic.guard.Unlock()
+
+	pending := topic.pending
+	topic.pending = nil
+
+	if err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to register topic %s", topic.name)
+		topic.state = topicFailed
+		topic.failedAt = time.Now()
+		for _, msg := range pending {
+			prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte(err.Error())})
+		}
+		return // ### return, registration failed ###
+	}
+
+	prod.Logger.Debug("Registered topic ", topic.name)
+	topic.state = topicReady
+	for _, msg := range pending {
+		prod.sendMessage(topic, msg)
+	}
+}
+
+func (prod *Kafka) produceMessage(msg *core.Message) {
+	if !prod.nilValueAllowed && len(msg.GetPayload()) == 0 {
+		streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+		prod.Logger.Errorf("0 byte message detected on %s. Discarded", streamName)
+		core.CountMessageDiscarded()
+		return // ### return, invalid data ###
+	}
+
+	topic, err := prod.getTopic(msg)
+	if err != nil {
+		prod.Logger.Warning(err.Error())
+		prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte(err.Error())})
+		return // ### return, invalid topic ###
+	}
+
+	if !prod.isTopicReady(topic, msg) {
+		return // ### return, registering or failed ###
+	}
+
 	if isConnected, err := prod.isConnected(topic.name); !isConnected {
 		prod.TryFallback(msg)
 		if err != nil {
@@ -491,10 +793,17 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 		return // ### return, not connected ###
 	}
 
+	prod.sendMessage(topic, msg)
+}
+
+func (prod *Kafka) sendMessage(topic *topicHandle, msg *core.Message) {
 	kafkaMsg := &kafka.ProducerMessage{
-		Topic:    topic.name,
-		Value:    kafka.ByteEncoder(msg.GetPayload()),
-		Metadata: &msg,
+		Topic:     topic.name,
+		Value:     kafka.ByteEncoder(msg.GetPayload()),
+		Headers:   prod.getKafkaMsgHeaders(msg),
+		Timestamp: msg.GetCreationTime(),
+		Partition: prod.getKafkaMsgPartition(msg),
+		Metadata:  msg,
 	}
 
 	kafkaKey := prod.getKafkaMsgKey(msg)
@@ -515,6 +824,25 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 	}
 }
 
+// getKafkaMsgPartition returns the partition set by PartitionFrom or
+// kafkaNoPartition if the partitioner should choose the partition.
+func (prod *Kafka) getKafkaMsgPartition(msg *core.Message) int32 {
+	if len(prod.partitionField) == 0 {
+		return kafkaNoPartition
+	}
+
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return kafkaNoPartition
+	}
+
+	partition, err := strconv.ParseInt(metadata.GetValueString(prod.partitionField), 10, 32)
+	if err != nil || partition < 0 {
+		return kafkaNoPartition
+	}
+	return int32(partition)
+}
+
 func (prod *Kafka) getKafkaMsgKey(msg *core.Message) []byte {
 	if len(prod.keyField) > 0 {
 		if metadata := msg.TryGetMetadata(); metadata != nil {
@@ -526,6 +854,37 @@ func (prod *Kafka) getKafkaMsgKey(msg *core.Message) []byte {
 
 }
 
+func (prod *Kafka) getKafkaMsgHeaders(msg *core.Message) []kafka.RecordHeader {
+	if len(prod.headerFields) == 0 {
+		return nil
+	}
+
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return nil
+	}
+
+	keys := prod.headerFields
+	if len(keys) == 1 && keys[0] == "*" {
+		keys = make([]string, 0, len(metadata))
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	headers := make([]kafka.RecordHeader, 0, len(keys))
+	for _, key := range keys {
+		if value, isSet := metadata.TryGetValue(key); isSet {
+			headers = append(headers, kafka.RecordHeader{
+				Key:   []byte(key),
+				Value: value,
+			})
+		}
+	}
+	return headers
+}
+
 func (prod *Kafka) checkAllTopics() bool {
 	topics, err := prod.client.Topics()
 	if err != nil {
@@ -627,6 +986,7 @@ func (prod *Kafka) closeConnection() {
 func (prod *Kafka) close() {
 	defer prod.WorkerDone()
 	prod.DefaultClose()
+	prod.registrations.Wait()
 	prod.closeConnection()
 }
 
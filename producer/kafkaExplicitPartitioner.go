@@ -0,0 +1,58 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	kafka "github.com/Shopify/sarama"
+)
+
+// kafkaNoPartition marks messages that are not assigned to a partition
+const kafkaNoPartition = int32(-1)
+
+// ExplicitPartitioner sends messages to the partition set in the message.
+// ExplicitPartitioner satisfies sarama.Partitioner so it can be directly assigned to sarama kafka producer config.
+// Note: If no partition is set, i.e. the partition is negative, the wrapped partitioner is used.
+type ExplicitPartitioner struct {
+	partitioner kafka.Partitioner
+}
+
+// NewExplicitPartitioner returns a constructor for a sarama partitioner that
+// uses the partition set in the message or the given partitioner if no
+// partition is set.
+func NewExplicitPartitioner(constructor kafka.PartitionerConstructor) kafka.PartitionerConstructor {
+	return func(topic string) kafka.Partitioner {
+		p := new(ExplicitPartitioner)
+		p.partitioner = constructor(topic)
+		return p
+	}
+}
+
+// Partition returns the partition set in the message. If no partition is set
+// the wrapped partitioner is used.
+func (p *ExplicitPartitioner) Partition(message *kafka.ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Partition <= kafkaNoPartition {
+		return p.partitioner.Partition(message, numPartitions)
+	}
+	if message.Partition >= numPartitions {
+		return -1, kafka.ErrInvalidPartition
+	}
+	return message.Partition, nil
+}
+
+// RequiresConsistency always returns true as explicit partitions must not be
+// mapped to the currently writable partitions.
+func (p *ExplicitPartitioner) RequiresConsistency() bool {
+	return true
+}
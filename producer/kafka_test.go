@@ -0,0 +1,176 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	kafka "github.com/Shopify/sarama"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"testing"
+	"time"
+)
+
+func newTestKafkaProducer(expect ttesting.Expect, id string, headers []string) *Kafka {
+	config := core.NewPluginConfig(id, "producer.Kafka")
+	config.Override("Version", "0.11")
+	config.Override("HeadersFrom", headers)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*Kafka)
+	expect.True(casted)
+	return prod
+}
+
+func TestKafkaHeadersFrom(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	metadata := core.Metadata{}
+	metadata.SetValue("trace", []byte("abc"))
+	metadata.SetValue("host", []byte("web01"))
+	msg := core.NewMessage(nil, []byte("payload"), metadata, core.InvalidStreamID)
+
+	prod := newTestKafkaProducer(expect, "testKafkaHeadersSelected", []string{"trace", "missing"})
+	headers := prod.getKafkaMsgHeaders(msg)
+	expect.Equal(1, len(headers))
+	expect.Equal("trace", string(headers[0].Key))
+	expect.Equal("abc", string(headers[0].Value))
+
+	prod = newTestKafkaProducer(expect, "testKafkaHeadersAll", []string{"*"})
+	headers = prod.getKafkaMsgHeaders(msg)
+	expect.Equal(2, len(headers))
+	expect.Equal("host", string(headers[0].Key))
+	expect.Equal("trace", string(headers[1].Key))
+
+	msg = core.NewMessage(nil, []byte("payload"), nil, core.InvalidStreamID)
+	expect.Equal(0, len(prod.getKafkaMsgHeaders(msg)))
+}
+
+func TestKafkaDynamicTopics(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("testKafkaDynamicTopics", "producer.Kafka")
+	config.Override("TopicFrom", "topic")
+	config.Override("TopicTemplate", "logs-{{.tenant}}")
+	config.Override("AllowedTopics", []string{"logs-*", "audit"})
+	config.Override("PartitionFrom", "partition")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*Kafka)
+	expect.True(casted)
+
+	newMsg := func(metadata core.Metadata) *core.Message {
+		return core.NewMessage(nil, []byte("payload"), metadata, core.InvalidStreamID)
+	}
+
+	topicName, err := prod.getDynamicTopicName(newMsg(core.Metadata{"topic": []byte("audit"), "tenant": []byte("a")}))
+	expect.NoError(err)
+	expect.Equal("audit", topicName)
+	topicName, err = prod.getDynamicTopicName(newMsg(core.Metadata{"tenant": []byte("a")}))
+	expect.NoError(err)
+	expect.Equal("logs-a", topicName)
+	topicName, err = prod.getDynamicTopicName(newMsg(nil))
+	expect.NoError(err)
+	expect.Equal("logs-", topicName)
+
+	expect.NoError(prod.isAllowedTopic("logs-a"))
+	expect.NoError(prod.isAllowedTopic("audit"))
+	expect.NotNil(prod.isAllowedTopic("audit2"))
+	expect.NotNil(prod.isAllowedTopic("logs-a/b"))
+	expect.NotNil(prod.isAllowedTopic(".."))
+
+	topic, err := prod.getTopic(newMsg(core.Metadata{"topic": []byte("secret")}))
+	expect.NotNil(err)
+	expect.Nil(topic)
+
+	expect.Equal(int32(3), prod.getKafkaMsgPartition(newMsg(core.Metadata{"partition": []byte("3")})))
+	expect.Equal(kafkaNoPartition, prod.getKafkaMsgPartition(newMsg(core.Metadata{"partition": []byte("x")})))
+	expect.Equal(kafkaNoPartition, prod.getKafkaMsgPartition(newMsg(nil)))
+
+	partitioner := NewExplicitPartitioner(kafka.NewRoundRobinPartitioner)("test")
+	expect.True(partitioner.RequiresConsistency())
+	expect.True(NewExplicitPartitioner(kafka.NewHashPartitioner)("test").RequiresConsistency())
+	partition, err := partitioner.Partition(&kafka.ProducerMessage{Partition: 2}, 4)
+	expect.NoError(err)
+	expect.Equal(int32(2), partition)
+	_, err = partitioner.Partition(&kafka.ProducerMessage{Partition: 4}, 4)
+	expect.NotNil(err)
+	_, err = partitioner.Partition(&kafka.ProducerMessage{Partition: kafkaNoPartition}, 4)
+	expect.NoError(err)
+
+	// Dynamic topics must be restricted
+	config = core.NewPluginConfig("testKafkaDynamicTopicsUnrestricted", "producer.Kafka")
+	config.Override("TopicFrom", "topic")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
+
+func TestKafkaTopicRegistration(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	// Sarama's logger is set by Configure, so the broker is started afterwards
+	config := core.NewPluginConfig("testKafkaTopicRegistration", "producer.Kafka")
+	config.Override("TopicFrom", "topic")
+	config.Override("AllowedTopics", []string{"logs-*"})
+	config.Override("Topics", map[string]string{"static": "logs-static"})
+	config.Override("PartitionFrom", "partition")
+	config.Override("ElectRetries", 0)
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	prod, casted := plugin.(*Kafka)
+	expect.True(casted)
+
+	broker := kafka.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]kafka.MockResponse{
+		"MetadataRequest": kafka.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("logs-a", 0, broker.BrokerID()).
+			SetLeader("logs-a", 1, broker.BrokerID()),
+		"ProduceRequest": kafka.NewMockProduceResponse(t),
+	})
+
+	prod.servers = []string{broker.Addr()}
+	defer prod.closeConnection()
+
+	prod.produceMessage(core.NewMessage(nil, []byte("known"), core.Metadata{"topic": []byte("logs-a"), "partition": []byte("1")}, core.InvalidStreamID))
+	prod.produceMessage(core.NewMessage(nil, []byte("unknown"), core.Metadata{"topic": []byte("logs-b")}, core.InvalidStreamID))
+	prod.registrations.Wait()
+
+	expect.Equal(topicReady, prod.topicHandles["logs-a"].state)
+	expect.Equal(topicFailed, prod.topicHandles["logs-b"].state)
+	expect.Equal(0, len(prod.topicHandles["logs-b"].pending))
+
+	// Static topics are not registered in the background
+	expect.Equal(topicReady, prod.topicHandles["logs-static"].state)
+
+	select {
+	case result := <-prod.producer.Successes():
+		expect.Equal("logs-a", result.Topic)
+		expect.Equal(int32(1), result.Partition)
+		msg, isMsg := result.Metadata.(*core.Message)
+		expect.True(isMsg)
+		expect.Equal("known", msg.String())
+
+	case err := <-prod.producer.Errors():
+		t.Error(err)
+
+	case <-time.After(5 * time.Second):
+		t.Error("Message was not sent")
+	}
+}
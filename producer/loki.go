@@ -0,0 +1,338 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/snappy"
+	"github.com/trivago/gollum/core"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lokiEncodingProtobuf = "protobuf"
+	lokiEncodingJSON     = "json"
+)
+
+// Loki producer plugin
+//
+// This producer sends messages to the push API of Grafana Loki. Each message
+// is sent as a log line using the creation time of the message as timestamp.
+//
+// Messages are grouped into Loki streams by their label set. Labels are built
+// from the stream name, static labels and metadata values. Each batch sends
+// one request containing all streams, with the entries of each stream
+// ordered by time.
+//
+// Failed requests are retried like in producer.HTTPRequest. If a request
+// finally fails, all of its messages are sent to the fallback.
+//
+// Parameters
+//
+// - Address: Defines the URL of the Loki push API.
+// By default this parameter is set to "http://localhost:3100/loki/api/v1/push".
+//
+// - Encoding: Defines the request format. Can be set to "protobuf" for
+// snappy compressed protocol buffers or "json".
+// By default this parameter is set to "protobuf".
+//
+// - Labels: Defines a map of static labels added to all streams.
+// By default this parameter is set to "empty".
+//
+// - LabelsFrom: Defines a list of metadata keys used as labels. Characters
+// not allowed in label names are replaced by "_". Keys that are not set are
+// skipped.
+// By default this parameter is set to an empty list.
+//
+// - StreamLabel: Defines the name of the label holding the gollum stream
+// name. When set to an empty string, the stream name is not used as label.
+// By default this parameter is set to "stream".
+//
+// - TenantID: Defines the tenant sent in the "X-Scope-OrgID" header. When
+// set to an empty string, no header is sent.
+// By default this parameter is set to "".
+//
+// - User: Defines the user name used for basic authentication. When set to
+// an empty string, no authentication is used.
+// By default this parameter is set to "".
+//
+// - Password: Defines the password used for basic authentication.
+// By default this parameter is set to "".
+//
+// - TimeoutSec: Defines the maximum number of seconds to wait for a response.
+// By default this parameter is set to "30".
+//
+// - Retry/Count: Defines the number of times a failed request is retried.
+// By default this parameter is set to "3".
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait before the
+// first retry.
+// By default this parameter is set to "500".
+//
+// - Retry/MaxDelaySec: Defines the maximum number of seconds to wait before
+// a retry.
+// By default this parameter is set to "30".
+//
+// Examples
+//
+// This example sends all messages to a local Loki instance, using the stream
+// name and the metadata keys "host" and "service" as labels:
+//
+//  lokiOut:
+//    Type: producer.Loki
+//    Streams: "*"
+//    Address: "http://loki:3100/loki/api/v1/push"
+//    TenantID: "team-a"
+//    Labels:
+//      env: production
+//    LabelsFrom:
+//      - host
+//      - service
+//    Batch:
+//      MaxCount: 2048
+//      FlushCount: 1024
+//      TimeoutSec: 1
+type Loki struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	address              string        `config:"Address" default:"http://localhost:3100/loki/api/v1/push"`
+	encoding             string        `config:"Encoding" default:"protobuf"`
+	labelsFrom           []string      `config:"LabelsFrom"`
+	streamLabel          string        `config:"StreamLabel" default:"stream"`
+	tenantID             string        `config:"TenantID"`
+	user                 string        `config:"User"`
+	password             string        `config:"Password"`
+	timeout              time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	sender               httpRetrySender
+	labels               map[string]string
+}
+
+// lokiBatchStream collects the messages of one Loki stream
+type lokiBatchStream struct {
+	labels   map[string]string
+	messages []*core.Message
+}
+
+func init() {
+	core.TypeRegistry.Register(Loki{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Loki) Configure(conf core.PluginConfigReader) {
+	prod.encoding = strings.ToLower(prod.encoding)
+	switch prod.encoding {
+	case lokiEncodingProtobuf, lokiEncodingJSON:
+	default:
+		conf.Errors.Pushf("Unknown encoding '%s'", prod.encoding)
+	}
+
+	if prod.streamLabel != "" {
+		prod.streamLabel = sanitizeLokiLabel(prod.streamLabel)
+	}
+
+	prod.labels = make(map[string]string)
+	for name, value := range conf.GetStringMap("Labels", map[string]string{}) {
+		prod.labels[sanitizeLokiLabel(name)] = value
+	}
+
+	prod.sender.init(&http.Client{Timeout: prod.timeout}, nil, &prod.SimpleProducer)
+}
+
+// sanitizeLokiLabel replaces all characters not allowed in label names by "_"
+func sanitizeLokiLabel(name string) string {
+	label := []byte(name)
+	for i, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			label[i] = '_'
+		}
+	}
+	return string(label)
+}
+
+// getLabels returns the label set of the given message
+func (prod *Loki) getLabels(msg *core.Message) map[string]string {
+	labels := make(map[string]string, len(prod.labels)+len(prod.labelsFrom)+1)
+	for name, value := range prod.labels {
+		labels[name] = value
+	}
+
+	if prod.streamLabel != "" {
+		labels[prod.streamLabel] = core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	}
+
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for _, key := range prod.labelsFrom {
+			if value := metadata.GetValueString(key); value != "" {
+				labels[sanitizeLokiLabel(key)] = value
+			}
+		}
+	}
+	return labels
+}
+
+// formatLokiLabels returns the given label set in the format used by Loki,
+// e.g. `{host="web01", stream="access"}`. Labels are sorted by name.
+func formatLokiLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// groupMessages groups the given messages by label set. The messages of each
+// stream are ordered by time. The streams are returned in the order of their
+// first message.
+func (prod *Loki) groupMessages(messages []*core.Message) ([]string, map[string]*lokiBatchStream) {
+	order := []string{}
+	streams := make(map[string]*lokiBatchStream)
+
+	for _, msg := range messages {
+		labels := prod.getLabels(msg)
+		key := formatLokiLabels(labels)
+
+		stream, exists := streams[key]
+		if !exists {
+			stream = &lokiBatchStream{labels: labels}
+			streams[key] = stream
+			order = append(order, key)
+		}
+		stream.messages = append(stream.messages, msg)
+	}
+
+	for _, stream := range streams {
+		entries := stream.messages
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].GetCreationTime().Before(entries[j].GetCreationTime())
+		})
+	}
+	return order, streams
+}
+
+// encodeBody returns the request body and content type for the given streams
+func (prod *Loki) encodeBody(order []string, streams map[string]*lokiBatchStream) ([]byte, string, error) {
+	if prod.encoding == lokiEncodingJSON {
+		type jsonStream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+
+		request := struct {
+			Streams []jsonStream `json:"streams"`
+		}{}
+
+		for _, key := range order {
+			stream := streams[key]
+			values := make([][2]string, len(stream.messages))
+			for i, msg := range stream.messages {
+				values[i] = [2]string{
+					strconv.FormatInt(msg.GetCreationTime().UnixNano(), 10),
+					msg.String(),
+				}
+			}
+			request.Streams = append(request.Streams, jsonStream{stream.labels, values})
+		}
+
+		body, err := json.Marshal(request)
+		return body, "application/json", err
+	}
+
+	request := &lokiPushRequest{}
+	for _, key := range order {
+		stream := &lokiStream{Labels: key}
+		for _, msg := range streams[key].messages {
+			created := msg.GetCreationTime()
+			stream.Entries = append(stream.Entries, &lokiEntry{
+				Timestamp: &timestamp.Timestamp{
+					Seconds: created.Unix(),
+					Nanos:   int32(created.Nanosecond()),
+				},
+				Line: msg.String(),
+			})
+		}
+		request.Streams = append(request.Streams, stream)
+	}
+
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return nil, "", err
+	}
+	return snappy.Encode(nil, data), "application/x-protobuf", nil
+}
+
+// send pushes the given body to Loki and retries the request if necessary.
+// The status of the last response is returned along with an error if the
+// request failed.
+func (prod *Loki) send(body []byte, contentType string) (int, error) {
+	status, _, err := prod.sender.send(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", prod.address, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", contentType)
+		if prod.tenantID != "" {
+			req.Header.Set("X-Scope-OrgID", prod.tenantID)
+		}
+		if prod.user != "" {
+			req.SetBasicAuth(prod.user, prod.password)
+		}
+		return req, nil
+	})
+	return status, err
+}
+
+// pushMessages sends the given messages in a single request. If the request
+// fails, all messages are sent to the fallback.
+func (prod *Loki) pushMessages(messages []*core.Message) {
+	order, streams := prod.groupMessages(messages)
+
+	status := 0
+	body, contentType, err := prod.encodeBody(order, streams)
+	if err == nil {
+		status, err = prod.send(body, contentType)
+	}
+
+	if err == nil {
+		return // ### return, success ###
+	}
+
+	prod.Logger.Error("Push failed: ", err)
+	metadata := newHTTPFallbackMetadata(status, err)
+	for _, msg := range messages {
+		prod.TryFallbackWithMetadata(msg, metadata)
+	}
+}
+
+// Produce sends batches of messages to Loki.
+func (prod *Loki) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.pushMessages })
+}
@@ -0,0 +1,53 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// The types in this file match the messages of the Loki push API as defined
+// in logproto (https://github.com/grafana/loki/blob/master/pkg/logproto/logproto.proto).
+// Only the fields required for pushing are declared.
+
+// lokiPushRequest matches logproto.PushRequest
+type lokiPushRequest struct {
+	Streams []*lokiStream `protobuf:"bytes,1,rep,name=streams" json:"streams,omitempty"`
+}
+
+func (m *lokiPushRequest) Reset()         { *m = lokiPushRequest{} }
+func (m *lokiPushRequest) String() string { return proto.CompactTextString(m) }
+func (*lokiPushRequest) ProtoMessage()    {}
+
+// lokiStream matches logproto.StreamAdapter
+type lokiStream struct {
+	Labels  string       `protobuf:"bytes,1,opt,name=labels,proto3" json:"labels,omitempty"`
+	Entries []*lokiEntry `protobuf:"bytes,2,rep,name=entries" json:"entries,omitempty"`
+}
+
+func (m *lokiStream) Reset()         { *m = lokiStream{} }
+func (m *lokiStream) String() string { return proto.CompactTextString(m) }
+func (*lokiStream) ProtoMessage()    {}
+
+// lokiEntry matches logproto.EntryAdapter
+type lokiEntry struct {
+	Timestamp *timestamp.Timestamp `protobuf:"bytes,1,opt,name=timestamp" json:"timestamp,omitempty"`
+	Line      string               `protobuf:"bytes,2,opt,name=line,proto3" json:"line,omitempty"`
+}
+
+func (m *lokiEntry) Reset()         { *m = lokiEntry{} }
+func (m *lokiEntry) String() string { return proto.CompactTextString(m) }
+func (*lokiEntry) ProtoMessage()    {}
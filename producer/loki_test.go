@@ -0,0 +1,127 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLokiMessages() []*core.Message {
+	streamID := core.StreamRegistry.GetStreamID("access")
+	first := core.NewMessage(nil, []byte("first"), core.Metadata{"host": []byte("web01")}, streamID)
+	time.Sleep(time.Millisecond)
+	second := core.NewMessage(nil, []byte("second"), core.Metadata{"host": []byte("web01")}, streamID)
+	other := core.NewMessage(nil, []byte("other"), core.Metadata{"host": []byte("db01")}, streamID)
+
+	// Entries are sorted by time within a stream
+	return []*core.Message{second, other, first}
+}
+
+func TestLokiProtobuf(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &httpRequestStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.Loki", "testLokiProtobuf", map[string]interface{}{
+		"Address":     server.URL + "/loki/api/v1/push",
+		"LabelsFrom":  []string{"host", "missing"},
+		"Labels":      map[string]string{"env": "test"},
+		"StreamLabel": "gollum-stream",
+		"TenantID":    "team-a",
+		"User":        "user",
+		"Password":    "secret",
+	}).(*Loki)
+
+	messages := newTestLokiMessages()
+	expect.Equal(`{env="test", gollum_stream="access", host="web01"}`, formatLokiLabels(prod.getLabels(messages[0])))
+
+	prod.pushMessages(messages)
+	expect.Equal(1, len(standIn.requests))
+
+	request := standIn.requests[0]
+	expect.Equal("POST", request.method)
+	expect.Equal("/loki/api/v1/push", request.path)
+	expect.Equal("application/x-protobuf", request.header.Get("Content-Type"))
+	expect.Equal("team-a", request.header.Get("X-Scope-OrgID"))
+	expect.Equal("Basic dXNlcjpzZWNyZXQ=", request.header.Get("Authorization"))
+
+	data, err := snappy.Decode(nil, []byte(request.body))
+	expect.NoError(err)
+
+	push := &lokiPushRequest{}
+	expect.NoError(proto.Unmarshal(data, push))
+	expect.Equal(2, len(push.Streams))
+	expect.Equal(`{env="test", gollum_stream="access", host="web01"}`, push.Streams[0].Labels)
+	expect.Equal(2, len(push.Streams[0].Entries))
+	expect.Equal("first", push.Streams[0].Entries[0].Line)
+	expect.Equal("second", push.Streams[0].Entries[1].Line)
+	expect.Equal(messages[2].GetCreationTime().UnixNano(),
+		time.Unix(push.Streams[0].Entries[0].Timestamp.Seconds, int64(push.Streams[0].Entries[0].Timestamp.Nanos)).UnixNano())
+	expect.Equal(`{env="test", gollum_stream="access", host="db01"}`, push.Streams[1].Labels)
+}
+
+func TestLokiJSON(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &httpRequestStandIn{statuses: []int{429, 503}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.Loki", "testLokiJSON", map[string]interface{}{
+		"Address":       server.URL,
+		"Encoding":      "json",
+		"LabelsFrom":    []string{"host"},
+		"StreamLabel":   "",
+		"Retry/DelayMs": 1,
+	}).(*Loki)
+
+	messages := newTestLokiMessages()
+	prod.pushMessages(messages)
+	expect.Equal(3, len(standIn.requests))
+	expect.Equal("application/json", standIn.requests[2].header.Get("Content-Type"))
+	expect.Equal("", standIn.requests[2].header.Get("Authorization"))
+
+	push := struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}{}
+	expect.NoError(json.Unmarshal([]byte(standIn.requests[2].body), &push))
+	expect.Equal(2, len(push.Streams))
+	expect.Equal(map[string]string{"host": "web01"}, push.Streams[0].Stream)
+	expect.Equal("first", push.Streams[0].Values[0][1])
+	expect.Equal("second", push.Streams[0].Values[1][1])
+	expect.Equal("other", push.Streams[1].Values[0][1])
+
+	// Client errors are not retried
+	standIn.statuses = []int{400}
+	status, err := prod.send([]byte("{}"), "application/json")
+	expect.NotNil(err)
+	expect.Equal(400, status)
+	expect.Equal(4, len(standIn.requests))
+
+	expect.Equal("host_name", sanitizeLokiLabel("host.name"))
+	expect.Equal("_abc", sanitizeLokiLabel("1abc"))
+}
@@ -20,6 +20,7 @@ import (
 	_ "github.com/trivago/gollum/filter"
 	_ "github.com/trivago/gollum/format"
 	_ "github.com/trivago/gollum/router"
+	"github.com/trivago/tgo/ttesting"
 	"runtime/debug"
 	"testing"
 )
@@ -31,6 +32,22 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
+// newTestProducer creates a producer of the given type using the given
+// settings. The test is aborted if the producer cannot be created.
+func newTestProducer(t *testing.T, typeName, name string, settings map[string]interface{}) core.Plugin {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig(name, typeName)
+	for key, value := range settings {
+		config.Override(key, value)
+	}
+	plugin, err := core.NewPluginWithConfig(config)
+	if !expect.NoError(err) {
+		t.FailNow()
+	}
+	return plugin
+}
+
 func TestProducerInterface(t *testing.T) {
 	producers := core.TypeRegistry.GetRegistered("producer.")
 	if len(producers) == 0 {
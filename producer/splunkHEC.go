@@ -0,0 +1,485 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const splunkHECChannelHeader = "X-Splunk-Request-Channel"
+
+// SplunkHEC producer plugin
+//
+// This producer sends messages to the Splunk HTTP event collector (HEC).
+// Messages are sent as events in batches to the "/services/collector/event"
+// endpoint. The creation time of a message is used as the event time unless
+// TimeFrom is set.
+//
+// Failed requests are retried like in producer.HTTPRequest. If a request
+// finally fails, all of its messages are sent to the fallback.
+//
+// If acknowledgements are enabled, the "/services/collector/ack" endpoint is
+// polled for each request. Messages of requests not acknowledged within
+// Ack/TimeoutSec are sent to the fallback. Please note that this may lead to
+// duplicates if the events are indexed later on.
+//
+// Parameters
+//
+// - Address: Defines the base URL of the event collector.
+// By default this parameter is set to "https://localhost:8088".
+//
+// - Token: Defines the token sent in the "Authorization: Splunk <token>"
+// header.
+// By default this parameter is set to "".
+//
+// - Channel: Defines the channel sent with each request. A random channel is
+// used if acknowledgements are enabled and no channel is set.
+// By default this parameter is set to "".
+//
+// - Host, Source, SourceType, Index: Define the default values of the event
+// fields of the same name. Empty values are not sent.
+// By default these parameters are set to "".
+//
+// - HostFrom, SourceFrom, SourceTypeFrom, IndexFrom: Define the metadata keys
+// used to set the event fields of the same name. If a key is not set, the
+// default value is used.
+// By default these parameters are set to "host", "source", "sourcetype" and
+// "index".
+//
+// - TimeFrom: Defines the metadata key holding the event time given as
+// seconds since epoch. If the key is not set, the creation time of the
+// message is used.
+// By default this parameter is set to "".
+//
+// - FieldsFrom: Defines a list of metadata keys sent as indexed fields.
+// By default this parameter is set to an empty list.
+//
+// - JSONEvent: When set to true, messages containing valid JSON are sent as
+// JSON events instead of strings.
+// By default this parameter is set to false.
+//
+// - Gzip: When set to true, requests are gzip compressed.
+// By default this parameter is set to false.
+//
+// - TimeoutSec: Defines the maximum number of seconds to wait for a response.
+// By default this parameter is set to "30".
+//
+// - Retry/Count: Defines the number of times a failed request is retried.
+// By default this parameter is set to "3".
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait before the
+// first retry.
+// By default this parameter is set to "500".
+//
+// - Retry/MaxDelaySec: Defines the maximum number of seconds to wait before
+// a retry.
+// By default this parameter is set to "30".
+//
+// - Ack/Enable: Enables polling for indexer acknowledgements. This requires
+// acknowledgements to be enabled for the token.
+// By default this parameter is set to false.
+//
+// - Ack/PollIntervalMs: Defines the number of milliseconds between two
+// acknowledgement requests.
+// By default this parameter is set to "1000".
+//
+// - Ack/TimeoutSec: Defines the number of seconds to wait for a request to be
+// acknowledged.
+// By default this parameter is set to "60".
+//
+// Examples
+//
+// This example sends all messages to Splunk, using the metadata key "host" as
+// host and waiting for the events to be indexed:
+//
+//  splunkOut:
+//    Type: producer.SplunkHEC
+//    Streams: "*"
+//    Address: "https://splunk:8088"
+//    Token: "00000000-0000-0000-0000-000000000000"
+//    SourceType: "gollum"
+//    Index: "main"
+//    Gzip: true
+//    Ack:
+//      Enable: true
+//    Batch:
+//      MaxCount: 512
+//      FlushCount: 256
+//      TimeoutSec: 1
+type SplunkHEC struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	address              string        `config:"Address" default:"https://localhost:8088"`
+	token                string        `config:"Token"`
+	channel              string        `config:"Channel"`
+	host                 string        `config:"Host"`
+	source               string        `config:"Source"`
+	sourceType           string        `config:"SourceType"`
+	index                string        `config:"Index"`
+	hostField            string        `config:"HostFrom" default:"host"`
+	sourceField          string        `config:"SourceFrom" default:"source"`
+	sourceTypeField      string        `config:"SourceTypeFrom" default:"sourcetype"`
+	indexField           string        `config:"IndexFrom" default:"index"`
+	timeField            string        `config:"TimeFrom"`
+	fieldsFrom           []string      `config:"FieldsFrom"`
+	jsonEvent            bool          `config:"JSONEvent"`
+	gzip                 bool          `config:"Gzip"`
+	timeout              time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	sender               httpRetrySender
+	ackEnabled           bool          `config:"Ack/Enable"`
+	ackInterval          time.Duration `config:"Ack/PollIntervalMs" default:"1000" metric:"ms"`
+	ackTimeout           time.Duration `config:"Ack/TimeoutSec" default:"60" metric:"sec"`
+	client               *http.Client
+	acks                 map[int64]splunkHECPending
+	ackGuard             *sync.Mutex
+	stopAcks             chan struct{}
+}
+
+// splunkHECEvent is an event sent to the event collector
+type splunkHECEvent struct {
+	Time       json.Number       `json:"time,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      interface{}       `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// splunkHECResponse is the response of the event collector
+type splunkHECResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// splunkHECPending holds the messages of a request waiting to be acknowledged
+type splunkHECPending struct {
+	messages []*core.Message
+	sent     time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(SplunkHEC{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *SplunkHEC) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+
+	prod.address = strings.TrimSuffix(prod.address, "/")
+	if prod.token == "" {
+		prod.Logger.Warning("No token set. Requests will be rejected by the event collector.")
+	}
+
+	if prod.ackEnabled && prod.channel == "" {
+		prod.channel = newSplunkHECChannel()
+	}
+
+	prod.client = &http.Client{Timeout: prod.timeout}
+	prod.sender.init(prod.client, nil, &prod.SimpleProducer)
+	prod.acks = make(map[int64]splunkHECPending)
+	prod.ackGuard = new(sync.Mutex)
+	prod.stopAcks = make(chan struct{})
+}
+
+// newSplunkHECChannel returns a random channel id formatted as UUID
+func newSplunkHECChannel() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// formatSplunkHECTime returns the given time as seconds since epoch with
+// millisecond precision.
+func formatSplunkHECTime(timestamp time.Time) json.Number {
+	seconds := float64(timestamp.UnixNano()/int64(time.Millisecond)) / 1000
+	return json.Number(strconv.FormatFloat(seconds, 'f', 3, 64))
+}
+
+// getSplunkHECValue returns the value of the given metadata key or the
+// default value if the key is not set.
+func getSplunkHECValue(metadata core.Metadata, key, defaultValue string) string {
+	if key != "" && metadata != nil {
+		if value := metadata.GetValueString(key); value != "" {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// newEvent returns the event for the given message
+func (prod *SplunkHEC) newEvent(msg *core.Message) splunkHECEvent {
+	metadata := msg.TryGetMetadata()
+	event := splunkHECEvent{
+		Time:       formatSplunkHECTime(msg.GetCreationTime()),
+		Host:       getSplunkHECValue(metadata, prod.hostField, prod.host),
+		Source:     getSplunkHECValue(metadata, prod.sourceField, prod.source),
+		SourceType: getSplunkHECValue(metadata, prod.sourceTypeField, prod.sourceType),
+		Index:      getSplunkHECValue(metadata, prod.indexField, prod.index),
+		Event:      msg.String(),
+	}
+
+	if value := getSplunkHECValue(metadata, prod.timeField, ""); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err == nil && !math.IsNaN(seconds) && !math.IsInf(seconds, 0) && seconds >= 0 {
+			event.Time = json.Number(strconv.FormatFloat(seconds, 'f', -1, 64))
+		}
+	}
+
+	if prod.jsonEvent && json.Valid(msg.GetPayload()) {
+		event.Event = json.RawMessage(msg.GetPayload())
+	}
+
+	for _, key := range prod.fieldsFrom {
+		if value := getSplunkHECValue(metadata, key, ""); value != "" {
+			if event.Fields == nil {
+				event.Fields = make(map[string]string)
+			}
+			event.Fields[key] = value
+		}
+	}
+	return event
+}
+
+// encodeBody returns the concatenated events of the given messages
+func (prod *SplunkHEC) encodeBody(messages []*core.Message) ([]byte, error) {
+	body := bytes.Buffer{}
+	var writer interface {
+		Write([]byte) (int, error)
+	} = &body
+
+	var compressor *gzip.Writer
+	if prod.gzip {
+		compressor = gzip.NewWriter(&body)
+		writer = compressor
+	}
+
+	encoder := json.NewEncoder(writer)
+	for _, msg := range messages {
+		if err := encoder.Encode(prod.newEvent(msg)); err != nil {
+			return nil, err
+		}
+	}
+
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// newRequest returns a request to the given endpoint of the event collector
+func (prod *SplunkHEC) newRequest(endpoint string, body []byte, compressed bool) (*http.Request, error) {
+	req, err := http.NewRequest("POST", prod.address+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Splunk "+prod.token)
+	req.Header.Set("Content-Type", "application/json")
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if prod.channel != "" {
+		req.Header.Set(splunkHECChannelHeader, prod.channel)
+	}
+	return req, nil
+}
+
+// send sends the given events and retries the request if necessary. The
+// status of the last response is returned along with the response body or
+// an error if the request failed.
+func (prod *SplunkHEC) send(body []byte) (int, splunkHECResponse, error) {
+	result := splunkHECResponse{}
+	status, respBody, err := prod.sender.send(func() (*http.Request, error) {
+		return prod.newRequest("/services/collector/event", body, prod.gzip)
+	})
+	if len(respBody) > 0 {
+		json.Unmarshal(respBody, &result)
+	}
+	return status, result, err
+}
+
+// tryFallback sends the given messages to the fallback, passing the error
+// and status code as metadata.
+func (prod *SplunkHEC) tryFallback(messages []*core.Message, status int, err error) {
+	metadata := newHTTPFallbackMetadata(status, err)
+	for _, msg := range messages {
+		prod.TryFallbackWithMetadata(msg, metadata)
+	}
+}
+
+// sendBatch sends the given messages in a single request. If the request
+// fails, all messages are sent to the fallback.
+func (prod *SplunkHEC) sendBatch(messages []*core.Message) {
+	body, err := prod.encodeBody(messages)
+	if err != nil {
+		prod.Logger.Error("Failed to encode events: ", err)
+		prod.tryFallback(messages, 0, err)
+		return // ### return, invalid data ###
+	}
+
+	status, result, err := prod.send(body)
+	if err != nil {
+		prod.Logger.Error("Send failed: ", err)
+		prod.tryFallback(messages, status, err)
+		return // ### return, failed ###
+	}
+
+	if !prod.ackEnabled {
+		return // ### return, done ###
+	}
+
+	if result.AckID == nil {
+		prod.Logger.Warning("No ackId received. Acknowledgements are not enabled for this token.")
+		return // ### return, acks not supported ###
+	}
+
+	prod.ackGuard.Lock()
+	prod.acks[*result.AckID] = splunkHECPending{messages: messages, sent: time.Now()}
+	prod.ackGuard.Unlock()
+}
+
+// pollAcks requests the status of all pending acknowledgements. Messages of
+// requests that have not been acknowledged in time are sent to the fallback.
+func (prod *SplunkHEC) pollAcks() {
+	prod.ackGuard.Lock()
+	ids := make([]int64, 0, len(prod.acks))
+	for id := range prod.acks {
+		ids = append(ids, id)
+	}
+	prod.ackGuard.Unlock()
+
+	if len(ids) == 0 {
+		return // ### return, nothing to poll ###
+	}
+
+	acked, err := prod.requestAcks(ids)
+	if err != nil {
+		prod.Logger.WithError(err).Warning("Failed to poll acknowledgements")
+	}
+
+	prod.ackGuard.Lock()
+	defer prod.ackGuard.Unlock()
+
+	for _, id := range ids {
+		pending := prod.acks[id]
+		switch {
+		case acked[strconv.FormatInt(id, 10)]:
+			delete(prod.acks, id)
+
+		case time.Since(pending.sent) >= prod.ackTimeout:
+			delete(prod.acks, id)
+			prod.Logger.Errorf("Request %d was not acknowledged", id)
+			prod.tryFallback(pending.messages, 0, fmt.Errorf("Request %d was not acknowledged", id))
+		}
+	}
+}
+
+// requestAcks returns the acknowledgement status of the given ids
+func (prod *SplunkHEC) requestAcks(ids []int64) (map[string]bool, error) {
+	body, _ := json.Marshal(map[string][]int64{"acks": ids})
+	req, err := prod.newRequest("/services/collector/ack", body, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := prod.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	result := struct {
+		Acks map[string]bool `json:"acks"`
+	}{}
+	err = json.Unmarshal(respBody, &result)
+	return result.Acks, err
+}
+
+// hasPendingAcks returns true if requests are waiting to be acknowledged
+func (prod *SplunkHEC) hasPendingAcks() bool {
+	prod.ackGuard.Lock()
+	defer prod.ackGuard.Unlock()
+	return len(prod.acks) > 0
+}
+
+func (prod *SplunkHEC) ackLoop() {
+	defer prod.WorkerDone()
+
+	ticker := time.NewTicker(prod.ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-prod.stopAcks:
+			return // ### return, stopped ###
+		case <-ticker.C:
+			prod.pollAcks()
+		}
+	}
+}
+
+func (prod *SplunkHEC) close() {
+	defer prod.WorkerDone()
+	prod.Batch.Close(prod.sendBatch, prod.GetShutdownTimeout())
+
+	if !prod.ackEnabled {
+		return // ### return, done ###
+	}
+
+	close(prod.stopAcks)
+	deadline := time.Now().Add(prod.GetShutdownTimeout())
+	for prod.hasPendingAcks() && time.Now().Before(deadline) {
+		time.Sleep(prod.ackInterval)
+		prod.pollAcks()
+	}
+
+	prod.ackGuard.Lock()
+	defer prod.ackGuard.Unlock()
+	for id, pending := range prod.acks {
+		prod.tryFallback(pending.messages, 0, fmt.Errorf("Request %d was not acknowledged before shutdown", id))
+	}
+}
+
+// Produce sends batches of messages to the event collector.
+func (prod *SplunkHEC) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	if prod.ackEnabled {
+		prod.AddWorker()
+		go prod.ackLoop()
+	}
+	prod.BatchControlLoop(func() core.AssemblyFunc { return prod.sendBatch })
+}
@@ -0,0 +1,252 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/json"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplunkHECEvents(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &httpRequestStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.SplunkHEC", "testSplunkHECEvents", map[string]interface{}{
+		"Token":      "secret",
+		"Address":    server.URL + "/",
+		"SourceType": "gollum",
+		"TimeFrom":   "time",
+		"FieldsFrom": []string{"dc", "missing"},
+		"JSONEvent":  true,
+		"Gzip":       true,
+	}).(*SplunkHEC)
+
+	streamID := core.StreamRegistry.GetStreamID("splunk")
+	messages := []*core.Message{
+		core.NewMessage(nil, []byte("hello"), core.Metadata{
+			"host":       []byte("web01"),
+			"sourcetype": []byte("access"),
+			"dc":         []byte("eu"),
+			"time":       []byte("1489672800.5"),
+		}, streamID),
+		core.NewMessage(nil, []byte(`{"status":200}`), core.Metadata{"index": []byte("main")}, streamID),
+	}
+
+	prod.sendBatch(messages)
+	expect.Equal(1, len(standIn.requests))
+
+	request := standIn.requests[0]
+	expect.Equal("POST", request.method)
+	expect.Equal("/services/collector/event", request.path)
+	expect.Equal("Splunk secret", request.header.Get("Authorization"))
+	expect.Equal("gzip", request.header.Get("Content-Encoding"))
+	expect.Equal("", request.header.Get(splunkHECChannelHeader))
+
+	lines := strings.Split(strings.TrimSpace(request.body), "\n")
+	expect.Equal(2, len(lines))
+
+	first := map[string]interface{}{}
+	expect.NoError(json.Unmarshal([]byte(lines[0]), &first))
+	expect.Equal(1489672800.5, first["time"])
+	expect.Equal("web01", first["host"])
+	expect.Equal("access", first["sourcetype"])
+	expect.Equal("hello", first["event"])
+	expect.Equal(map[string]interface{}{"dc": "eu"}, first["fields"])
+	expect.Nil(first["index"])
+
+	second := map[string]interface{}{}
+	expect.NoError(json.Unmarshal([]byte(lines[1]), &second))
+	expect.Equal("gollum", second["sourcetype"])
+	expect.Equal("main", second["index"])
+	expect.Equal(map[string]interface{}{"status": float64(200)}, second["event"])
+	expect.Equal(messages[1].GetCreationTime().Unix(), int64(second["time"].(float64)))
+}
+
+func TestSplunkHECEventTime(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestProducer(t, "producer.SplunkHEC", "testSplunkHECEventTime", map[string]interface{}{
+		"TimeFrom": "time",
+	}).(*SplunkHEC)
+
+	newMsg := func(value string) *core.Message {
+		return core.NewMessage(nil, []byte("hello"), core.Metadata{"time": []byte(value)}, core.InvalidStreamID)
+	}
+
+	// Values are sent as parsed, never as given
+	expect.Equal(json.Number("8"), prod.newEvent(newMsg("0x1p3")).Time)
+	expect.Equal(json.Number("1489672800.5"), prod.newEvent(newMsg("1489672800.50")).Time)
+
+	// Invalid values fall back to the creation time
+	for _, value := range []string{"inf", "-Inf", "NaN", "-1", "yesterday"} {
+		msg := newMsg(value)
+		expect.Equal(formatSplunkHECTime(msg.GetCreationTime()), prod.newEvent(msg).Time)
+	}
+}
+
+func TestSplunkHECRetry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	standIn := &httpRequestStandIn{statuses: []int{503, 429}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.SplunkHEC", "testSplunkHECRetry", map[string]interface{}{
+		"Address":       server.URL,
+		"Retry/DelayMs": 1,
+	}).(*SplunkHEC)
+
+	msg := core.NewMessage(nil, []byte("hello"), nil, core.StreamRegistry.GetStreamID("splunk"))
+	prod.sendBatch([]*core.Message{msg})
+	expect.Equal(3, len(standIn.requests))
+
+	// Client errors are not retried
+	standIn.requests = nil
+	standIn.statuses = []int{400}
+	prod.sendBatch([]*core.Message{msg})
+	expect.Equal(1, len(standIn.requests))
+
+	standIn.requests = nil
+	standIn.statuses = []int{500, 500, 500, 500, 500}
+	prod.sendBatch([]*core.Message{msg})
+	expect.Equal(4, len(standIn.requests))
+}
+
+func TestSplunkHECAck(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	channels := []string{}
+	acked := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		guard.Lock()
+		defer guard.Unlock()
+
+		channels = append(channels, r.Header.Get(splunkHECChannelHeader))
+		switch r.URL.Path {
+		case "/services/collector/event":
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case "/services/collector/ack":
+			body, _ := ioutil.ReadAll(r.Body)
+			expect.Equal(`{"acks":[7]}`, string(body))
+			if acked {
+				w.Write([]byte(`{"acks":{"7":true}}`))
+			} else {
+				w.Write([]byte(`{"acks":{"7":false}}`))
+			}
+		}
+	}))
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.SplunkHEC", "testSplunkHECAck", map[string]interface{}{
+		"Address":    server.URL,
+		"Ack/Enable": true,
+	}).(*SplunkHEC)
+	expect.Equal(36, len(prod.channel))
+
+	msg := core.NewMessage(nil, []byte("hello"), nil, core.StreamRegistry.GetStreamID("splunk"))
+	prod.sendBatch([]*core.Message{msg})
+	expect.True(prod.hasPendingAcks())
+
+	prod.pollAcks()
+	expect.True(prod.hasPendingAcks())
+
+	guard.Lock()
+	acked = true
+	guard.Unlock()
+
+	prod.pollAcks()
+	expect.False(prod.hasPendingAcks())
+
+	// Requests not acknowledged in time are removed
+	guard.Lock()
+	acked = false
+	guard.Unlock()
+
+	prod.sendBatch([]*core.Message{msg})
+	prod.ackTimeout = time.Duration(0)
+	prod.pollAcks()
+	expect.False(prod.hasPendingAcks())
+
+	for _, channel := range channels {
+		expect.Equal(prod.channel, channel)
+	}
+}
+
+func TestSplunkHECProduceAck(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	guard := new(sync.Mutex)
+	numAckRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/collector/event":
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":1}`))
+		case "/services/collector/ack":
+			guard.Lock()
+			numAckRequests++
+			guard.Unlock()
+			w.Write([]byte(`{"acks":{"1":true}}`))
+		}
+	}))
+	defer server.Close()
+
+	prod := newTestProducer(t, "producer.SplunkHEC", "testSplunkHECProduceAck", map[string]interface{}{
+		"Address":            server.URL,
+		"Ack/Enable":         true,
+		"Ack/PollIntervalMs": 10,
+		"ShutdownTimeoutMs":  1000,
+	}).(*SplunkHEC)
+
+	workers := new(sync.WaitGroup)
+	go prod.Produce(workers)
+
+	for i := 0; i < 100 && prod.GetState() != core.PluginStateActive; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect.Equal(core.PluginStateActive, prod.GetState())
+
+	prod.Enqueue(core.NewMessage(nil, []byte("hello"), nil, core.StreamRegistry.GetStreamID("splunk")), time.Second)
+	prod.Control() <- core.PluginControlStopProducer
+
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Producer did not stop")
+	}
+
+	expect.False(prod.hasPendingAcks())
+	guard.Lock()
+	expect.Greater(numAckRequests, 0)
+	guard.Unlock()
+}
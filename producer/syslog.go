@@ -0,0 +1,469 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tnet"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	syslogRFC3164       = "RFC3164"
+	syslogRFC5424       = "RFC5424"
+	syslogOctetCounting = "octet-counting"
+	syslogNewline       = "newline"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3,
+	"warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Syslog producer plugin
+//
+// This producer sends messages to a syslog server over TCP, TLS or UDP.
+// Messages are formatted according to RFC3164 or RFC5424 using the payload as
+// message text. Header fields are taken from metadata, so messages received
+// by consumer.Syslogd with SetMetadata enabled keep their facility, severity,
+// hostname and so on.
+//
+// Messages sent over TCP or TLS are framed as described in RFC6587, either by
+// prefixing each message with its length (octet counting) or by terminating
+// it with a newline. Messages sent over UDP are not framed, each message is
+// sent as a single datagram.
+//
+// If writing to a connection fails before any data was written, the producer
+// reconnects and sends the batch again. If a part of the batch was written,
+// only the messages not written completely are passed to the fallback, so
+// that messages are not sent twice. Messages that cannot be sent are passed
+// to the fallback.
+// Please note that a batch may be received twice if the connection broke
+// after parts of it have been sent.
+//
+// Metadata
+//
+// - facility: The facility as number or name, e.g. "16" or "local0".
+//
+// - severity: The severity as number or name, e.g. "3" or "err".
+//
+// - hostname, app_name, proc_id, msg_id: The header fields of the same name.
+// For RFC3164 app_name and proc_id are used as tag.
+//
+// - tag: Used as app_name if app_name is not set. consumer.Syslogd stores the
+// tag of RFC3164 messages here.
+//
+// - structured_data: The RFC5424 structured data, e.g. `[id@1 key="value"]`.
+// Values not enclosed in brackets are ignored. consumer.Syslogd does not set
+// this field, so it has to be added by other plugins, e.g. a formatter.
+//
+// The metadata keys can be changed using the "*From" parameters. If a key is
+// not set, the default value of the corresponding parameter is used.
+//
+// Parameters
+//
+// - Address: Defines the address of the syslog server. The protocol can be
+// given as prefix, e.g. "udp://localhost:514". If no protocol is given, TCP
+// is used.
+// By default this parameter is set to "localhost:514".
+//
+// - Format: Defines the message format. Can be "RFC3164" or "RFC5424".
+// By default this parameter is set to "RFC5424".
+//
+// - Framing: Defines the framing used for TCP and TLS connections. Can be
+// "octet-counting" or "newline". Newline framing removes trailing newlines
+// from messages, but newlines within a message will split it.
+// By default this parameter is set to "octet-counting".
+//
+// - Facility: Defines the default facility.
+// By default this parameter is set to "user".
+//
+// - Severity: Defines the default severity.
+// By default this parameter is set to "info".
+//
+// - Hostname: Defines the default hostname. If empty, the hostname of the
+// local machine is used.
+// By default this parameter is set to "".
+//
+// - AppName: Defines the default application name.
+// By default this parameter is set to "gollum".
+//
+// - ProcID: Defines the default process id.
+// By default this parameter is set to "".
+//
+// - MsgID: Defines the default RFC5424 message id.
+// By default this parameter is set to "".
+//
+// - StructuredData: Defines the default RFC5424 structured data.
+// By default this parameter is set to "".
+//
+// - FacilityFrom, SeverityFrom, HostnameFrom, AppNameFrom, ProcIDFrom,
+// MsgIDFrom, StructuredDataFrom: Define the metadata keys to read the
+// header fields from. Set to "" to always use the default value.
+// By default these parameters are set to "facility", "severity", "hostname",
+// "app_name", "proc_id", "msg_id" and "structured_data".
+//
+// - TimestampFrom: Defines the metadata key to read the timestamp from. If
+// empty or if the value cannot be parsed, the creation time of the message
+// is used.
+// By default this parameter is set to "".
+//
+// - TimestampFormat: Defines the go time format used to parse TimestampFrom.
+// The default matches the default of consumer.Syslogd.
+// By default this parameter is set to "2006-01-02T15:04:05.000 MST".
+//
+// - TimeoutSec: Defines the number of seconds to wait when connecting or
+// writing to the server.
+// By default this parameter is set to "5".
+//
+// - ReconnectDelayMs: Defines the minimum number of milliseconds to wait
+// after a failed connection attempt before connecting again. Messages sent
+// in the meantime are passed to the fallback.
+// By default this parameter is set to "1000".
+//
+// Examples
+//
+// This example forwards all messages received by consumer.Syslogd to a SIEM
+// system using syslog over TLS (RFC5425):
+//
+//  SyslogIn:
+//    Type: consumer.Syslogd
+//    Streams: syslog
+//    Address: "udp://0.0.0.0:514"
+//    Format: RFC5424
+//    SetMetadata: true
+//
+//  SiemOut:
+//    Type: producer.Syslog
+//    Streams: syslog
+//    Address: "siem.example.com:6514"
+//    TLS: true
+//    ServerCA: /etc/ssl/siem-ca.pem
+//    TimestampFrom: timestamp
+type Syslog struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	TLS                  components.TLSClientConfig `gollumdoc:"embed_type"`
+	format               string                     `config:"Format" default:"RFC5424"`
+	framing              string                     `config:"Framing" default:"octet-counting"`
+	facilityName         string                     `config:"Facility" default:"user"`
+	severityName         string                     `config:"Severity" default:"info"`
+	hostname             string                     `config:"Hostname"`
+	appName              string                     `config:"AppName" default:"gollum"`
+	procID               string                     `config:"ProcID"`
+	msgID                string                     `config:"MsgID"`
+	structuredData       string                     `config:"StructuredData"`
+	facilityField        string                     `config:"FacilityFrom" default:"facility"`
+	severityField        string                     `config:"SeverityFrom" default:"severity"`
+	hostnameField        string                     `config:"HostnameFrom" default:"hostname"`
+	appNameField         string                     `config:"AppNameFrom" default:"app_name"`
+	procIDField          string                     `config:"ProcIDFrom" default:"proc_id"`
+	msgIDField           string                     `config:"MsgIDFrom" default:"msg_id"`
+	structuredDataField  string                     `config:"StructuredDataFrom" default:"structured_data"`
+	timestampField       string                     `config:"TimestampFrom"`
+	timestampFormat      string                     `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+	timeout              time.Duration              `config:"TimeoutSec" default:"5" metric:"sec"`
+	reconnectDelay       time.Duration              `config:"ReconnectDelayMs" default:"1000" metric:"ms"`
+	protocol             string
+	address              string
+	facility             int
+	severity             int
+	connection           net.Conn
+	lastConnectError     time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(Syslog{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Syslog) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.protocol, prod.address = tnet.ParseAddress(conf.GetString("Address", "localhost:514"), "tcp")
+
+	switch prod.protocol {
+	case "tcp":
+	case "udp":
+		if prod.TLS.IsEnabled() {
+			conf.Errors.Pushf("TLS is only supported for TCP connections")
+		}
+	default:
+		conf.Errors.Pushf("Protocol %s is not supported", prod.protocol)
+	}
+
+	switch prod.format {
+	case syslogRFC3164, syslogRFC5424:
+	default:
+		conf.Errors.Pushf("Format %s is not supported", prod.format)
+	}
+
+	switch prod.framing {
+	case syslogOctetCounting, syslogNewline:
+	default:
+		conf.Errors.Pushf("Framing %s is not supported", prod.framing)
+	}
+
+	var ok bool
+	if prod.facility, ok = parseSyslogValue(prod.facilityName, syslogFacilities, 23); !ok {
+		conf.Errors.Pushf("Unknown facility %s", prod.facilityName)
+	}
+	if prod.severity, ok = parseSyslogValue(prod.severityName, syslogSeverities, 7); !ok {
+		conf.Errors.Pushf("Unknown severity %s", prod.severityName)
+	}
+
+	if prod.hostname == "" {
+		prod.hostname, _ = os.Hostname()
+	}
+}
+
+// parseSyslogValue returns the numeric value of a facility or severity given
+// by number or name.
+func parseSyslogValue(value string, names map[string]int, max int) (int, bool) {
+	if number, err := strconv.Atoi(value); err == nil {
+		return number, number >= 0 && number <= max
+	}
+	number, ok := names[strings.ToLower(value)]
+	return number, ok
+}
+
+// sanitizeSyslogField returns a header field containing printable ASCII
+// characters only, truncated to maxLength. Empty fields are returned as "-".
+func sanitizeSyslogField(value string, maxLength int) string {
+	if value == "" {
+		return "-"
+	}
+
+	field := []byte(value)
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	return string(field)
+}
+
+// getValue returns the value of the given metadata key or the default value
+// if the key is not set.
+func (prod *Syslog) getValue(metadata core.Metadata, key, defaultValue string) string {
+	if key != "" && metadata != nil {
+		if value := metadata.GetValueString(key); value != "" {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// getPriority returns the priority of the given message
+func (prod *Syslog) getPriority(metadata core.Metadata) int {
+	facility, severity := prod.facility, prod.severity
+	if value := prod.getValue(metadata, prod.facilityField, ""); value != "" {
+		if number, ok := parseSyslogValue(value, syslogFacilities, 23); ok {
+			facility = number
+		}
+	}
+	if value := prod.getValue(metadata, prod.severityField, ""); value != "" {
+		if number, ok := parseSyslogValue(value, syslogSeverities, 7); ok {
+			severity = number
+		}
+	}
+	return facility*8 + severity
+}
+
+// getTimestamp returns the timestamp of the given message
+func (prod *Syslog) getTimestamp(msg *core.Message, metadata core.Metadata) time.Time {
+	if value := prod.getValue(metadata, prod.timestampField, ""); value != "" {
+		if timestamp, err := time.Parse(prod.timestampFormat, value); err == nil {
+			return timestamp
+		}
+	}
+	return msg.GetCreationTime()
+}
+
+// formatMessage returns the unframed syslog message for the given message
+func (prod *Syslog) formatMessage(msg *core.Message) []byte {
+	metadata := msg.TryGetMetadata()
+	priority := prod.getPriority(metadata)
+	timestamp := prod.getTimestamp(msg, metadata)
+	hostname := sanitizeSyslogField(prod.getValue(metadata, prod.hostnameField, prod.hostname), 255)
+	appName := prod.getValue(metadata, prod.appNameField, "")
+	if appName == "" && prod.appNameField != "" {
+		// consumer.Syslogd stores the RFC3164 tag as "tag"
+		appName = prod.getValue(metadata, "tag", "")
+	}
+	if appName == "" {
+		appName = prod.appName
+	}
+	procID := prod.getValue(metadata, prod.procIDField, prod.procID)
+
+	buffer := bytes.Buffer{}
+	if prod.format == syslogRFC3164 {
+		// <PRI>TIMESTAMP HOSTNAME TAG: MSG
+		tag := sanitizeSyslogField(appName, 32)
+		if procID != "" {
+			tag += "[" + sanitizeSyslogField(procID, 128) + "]"
+		}
+		fmt.Fprintf(&buffer, "<%d>%s %s %s: ", priority, timestamp.Format(time.Stamp), hostname, tag)
+	} else {
+		// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+		structuredData := prod.getValue(metadata, prod.structuredDataField, prod.structuredData)
+		if !strings.HasPrefix(structuredData, "[") || !strings.HasSuffix(structuredData, "]") {
+			structuredData = "-"
+		}
+
+		fmt.Fprintf(&buffer, "<%d>1 %s %s %s %s %s %s ",
+			priority,
+			timestamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+			hostname,
+			sanitizeSyslogField(appName, 48),
+			sanitizeSyslogField(procID, 128),
+			sanitizeSyslogField(prod.getValue(metadata, prod.msgIDField, prod.msgID), 32),
+			structuredData)
+	}
+
+	buffer.Write(msg.GetPayload())
+	return buffer.Bytes()
+}
+
+// frameMessage returns the given syslog message framed according to RFC6587
+func (prod *Syslog) frameMessage(message []byte) []byte {
+	if prod.framing == syslogNewline {
+		return append(bytes.TrimRight(message, "\r\n"), '\n')
+	}
+	return append([]byte(strconv.Itoa(len(message))+" "), message...)
+}
+
+func (prod *Syslog) tryConnect() bool {
+	if prod.connection != nil {
+		return true // ### return, connection active ###
+	}
+
+	if time.Since(prod.lastConnectError) < prod.reconnectDelay {
+		return false // ### return, waiting for reconnect ###
+	}
+
+	conn, err := prod.TLS.Dial(prod.protocol, prod.address, prod.timeout)
+	if err != nil {
+		prod.Logger.Error("Connection error: ", err)
+		prod.lastConnectError = time.Now()
+		return false // ### return, connection failed ###
+	}
+
+	prod.connection = conn
+	return true
+}
+
+func (prod *Syslog) closeConnection() {
+	if prod.connection != nil {
+		prod.connection.Close()
+		prod.connection = nil
+	}
+}
+
+// write writes the given data to the connection and returns the number of
+// bytes written. If nothing could be written, e.g. because the connection has
+// been closed by the server, it reconnects and writes the data once more.
+func (prod *Syslog) write(data []byte) (int, error) {
+	for attempt := 0; ; attempt++ {
+		if !prod.tryConnect() {
+			return 0, fmt.Errorf("Not connected to %s", prod.address) // ### return, not connected ###
+		}
+
+		prod.connection.SetWriteDeadline(time.Now().Add(prod.timeout))
+		written, err := prod.connection.Write(data)
+		if err == nil {
+			return written, nil // ### return, success ###
+		}
+
+		prod.Logger.Error("Write error: ", err)
+		prod.closeConnection()
+		if written > 0 || attempt > 0 {
+			return written, err // ### return, failed ###
+		}
+	}
+}
+
+// writeBatch frames the given messages and sends them together. If the
+// write fails, the messages that have not been written completely are
+// returned.
+func (prod *Syslog) writeBatch(messages []*core.Message) ([]*core.Message, error) {
+	buffer := bytes.Buffer{}
+	frameEnds := make([]int, len(messages))
+	for i, msg := range messages {
+		buffer.Write(prod.frameMessage(prod.formatMessage(msg)))
+		frameEnds[i] = buffer.Len()
+	}
+
+	written, err := prod.write(buffer.Bytes())
+	if err == nil {
+		return nil, nil // ### return, success ###
+	}
+
+	for i, end := range frameEnds {
+		if end > written {
+			return messages[i:], err // ### return, partially written ###
+		}
+	}
+	return nil, err
+}
+
+// sendBatch sends the given messages to the syslog server. UDP messages are
+// sent as separate datagrams, TCP messages are framed and sent together.
+func (prod *Syslog) sendBatch(messages []*core.Message) {
+	if prod.protocol == "udp" {
+		for _, msg := range messages {
+			if _, err := prod.write(prod.formatMessage(msg)); err != nil {
+				prod.TryFallbackWithMetadata(msg, core.Metadata{"error": []byte(err.Error())})
+			}
+		}
+		return // ### return, done ###
+	}
+
+	unwritten, err := prod.writeBatch(messages)
+	if err != nil {
+		metadata := core.Metadata{"error": []byte(err.Error())}
+		for _, msg := range unwritten {
+			prod.TryFallbackWithMetadata(msg, metadata)
+		}
+	}
+}
+
+func (prod *Syslog) close() {
+	defer prod.WorkerDone()
+	prod.Batch.Close(prod.sendBatch, prod.GetShutdownTimeout())
+	prod.closeConnection()
+}
+
+// Produce sends batches of messages to a syslog server.
+func (prod *Syslog) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.sendBatch })
+}
@@ -0,0 +1,211 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bufio"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSyslogMessage(payload string, metadata core.Metadata) *core.Message {
+	if metadata == nil {
+		metadata = core.Metadata{}
+	}
+	metadata.SetValue("timestamp", []byte("2017-03-16T14:00:00.123456Z"))
+	return core.NewMessage(nil, []byte(payload), metadata, core.StreamRegistry.GetStreamID("syslog"))
+}
+
+func TestSyslogFormat(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestProducer(t, "producer.Syslog", "testSyslogFormat", map[string]interface{}{
+		"Address":         "udp://localhost:514",
+		"Hostname":        "gollum01",
+		"TimestampFrom":   "timestamp",
+		"TimestampFormat": time.RFC3339Nano,
+	}).(*Syslog)
+
+	msg := newTestSyslogMessage("hello", nil)
+	expect.Equal("<14>1 2017-03-16T14:00:00.123456Z gollum01 gollum - - - hello", string(prod.formatMessage(msg)))
+
+	msg = newTestSyslogMessage("hello", core.Metadata{
+		"facility":        []byte("local0"),
+		"severity":        []byte("3"),
+		"hostname":        []byte("web 01"),
+		"app_name":        []byte("nginx"),
+		"proc_id":         []byte("42"),
+		"msg_id":          []byte("access"),
+		"structured_data": []byte(`[origin ip="10.0.0.1"]`),
+	})
+	expect.Equal(`<131>1 2017-03-16T14:00:00.123456Z web_01 nginx 42 access [origin ip="10.0.0.1"] hello`, string(prod.formatMessage(msg)))
+
+	// Invalid values fall back to the defaults
+	msg = newTestSyslogMessage("hello", core.Metadata{
+		"facility":        []byte("unknown"),
+		"severity":        []byte("8"),
+		"structured_data": []byte("invalid"),
+	})
+	expect.Equal("<14>1 2017-03-16T14:00:00.123456Z gollum01 gollum - - - hello", string(prod.formatMessage(msg)))
+
+	prod = newTestProducer(t, "producer.Syslog", "testSyslogFormat3164", map[string]interface{}{
+		"Address":         "udp://localhost:514",
+		"Format":          "RFC3164",
+		"Facility":        "daemon",
+		"Severity":        "warning",
+		"Hostname":        "gollum01",
+		"TimestampFrom":   "timestamp",
+		"TimestampFormat": time.RFC3339Nano,
+	}).(*Syslog)
+
+	msg = newTestSyslogMessage("hello", core.Metadata{"proc_id": []byte("42")})
+	expect.Equal("<28>Mar 16 14:00:00 gollum01 gollum[42]: hello", string(prod.formatMessage(msg)))
+
+	// RFC3164 messages received by consumer.Syslogd store the tag
+	msg = newTestSyslogMessage("hello", core.Metadata{"tag": []byte("sshd")})
+	expect.Equal("<28>Mar 16 14:00:00 gollum01 sshd: hello", string(prod.formatMessage(msg)))
+
+	msg = newTestSyslogMessage("hello", core.Metadata{"tag": []byte("sshd"), "app_name": []byte("nginx")})
+	expect.Equal("<28>Mar 16 14:00:00 gollum01 nginx: hello", string(prod.formatMessage(msg)))
+}
+
+func TestSyslogFraming(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	prod := newTestProducer(t, "producer.Syslog", "testSyslogFraming", map[string]interface{}{}).(*Syslog)
+	expect.Equal("5 hello", string(prod.frameMessage([]byte("hello"))))
+
+	prod = newTestProducer(t, "producer.Syslog", "testSyslogFramingNewline", map[string]interface{}{
+		"Framing": "newline",
+	}).(*Syslog)
+	expect.Equal("hello\n", string(prod.frameMessage([]byte("hello\r\n"))))
+}
+
+func TestSyslogTCP(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	prod := newTestProducer(t, "producer.Syslog", "testSyslogTCP", map[string]interface{}{
+		"Address":         listener.Addr().String(),
+		"Hostname":        "gollum01",
+		"TimestampFrom":   "timestamp",
+		"TimestampFormat": time.RFC3339Nano,
+	}).(*Syslog)
+	defer prod.closeConnection()
+
+	prod.sendBatch([]*core.Message{
+		newTestSyslogMessage("first", nil),
+		newTestSyslogMessage("second", nil),
+	})
+
+	conn, err := listener.Accept()
+	expect.NoError(err)
+	defer conn.Close()
+
+	first := "<14>1 2017-03-16T14:00:00.123456Z gollum01 gollum - - - first"
+	second := "<14>1 2017-03-16T14:00:00.123456Z gollum01 gollum - - - second"
+	expected := strconv.Itoa(len(first)) + " " + first + strconv.Itoa(len(second)) + " " + second
+
+	received := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(bufio.NewReader(conn), received)
+	expect.NoError(err)
+	expect.Equal(expected, string(received))
+}
+
+func TestSyslogPartialWrite(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	prod := newTestProducer(t, "producer.Syslog", "testSyslogPartialWrite", map[string]interface{}{
+		"Address": listener.Addr().String(),
+	}).(*Syslog)
+	defer prod.closeConnection()
+
+	// The batch is larger than the socket buffers, so the server drops the
+	// connection while the batch is being written.
+	payload := strings.Repeat("x", 64<<10)
+	messages := make([]*core.Message, 512)
+	for i := range messages {
+		messages[i] = newTestSyslogMessage(payload, nil)
+	}
+	frameSize := len(prod.frameMessage(prod.formatMessage(messages[0])))
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.ReadFull(conn, make([]byte, 3*frameSize))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+
+	unwritten, err := prod.writeBatch(messages)
+	expect.NotNil(err)
+	expect.Greater(len(unwritten), 0)
+	expect.Leq(len(unwritten), len(messages)-3)
+	expect.Equal(messages[len(messages)-1], unwritten[len(unwritten)-1])
+
+	// The written part of the batch must not be sent again
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = listener.Accept()
+	expect.NotNil(err)
+}
+
+func TestSyslogUDP(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer conn.Close()
+
+	prod := newTestProducer(t, "producer.Syslog", "testSyslogUDP", map[string]interface{}{
+		"Address":         "udp://" + conn.LocalAddr().String(),
+		"Format":          "RFC3164",
+		"Hostname":        "gollum01",
+		"TimestampFrom":   "timestamp",
+		"TimestampFormat": time.RFC3339Nano,
+	}).(*Syslog)
+	defer prod.closeConnection()
+
+	prod.sendBatch([]*core.Message{
+		newTestSyslogMessage("first", nil),
+		newTestSyslogMessage("second", nil),
+	})
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := conn.ReadFrom(buffer)
+	expect.NoError(err)
+	expect.Equal("<14>Mar 16 14:00:00 gollum01 gollum: first", string(buffer[:n]))
+
+	n, _, err = conn.ReadFrom(buffer)
+	expect.NoError(err)
+	expect.Equal("<14>Mar 16 14:00:00 gollum01 gollum: second", string(buffer[:n]))
+}
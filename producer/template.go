@@ -0,0 +1,52 @@
+// Copyright 2015-2017 trivago GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"github.com/trivago/gollum/core"
+	"text/template"
+)
+
+// newMetadataTemplate parses a go template that is executed with the metadata
+// of a message. Missing keys are replaced by an empty string.
+func newMetadataTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Parse(text)
+}
+
+// getTemplateValues returns the metadata of the given message as values for
+// executeMetadataTemplate.
+func getTemplateValues(msg *core.Message) map[string]string {
+	values := map[string]string{}
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for key, value := range metadata {
+			values[key] = string(value)
+		}
+	}
+	return values
+}
+
+// executeMetadataTemplate executes the given template with the given values.
+// Nil values are treated like an empty map.
+func executeMetadataTemplate(tpl *template.Template, values map[string]string) (string, error) {
+	if values == nil {
+		values = map[string]string{}
+	}
+	result := bytes.Buffer{}
+	if err := tpl.Execute(&result, values); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}